@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/looplanguage/compiler/lint"
+	"github.com/looplanguage/loop/lexer"
+	"github.com/looplanguage/loop/parser"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// check is "lpc check", it reports the lint warnings of a file. Each -W flag
+// enables a category, without any every category is reported.
+func check(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	allPtr := flags.Bool("Wall", false, "Enables every warning")
+
+	enabled := map[lint.Category]*bool{}
+	for _, category := range lint.Categories {
+		enabled[category] = flags.Bool("W"+category.String(), false, fmt.Sprintf("Enables %s warnings", category))
+	}
+
+	_ = flags.Parse(args)
+
+	var categories []lint.Category
+	if !*allPtr {
+		for _, category := range lint.Categories {
+			if *enabled[category] {
+				categories = append(categories, category)
+			}
+		}
+	}
+
+	file := flags.Arg(0)
+
+	bytes, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	p := parser.Create(lexer.Create(string(bytes)))
+	program := p.Parse()
+
+	if len(p.Errors) != 0 {
+		for _, err := range p.Errors {
+			fmt.Println(err)
+		}
+		os.Exit(1)
+	}
+
+	warnings := lint.Lint(program, categories...)
+
+	for _, warning := range warnings {
+		fmt.Println(warning)
+	}
+
+	if len(warnings) != 0 {
+		os.Exit(1)
+	}
+}
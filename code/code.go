@@ -37,39 +37,147 @@ const (
 	OpGetVar
 
 	OpSetIndex
+
+	// OpWide doubles the operand widths of the next instruction
+	OpWide
+
+	// Superinstructions, see superinstructions below
+	OpIncrementVar
+	OpJumpIfVarNotGreater
+	OpJumpIfConstantNotGreater
+
+	// OpTailCall calls a function in place of the current one, returning
+	// what it returns
+	OpTailCall
+
+	// Cells hold locals that closures capture and that are assigned to, so
+	// the function and its closures share them. OpMakeCell puts a local in
+	// a new cell, OpLoadCell and OpStoreCell read and write the cell on top
+	// of the stack.
+	OpMakeCell
+	OpLoadCell
+	OpStoreCell
+
+	// OpIterInit replaces an array or hashmap by an iterator over it.
+	// OpIterNext advances the iterator on top of the stack, leaving it there,
+	// and pushes as many values as its first operand: the element of an array
+	// or the key of a hashmap, or the index and element or the key and value
+	// when it is 2. Once there are no elements left it pushes that many nulls
+	// instead and jumps, so both paths leave the same values on the stack.
+	OpIterInit
+	OpIterNext
+
+	// OpConcat pops as many values as its operand and pushes them joined
+	// into one string, values that aren't strings are converted like print
+	// does
+	OpConcat
+
+	// OpJumpTable pops a value and looks it up in the array constant of its
+	// first operand, comparing like OpEquals. When it is the k-th element
+	// execution continues at the k-th of the OpJump instructions following
+	// it, as many as its second operand. Other values jump to the last
+	// operand.
+	OpJumpTable
+	// OpMatchArray replaces the value on top of the stack by whether it is an
+	// array with as many elements as its first operand, or at least as many
+	// when its second operand is 1. OpMatchKey pops a key and a value and
+	// pushes whether the value is a hashmap with that key.
+	OpMatchArray
+	OpMatchKey
+
+	// OpSlice replaces an array by an array of its elements from the index of
+	// its operand on, which is empty when the array is shorter
+	OpSlice
+
+	// OpJumpIfArgument jumps when the call of the current function passed an
+	// argument for the parameter of its first operand. It skips evaluating
+	// the default value of the parameter.
+	OpJumpIfArgument
 )
 
 var definitions = map[OpCode]*Definition{
-	OpConstant:           {"OpConstant", []int{2}},
-	OpAdd:                {"OpAdd", []int{}},
-	OpMultiply:           {"OpMultiply", []int{}},
-	OpDivide:             {"OpDivide", []int{}},
-	OpPop:                {"OpPop", []int{}},
-	OpSubtract:           {"OpSubtract", []int{}},
-	OpTrue:               {"OpTrue", []int{}},
-	OpFalse:              {"OpFalse", []int{}},
-	OpEquals:             {"OpEquals", []int{}},
-	OpNotEquals:          {"OpNotEquals", []int{}},
-	OpGreaterThan:        {"OpGreaterThan", []int{}},
-	OpJump:               {"OpJump", []int{2}},
-	OpJumpIfNotTrue:      {"OpJumpIfNotTrue", []int{2}},
-	OpNull:               {"OpNull", []int{}},
-	OpSetGlobal:          {"OpSetGlobal", []int{2}},
-	OpGetGlobal:          {"OpGetGlobal", []int{2}},
-	OpArray:              {"OpArray", []int{2}},
-	OpHash:               {"OpHash", []int{2}},
-	OpIndex:              {"OpHash", []int{}},
-	OpCall:               {"OpCall", []int{1}},
-	OpReturn:             {"OpReturn", []int{}},
-	OpReturnValue:        {"OpReturnValue", []int{}},
-	OpSetLocal:           {"OpSetLocal", []int{1}},
-	OpGetLocal:           {"OpGetLocal", []int{1}},
-	OpGetBuiltinFunction: {"OpGetBuiltinFunction", []int{1}},
-	OpClosure:            {"OpClosure", []int{2, 1}},
-	OpGetFree:            {"OpGetFree", []int{1}},
-
-	OpSetVar: {"OpSetVar", []int{2}},
-	OpGetVar: {"OpGetVar", []int{2}},
-
-	OpSetIndex: {"OpSetIndex", []int{}},
+	OpConstant:           {"OpConstant", []int{2}, Fixed(0), Fixed(1), ReadsConstant},
+	OpAdd:                {"OpAdd", []int{}, Fixed(2), Fixed(1), 0},
+	OpMultiply:           {"OpMultiply", []int{}, Fixed(2), Fixed(1), 0},
+	OpDivide:             {"OpDivide", []int{}, Fixed(2), Fixed(1), 0},
+	OpPop:                {"OpPop", []int{}, Fixed(1), Fixed(0), 0},
+	OpSubtract:           {"OpSubtract", []int{}, Fixed(2), Fixed(1), 0},
+	OpTrue:               {"OpTrue", []int{}, Fixed(0), Fixed(1), 0},
+	OpFalse:              {"OpFalse", []int{}, Fixed(0), Fixed(1), 0},
+	OpEquals:             {"OpEquals", []int{}, Fixed(2), Fixed(1), 0},
+	OpNotEquals:          {"OpNotEquals", []int{}, Fixed(2), Fixed(1), 0},
+	OpGreaterThan:        {"OpGreaterThan", []int{}, Fixed(2), Fixed(1), 0},
+	OpJump:               {"OpJump", []int{2}, Fixed(0), Fixed(0), Jump | Terminator},
+	OpJumpIfNotTrue:      {"OpJumpIfNotTrue", []int{2}, Fixed(1), Fixed(0), Jump},
+	OpNull:               {"OpNull", []int{}, Fixed(0), Fixed(1), 0},
+	OpSetGlobal:          {"OpSetGlobal", []int{2}, Fixed(1), Fixed(0), 0},
+	OpGetGlobal:          {"OpGetGlobal", []int{2}, Fixed(0), Fixed(1), 0},
+	OpArray:              {"OpArray", []int{2}, FromOperand(0, 0), Fixed(1), 0},
+	OpHash:               {"OpHash", []int{2}, FromOperand(0, 0), Fixed(1), 0},
+	OpIndex:              {"OpIndex", []int{}, Fixed(2), Fixed(1), 0},
+	OpCall:               {"OpCall", []int{1}, FromOperand(0, 1), Fixed(1), 0},
+	OpReturn:             {"OpReturn", []int{}, Fixed(0), Fixed(0), Terminator},
+	OpReturnValue:        {"OpReturnValue", []int{}, Fixed(1), Fixed(0), Terminator},
+	OpSetLocal:           {"OpSetLocal", []int{1}, Fixed(1), Fixed(0), 0},
+	OpGetLocal:           {"OpGetLocal", []int{1}, Fixed(0), Fixed(1), 0},
+	OpGetBuiltinFunction: {"OpGetBuiltinFunction", []int{1}, Fixed(0), Fixed(1), 0},
+	OpClosure:            {"OpClosure", []int{2, 1}, FromOperand(1, 0), Fixed(1), ReadsConstant},
+	OpGetFree:            {"OpGetFree", []int{1}, Fixed(0), Fixed(1), 0},
+
+	OpSetVar: {"OpSetVar", []int{2}, Fixed(1), Fixed(0), 0},
+	OpGetVar: {"OpGetVar", []int{2}, Fixed(0), Fixed(1), 0},
+
+	OpSetIndex: {"OpSetIndex", []int{}, Fixed(3), Fixed(0), 0},
+
+	OpWide: {"OpWide", []int{}, Fixed(0), Fixed(0), Prefix},
+
+	OpIncrementVar:             {"OpIncrementVar", []int{2, 2}, Fixed(0), Fixed(0), ReadsConstant},
+	OpJumpIfVarNotGreater:      {"OpJumpIfVarNotGreater", []int{2, 2, 2}, Fixed(0), Fixed(0), ReadsConstant | Jump},
+	OpJumpIfConstantNotGreater: {"OpJumpIfConstantNotGreater", []int{2, 2, 2}, Fixed(0), Fixed(0), ReadsConstant | Jump},
+
+	OpTailCall: {"OpTailCall", []int{1}, FromOperand(0, 1), Fixed(0), Terminator},
+
+	OpMakeCell:  {"OpMakeCell", []int{1}, Fixed(0), Fixed(0), 0},
+	OpLoadCell:  {"OpLoadCell", []int{}, Fixed(1), Fixed(1), 0},
+	OpStoreCell: {"OpStoreCell", []int{}, Fixed(2), Fixed(0), 0},
+
+	OpIterInit: {"OpIterInit", []int{}, Fixed(1), Fixed(1), 0},
+	OpIterNext: {"OpIterNext", []int{1, 2}, Fixed(1), FromOperand(0, 1), Jump},
+
+	OpConcat: {"OpConcat", []int{1}, FromOperand(0, 0), Fixed(1), 0},
+
+	OpJumpTable:  {"OpJumpTable", []int{2, 2, 2}, Fixed(1), Fixed(0), ReadsConstant | Jump | Terminator | Table},
+	OpMatchArray: {"OpMatchArray", []int{2, 1}, Fixed(1), Fixed(1), 0},
+	OpMatchKey:   {"OpMatchKey", []int{}, Fixed(2), Fixed(1), 0},
+
+	OpSlice: {"OpSlice", []int{2}, Fixed(1), Fixed(1), 0},
+
+	OpJumpIfArgument: {"OpJumpIfArgument", []int{1, 2}, Fixed(0), Fixed(0), Jump},
+}
+
+// superinstructions are sequences of instructions that the peephole optimizer
+// replaces by a single instruction
+var superinstructions = []Superinstruction{
+	// x = x + constant
+	{
+		Pattern: []OpCode{OpGetVar, OpConstant, OpAdd, OpSetVar},
+		Fuse: func(operands [][]int) (OpCode, []int, bool) {
+			variable, constant := operands[0][0], operands[1][0]
+			return OpIncrementVar, []int{constant, variable}, variable == operands[3][0]
+		},
+	},
+	// if (x > constant) or while (x > constant)
+	{
+		Pattern: []OpCode{OpGetVar, OpConstant, OpGreaterThan, OpJumpIfNotTrue},
+		Fuse: func(operands [][]int) (OpCode, []int, bool) {
+			return OpJumpIfVarNotGreater, []int{operands[1][0], operands[0][0], operands[3][0]}, true
+		},
+	},
+	// if (x < constant) or while (x < constant), which is compiled as constant > x
+	{
+		Pattern: []OpCode{OpConstant, OpGetVar, OpGreaterThan, OpJumpIfNotTrue},
+		Fuse: func(operands [][]int) (OpCode, []int, bool) {
+			return OpJumpIfConstantNotGreater, []int{operands[0][0], operands[1][0], operands[3][0]}, true
+		},
+	},
 }
@@ -2,7 +2,17 @@ package code
 
 import "testing"
 
-func TestMake(t *testing.T) {
+// mustEncode encodes an instruction the test knows to fit
+func mustEncode(op OpCode, operands ...int) []byte {
+	instruction, err := Encode(op, operands...)
+	if err != nil {
+		panic(err)
+	}
+
+	return instruction
+}
+
+func TestEncode(t *testing.T) {
 	tests := []struct {
 		op       OpCode
 		operands []int
@@ -14,10 +24,16 @@ func TestMake(t *testing.T) {
 		{OpSubtract, []int{}, []byte{byte(OpSubtract)}},
 		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
 		{OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 255}},
+		{OpConstant, []int{65536}, []byte{byte(OpWide), byte(OpConstant), 0, 1, 0, 0}},
+		{OpGetLocal, []int{256}, []byte{byte(OpWide), byte(OpGetLocal), 1, 0}},
+		{OpClosure, []int{1, 300}, []byte{byte(OpWide), byte(OpClosure), 0, 0, 0, 1, 1, 44}},
 	}
 
 	for _, tc := range tests {
-		instruction := Make(tc.op, tc.operands...)
+		instruction, err := Encode(tc.op, tc.operands...)
+		if err != nil {
+			t.Fatalf("encode failed: %s", err)
+		}
 
 		if len(instruction) != len(tc.expected) {
 			t.Errorf("instruction has wrong length. want=%d. got=%d", len(tc.expected), len(instruction))
@@ -33,18 +49,21 @@ func TestMake(t *testing.T) {
 
 func TestInstructionFormatting(t *testing.T) {
 	instructions := []Instructions{
-		Make(OpAdd),
-		Make(OpConstant, 2),
-		Make(OpConstant, 65535),
-		Make(OpMultiply),
-		Make(OpDivide),
-		Make(OpSubtract),
-		Make(OpEquals),
-		Make(OpNotEquals),
-		Make(OpGreaterThan),
-		Make(OpNull),
-		Make(OpGetLocal, 1),
-		Make(OpClosure, 65535, 255),
+		mustEncode(OpAdd),
+		mustEncode(OpConstant, 2),
+		mustEncode(OpConstant, 65535),
+		mustEncode(OpMultiply),
+		mustEncode(OpDivide),
+		mustEncode(OpSubtract),
+		mustEncode(OpEquals),
+		mustEncode(OpNotEquals),
+		mustEncode(OpGreaterThan),
+		mustEncode(OpNull),
+		mustEncode(OpGetLocal, 1),
+		mustEncode(OpClosure, 65535, 255),
+		mustEncode(OpConstant, 65536),
+		mustEncode(OpCall, 300),
+		mustEncode(OpJumpIfVarNotGreater, 1, 2, 3),
 	}
 
 	expected := `[0000] OpAdd
@@ -59,6 +78,9 @@ func TestInstructionFormatting(t *testing.T) {
 [0013] OpNull
 [0014] OpGetLocal 1
 [0016] OpClosure 65535 255
+[0020] OpWide OpConstant 65536
+[0026] OpWide OpCall 300
+[0030] OpJumpIfVarNotGreater 1 2 3
 `
 
 	concatted := Instructions{}
@@ -84,7 +106,7 @@ func TestReadOperands(t *testing.T) {
 	}
 
 	for _, tc := range tests {
-		instruction := Make(tc.op, tc.operands...)
+		instruction := mustEncode(tc.op, tc.operands...)
 
 		def, err := Lookup(byte(tc.op))
 		if err != nil {
@@ -103,3 +125,313 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestMaxStackDepth(t *testing.T) {
+	tests := []struct {
+		instructions []Instructions
+		expected     int
+	}{
+		{[]Instructions{}, 0},
+		{
+			[]Instructions{
+				mustEncode(OpConstant, 0),
+				mustEncode(OpConstant, 1),
+				mustEncode(OpAdd),
+				mustEncode(OpPop),
+			},
+			2,
+		},
+		{
+			[]Instructions{
+				mustEncode(OpConstant, 0),
+				mustEncode(OpConstant, 1),
+				mustEncode(OpConstant, 2),
+				mustEncode(OpArray, 3),
+				mustEncode(OpConstant, 3),
+				mustEncode(OpIndex),
+				mustEncode(OpPop),
+			},
+			3,
+		},
+		{
+			// Only the deeper branch of a conditional counts
+			[]Instructions{
+				mustEncode(OpTrue),
+				mustEncode(OpJumpIfNotTrue, 13),
+				mustEncode(OpConstant, 0),
+				mustEncode(OpConstant, 1),
+				mustEncode(OpAdd),
+				mustEncode(OpJump, 14),
+				mustEncode(OpNull),
+				mustEncode(OpPop),
+			},
+			2,
+		},
+		{
+			// Arguments and the function itself are on the stack while calling
+			[]Instructions{
+				mustEncode(OpGetVar, 0),
+				mustEncode(OpConstant, 0),
+				mustEncode(OpConstant, 1),
+				mustEncode(OpCall, 2),
+				mustEncode(OpReturnValue),
+			},
+			3,
+		},
+		{
+			// Every entry of a jump table is a path
+			[]Instructions{
+				mustEncode(OpConstant, 0),
+				mustEncode(OpJumpTable, 1, 2, 29),
+				mustEncode(OpJump, 16),
+				mustEncode(OpJump, 21),
+				mustEncode(OpNull),
+				mustEncode(OpPop),
+				mustEncode(OpJump, 29),
+				mustEncode(OpConstant, 0),
+				mustEncode(OpConstant, 0),
+				mustEncode(OpAdd),
+				mustEncode(OpPop),
+			},
+			2,
+		},
+	}
+
+	for _, tc := range tests {
+		instructions := Instructions{}
+		for _, ins := range tc.instructions {
+			instructions = append(instructions, ins...)
+		}
+
+		depth := MaxStackDepth(instructions)
+		if depth != tc.expected {
+			t.Errorf("wrong max stack depth for\n%s\nwant=%d. got=%d", instructions, tc.expected, depth)
+		}
+	}
+}
+
+func TestDefinitions_Metadata(t *testing.T) {
+	// Every opcode needs an entry here, so adding an opcode without thinking
+	// about its stack effect and flags makes this test fail
+	tests := map[OpCode]struct {
+		operands []int
+		pops     int
+		pushes   int
+		flags    Flag
+	}{
+		OpConstant:           {[]int{1}, 0, 1, ReadsConstant},
+		OpAdd:                {[]int{}, 2, 1, 0},
+		OpMultiply:           {[]int{}, 2, 1, 0},
+		OpDivide:             {[]int{}, 2, 1, 0},
+		OpPop:                {[]int{}, 1, 0, 0},
+		OpSubtract:           {[]int{}, 2, 1, 0},
+		OpTrue:               {[]int{}, 0, 1, 0},
+		OpFalse:              {[]int{}, 0, 1, 0},
+		OpEquals:             {[]int{}, 2, 1, 0},
+		OpNotEquals:          {[]int{}, 2, 1, 0},
+		OpGreaterThan:        {[]int{}, 2, 1, 0},
+		OpJump:               {[]int{10}, 0, 0, Jump | Terminator},
+		OpJumpIfNotTrue:      {[]int{10}, 1, 0, Jump},
+		OpNull:               {[]int{}, 0, 1, 0},
+		OpSetGlobal:          {[]int{1}, 1, 0, 0},
+		OpGetGlobal:          {[]int{1}, 0, 1, 0},
+		OpArray:              {[]int{3}, 3, 1, 0},
+		OpHash:               {[]int{4}, 4, 1, 0},
+		OpIndex:              {[]int{}, 2, 1, 0},
+		OpCall:               {[]int{2}, 3, 1, 0},
+		OpReturn:             {[]int{}, 0, 0, Terminator},
+		OpReturnValue:        {[]int{}, 1, 0, Terminator},
+		OpSetLocal:           {[]int{1}, 1, 0, 0},
+		OpGetLocal:           {[]int{1}, 0, 1, 0},
+		OpGetBuiltinFunction: {[]int{1}, 0, 1, 0},
+		OpClosure:            {[]int{1, 2}, 2, 1, ReadsConstant},
+		OpGetFree:            {[]int{1}, 0, 1, 0},
+		OpSetVar:             {[]int{1}, 1, 0, 0},
+		OpGetVar:             {[]int{1}, 0, 1, 0},
+		OpSetIndex:           {[]int{}, 3, 0, 0},
+		OpWide:               {[]int{}, 0, 0, Prefix},
+
+		OpIncrementVar:             {[]int{1, 2}, 0, 0, ReadsConstant},
+		OpJumpIfVarNotGreater:      {[]int{1, 2, 10}, 0, 0, ReadsConstant | Jump},
+		OpJumpIfConstantNotGreater: {[]int{1, 2, 10}, 0, 0, ReadsConstant | Jump},
+
+		OpTailCall: {[]int{2}, 3, 0, Terminator},
+
+		OpMakeCell:  {[]int{1}, 0, 0, 0},
+		OpLoadCell:  {[]int{}, 1, 1, 0},
+		OpStoreCell: {[]int{}, 2, 0, 0},
+
+		OpIterInit: {[]int{}, 1, 1, 0},
+		OpIterNext: {[]int{2, 10}, 1, 3, Jump},
+
+		OpConcat: {[]int{3}, 3, 1, 0},
+
+		OpJumpTable:  {[]int{0, 2, 10}, 1, 0, ReadsConstant | Jump | Terminator | Table},
+		OpMatchArray: {[]int{2, 1}, 1, 1, 0},
+		OpMatchKey:   {[]int{}, 2, 1, 0},
+
+		OpSlice: {[]int{2}, 1, 1, 0},
+
+		OpJumpIfArgument: {[]int{1, 10}, 0, 0, Jump},
+	}
+
+	names := map[string]OpCode{}
+
+	for op := 0; op < 256; op++ {
+		def, err := Lookup(byte(op))
+		if err != nil {
+			// Opcodes are numbered without gaps
+			if _, ok := definitions[OpCode(op+1)]; ok && op < 255 {
+				t.Errorf("opcode %d has no definition", op)
+			}
+
+			continue
+		}
+
+		if other, ok := names[def.Name]; ok {
+			t.Errorf("opcodes %d and %d are both named %s", other, op, def.Name)
+		}
+
+		names[def.Name] = OpCode(op)
+
+		tc, ok := tests[OpCode(op)]
+		if !ok {
+			t.Errorf("%s has no stack effect test", def.Name)
+			continue
+		}
+
+		if len(tc.operands) != len(def.OperandWidths) {
+			t.Errorf("%s has %d operands, test gives %d", def.Name, len(def.OperandWidths), len(tc.operands))
+			continue
+		}
+
+		pops, pushes := def.StackEffect(tc.operands)
+		if pops != tc.pops || pushes != tc.pushes {
+			t.Errorf("wrong stack effect for %s. want=(%d, %d). got=(%d, %d)", def.Name, tc.pops, tc.pushes, pops, pushes)
+		}
+
+		if def.Flags != tc.flags {
+			t.Errorf("wrong flags for %s. want=%b. got=%b", def.Name, tc.flags, def.Flags)
+		}
+	}
+}
+
+func TestEncode_Errors(t *testing.T) {
+	tests := []struct {
+		op       OpCode
+		operands []int
+		expected string
+	}{
+		{OpConstant, []int{1 << 32}, "operand 0 of OpConstant out of range. got=4294967296"},
+		{OpGetLocal, []int{-1}, "operand 0 of OpGetLocal out of range. got=-1"},
+		{OpCall, []int{65536}, "operand 0 of OpCall out of range. got=65536"},
+		{OpAdd, []int{1}, "too many operands for OpAdd. got=1. expected=0"},
+		{OpCode(255), []int{}, "unknown opcode 255"},
+	}
+
+	for _, tc := range tests {
+		_, err := Encode(tc.op, tc.operands...)
+
+		if err == nil || err.Error() != tc.expected {
+			t.Errorf("incorrect error. got=%q. expected=%q", err, tc.expected)
+		}
+	}
+}
+
+func TestTableEntries(t *testing.T) {
+	tests := []struct {
+		instructions []Instructions
+		expected     []int
+		err          string
+	}{
+		{[]Instructions{mustEncode(OpJumpTable, 0, 2, 13), mustEncode(OpJump, 0), mustEncode(OpJump, 0)}, []int{7, 10}, ""},
+		{[]Instructions{mustEncode(OpJumpTable, 0, 0, 7)}, nil, ""},
+		{[]Instructions{mustEncode(OpJumpTable, 0, 2, 13), mustEncode(OpJump, 0)}, nil, "OpJumpTable is missing entry 1"},
+		{[]Instructions{mustEncode(OpJumpTable, 0, 1, 13), mustEncode(OpNull)}, nil, "entry 0 of OpJumpTable is not OpJump. got=OpNull"},
+		{
+			[]Instructions{mustEncode(OpJumpTable, 0, 2, 13), mustEncode(OpJump, 0), mustEncode(OpJump, 70000)},
+			nil,
+			"entries of OpJumpTable have different widths",
+		},
+	}
+
+	for _, tc := range tests {
+		instructions := Instructions{}
+		for _, ins := range tc.instructions {
+			instructions = append(instructions, ins...)
+		}
+
+		table, err := ReadInstruction(instructions, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		entries, err := TableEntries(instructions, table, 0)
+
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("incorrect error. got=%v. expected=%q", err, tc.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if len(entries) != len(tc.expected) {
+			t.Fatalf("wrong entries. got=%v. expected=%v", entries, tc.expected)
+		}
+
+		for i, entry := range entries {
+			if entry != tc.expected[i] {
+				t.Errorf("wrong entries. got=%v. expected=%v", entries, tc.expected)
+			}
+		}
+	}
+}
+
+func TestReadInstruction(t *testing.T) {
+	tests := []struct {
+		instructions Instructions
+		op           OpCode
+		operands     []int
+		wide         bool
+		size         int
+		err          string
+	}{
+		{mustEncode(OpConstant, 65535), OpConstant, []int{65535}, false, 3, ""},
+		{mustEncode(OpConstant, 65536), OpConstant, []int{65536}, true, 6, ""},
+		{mustEncode(OpClosure, 70000, 256), OpClosure, []int{70000, 256}, true, 8, ""},
+		{Instructions{byte(OpWide)}, 0, nil, false, 0, "OpWide is truncated"},
+		{Instructions{byte(OpWide), byte(OpAdd)}, 0, nil, false, 0, "OpWide can not prefix OpAdd"},
+		{Instructions{byte(OpWide), byte(OpConstant), 0, 0}, 0, nil, false, 0, "OpConstant is truncated"},
+	}
+
+	for _, tc := range tests {
+		instruction, err := ReadInstruction(tc.instructions, 0)
+
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("incorrect error. got=%q. expected=%q", err, tc.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if instruction.Op != tc.op || instruction.Wide != tc.wide || instruction.Size != tc.size {
+			t.Errorf("wrong instruction. got=%+v", instruction)
+		}
+
+		for i, want := range tc.operands {
+			if instruction.Operands[i] != want {
+				t.Errorf("unexpected operand. want=%d. got=%d", want, instruction.Operands[i])
+			}
+		}
+	}
+}
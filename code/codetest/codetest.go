@@ -0,0 +1,15 @@
+// Package codetest helps tests write the instructions they expect.
+package codetest
+
+import "github.com/looplanguage/compiler/code"
+
+// Make encodes an instruction like code.Encode. It panics if the instruction
+// can't be encoded, a test expecting it is wrong.
+func Make(op code.OpCode, operands ...int) []byte {
+	instruction, err := code.Encode(op, operands...)
+	if err != nil {
+		panic(err)
+	}
+
+	return instruction
+}
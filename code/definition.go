@@ -9,6 +9,171 @@ import (
 type Definition struct {
 	Name          string
 	OperandWidths []int
+
+	// Amount of values the instruction pops off and pushes onto the stack
+	Pops   StackCount
+	Pushes StackCount
+
+	Flags Flag
+}
+
+// StackCount is an amount of stack values, which can depend on an operand.
+// For example OpCall pops its first operand plus one values.
+type StackCount struct {
+	Fixed int
+	// Index of the operand that is added to Fixed, or -1 if there is none
+	Operand int
+}
+
+// Fixed is a StackCount that doesn't depend on any operand
+func Fixed(n int) StackCount {
+	return StackCount{Fixed: n, Operand: -1}
+}
+
+// FromOperand is a StackCount of the value of an operand plus extra
+func FromOperand(operand, extra int) StackCount {
+	return StackCount{Fixed: extra, Operand: operand}
+}
+
+// Count returns the amount of values for an instruction with the given operands
+func (s StackCount) Count(operands []int) int {
+	if s.Operand < 0 {
+		return s.Fixed
+	}
+
+	return s.Fixed + operands[s.Operand]
+}
+
+type Flag uint8
+
+const (
+	// Jump instructions have an instruction offset as their last operand
+	Jump Flag = 1 << iota
+	// Terminators never continue with the next instruction
+	Terminator
+	// ReadsConstant instructions have a constant index as their first operand
+	ReadsConstant
+	// Prefixes change the instruction that follows them instead of executing
+	Prefix
+	// Tables are followed by as many OpJump instructions as their second
+	// operand, execution continues at one of them
+	Table
+)
+
+// Is reports whether the definition has all of the given flags
+func (def *Definition) Is(flags Flag) bool {
+	return def.Flags&flags == flags
+}
+
+// JumpTarget returns the instruction offset a jump instruction jumps to
+func (def *Definition) JumpTarget(operands []int) int {
+	return operands[len(operands)-1]
+}
+
+// TableEntries returns the offsets of the jumps following the table
+// instruction at offset. They have to be OpJump instructions of the same
+// width, so the VM can find the one to continue at without decoding them.
+func TableEntries(ins Instructions, table Instruction, offset int) ([]int, error) {
+	var entries []int
+
+	position := offset + table.Size
+	for i := 0; i < table.Operands[1]; i++ {
+		entry, err := ReadInstruction(ins, position)
+		if err != nil {
+			return nil, fmt.Errorf("%s is missing entry %d", table.Def.Name, i)
+		}
+
+		if entry.Op != OpJump {
+			return nil, fmt.Errorf("entry %d of %s is not OpJump. got=%s", i, table.Def.Name, entry.Def.Name)
+		}
+
+		if i > 0 && entry.Size != position-entries[i-1] {
+			return nil, fmt.Errorf("entries of %s have different widths", table.Def.Name)
+		}
+
+		entries = append(entries, position)
+		position += entry.Size
+	}
+
+	return entries, nil
+}
+
+// StackEffect returns how many values an instruction with the given operands
+// pops off and pushes onto the stack
+func (def *Definition) StackEffect(operands []int) (int, int) {
+	return def.Pops.Count(operands), def.Pushes.Count(operands)
+}
+
+// WideOperandWidths returns the operand widths of the instruction when it is
+// prefixed with OpWide
+func (def *Definition) WideOperandWidths() []int {
+	widths := make([]int, len(def.OperandWidths))
+
+	for i, width := range def.OperandWidths {
+		widths[i] = width * 2
+	}
+
+	return widths
+}
+
+// Instruction is a single decoded instruction
+type Instruction struct {
+	Op       OpCode
+	Def      *Definition
+	Operands []int
+	// Whether the instruction is prefixed with OpWide
+	Wide bool
+	// Amount of bytes the instruction takes up, including the OpWide prefix
+	Size int
+}
+
+// ReadInstruction decodes the instruction starting at offset
+func ReadInstruction(ins Instructions, offset int) (Instruction, error) {
+	instruction := Instruction{}
+	position := offset
+
+	if offset < 0 || offset >= len(ins) {
+		return instruction, fmt.Errorf("offset %d out of range", offset)
+	}
+
+	if OpCode(ins[position]) == OpWide {
+		instruction.Wide = true
+		position++
+
+		if position >= len(ins) {
+			return instruction, fmt.Errorf("OpWide is truncated")
+		}
+	}
+
+	def, err := Lookup(ins[position])
+	if err != nil {
+		return instruction, err
+	}
+
+	widths := def.OperandWidths
+	if instruction.Wide {
+		if len(widths) == 0 || def.Is(Prefix) {
+			return instruction, fmt.Errorf("OpWide can not prefix %s", def.Name)
+		}
+
+		widths = def.WideOperandWidths()
+	}
+
+	size := 1
+	for _, width := range widths {
+		size += width
+	}
+
+	if position+size > len(ins) {
+		return instruction, fmt.Errorf("%s is truncated", def.Name)
+	}
+
+	instruction.Op = OpCode(ins[position])
+	instruction.Def = def
+	instruction.Operands, _ = readOperands(widths, ins[position+1:])
+	instruction.Size = position - offset + size
+
+	return instruction, nil
 }
 
 func (ins Instructions) String() string {
@@ -17,22 +182,25 @@ func (ins Instructions) String() string {
 	i := 0
 
 	for i < len(ins) {
-		def, err := Lookup(ins[i])
+		instruction, err := ReadInstruction(ins, i)
 		if err != nil {
 			fmt.Fprintf(&out, "error: %s\n", err)
+			i++
 			continue
 		}
 
-		operands, read := ReadOperands(def, ins[i+1:])
+		formatted := ins.fmtInstruction(instruction.Def, instruction.Operands)
+		if instruction.Wide {
+			formatted = "OpWide " + formatted
+		}
 
-		fmt.Fprintf(&out, "[%04d] %s\n", i, ins.fmtInstruction(def, operands))
+		fmt.Fprintf(&out, "[%04d] %s\n", i, formatted)
 
-		i += 1 + read
+		i += instruction.Size
 	}
 
 	return out.String()
 }
-
 func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 	operandCount := len(def.OperandWidths)
 
@@ -47,17 +215,26 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 		return fmt.Sprintf("%s %d", def.Name, operands[0])
 	case 2:
 		return fmt.Sprintf("%s %d %d", def.Name, operands[0], operands[1])
+	case 3:
+		return fmt.Sprintf("%s %d %d %d", def.Name, operands[0], operands[1], operands[2])
 	}
 
 	return fmt.Sprintf("unhandled operandCount. got=%s\n", def.Name)
 }
 
+// ReadOperands reads the operands of an instruction without OpWide prefix
 func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
-	operands := make([]int, len(def.OperandWidths))
+	return readOperands(def.OperandWidths, ins)
+}
+
+func readOperands(widths []int, ins Instructions) ([]int, int) {
+	operands := make([]int, len(widths))
 	offset := 0
 
-	for i, width := range def.OperandWidths {
+	for i, width := range widths {
 		switch width {
+		case 4:
+			operands[i] = int(ReadUint32(ins[offset:]))
 		case 2:
 			operands[i] = int(ReadUint16(ins[offset:]))
 		case 1:
@@ -78,6 +255,10 @@ func ReadUint16(ins Instructions) uint16 {
 	return binary.BigEndian.Uint16(ins)
 }
 
+func ReadUint32(ins Instructions) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
+
 func Lookup(op byte) (*Definition, error) {
 	def, ok := definitions[OpCode(op)]
 
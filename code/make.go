@@ -1,18 +1,59 @@
 package code
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"fmt"
+)
 
-func Make(op OpCode, operands ...int) []byte {
+// Encode encodes an instruction. Operands too large for their regular width
+// are encoded with an OpWide prefix, which doubles the width of every
+// operand. It returns an error for unknown opcodes and operands that don't
+// fit even then.
+func Encode(op OpCode, operands ...int) ([]byte, error) {
 	def, ok := definitions[op]
+	if !ok {
+		return nil, fmt.Errorf("unknown opcode %d", op)
+	}
+
+	for i, o := range operands {
+		if i < len(def.OperandWidths) && !fits(o, def.OperandWidths[i]) {
+			return EncodeWide(op, operands...)
+		}
+	}
 
-	// If the opcode doesn't exist, return an empty byte array
+	return encode(op, def.OperandWidths, operands)
+}
+
+// EncodeWide encodes an instruction with an OpWide prefix, even when all of
+// its operands would fit their regular width
+func EncodeWide(op OpCode, operands ...int) ([]byte, error) {
+	def, ok := definitions[op]
 	if !ok {
-		return []byte{}
+		return nil, fmt.Errorf("unknown opcode %d", op)
+	}
+
+	if len(def.OperandWidths) == 0 {
+		return nil, fmt.Errorf("%s has no operands to widen", def.Name)
+	}
+
+	instruction, err := encode(op, def.WideOperandWidths(), operands)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{byte(OpWide)}, instruction...), nil
+}
+
+func encode(op OpCode, widths []int, operands []int) ([]byte, error) {
+	def := definitions[op]
+
+	if len(operands) > len(widths) {
+		return nil, fmt.Errorf("too many operands for %s. got=%d. expected=%d", def.Name, len(operands), len(widths))
 	}
 
 	instructionLength := 1
 
-	for _, operandWidth := range def.OperandWidths {
+	for _, operandWidth := range widths {
 		instructionLength += operandWidth
 	}
 
@@ -21,9 +62,15 @@ func Make(op OpCode, operands ...int) []byte {
 
 	offset := 1
 	for i, o := range operands {
-		width := def.OperandWidths[i]
+		width := widths[i]
+
+		if !fits(o, width) {
+			return nil, fmt.Errorf("operand %d of %s out of range. got=%d", i, def.Name, o)
+		}
 
 		switch width {
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
 		case 2:
 			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
 		case 1:
@@ -33,5 +80,9 @@ func Make(op OpCode, operands ...int) []byte {
 		offset += width
 	}
 
-	return instruction
+	return instruction, nil
+}
+
+func fits(operand, width int) bool {
+	return operand >= 0 && uint64(operand) < 1<<(8*uint(width))
 }
@@ -0,0 +1,78 @@
+package code
+
+// StackEffect returns how many values an instruction pops off and pushes
+// onto the stack, unknown opcodes have no effect
+func StackEffect(op OpCode, operands []int) (int, int) {
+	def, ok := definitions[op]
+	if !ok {
+		return 0, 0
+	}
+
+	return def.StackEffect(operands)
+}
+
+// MaxStackDepth returns the deepest the stack gets on any path through the
+// instructions. The instructions are expected to be valid, unknown opcodes
+// and jumps outside of the instructions end the path they're on.
+func MaxStackDepth(ins Instructions) int {
+	depths := map[int]int{0: 0}
+	work := []int{0}
+	max := 0
+
+	visit := func(target, depth int) {
+		if target >= len(ins) {
+			return
+		}
+
+		if _, ok := depths[target]; ok {
+			return
+		}
+
+		depths[target] = depth
+		work = append(work, target)
+	}
+
+	for len(work) > 0 {
+		position := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		if position >= len(ins) {
+			continue
+		}
+
+		instruction, err := ReadInstruction(ins, position)
+		if err != nil {
+			continue
+		}
+
+		def, operands := instruction.Def, instruction.Operands
+
+		pop, push := def.StackEffect(operands)
+		depth := depths[position] - pop + push
+
+		if depth < 0 {
+			depth = 0
+		}
+
+		if depth > max {
+			max = depth
+		}
+
+		if def.Is(Jump) {
+			visit(def.JumpTarget(operands), depth)
+		}
+
+		if !def.Is(Terminator) {
+			visit(position+instruction.Size, depth)
+		}
+
+		if def.Is(Table) {
+			entries, _ := TableEntries(ins, instruction, position)
+			for _, entry := range entries {
+				visit(entry, depth)
+			}
+		}
+	}
+
+	return max
+}
@@ -0,0 +1,23 @@
+package code
+
+// Superinstruction describes a sequence of instructions that can be replaced
+// by a single instruction doing the same work:
+//
+//	OpIncrementVar constant variable
+//		adds a constant to a variable
+//	OpJumpIfVarNotGreater constant variable target
+//		jumps to target unless the variable is greater than the constant
+//	OpJumpIfConstantNotGreater constant variable target
+//		jumps to target unless the constant is greater than the variable
+type Superinstruction struct {
+	Pattern []OpCode
+	// Fuse receives the operands of every instruction in Pattern and returns
+	// the replacing instruction, or false if these operands can't be fused
+	Fuse func(operands [][]int) (OpCode, []int, bool)
+}
+
+// Superinstructions returns every superinstruction, the peephole package
+// turns them into rules
+func Superinstructions() []Superinstruction {
+	return superinstructions
+}
@@ -1,8 +1,12 @@
 package compiler
 
 import (
+	"errors"
 	"fmt"
 	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/ir"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/compiler/values"
 	"github.com/looplanguage/loop/models/ast"
 	"github.com/looplanguage/loop/models/object"
 	"sort"
@@ -10,15 +14,59 @@ import (
 
 var jumpReturns []*int
 
+// operators are the opcodes of the infix operators. "<" is ">" with its
+// operands swapped.
+var operators = map[string]code.OpCode{
+	"+":  code.OpAdd,
+	"-":  code.OpSubtract,
+	"*":  code.OpMultiply,
+	"/":  code.OpDivide,
+	"==": code.OpEquals,
+	"!=": code.OpNotEquals,
+	">":  code.OpGreaterThan,
+	"<":  code.OpGreaterThan,
+}
+
 func (c *Compiler) Compile(node ast.Node, root, identifier, previous string) error {
+	c.bytecode = nil
+
 	switch node := node.(type) {
 	case *ast.Program:
-		for _, stmt := range node.Statements {
-			err := c.Compile(stmt, root, identifier, previous)
+		if (c.OptimizationLevel >= 2 || c.TailCalls) && root == previous {
+			c.collectAssignments(node)
+		}
+
+		if c.OptimizationLevel > 0 && root == previous && len(c.currentInstructions()) == 0 && canLower(node, false) {
+			constants := c.constantPool()
+			b := ir.NewBuilder(constants)
+
+			err := c.lower(b, node, root, previous)
 			if err != nil {
 				return err
 			}
+
+			b.Exit()
+
+			return c.emitLowered(b, constants)
 		}
+
+		// When a jump in the root program turns out to be too far for a
+		// regular jump, the program is compiled again using only wide jumps
+		if root == previous && !c.wideJumps {
+			state := c.saveState()
+
+			err := c.compileStatements(node, root, identifier, previous)
+			if errors.Is(err, errJumpOutOfRange) {
+				c.restoreState(state)
+				c.wideJumps = true
+
+				return c.Compile(node, root, identifier, previous)
+			}
+
+			return err
+		}
+
+		return c.compileStatements(node, root, identifier, previous)
 	case *ast.ExpressionStatement:
 		err := c.Compile(node.Expression, root, "", previous)
 		if err != nil {
@@ -26,55 +74,52 @@ func (c *Compiler) Compile(node ast.Node, root, identifier, previous string) err
 		}
 		c.emit(code.OpPop)
 	case *ast.SuffixExpression:
-		if node.Operator == "<" {
-			err := c.Compile(node.Right, root, "", previous)
-			if err != nil {
-				return err
-			}
-
-			err = c.Compile(node.Left, root, "", previous)
-			if err != nil {
-				return err
-			}
+		op, ok := operators[node.Operator]
+		if !ok {
+			return fmt.Errorf("unknown operator: %s", node.Operator)
+		}
 
-			c.emit(code.OpGreaterThan)
-			return nil
+		left, right := node.Left, node.Right
+		if node.Operator == "<" {
+			left, right = right, left
 		}
 
-		err := c.Compile(node.Left, root, "", previous)
+		err := c.Compile(left, root, "", previous)
 		if err != nil {
 			return err
 		}
 
-		err = c.Compile(node.Right, root, "", previous)
+		err = c.Compile(right, root, "", previous)
 		if err != nil {
 			return err
 		}
 
-		switch node.Operator {
-		case "+":
-			c.emit(code.OpAdd)
-		case "*":
-			c.emit(code.OpMultiply)
-		case "/":
-			c.emit(code.OpDivide)
-		case "-":
-			c.emit(code.OpSubtract)
-		case "==":
-			c.emit(code.OpEquals)
-		case "!=":
-			c.emit(code.OpNotEquals)
-		case ">":
-			c.emit(code.OpGreaterThan)
-		default:
-			return fmt.Errorf("unknown operator: %s", node.Operator)
-		}
+		c.emit(op)
 	case *ast.IntegerLiteral:
 		integer := &object.Integer{Value: node.Value}
-		c.emit(code.OpConstant, c.addConstant(integer))
+
+		index, err := c.addConstant(integer)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpConstant, index)
+	case *syntax.Float:
+		index, err := c.addConstant(&values.Float{Value: node.Value})
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpConstant, index)
 	case *ast.String:
 		str := &object.String{Value: node.Value}
-		c.emit(code.OpConstant, c.addConstant(str))
+
+		index, err := c.addConstant(str)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpConstant, index)
 	case *ast.Boolean:
 		switch node.Value {
 		case true:
@@ -89,47 +134,41 @@ func (c *Compiler) Compile(node ast.Node, root, identifier, previous string) err
 			return err
 		}
 
-		jumpPos := c.emit(code.OpJumpIfNotTrue, 9999)
+		jumpPos := c.emitJump(code.OpJumpIfNotTrue)
+
+		c.enterLoop(&loop{next: startPos})
 
 		err = c.Compile(node.Block, root, "", previous)
 		if err != nil {
 			return err
 		}
 
-		if !c.lastInstructionIs(code.OpReturnValue) {
-			c.emit(code.OpNull)
-		}
-
 		c.emit(code.OpJump, startPos)
 		afterPos := len(c.currentInstructions())
 		c.changeOperand(jumpPos, afterPos)
+		c.leaveLoop(afterPos)
 
-		if c.currentScope.Outer == nil {
-			skipTo := len(c.currentInstructions())
-			for _, jumpReturn := range jumpReturns {
-				c.changeOperand(*jumpReturn, skipTo)
-			}
+		// A while loop evaluates to null, pushed once the loop is done so the
+		// stack depth is the same on every iteration
+		c.emit(code.OpNull)
 
-			jumpReturns = []*int{}
-		}
+		c.patchRootReturns()
 	case *ast.ConditionalStatement:
 		err := c.Compile(node.Condition, root, "", previous)
 		if err != nil {
 			return err
 		}
 
-		jumpPos := c.emit(code.OpJumpIfNotTrue, 9999)
+		jumpPos := c.emitJump(code.OpJumpIfNotTrue)
 
 		err = c.Compile(node.Body, root, "", previous)
 		if err != nil {
 			return err
 		}
 
-		if c.lastInstructionIs(code.OpPop) {
-			c.removeLastPop()
-		}
+		c.keepBlockValue()
 
-		jumpToEnd := c.emit(code.OpJump, 9999)
+		jumpToEnd := c.emitJump(code.OpJump)
 
 		afterConsequencePos := len(c.currentInstructions())
 		c.changeOperand(jumpPos, afterConsequencePos)
@@ -139,7 +178,7 @@ func (c *Compiler) Compile(node ast.Node, root, identifier, previous string) err
 		} else if node.ElseCondition != nil {
 			err := c.Compile(node.ElseCondition, root, "", previous)
 			if err != nil {
-				return nil
+				return err
 			}
 
 			if c.lastInstructionIs(code.OpPop) {
@@ -148,76 +187,65 @@ func (c *Compiler) Compile(node ast.Node, root, identifier, previous string) err
 		} else if node.ElseStatement != nil {
 			err := c.Compile(node.ElseStatement, root, "", previous)
 			if err != nil {
-				return nil
+				return err
 			}
+
+			c.keepBlockValue()
 		}
 
 		afterAlternativePos := len(c.currentInstructions())
 		c.changeOperand(jumpToEnd, afterAlternativePos)
 
-		if c.currentScope.Outer == nil {
-			skipTo := len(c.currentInstructions())
-			for _, jumpReturn := range jumpReturns {
-				c.changeOperand(*jumpReturn, skipTo)
-			}
+		c.patchRootReturns()
+	case *ast.BlockStatement:
+		c.enterBlock()
+
+		cells, err := c.hoist(node.Statements, root)
+		if err != nil {
+			return err
+		}
 
-			jumpReturns = []*int{}
+		for _, index := range cells {
+			c.emit(code.OpMakeCell, index)
 		}
-	case *ast.BlockStatement:
-		c.currentScope = c.deeperScope()
+
 		for _, s := range node.Statements {
 			err := c.Compile(s, root, "", previous)
 			if err != nil {
 				return err
 			}
 		}
-		c.currentScope = c.currentScope.Outer
+		c.leaveBlock()
 
 	case *ast.VariableDeclaration:
-		index := c.variables
-
-		name := node.Identifier.Value
+		symbol := c.define(node.Identifier.Value, root)
 
-		if root != "" {
-			name = "_INTERNAL_" + root + "" + name
+		return c.compileDeclaration(node, symbol, root, previous)
+	case *syntax.ConstantDeclaration:
+		symbol, err := c.defineConstant(node.Identifier.Value, root, c.constantValue(node.Value, root))
+		if err != nil || symbol.Scope == ConstantScope {
+			return err
 		}
 
-		c.currentScope.Variables[index] = Variable{
-			Name:   name,
-			Index:  index,
-			Object: &object.Null{},
+		return c.compileDeclaration(&node.VariableDeclaration, symbol, root, previous)
+	case *syntax.FunctionDeclaration:
+		return c.compileFunctionDeclaration(node, root, previous)
+	case *syntax.Destructuring:
+		return c.compileDestructuring(node.Pattern, node.Value, true, root, previous)
+	case *syntax.DestructuringAssign:
+		return c.compileDestructuring(node.Pattern, node.Value, false, root, previous)
+	case *ast.Assign:
+		symbol, err := c.assignee(node.Identifier.Value, root)
+		if err != nil {
+			return err
 		}
 
-		c.variables++
-
-		err := c.Compile(node.Value, root, "", previous)
+		err = c.Compile(node.Value, root, "", previous)
 		if err != nil {
 			return err
 		}
 
-		c.emit(code.OpSetVar, index)
-	case *ast.Assign:
-		variable := c.currentScope.FindByName(node.Identifier.Value, root)
-
-		if variable == nil {
-			if s, ok := c.symbolTable.Resolve(node.Identifier.Value); ok {
-				err := c.Compile(node.Value, root, "", previous)
-				if err != nil {
-					return err
-				}
-
-				c.emit(code.OpSetLocal, s.Index)
-			} else {
-				return fmt.Errorf("undefined variable %s", node.Identifier.Value)
-			}
-		} else {
-			err := c.Compile(node.Value, root, "", previous)
-			if err != nil {
-				return err
-			}
-
-			c.emit(code.OpSetVar, variable.Index)
-		}
+		c.storeSymbol(symbol)
 	case *ast.IndexAssign:
 		// Put the new value on the stack
 		err := c.Compile(node.Value, root, "", "")
@@ -242,17 +270,12 @@ func (c *Compiler) Compile(node ast.Node, root, identifier, previous string) err
 
 		c.emit(code.OpSetIndex)
 	case *ast.Identifier:
-		variable := c.currentScope.FindByName(node.Value, root)
-
-		if variable != nil {
-			c.emit(code.OpGetVar, variable.Index)
-		} else {
-			if symbol, ok := c.symbolTable.Resolve(node.Value); ok {
-				c.loadSymbol(symbol)
-			} else {
-				return fmt.Errorf("undefined variable %s", node.Value)
-			}
+		symbol, ok := c.resolve(node.Value, root)
+		if !ok {
+			return fmt.Errorf("undefined variable %s", node.Value)
 		}
+
+		c.loadSymbol(symbol)
 	case *ast.Array:
 		for _, element := range node.Elements {
 			err := c.Compile(element, root, "", previous)
@@ -275,17 +298,7 @@ func (c *Compiler) Compile(node ast.Node, root, identifier, previous string) err
 
 		c.emit(code.OpIndex)
 	case *ast.Hashmap:
-		keys := []ast.Expression{}
-		for k := range node.Values {
-			keys = append(keys, k)
-		}
-
-		// TODO: Change this for the tests, this affects compiler performance
-		sort.Slice(keys, func(i, j int) bool {
-			return keys[i].String() < keys[j].String()
-		})
-
-		for _, k := range keys {
+		for _, k := range sortedKeys(node) {
 			err := c.Compile(k, root, "", previous)
 			if err != nil {
 				return err
@@ -297,41 +310,31 @@ func (c *Compiler) Compile(node ast.Node, root, identifier, previous string) err
 		}
 
 		c.emit(code.OpHash, len(node.Values)*2)
-	case *ast.Function:
-		c.enterScope()
+	case *ast.Function, *syntax.Function:
+		function, _ := functionOf(node)
 
-		for _, p := range node.Parameters {
-			c.symbolTable.Define(p.Value)
-		}
-
-		err := c.Compile(node.Body, root, "", previous)
+		index, freeSymbols, err := c.compileFunction(function, root, previous)
 		if err != nil {
 			return err
 		}
 
-		if c.lastInstructionIs(code.OpPop) {
-			c.replaceLastPopWithReturn()
-		}
-
-		if !c.lastInstructionIs(code.OpReturnValue) && !c.lastInstructionIs(code.OpReturn) {
-			c.emit(code.OpReturn)
-		}
-
-		freeSymbols := c.symbolTable.FreeSymbols
-		numLocals := c.symbolTable.numDefinitions
-		instructions := c.leaveScope()
-
+		// Captured cells are shared with the closure, not loaded from
 		for _, s := range freeSymbols {
-			c.loadSymbol(s)
-		}
-
-		compiledFunc := &object.CompiledFunction{
-			Instructions:  instructions,
-			NumLocals:     numLocals,
-			NumParameters: len(node.Parameters),
-		}
-
-		c.emit(code.OpClosure, c.addConstant(compiledFunc), len(freeSymbols))
+			c.emit(symbolInstruction(s))
+		}
+
+		op, operands := closureInstruction(index, freeSymbols)
+		c.emit(op, operands...)
+	case *syntax.ForEach:
+		return c.compileForEach(node, root, previous)
+	case *syntax.Template:
+		return c.compileTemplate(node, root, previous)
+	case *syntax.Match:
+		return c.compileMatch(node, root, previous)
+	case *syntax.Break:
+		return c.compileBreak()
+	case *syntax.Continue:
+		return c.compileContinue()
 	case *ast.Return:
 		if c.currentScope.Outer == nil {
 			return fmt.Errorf("cannot have return statement in root scope")
@@ -342,13 +345,21 @@ func (c *Compiler) Compile(node ast.Node, root, identifier, previous string) err
 			return err
 		}
 
+		if call, ok := node.Value.(*ast.CallExpression); ok && c.isTailCall(call) {
+			return nil
+		}
+
 		c.emit(code.OpReturnValue)
 
 		if c.scopeIndex == 0 {
-			val := c.emit(code.OpJump, 9999)
+			val := c.emitJump(code.OpJump)
 			jumpReturns = append(jumpReturns, &val)
 		}
 	case *ast.CallExpression:
+		if c.isTailCall(node) {
+			return c.compileTailCall(node, root, previous)
+		}
+
 		err := c.Compile(node.Function, root, "", previous)
 		if err != nil {
 			return err
@@ -369,23 +380,200 @@ func (c *Compiler) Compile(node ast.Node, root, identifier, previous string) err
 			return err
 		}
 	case *ast.Export:
-		index := c.variables
+		symbol := c.define(identifier, "")
 
-		c.currentScope.Variables[index] = Variable{
-			Name:   identifier,
-			Index:  index,
-			Object: &object.Null{},
+		err := c.Compile(node.Expression, root, identifier, previous)
+		if err != nil {
+			return err
 		}
 
-		c.variables++
+		c.storeSymbol(symbol)
+	}
 
-		err := c.Compile(node.Expression, root, identifier, previous)
+	return nil
+}
+
+// compileDeclaration stores the value of a declaration in the variable it
+// declares
+func (c *Compiler) compileDeclaration(node *ast.VariableDeclaration, symbol Symbol, root, previous string) error {
+	if _, ok := functionOf(node.Value); ok {
+		c.declaring = &symbol
+		c.functionName = node.Identifier.Value
+	}
+
+	// The cell exists before the value, so closures in it capture it
+	if symbol.Cell {
+		c.emit(code.OpMakeCell, symbol.Index)
+	}
+
+	err := c.Compile(node.Value, root, "", previous)
+	if err != nil {
+		return err
+	}
+
+	c.storeSymbol(symbol)
+	c.registerInlineCandidate(symbol, node, root)
+
+	return nil
+}
+
+// patchRootReturns makes the returns in the blocks of the root program jump
+// past the statement they are in
+func (c *Compiler) patchRootReturns() {
+	if c.currentScope.Outer != nil {
+		return
+	}
+
+	skipTo := len(c.currentInstructions())
+	for _, jumpReturn := range jumpReturns {
+		c.changeOperand(*jumpReturn, skipTo)
+	}
+
+	jumpReturns = []*int{}
+}
+
+func (c *Compiler) compileStatements(node *ast.Program, root, identifier, previous string) error {
+	// Globals are never kept in a cell
+	_, err := c.hoist(node.Statements, root)
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range node.Statements {
+		err := c.Compile(stmt, root, identifier, previous)
 		if err != nil {
 			return err
 		}
 
-		c.emit(code.OpSetVar, index)
+		if c.err != nil {
+			return c.err
+		}
 	}
 
 	return nil
 }
+
+// compileFunction compiles a function into a constant and returns its index
+// together with the symbols the closure has to capture
+func (c *Compiler) compileFunction(node *syntax.Function, root, previous string) (int, []Symbol, error) {
+	defaults, err := checkParameters(node)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	variable, name := c.declaring, c.functionName
+	c.declaring, c.functionName = nil, ""
+
+	c.enterScope()
+
+	c.scopes[c.scopeIndex].variable = variable
+	c.scopes[c.scopeIndex].parameters = len(node.Parameters)
+
+	// Calling itself with every argument would skip the defaults and the
+	// array of the variadic parameter, so it is a regular call
+	if defaults > 0 || node.Variadic {
+		c.scopes[c.scopeIndex].parameters = -1
+	}
+
+	frame := c.currentScope.frame
+	frame.cells = cellVariables(withDefaults(node))
+
+	var parameters []Symbol
+	for _, p := range node.Parameters {
+		parameters = append(parameters, c.define(p.Value, root))
+	}
+
+	// Parameters are put in their cells when the function starts
+	parameterCells := append([]int{}, frame.cellSlots...)
+
+	if c.TailCalls {
+		c.markTailCalls(node.Body.Statements, true)
+	}
+
+	// The defaults jump over each other, which is only compiled directly
+	if c.OptimizationLevel > 0 && defaults == 0 && canLower(node.Body, true) {
+		constants := c.constantPool()
+		b := ir.NewBuilder(constants)
+
+		for _, index := range parameterCells {
+			b.Emit(code.OpMakeCell, index)
+		}
+
+		err := c.lower(b, node.Body, root, previous)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// Like replaceLastPopWithReturn, the value of the last expression is
+		// left on the stack
+		b.RemoveLastPop()
+		b.Return()
+
+		err = c.emitLowered(b, constants)
+		if err != nil {
+			return 0, nil, err
+		}
+	} else {
+		for _, index := range parameterCells {
+			c.emit(code.OpMakeCell, index)
+		}
+
+		err := c.compileDefaults(node, parameters, root, previous)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		err = c.Compile(node.Body, root, "", previous)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if c.lastInstructionIs(code.OpPop) {
+			c.replaceLastPopWithReturn()
+		}
+
+		if !c.lastInstructionIs(code.OpReturnValue) && !c.lastInstructionIs(code.OpReturn) && !c.lastInstructionIs(code.OpTailCall) {
+			c.emit(code.OpReturn)
+		}
+	}
+
+	freeSymbols := frame.free
+	numLocals := frame.slots.max
+	instructions := c.optimize(c.leaveScope())
+
+	compiledFunc := &object.CompiledFunction{
+		Instructions:  instructions,
+		NumLocals:     numLocals,
+		NumParameters: len(node.Parameters),
+	}
+
+	index, err := c.addConstant(compiledFunc)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	c.functions[index] = FunctionMetadata{
+		MaxStackDepth: code.MaxStackDepth(instructions),
+		Cells:         frame.cellSlots,
+		Defaults:      defaults,
+		Variadic:      node.Variadic,
+		Name:          name,
+	}
+
+	return index, freeSymbols, nil
+}
+
+// sortedKeys returns the keys of a hashmap in the order they are compiled in
+func sortedKeys(node *ast.Hashmap) []ast.Expression {
+	keys := []ast.Expression{}
+	for k := range node.Values {
+		keys = append(keys, k)
+	}
+
+	// TODO: Change this for the tests, this affects compiler performance
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	return keys
+}
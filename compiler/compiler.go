@@ -1,8 +1,14 @@
 package compiler
 
 import (
-	"encoding/gob"
+	"errors"
+	"fmt"
 	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/ir"
+	"github.com/looplanguage/compiler/peephole"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/compiler/values"
+	"github.com/looplanguage/loop/models/ast"
 	"github.com/looplanguage/loop/models/object"
 )
 
@@ -10,48 +16,31 @@ type CompilationScope struct {
 	instructions        code.Instructions
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
-}
-
-type Variable struct {
-	Name   string
-	Index  int
-	Scope  int
-	Object object.Object
-}
-
-type VariableScope struct {
-	Variables map[int]Variable
-	Outer     *VariableScope
-}
-
-func (vs *VariableScope) FindByName(name, root string) *Variable {
-	if root == "" {
-		for _, v := range vs.Variables {
-			if v.Name == name {
-				return &v
-			}
-		}
-	} else {
-		for _, v := range vs.Variables {
-			if v.Name == "_INTERNAL_"+root+name {
-				return &v
-			}
-			if v.Name == name {
-				return &v
-			}
-		}
-	}
-
-	if vs.Outer != nil {
-		return vs.Outer.FindByName(name, root)
-	}
 
-	return nil
+	// Variable the function is declared as, or nil
+	variable   *Symbol
+	parameters int
+	// Loops being compiled, innermost last
+	loops []*loop
 }
 
 type Compiler struct {
-	constants   []object.Object
-	symbolTable *SymbolTable
+	// OptimizationLevel 0 compiles the AST straight to instructions, from
+	// level 1 on it is lowered to the intermediate representation first
+	// and optimized there. Level 2 also inlines calls to small functions.
+	OptimizationLevel int
+	// Peephole rules applied to the instructions of every function and of
+	// the program itself
+	Rules []peephole.Rule
+	// Replace common sequences of instructions by superinstructions, which
+	// the VM has to support
+	Superinstructions bool
+	// Calls in tail position reuse the frame of the calling function. Calls
+	// of a function to itself become jumps to its start, other calls use
+	// OpTailCall, which the VM has to support.
+	TailCalls bool
+
+	constants []object.Object
 
 	VariableScopes []VariableScope
 	currentScope   *VariableScope
@@ -59,11 +48,76 @@ type Compiler struct {
 	scopes     []CompilationScope
 	scopeIndex int
 
-	variables int
+	// Slots of the global variables
+	globals slots
+
+	// Metadata of every function in the constant pool, by constant index
+	functions map[int]FunctionMetadata
+
+	// Emit jumps with an OpWide prefix, set once a jump target didn't fit
+	wideJumps bool
+	// First error that occurred while emitting instructions
+	err error
+
+	// Optimizations that run on the intermediate representation
+	passes []ir.Pass
+
+	// Functions calls can be inlined to from -O2 on, by variable index
+	inlineCandidates map[int]*inlineCandidate
+	// Names that are assigned to anywhere, their functions aren't inlined
+	reassigned map[string]bool
+	// How many inlined calls the current call is inlined in
+	inlineDepth int
+
+	// Calls in tail position of the functions compiled so far
+	tailPositions map[*ast.CallExpression]bool
+	// Variable the next compiled function is declared as, or nil
+	declaring *Symbol
+	// Name the next compiled function is recorded with
+	functionName string
+	// Variables of the declared functions, defined when their block starts
+	hoisted map[*syntax.FunctionDeclaration]Symbol
+
+	// Optimized bytecode of what is compiled so far, cleared by Compile
+	bytecode *Bytecode
+	// Constants added by internConstant, by type and value
+	interned map[string]int
 
 	root string
 }
 
+// FunctionMetadata is information about a compiled function that isn't stored
+// on object.CompiledFunction itself
+type FunctionMetadata struct {
+	// Deepest the operand stack of the function gets, a VM can preallocate
+	// exactly this many slots
+	MaxStackDepth int
+	// Locals captured by closures that are kept in a cell, only these have
+	// to outlive the call. The other locals can stay on the stack.
+	Cells []int
+	// Parameters before the variadic one that have a default value, calls
+	// can leave out their arguments
+	Defaults int
+	// Whether the last parameter is an array of the arguments after the
+	// other parameters
+	Variadic bool
+	// Name of the variable the function is declared as, empty for
+	// anonymous functions
+	Name string
+}
+
+// Arity returns the fewest and the most arguments a call of function can
+// pass, the most is -1 for variadic functions
+func (m FunctionMetadata) Arity(function *object.CompiledFunction) (int, int) {
+	min := function.NumParameters - m.Defaults
+
+	if m.Variadic {
+		return min - 1, -1
+	}
+
+	return min, function.NumParameters
+}
+
 type EmittedInstruction struct {
 	OpCode   code.OpCode
 	Position int
@@ -76,18 +130,17 @@ func Create() *Compiler {
 		previousInstruction: EmittedInstruction{},
 	}
 
-	symbolTable := CreateSymbolTable()
-
-	for i, value := range object.Builtins {
-		symbolTable.DefineBuiltin(i, value.Name)
-	}
-
 	return &Compiler{
-		constants:   []object.Object{},
-		symbolTable: symbolTable,
-		scopes:      []CompilationScope{globalScope},
-		scopeIndex:  0,
-		variables:   0,
+		constants:  []object.Object{},
+		scopes:     []CompilationScope{globalScope},
+		scopeIndex: 0,
+		functions:  map[int]FunctionMetadata{},
+		passes:     ir.Passes,
+
+		inlineCandidates: map[int]*inlineCandidate{},
+		reassigned:       map[string]bool{},
+		tailPositions:    map[*ast.CallExpression]bool{},
+		hoisted:          map[*syntax.FunctionDeclaration]Symbol{},
 		currentScope: &VariableScope{
 			Variables: map[int]Variable{},
 			Outer:     nil,
@@ -99,6 +152,8 @@ func (c *Compiler) deeperScope() *VariableScope {
 	return &VariableScope{
 		Variables: map[int]Variable{},
 		Outer:     c.currentScope,
+		frame:     c.currentScope.frame,
+		start:     c.slots(c.currentScope).next,
 	}
 }
 
@@ -107,47 +162,107 @@ func (c *Compiler) currentInstructions() code.Instructions {
 }
 
 func (c *Compiler) loadSymbol(s Symbol) {
-	switch s.Scope {
-	case GlobalScope:
-		c.emit(code.OpGetGlobal, s.Index)
-	case LocalScope:
-		c.emit(code.OpGetLocal, s.Index)
-	case BuiltinScope:
-		c.emit(code.OpGetBuiltinFunction, s.Index)
-	case FreeScope:
-		c.emit(code.OpGetFree, s.Index)
+	c.emit(symbolInstruction(s))
+
+	if s.Cell {
+		c.emit(code.OpLoadCell)
 	}
 }
 
-func (s *SymbolTable) GetAllVariables(current map[string]Symbol) map[string]Symbol {
-	returnVal := current
-
-	for k, v := range s.store {
-		returnVal[k] = v
+// storeSymbol stores the value on top of the stack in a variable, or in the
+// cell it is kept in
+func (c *Compiler) storeSymbol(s Symbol) {
+	switch {
+	case s.Cell:
+		c.emit(symbolInstruction(s))
+		c.emit(code.OpStoreCell)
+	case s.Scope == GlobalScope:
+		c.emit(code.OpSetVar, s.Index)
+	default:
+		c.emit(code.OpSetLocal, s.Index)
 	}
+}
 
-	if s.Outer != nil {
-		return s.Outer.GetAllVariables(returnVal)
+// symbolInstruction returns the instruction that loads a symbol
+func symbolInstruction(s Symbol) (code.OpCode, int) {
+	switch s.Scope {
+	case LocalScope:
+		return code.OpGetLocal, s.Index
+	case BuiltinScope:
+		return code.OpGetBuiltinFunction, s.Index
+	case FreeScope:
+		return code.OpGetFree, s.Index
+	case ConstantScope:
+		return code.OpConstant, s.Index
 	}
 
-	return returnVal
+	return code.OpGetVar, s.Index
 }
 
-func CreateWithState(s *SymbolTable, constants []object.Object) *Compiler {
+// CreateWithState creates a compiler that continues with the global variables
+// and constants of an earlier one
+func CreateWithState(scope *VariableScope, constants []object.Object) *Compiler {
 	comp := Create()
-	comp.symbolTable = s
+	comp.currentScope = scope
 	comp.constants = constants
 
+	// Variables of earlier programs can be used by functions at any time
+	for s := scope; s != nil; s = s.Outer {
+		for index := range s.Variables {
+			if index >= comp.globals.next {
+				comp.globals = slots{next: index + 1, max: index + 1, kept: index + 1}
+			}
+		}
+	}
+
 	return comp
 }
 
-func (c *Compiler) addConstant(obj object.Object) int {
+func (c *Compiler) addConstant(obj object.Object) (int, error) {
+	err := validateConstant(obj)
+	if err != nil {
+		return 0, err
+	}
+
 	c.constants = append(c.constants, obj)
-	return len(c.constants) - 1
+	return len(c.constants) - 1, nil
+}
+
+// internConstant adds an integer, float or string to the constant pool once,
+// later calls with an equal value return the same index. Other objects are
+// added every time.
+func (c *Compiler) internConstant(obj object.Object) (int, error) {
+	switch obj.(type) {
+	case *object.Integer, *values.Float, *object.String:
+	default:
+		return c.addConstant(obj)
+	}
+
+	key := string(obj.Type()) + " " + obj.Inspect()
+	if index, ok := c.interned[key]; ok {
+		return index, nil
+	}
+
+	index, err := c.addConstant(obj)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.interned == nil {
+		c.interned = map[string]int{}
+	}
+
+	c.interned[key] = index
+
+	return index, nil
 }
 
 func (c *Compiler) emit(op code.OpCode, operands ...int) int {
-	ins := code.Make(op, operands...)
+	ins, err := code.Encode(op, operands...)
+	if err != nil {
+		c.fail(err)
+	}
+
 	pos := c.addInstruction(ins)
 
 	c.setLastInstruction(op, pos)
@@ -155,6 +270,36 @@ func (c *Compiler) emit(op code.OpCode, operands ...int) int {
 	return pos
 }
 
+// emitJump emits a jump with a placeholder target, which is changed with
+// changeOperand once the target is known. The operands are the ones before
+// the target.
+func (c *Compiler) emitJump(op code.OpCode, operands ...int) int {
+	operands = append(operands, 9999)
+
+	if !c.wideJumps {
+		return c.emit(op, operands...)
+	}
+
+	ins, err := code.EncodeWide(op, operands...)
+	if err != nil {
+		c.fail(err)
+	}
+
+	pos := c.addInstruction(ins)
+
+	c.setLastInstruction(op, pos)
+
+	return pos
+}
+
+// fail records an error that occurred while emitting instructions, it is
+// returned by Compile once the current statement has been compiled
+func (c *Compiler) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
 func (c *Compiler) lastInstructionIs(op code.OpCode) bool {
 	if len(c.currentInstructions()) == 0 {
 		return false
@@ -165,7 +310,12 @@ func (c *Compiler) lastInstructionIs(op code.OpCode) bool {
 
 func (c *Compiler) replaceLastPopWithReturn() {
 	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
-	c.replaceInstruction(lastPos, code.Make(code.OpReturn))
+	ins, err := code.Encode(code.OpReturn)
+	if err != nil {
+		c.fail(err)
+	}
+
+	c.replaceInstruction(lastPos, ins)
 
 	c.scopes[c.scopeIndex].lastInstruction.OpCode = code.OpReturn
 }
@@ -181,6 +331,16 @@ func (c *Compiler) removeLastPop() {
 	c.scopes[c.scopeIndex].lastInstruction = previous
 }
 
+// keepBlockValue makes sure a compiled block leaves exactly one value on the
+// stack, either the value of its last expression or null
+func (c *Compiler) keepBlockValue() {
+	if c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	} else if !c.lastInstructionIs(code.OpReturnValue) && !c.lastInstructionIs(code.OpReturn) {
+		c.emit(code.OpNull)
+	}
+}
+
 func (c *Compiler) setLastInstruction(op code.OpCode, pos int) {
 	previous := c.scopes[c.scopeIndex].lastInstruction
 	last := EmittedInstruction{OpCode: op, Position: pos}
@@ -197,18 +357,69 @@ func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
 	}
 }
 
+// changeOperand changes the last operand of an instruction, which is the
+// target of a jump
 func (c *Compiler) changeOperand(opPos int, operand int) {
-	op := code.OpCode(c.currentInstructions()[opPos])
-	newInstruction := code.Make(op, operand)
+	old, err := code.ReadInstruction(c.currentInstructions(), opPos)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+
+	operands := append(old.Operands[:len(old.Operands)-1], operand)
+
+	// The instruction is changed in place, so it has to keep its width
+	var newInstruction []byte
+	if old.Wide {
+		newInstruction, err = code.EncodeWide(old.Op, operands...)
+	} else {
+		newInstruction, err = code.Encode(old.Op, operands...)
+	}
+
+	if err == nil && len(newInstruction) != old.Size {
+		err = fmt.Errorf("%w. got=%d", errJumpOutOfRange, operand)
+	}
+
+	if err != nil {
+		c.fail(err)
+		return
+	}
 
 	c.replaceInstruction(opPos, newInstruction)
 }
 
+// Bytecode returns the optimized bytecode of what is compiled so far. It is
+// only optimized again once more is compiled.
 func (c *Compiler) Bytecode() *Bytecode {
-	return &Bytecode{
-		Instructions: c.currentInstructions(),
-		Constants:    c.constants,
+	if c.bytecode != nil {
+		return c.bytecode
+	}
+
+	instructions := c.optimize(c.currentInstructions())
+
+	c.bytecode = &Bytecode{
+		Instructions:  instructions,
+		Constants:     c.constants,
+		MaxStackDepth: code.MaxStackDepth(instructions),
+		NumVariables:  c.globals.max,
+		Functions:     c.functions,
 	}
+
+	return c.bytecode
+}
+
+// optimize runs the enabled optimizations over a finished instruction stream
+func (c *Compiler) optimize(instructions code.Instructions) code.Instructions {
+	rules := c.Rules
+	if c.Superinstructions {
+		rules = append(rules[:len(rules):len(rules)], peephole.Superinstructions()...)
+	}
+
+	if len(rules) == 0 {
+		return instructions
+	}
+
+	return peephole.Optimize(instructions, rules)
 }
 
 func (c *Compiler) addInstruction(ins []byte) int {
@@ -226,7 +437,14 @@ func (c *Compiler) enterScope() {
 		lastInstruction:     EmittedInstruction{},
 		previousInstruction: EmittedInstruction{},
 	}
-	c.symbolTable = CreateEnclosedSymbolTable(c.symbolTable)
+
+	// Every function has a frame of its own
+	c.currentScope = &VariableScope{
+		Variables: map[int]Variable{},
+		Outer:     c.currentScope,
+		frame:     &frame{outer: c.currentScope},
+	}
+
 	c.scopes = append(c.scopes, scope)
 	c.scopeIndex++
 }
@@ -234,7 +452,7 @@ func (c *Compiler) enterScope() {
 func (c *Compiler) leaveScope() code.Instructions {
 	instructions := c.currentInstructions()
 
-	c.symbolTable = c.symbolTable.Outer
+	c.currentScope = c.currentScope.frame.outer
 
 	c.scopes = c.scopes[:len(c.scopes)-1]
 	c.scopeIndex--
@@ -242,15 +460,91 @@ func (c *Compiler) leaveScope() code.Instructions {
 	return instructions
 }
 
+var errJumpOutOfRange = errors.New("jump target out of range")
+
+// compilerState is everything needed to compile the root program again
+type compilerState struct {
+	constants       int
+	instructions    int
+	lastInstruction EmittedInstruction
+	previous        EmittedInstruction
+	globals         slots
+	variableScope   *VariableScope
+	scopeVariables  map[int]Variable
+	scopeNames      map[string]Variable
+}
+
+func (c *Compiler) saveState() compilerState {
+	state := compilerState{
+		constants:       len(c.constants),
+		instructions:    len(c.scopes[0].instructions),
+		lastInstruction: c.scopes[0].lastInstruction,
+		previous:        c.scopes[0].previousInstruction,
+		globals:         c.globals,
+		variableScope:   c.currentScope,
+		scopeVariables:  map[int]Variable{},
+		scopeNames:      map[string]Variable{},
+	}
+
+	for k, v := range c.currentScope.Variables {
+		state.scopeVariables[k] = v
+	}
+
+	for k, v := range c.currentScope.index() {
+		state.scopeNames[k] = v
+	}
+
+	return state
+}
+
+func (c *Compiler) restoreState(state compilerState) {
+	c.bytecode = nil
+
+	for index := range c.functions {
+		if index >= state.constants {
+			delete(c.functions, index)
+		}
+	}
+
+	c.constants = c.constants[:state.constants]
+
+	for key, index := range c.interned {
+		if index >= state.constants {
+			delete(c.interned, key)
+		}
+	}
+
+	c.scopes = c.scopes[:1]
+	c.scopeIndex = 0
+	c.scopes[0].instructions = c.scopes[0].instructions[:state.instructions]
+	c.scopes[0].lastInstruction = state.lastInstruction
+	c.scopes[0].previousInstruction = state.previous
+
+	for index := range c.inlineCandidates {
+		if index >= state.globals.next {
+			delete(c.inlineCandidates, index)
+		}
+	}
+
+	c.globals = state.globals
+	c.currentScope = state.variableScope
+	c.currentScope.Variables = state.scopeVariables
+	c.currentScope.names = state.scopeNames
+
+	c.err = nil
+	jumpReturns = []*int{}
+}
+
 type Bytecode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
 	Variables    []VariableScope
-}
 
-func RegisterGobTypes() {
-	gob.Register(&object.String{})
-	gob.Register(&object.Integer{})
-	gob.Register(&object.CompiledFunction{})
-	gob.Register(&object.Null{})
+	// Deepest the operand stack of the top-level program gets
+	MaxStackDepth int
+	// Most global variables in use at once, their slots are reused once
+	// the block declaring them ended
+	NumVariables int
+	// Metadata of the functions in Constants, by constant index
+	Functions map[int]FunctionMetadata
 }
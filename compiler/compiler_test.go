@@ -3,10 +3,16 @@ package compiler
 import (
 	"fmt"
 	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"github.com/looplanguage/compiler/peephole"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/compiler/values"
 	"github.com/looplanguage/loop/lexer"
 	"github.com/looplanguage/loop/models/ast"
 	"github.com/looplanguage/loop/models/object"
 	"github.com/looplanguage/loop/parser"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -14,6 +20,8 @@ type compilerTestCase struct {
 	input                string
 	expectedConstants    []interface{}
 	expectedInstructions []code.Instructions
+	// Parses the input instead of parse
+	parse func(string) *ast.Program
 }
 
 type compilerTestCaseError struct {
@@ -27,74 +35,74 @@ func TestIntegerArithmetic(t *testing.T) {
 			input:             "1 + 2",
 			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "1 * 2",
 			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpMultiply),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpMultiply),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "1 / 2",
 			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpDivide),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpDivide),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "1; 2",
 			expectedConstants: []interface{}{1, 2}, expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpPop),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "1 - 2",
 			expectedConstants: []interface{}{1, 2}, expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpSubtract),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpSubtract),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "true",
 			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpTrue),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "false",
 			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpFalse),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpFalse),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "1 == 1",
 			expectedConstants: []interface{}{1, 1},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpEquals),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpEquals),
+				codetest.Make(code.OpPop),
 			},
 		},
 		/* TODO: Add parser support
@@ -102,40 +110,40 @@ func TestIntegerArithmetic(t *testing.T) {
 			input:             "1 != 1",
 			expectedConstants: []interface{}{1, 1},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpNotEquals),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpNotEquals),
+				codetest.Make(code.OpPop),
 			},
 		},*/
 		{
 			input:             "1 > 1",
 			expectedConstants: []interface{}{1, 1},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpGreaterThan),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpGreaterThan),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "1 < 1",
 			expectedConstants: []interface{}{1, 1},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpGreaterThan),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpGreaterThan),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "true == false",
 			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpTrue),
-				code.Make(code.OpFalse),
-				code.Make(code.OpEquals),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpFalse),
+				codetest.Make(code.OpEquals),
+				codetest.Make(code.OpPop),
 			},
 		},
 	}
@@ -143,52 +151,177 @@ func TestIntegerArithmetic(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestCompiler_Floats(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `float("3.14") + 1`,
+			expectedConstants: []interface{}{3.14, 1},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseFloats,
+		},
+		{
+			input:             `2 > float("0.5")`,
+			expectedConstants: []interface{}{2, 0.5},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpGreaterThan),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseFloats,
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCompiler_FloatFolding(t *testing.T) {
+	tests := []struct {
+		input                string
+		expectedConstants    []interface{}
+		expectedInstructions []code.Instructions
+	}{
+		{
+			// Folding keeps the precision of the VM
+			input:             `var x = float("0.1") + float("0.2")`,
+			expectedConstants: []interface{}{0.30000000000000004},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+			},
+		},
+		{
+			input:             `var x = 1 / float("4")`,
+			expectedConstants: []interface{}{0.25},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+			},
+		},
+		{
+			input:             `var x = float("1.5") == 1`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpFalse),
+				codetest.Make(code.OpSetVar, 0),
+			},
+		},
+		{
+			// Infinity and division by zero are left to the VM
+			input:             `var x = float("1e308") * 10; var y = float("1.5") / 0`,
+			expectedConstants: []interface{}{1e308, 10, 1.5, 0},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpMultiply),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpDivide),
+				codetest.Make(code.OpSetVar, 1),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		bytecode := compileProgramAt(t, parseFloats(tc.input), 1)
+
+		err := testInstructions(tc.expectedInstructions, bytecode.Instructions)
+		if err != nil {
+			t.Fatalf("testInstructions failed for %q with: %s", tc.input, err)
+		}
+
+		err = testConstants(tc.expectedConstants, bytecode.Constants)
+		if err != nil {
+			t.Fatalf("testConstants failed for %q with: %s", tc.input, err)
+		}
+	}
+}
+
+func TestCompiler_FloatPrograms(t *testing.T) {
+	tests := []programTest{
+		{`print(1 / float("2"))`, []string{"0.5"}},
+		{`print(float("2.5") * 2)`, []string{"5.0"}},
+		{`print(float("0.1") + float("0.2"))`, []string{"0.30000000000000004"}},
+		{`print(3 > float("2.5"))`, []string{"true"}},
+		{`print(1 == float("1"))`, []string{"true"}},
+		{`var x = float("1.5"); print(x + x)`, []string{"3.0"}},
+		{`var f = fun(x) { x * float("0.5") }; print(f(3))`, []string{"1.5"}},
+	}
+
+	runPrograms(t, tests, parseFloats)
+}
+
 func TestCompiler_Conditionals(t *testing.T) {
 	tests := []compilerTestCase{
 		{
 			input:             `if(true) { 10 }; 1000;`,
 			expectedConstants: []interface{}{10, 1000},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpTrue),
-				code.Make(code.OpJumpIfNotTrue, 10),
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpJump, 11),
-				code.Make(code.OpNull),
-				code.Make(code.OpPop),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpIfNotTrue, 10),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpJump, 11),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             `if(true) { 10 } else { 20 }; 1000;`,
 			expectedConstants: []interface{}{10, 20, 1000},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpTrue),
-				code.Make(code.OpJumpIfNotTrue, 10),
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpJump, 13),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpPop),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpIfNotTrue, 10),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpJump, 13),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             `if(true) { 10 } else if(true) { 20 } else { 30 }; 1000;`,
 			expectedConstants: []interface{}{10, 20, 30, 1000},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpTrue),
-				code.Make(code.OpJumpIfNotTrue, 10),
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpJump, 23),
-				code.Make(code.OpTrue),
-				code.Make(code.OpJumpIfNotTrue, 20),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpJump, 23),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpPop),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpIfNotTrue, 10),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpJump, 23),
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpIfNotTrue, 20),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpJump, 23),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			// A block that doesn't end in an expression evaluates to null
+			input:             `if(true) { var x = 10 } else { var y = 20 }; 1000;`,
+			expectedConstants: []interface{}{10, 20, 1000},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpIfNotTrue, 14),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpJump, 21),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpPop),
 			},
 		},
 	}
@@ -196,6 +329,96 @@ func TestCompiler_Conditionals(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestCompiler_While(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// The null the loop evaluates to is pushed once it is done, so
+			// the stack depth is the same on every iteration
+			input:             `var i = 0; while(i < 3) { i = i + 1 }; 1000;`,
+			expectedConstants: []interface{}{0, 3, 1, 1000},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpGreaterThan),
+				codetest.Make(code.OpJumpIfNotTrue, 29),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpJump, 6),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCompiler_ReturningBlocks(t *testing.T) {
+	// Without the intermediate representation the jumps after a return are
+	// kept, even though they can't be reached
+	tests := []compilerTestCase{
+		{
+			// A block ending in a return has no value to keep
+			input: `fun() { if(true) { return 10 } else { return 20 } }`,
+			expectedConstants: []interface{}{10, 20, []code.Instructions{
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpIfNotTrue, 11),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpReturnValue),
+				codetest.Make(code.OpJump, 15),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpReturnValue),
+				codetest.Make(code.OpReturn),
+			}},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fun() { while(true) { return 1 } }`,
+			expectedConstants: []interface{}{1, []code.Instructions{
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpIfNotTrue, 11),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpReturnValue),
+				codetest.Make(code.OpJump, 0),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpReturn),
+			}},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpPop),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		compiler := Create()
+
+		err := compiler.Compile(parse(tc.input), "", "", "")
+		if err != nil {
+			t.Fatalf("compiler error for %q: %s", tc.input, err)
+		}
+
+		err = testInstructions(tc.expectedInstructions, compiler.Bytecode().Instructions)
+		if err != nil {
+			t.Fatalf("testInstructions failed for %q with: %s", tc.input, err)
+		}
+
+		err = testConstants(tc.expectedConstants, compiler.Bytecode().Constants)
+		if err != nil {
+			t.Fatalf("testConstants failed for %q with: %s", tc.input, err)
+		}
+	}
+}
+
 func TestCompiler_VariableScope(t *testing.T) {
 	tests := []compilerTestCaseError{
 		{
@@ -271,6 +494,15 @@ func TestCompiler_VariableScope(t *testing.T) {
 			`,
 			expected: "undefined variable y",
 		},
+		{
+			// Errors in an else branch aren't dropped
+			input:    `if(true) { 1 } else { z }`,
+			expected: "undefined variable z",
+		},
+		{
+			input:    `if(true) { 1 } else if(false) { z }`,
+			expected: "undefined variable z",
+		},
 	}
 
 	runCompilerTestsErrors(t, tests)
@@ -308,7 +540,11 @@ func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 	i := 0
 	for _, tc := range tests {
 		i++
+
 		program := parse(tc.input)
+		if tc.parse != nil {
+			program = tc.parse(tc.input)
+		}
 
 		compiler := Create()
 
@@ -331,6 +567,27 @@ func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 		if err != nil {
 			t.Fatalf("[%d/%d] testConstants failed with: %s", i, len(tests), err)
 		}
+
+		// Without any optimizations the intermediate representation has to
+		// result in the same instructions
+		lowered := Create()
+		lowered.OptimizationLevel = 1
+		lowered.passes = nil
+
+		err = lowered.Compile(program, "", "", "")
+		if err != nil {
+			t.Fatalf("compiler error at -O1: %s", err)
+		}
+
+		err = testInstructions(tc.expectedInstructions, lowered.Bytecode().Instructions)
+		if err != nil {
+			t.Errorf("testInstructions failed at -O1 for %q with: %s", tc.input, err)
+		}
+
+		err = testConstants(tc.expectedConstants, lowered.Bytecode().Constants)
+		if err != nil {
+			t.Errorf("testConstants failed at -O1 for %q with: %s", tc.input, err)
+		}
 	}
 }
 
@@ -340,32 +597,32 @@ func TestCompiler_VariableStatements(t *testing.T) {
 			input:             "var test = 1; var testtwo = 2;",
 			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetVar, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpSetVar, 1),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpSetVar, 1),
 			},
 		},
 		{
 			input:             "var test = 1; test;",
 			expectedConstants: []interface{}{1},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetVar, 0),
-				code.Make(code.OpGetVar, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "var test = 1; var two = test; two;",
 			expectedConstants: []interface{}{1},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetVar, 0),
-				code.Make(code.OpGetVar, 0),
-				code.Make(code.OpSetVar, 1),
-				code.Make(code.OpGetVar, 1),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpSetVar, 1),
+				codetest.Make(code.OpGetVar, 1),
+				codetest.Make(code.OpPop),
 			},
 		},
 	}
@@ -379,18 +636,18 @@ func TestCompiler_Strings(t *testing.T) {
 			input:             `"test"`,
 			expectedConstants: []interface{}{"test"},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             `"hello " + "world"`,
 			expectedConstants: []interface{}{"hello ", "world"},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpPop),
 			},
 		},
 	}
@@ -404,36 +661,36 @@ func TestCompiler_Arrays(t *testing.T) {
 			input:             "[]",
 			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpArray, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpArray, 0),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "[1, 2, 3]",
 			expectedConstants: []interface{}{1, 2, 3},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpArray, 3),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpArray, 3),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "[1 + 2, 3 * 4, 5 - 6]",
 			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpMultiply),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpSubtract),
-				code.Make(code.OpArray, 3),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpMultiply),
+				codetest.Make(code.OpConstant, 4),
+				codetest.Make(code.OpConstant, 5),
+				codetest.Make(code.OpSubtract),
+				codetest.Make(code.OpArray, 3),
+				codetest.Make(code.OpPop),
 			},
 		},
 	}
@@ -441,44 +698,159 @@ func TestCompiler_Arrays(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestCompiler_ForEach(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "each([1, 2], fun(x) { x })",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpArray, 2),
+				codetest.Make(code.OpIterInit),
+				// 0010
+				codetest.Make(code.OpIterNext, 1, 24),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpJump, 10),
+				// 0024
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseLoops,
+		},
+		{
+			input:             "each({}, fun(k, v) { if(true) { break }; continue })",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpHash, 0),
+				codetest.Make(code.OpIterInit),
+				// 0004
+				codetest.Make(code.OpIterNext, 2, 33),
+				codetest.Make(code.OpSetVar, 1),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpIfNotTrue, 25),
+				codetest.Make(code.OpJump, 35),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpJump, 26),
+				// 0025
+				codetest.Make(code.OpNull),
+				// 0026
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpJump, 4),
+				codetest.Make(code.OpJump, 4),
+				// 0033
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpPop),
+				// 0035
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseLoops,
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCompiler_ForEachPrograms(t *testing.T) {
+	tests := []programTest{
+		{"var sum = 0; each([1, 2, 3], fun(x) { sum = sum + x }); print(sum)", []string{"6"}},
+		{`each(["a", "b"], fun(i, x) { print(i, x) })`, []string{"0 a", "1 b"}},
+		{`each({"b": 2, "a": 1}, fun(k) { print(k) })`, []string{"a", "b"}},
+		{`each({"b": 2, "a": 1}, fun(k, v) { print(k, v) })`, []string{"a 1", "b 2"}},
+		{"each([], fun(x) { print(x) }); print(1)", []string{"1"}},
+		{
+			"each([1, 2, 3, 4, 5], fun(x) { if(x == 2) { continue }; if(x == 4) { break }; print(x) })",
+			[]string{"1", "3"},
+		},
+		{
+			// Break and continue end the innermost loop
+			"each([1, 2], fun(x) { each([1, 2, 3], fun(y) { if(y == 2) { break }; print(x, y) }) })",
+			[]string{"1 1", "2 1"},
+		},
+		{
+			"var i = 0; while(true) { i = i + 1; if(i == 2) { continue }; if(i > 3) { break }; print(i) }",
+			[]string{"1", "3"},
+		},
+		{
+			"var find = fun(xs) { each(xs, fun(x) { if(x > 1) { return x } }); 0 }; print(find([1, 5, 3])); print(find([]))",
+			[]string{"5", "0"},
+		},
+		{
+			// Closures capture the variables of their own iteration
+			"var f = fun(xs) { var gs = [0, 0]; each(xs, fun(i, x) { gs[i] = fun() { x = x + 10; x } }); print(gs[0]()); print(gs[1]()); print(gs[0]()) }; f([1, 2])",
+			[]string{"11", "12", "21"},
+		},
+	}
+
+	runPrograms(t, tests, parseLoops)
+}
+
+func TestCompiler_ForEachErrors(t *testing.T) {
+	tests := []compilerTestCaseError{
+		{"each([1], fun(x) { x }); x", "undefined variable x"},
+		{"break", "break outside of a loop"},
+		{"while(true) { fun() { continue } }", "continue outside of a loop"},
+		{"each([1], fun(x) { fun() { break } })", "break outside of a loop"},
+	}
+
+	for _, tc := range tests {
+		for _, level := range []int{0, 1} {
+			compiler := Create()
+			compiler.OptimizationLevel = level
+
+			err := compiler.Compile(parseLoops(tc.input), "", "", "")
+			if err == nil || err.Error() != tc.expected {
+				t.Fatalf("incorrect error at -O%d for %q. got=%v. expected=%q", level, tc.input, err, tc.expected)
+			}
+		}
+	}
+}
+
 func TestCompiler_HashMaps(t *testing.T) {
 	tests := []compilerTestCase{
 		{
 			input:             "{}",
 			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpHash, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpHash, 0),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "{1: 2, 3: 4, 5: 6}",
 			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpHash, 6),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpConstant, 4),
+				codetest.Make(code.OpConstant, 5),
+				codetest.Make(code.OpHash, 6),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "{1: 2 + 2, 3: 4 * 4}",
 			expectedConstants: []interface{}{1, 2, 2, 3, 4, 4},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpMultiply),
-				code.Make(code.OpHash, 4),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpConstant, 4),
+				codetest.Make(code.OpConstant, 5),
+				codetest.Make(code.OpMultiply),
+				codetest.Make(code.OpHash, 4),
+				codetest.Make(code.OpPop),
 			},
 		},
 	}
@@ -492,29 +864,29 @@ func TestCompiler_IndexExpression(t *testing.T) {
 			input:             "[1, 2, 3][1 + 1]",
 			expectedConstants: []interface{}{1, 2, 3, 1, 1},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpArray, 3),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpAdd),
-				code.Make(code.OpIndex),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpArray, 3),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpConstant, 4),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpIndex),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "{1: 2}[2 - 1]",
 			expectedConstants: []interface{}{1, 2, 2, 1},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpHash, 2),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpSubtract),
-				code.Make(code.OpIndex),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpHash, 2),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpSubtract),
+				codetest.Make(code.OpIndex),
+				codetest.Make(code.OpPop),
 			},
 		},
 	}
@@ -530,15 +902,15 @@ func TestCompiler_Functions(t *testing.T) {
 				10,
 				2,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpConstant, 1),
-					code.Make(code.OpMultiply),
-					code.Make(code.OpReturnValue),
+					codetest.Make(code.OpConstant, 0),
+					codetest.Make(code.OpConstant, 1),
+					codetest.Make(code.OpMultiply),
+					codetest.Make(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
@@ -547,27 +919,27 @@ func TestCompiler_Functions(t *testing.T) {
 				10,
 				2,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpConstant, 1),
-					code.Make(code.OpMultiply),
-					code.Make(code.OpReturn),
+					codetest.Make(code.OpConstant, 0),
+					codetest.Make(code.OpConstant, 1),
+					codetest.Make(code.OpMultiply),
+					codetest.Make(code.OpReturn),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input: "fun() { }",
 			expectedConstants: []interface{}{
 				[]code.Instructions{
-					code.Make(code.OpReturn),
+					codetest.Make(code.OpReturn),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpPop),
 			},
 		},
 	}
@@ -582,14 +954,14 @@ func TestCompiler_CallExpression(t *testing.T) {
 			expectedConstants: []interface{}{
 				24,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpReturnValue),
+					codetest.Make(code.OpConstant, 0),
+					codetest.Make(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpCall, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpCall, 0),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
@@ -597,27 +969,27 @@ func TestCompiler_CallExpression(t *testing.T) {
 			expectedConstants: []interface{}{
 				24,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpReturn),
+					codetest.Make(code.OpConstant, 0),
+					codetest.Make(code.OpReturn),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpCall, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpCall, 0),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input: `fun() { }()`,
 			expectedConstants: []interface{}{
 				[]code.Instructions{
-					code.Make(code.OpReturn),
+					codetest.Make(code.OpReturn),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0, 0),
-				code.Make(code.OpCall, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpCall, 0),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
@@ -625,60 +997,60 @@ func TestCompiler_CallExpression(t *testing.T) {
 			expectedConstants: []interface{}{
 				50,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpReturnValue),
+					codetest.Make(code.OpConstant, 0),
+					codetest.Make(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpSetVar, 0),
-				code.Make(code.OpGetVar, 0),
-				code.Make(code.OpCall, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpCall, 0),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input: `var test = fun(a) { a }; test(100)`,
 			expectedConstants: []interface{}{
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpReturn),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpReturn),
 				},
 				100,
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0, 0),
-				code.Make(code.OpSetVar, 0),
-				code.Make(code.OpGetVar, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpCall, 1),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpCall, 1),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input: `var test = fun(a, b, c) { a; b; c }; test(100, 200, 300)`,
 			expectedConstants: []interface{}{
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpPop),
-					code.Make(code.OpGetLocal, 1),
-					code.Make(code.OpPop),
-					code.Make(code.OpGetLocal, 2),
-					code.Make(code.OpReturn),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpPop),
+					codetest.Make(code.OpGetLocal, 1),
+					codetest.Make(code.OpPop),
+					codetest.Make(code.OpGetLocal, 2),
+					codetest.Make(code.OpReturn),
 				},
 				100,
 				200,
 				300,
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0, 0),
-				code.Make(code.OpSetVar, 0),
-				code.Make(code.OpGetVar, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpCall, 3),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpCall, 3),
+				codetest.Make(code.OpPop),
 			},
 		},
 	}
@@ -698,20 +1070,20 @@ func TestCompiler_Closures(t *testing.T) {
 			`,
 			expectedConstants: []interface{}{
 				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpAdd),
-					code.Make(code.OpReturnValue),
+					codetest.Make(code.OpGetFree, 0),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpAdd),
+					codetest.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpClosure, 0, 1),
-					code.Make(code.OpReturnValue),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpClosure, 0, 1),
+					codetest.Make(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
@@ -726,28 +1098,28 @@ func TestCompiler_Closures(t *testing.T) {
             `,
 			expectedConstants: []interface{}{
 				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetFree, 1),
-					code.Make(code.OpAdd),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpAdd),
-					code.Make(code.OpReturnValue),
+					codetest.Make(code.OpGetFree, 0),
+					codetest.Make(code.OpGetFree, 1),
+					codetest.Make(code.OpAdd),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpAdd),
+					codetest.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpClosure, 0, 2),
-					code.Make(code.OpReturnValue),
+					codetest.Make(code.OpGetFree, 0),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpClosure, 0, 2),
+					codetest.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpClosure, 1, 1),
-					code.Make(code.OpReturnValue),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpClosure, 1, 1),
+					codetest.Make(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
@@ -770,35 +1142,38 @@ func TestCompiler_Closures(t *testing.T) {
 				77,
 				88,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 3),
-					code.Make(code.OpSetVar, 3),
-					code.Make(code.OpGetVar, 0),
-					code.Make(code.OpGetVar, 1),
-					code.Make(code.OpAdd),
-					code.Make(code.OpGetVar, 2),
-					code.Make(code.OpAdd),
-					code.Make(code.OpGetVar, 3),
-					code.Make(code.OpAdd),
-					code.Make(code.OpReturnValue),
+					codetest.Make(code.OpConstant, 3),
+					codetest.Make(code.OpSetLocal, 0),
+					codetest.Make(code.OpGetVar, 0),
+					codetest.Make(code.OpGetFree, 0),
+					codetest.Make(code.OpAdd),
+					codetest.Make(code.OpGetFree, 1),
+					codetest.Make(code.OpAdd),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpAdd),
+					codetest.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpConstant, 2),
-					code.Make(code.OpSetVar, 2),
-					code.Make(code.OpClosure, 4, 0),
-					code.Make(code.OpReturnValue),
+					codetest.Make(code.OpConstant, 2),
+					codetest.Make(code.OpSetLocal, 0),
+					codetest.Make(code.OpGetFree, 0),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpClosure, 4, 2),
+					codetest.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpConstant, 1),
-					code.Make(code.OpSetVar, 1),
-					code.Make(code.OpClosure, 5, 0),
-					code.Make(code.OpReturnValue),
+					codetest.Make(code.OpConstant, 1),
+					codetest.Make(code.OpSetLocal, 0),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpClosure, 5, 1),
+					codetest.Make(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetVar, 0),
-				code.Make(code.OpClosure, 6, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpConstant, 6),
+				codetest.Make(code.OpPop),
 			},
 		},
 	}
@@ -811,7 +1186,7 @@ func TestCompiler_Scopes(t *testing.T) {
 	if compiler.scopeIndex != 0 {
 		t.Errorf("scopeIndex wrong. got=%d, want=%d", compiler.scopeIndex, 0)
 	}
-	globalSymbolTable := compiler.symbolTable
+	globalScope := compiler.currentScope
 	compiler.emit(code.OpMultiply)
 	compiler.enterScope()
 	if compiler.scopeIndex != 1 {
@@ -827,19 +1202,19 @@ func TestCompiler_Scopes(t *testing.T) {
 		t.Errorf("lastInstruction.Opcode wrong. got=%d, want=%d",
 			last.OpCode, code.OpSubtract)
 	}
-	if compiler.symbolTable.Outer != globalSymbolTable {
-		t.Errorf("compiler did not enclose symbolTable")
+	if compiler.currentScope.Outer != globalScope || compiler.currentScope.frame == nil {
+		t.Errorf("compiler did not enclose variable scope in a frame")
 	}
 	compiler.leaveScope()
 	if compiler.scopeIndex != 0 {
 		t.Errorf("scopeIndex wrong. got=%d, want=%d",
 			compiler.scopeIndex, 0)
 	}
-	if compiler.symbolTable != globalSymbolTable {
-		t.Errorf("compiler did not restore global symbol table")
+	if compiler.currentScope != globalScope {
+		t.Errorf("compiler did not restore global variable scope")
 	}
-	if compiler.symbolTable.Outer != nil {
-		t.Errorf("compiler modified global symbol table incorrectly")
+	if compiler.currentScope.Outer != nil || compiler.currentScope.frame != nil {
+		t.Errorf("compiler modified global variable scope incorrectly")
 	}
 	compiler.emit(code.OpAdd)
 	if len(compiler.scopes[compiler.scopeIndex].instructions) != 2 {
@@ -865,15 +1240,15 @@ func TestCompiler_VariableScopes(t *testing.T) {
 			expectedConstants: []interface{}{
 				100,
 				[]code.Instructions{
-					code.Make(code.OpGetVar, 0),
-					code.Make(code.OpReturnValue),
+					codetest.Make(code.OpGetVar, 0),
+					codetest.Make(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetVar, 0),
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
@@ -881,15 +1256,15 @@ func TestCompiler_VariableScopes(t *testing.T) {
 			expectedConstants: []interface{}{
 				100,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpSetVar, 0),
-					code.Make(code.OpGetVar, 0),
-					code.Make(code.OpReturnValue),
+					codetest.Make(code.OpConstant, 0),
+					codetest.Make(code.OpSetLocal, 0),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
@@ -898,19 +1273,19 @@ func TestCompiler_VariableScopes(t *testing.T) {
 				100,
 				55,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpSetVar, 0),
-					code.Make(code.OpConstant, 1),
-					code.Make(code.OpSetVar, 1),
-					code.Make(code.OpGetVar, 0),
-					code.Make(code.OpGetVar, 1),
-					code.Make(code.OpMultiply),
-					code.Make(code.OpReturnValue),
+					codetest.Make(code.OpConstant, 0),
+					codetest.Make(code.OpSetLocal, 0),
+					codetest.Make(code.OpConstant, 1),
+					codetest.Make(code.OpSetLocal, 1),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpGetLocal, 1),
+					codetest.Make(code.OpMultiply),
+					codetest.Make(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpPop),
 			},
 		},
 	}
@@ -924,25 +1299,25 @@ func TestCompiler_BuiltinFunctions(t *testing.T) {
 			input:             `len([])`,
 			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpGetBuiltinFunction, 0),
-				code.Make(code.OpArray, 0),
-				code.Make(code.OpCall, 1),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpGetBuiltinFunction, 0),
+				codetest.Make(code.OpArray, 0),
+				codetest.Make(code.OpCall, 1),
+				codetest.Make(code.OpPop),
 			},
 		},
 		{
 			input: `fun() { return len([]) }`,
 			expectedConstants: []interface{}{
 				[]code.Instructions{
-					code.Make(code.OpGetBuiltinFunction, 0),
-					code.Make(code.OpArray, 0),
-					code.Make(code.OpCall, 1),
-					code.Make(code.OpReturnValue),
+					codetest.Make(code.OpGetBuiltinFunction, 0),
+					codetest.Make(code.OpArray, 0),
+					codetest.Make(code.OpCall, 1),
+					codetest.Make(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0, 0),
-				code.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpPop),
 			},
 		},
 	}
@@ -950,37 +1325,419 @@ func TestCompiler_BuiltinFunctions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestCompiler_DefineBuiltins(t *testing.T) {
-	global := CreateSymbolTable()
-	firstLocal := CreateEnclosedSymbolTable(global)
-	secondLocal := CreateEnclosedSymbolTable(firstLocal)
+func TestCompiler_MaxStackDepth(t *testing.T) {
+	tests := []struct {
+		input     string
+		main      int
+		functions map[int]int
+	}{
+		{"1 + 2", 2, map[int]int{}},
+		{"[1, 2 * 3, 4]", 3, map[int]int{}},
+		{"var test = 1; test", 1, map[int]int{}},
+		{"if(true) { 1 + 2 * 3 } else { 4 }", 3, map[int]int{}},
+		{"fun(a, b) { return len([a, b]) }(1, 2)", 3, map[int]int{0: 3}},
+		{"fun(a) { return fun(b) { return a + b } }", 1, map[int]int{0: 2, 1: 1}},
+	}
+
+	for _, tc := range tests {
+		compiler := Create()
+
+		err := compiler.Compile(parse(tc.input), "", "", "")
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+
+		if bytecode.MaxStackDepth != tc.main {
+			t.Errorf("wrong max stack depth for %q. got=%d. want=%d", tc.input, bytecode.MaxStackDepth, tc.main)
+		}
+
+		if len(bytecode.Functions) != len(tc.functions) {
+			t.Fatalf("wrong number of functions for %q. got=%d. want=%d", tc.input, len(bytecode.Functions), len(tc.functions))
+		}
 
-	expected := []Symbol{
-		{Name: "a", Scope: BuiltinScope, Index: 0},
-		{Name: "b", Scope: BuiltinScope, Index: 1},
-		{Name: "e", Scope: BuiltinScope, Index: 2},
-		{Name: "f", Scope: BuiltinScope, Index: 3},
+		for index, depth := range tc.functions {
+			if bytecode.Functions[index].MaxStackDepth != depth {
+				t.Errorf("wrong max stack depth of function %d in %q. got=%d. want=%d",
+					index, tc.input, bytecode.Functions[index].MaxStackDepth, depth)
+			}
+		}
 	}
+}
 
-	for i, v := range expected {
-		global.DefineBuiltin(i, v.Name)
+func TestCompiler_WideOperands(t *testing.T) {
+	// More constants than a regular OpConstant can address
+	input := strings.Repeat("1; ", 65537)
+
+	compiler := Create()
+	err := compiler.Compile(parse(input), "", "", "")
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
 	}
 
-	for _, table := range []*SymbolTable{global, firstLocal, secondLocal} {
-		for _, sym := range expected {
-			result, ok := table.Resolve(sym.Name)
-			if !ok {
-				t.Errorf("name %s not resolable", sym.Name)
-				continue
-			}
+	instructions := compiler.Bytecode().Instructions
+	last, err := code.ReadInstruction(instructions, len(instructions)-7)
+	if err != nil {
+		t.Fatalf("unable to read last constant: %s", err)
+	}
+
+	if last.Op != code.OpConstant || !last.Wide || last.Operands[0] != 65536 {
+		t.Fatalf("last constant not loaded with a wide operand. got=%+v", last)
+	}
+}
+
+func TestCompiler_OperandOutOfRange(t *testing.T) {
+	// Even with an OpWide prefix OpCall can't pass this many arguments
+	input := "var f = fun() { 1 }; f(" + strings.Repeat("1, ", 65535) + "1)"
+
+	for _, level := range []int{0, 1} {
+		compiler := Create()
+		compiler.OptimizationLevel = level
+
+		err := compiler.Compile(parse(input), "", "", "")
+		if err == nil || err.Error() != "operand 0 of OpCall out of range. got=65536" {
+			t.Fatalf("incorrect error at -O%d. got=%v. expected=%q", level, err, "operand 0 of OpCall out of range. got=65536")
+		}
+	}
+}
+
+func TestCompiler_WideJumps(t *testing.T) {
+	// The body of the conditional is too large for a regular jump
+	input := "if(true) { " + strings.Repeat("true; ", 40000) + "}; 5"
+
+	compiler := Create()
+	err := compiler.Compile(parse(input), "", "", "")
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
 
-			if result != sym {
-				t.Errorf("wrong symbol (%s). expected=%+v. got=%+v", sym.Name, sym, result)
+	bytecode := compiler.Bytecode()
+
+	if len(bytecode.Constants) != 1 {
+		t.Fatalf("constants were not reset before compiling again. got=%d", len(bytecode.Constants))
+	}
+
+	jump, err := code.ReadInstruction(bytecode.Instructions, 1)
+	if err != nil {
+		t.Fatalf("unable to read jump: %s", err)
+	}
+
+	if jump.Op != code.OpJumpIfNotTrue || !jump.Wide {
+		t.Fatalf("expected a wide OpJumpIfNotTrue. got=%+v", jump)
+	}
+
+	// Skips the body, which ends with a wide jump over the alternative
+	expected := 1 + jump.Size + 40000*2 - 1 + 6
+	if jump.Operands[0] != expected {
+		t.Fatalf("wrong jump target. got=%d. want=%d", jump.Operands[0], expected)
+	}
+}
+
+func TestCompiler_OptimizationLevel(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// Only the folded values get into the constant pool
+			input:             "len(1 + 2 * 3)",
+			expectedConstants: []interface{}{7},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpGetBuiltinFunction, 0),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpCall, 1),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			// Equal values are added once
+			input:             "len(1 + 2 + 3); len(2 * 3); len(6)",
+			expectedConstants: []interface{}{6},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpGetBuiltinFunction, 0),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpCall, 1),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpGetBuiltinFunction, 0),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpCall, 1),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpGetBuiltinFunction, 0),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpCall, 1),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "len(if(true) { 10 } else { 20 })",
+			expectedConstants: []interface{}{10},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpGetBuiltinFunction, 0),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpCall, 1),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "var x = 1; while(false) { x = 2 }; len(x)",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetBuiltinFunction, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpCall, 1),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			input: "len(fun(a) { if(1 > 2) { return a }; a })",
+			expectedConstants: []interface{}{[]code.Instructions{
+				codetest.Make(code.OpGetLocal, 0),
+				codetest.Make(code.OpReturn),
+			}},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpGetBuiltinFunction, 0),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpCall, 1),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			// The value of the condition is unknown, so only the unused
+			// values in the branches are removed
+			input:             "var x = 1; if(x > 5) { 1; x } else { 2 }",
+			expectedConstants: []interface{}{1, 5, 2},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpGreaterThan),
+				codetest.Make(code.OpJumpIfNotTrue, 22),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpJump, 25),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpPop),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		compiler := Create()
+		compiler.OptimizationLevel = 1
+
+		err := compiler.Compile(parse(tc.input), "", "", "")
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+
+		err = testInstructions(tc.expectedInstructions, bytecode.Instructions)
+		if err != nil {
+			t.Errorf("testInstructions failed for %q with: %s", tc.input, err)
+		}
+
+		err = testConstants(tc.expectedConstants, bytecode.Constants)
+		if err != nil {
+			t.Errorf("testConstants failed for %q with: %s", tc.input, err)
+		}
+	}
+}
+
+func TestCompiler_PeepholeRules(t *testing.T) {
+	compiler := Create()
+	compiler.Rules = peephole.Rules
+
+	err := compiler.Compile(parse("if(true) { 10 }; fun() { while(false) { 1 }; 2 }"), "", "", "")
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+
+	err = testInstructions([]code.Instructions{
+		codetest.Make(code.OpConstant, 0),
+		codetest.Make(code.OpJump, 7),
+		codetest.Make(code.OpNull),
+		codetest.Make(code.OpPop),
+		codetest.Make(code.OpConstant, 3),
+		codetest.Make(code.OpPop),
+	}, bytecode.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed with: %s", err)
+	}
+
+	err = testConstants([]interface{}{10, 1, 2, []code.Instructions{
+		codetest.Make(code.OpJump, 10),
+		codetest.Make(code.OpConstant, 1),
+		codetest.Make(code.OpPop),
+		codetest.Make(code.OpJump, 0),
+		codetest.Make(code.OpConstant, 2),
+		codetest.Make(code.OpReturn),
+	}}, bytecode.Constants)
+	if err != nil {
+		t.Fatalf("testConstants failed with: %s", err)
+	}
+}
+
+func TestCompiler_BytecodeOptimizedOnce(t *testing.T) {
+	compiler := Create()
+	compiler.Rules = peephole.Rules
+
+	err := compiler.Compile(parse("if(true) { 10 }"), "", "", "")
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	first := compiler.Bytecode()
+	if compiler.Bytecode() != first {
+		t.Fatalf("bytecode is optimized again without compiling anything")
+	}
+
+	err = compiler.Compile(parse("20"), "", "", "")
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	second := compiler.Bytecode()
+	if second == first {
+		t.Fatalf("bytecode isn't updated after compiling more")
+	}
+
+	err = testInstructions([]code.Instructions{
+		codetest.Make(code.OpConstant, 0),
+		codetest.Make(code.OpJump, 7),
+		codetest.Make(code.OpNull),
+		codetest.Make(code.OpPop),
+		codetest.Make(code.OpConstant, 1),
+		codetest.Make(code.OpPop),
+	}, second.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed with: %s", err)
+	}
+}
+
+func TestCompiler_Superinstructions(t *testing.T) {
+	input := `
+	var i = 0
+	while(i < 10) {
+		i = i + 1
+	}
+	fun(x) {
+		var y = 0
+		if(y > 5) { y = y + x }
+	}
+	`
+
+	compiler := Create()
+	compiler.Superinstructions = true
+
+	err := compiler.Compile(parse(input), "", "", "")
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+
+	err = testInstructions([]code.Instructions{
+		codetest.Make(code.OpConstant, 0),
+		codetest.Make(code.OpSetVar, 0),
+		codetest.Make(code.OpJumpIfConstantNotGreater, 1, 0, 21),
+		codetest.Make(code.OpIncrementVar, 2, 0),
+		codetest.Make(code.OpJump, 6),
+		codetest.Make(code.OpNull),
+		codetest.Make(code.OpPop),
+		codetest.Make(code.OpConstant, 5),
+		codetest.Make(code.OpPop),
+	}, bytecode.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed with: %s", err)
+	}
+
+	// Superinstructions only work on globals, y and x are locals
+	err = testConstants([]interface{}{0, 10, 1, 0, 5, []code.Instructions{
+		codetest.Make(code.OpConstant, 3),
+		codetest.Make(code.OpSetLocal, 1),
+		codetest.Make(code.OpGetLocal, 1),
+		codetest.Make(code.OpConstant, 4),
+		codetest.Make(code.OpGreaterThan),
+		codetest.Make(code.OpJumpIfNotTrue, 25),
+		codetest.Make(code.OpGetLocal, 1),
+		codetest.Make(code.OpGetLocal, 0),
+		codetest.Make(code.OpAdd),
+		codetest.Make(code.OpSetLocal, 1),
+		codetest.Make(code.OpNull),
+		codetest.Make(code.OpJump, 26),
+		codetest.Make(code.OpNull),
+		codetest.Make(code.OpReturn),
+	}}, bytecode.Constants)
+	if err != nil {
+		t.Fatalf("testConstants failed with: %s", err)
+	}
+}
+
+// Reports how many instructions the sample programs consist of and how many
+// the test machine dispatches running them, with and without
+// superinstructions
+func BenchmarkCompiler_Superinstructions(b *testing.B) {
+	samples := []string{
+		"var i = 0; while(i < 1000) { i = i + 1 }",
+		"var i = 1000; var sum = 0; while(i > 0) { sum = sum + i; i = i - 1 }",
+		"var count = 0; var i = 0; while(i < 100) { if(i > 50) { count = count + 1 }; i = i + 1 }",
+	}
+
+	for _, sample := range samples {
+		program := parse(sample)
+
+		for _, enabled := range []bool{false, true} {
+			name := "plain"
+			if enabled {
+				name = "fused"
 			}
+
+			b.Run(name, func(b *testing.B) {
+				var bytecode *Bytecode
+
+				for n := 0; n < b.N; n++ {
+					compiler := Create()
+					compiler.Superinstructions = enabled
+
+					err := compiler.Compile(program, "", "", "")
+					if err != nil {
+						b.Fatalf("compiler error: %s", err)
+					}
+
+					bytecode = compiler.Bytecode()
+				}
+
+				m, err := run(bytecode)
+				if err != nil {
+					b.Fatalf("run failed: %s", err)
+				}
+
+				b.ReportMetric(float64(countInstructions(bytecode.Instructions)), "instructions")
+				b.ReportMetric(float64(len(bytecode.Instructions)), "bytes")
+				b.ReportMetric(float64(m.dispatches), "dispatches")
+			})
 		}
 	}
 }
 
+func countInstructions(ins code.Instructions) int {
+	count := 0
+
+	for i := 0; i < len(ins); count++ {
+		instruction, err := code.ReadInstruction(ins, i)
+		if err != nil {
+			return -1
+		}
+
+		i += instruction.Size
+	}
+
+	return count
+}
+
 func testInstructions(
 	expected []code.Instructions,
 	actual code.Instructions,
@@ -1021,12 +1778,28 @@ func testConstants(expected []interface{}, actual []object.Object) error {
 			if err != nil {
 				return fmt.Errorf("constant %d - testIntegerObject failed with: %s", i, err)
 			}
+		case float64:
+			err := testFloatObject(constant, actual[i])
+
+			if err != nil {
+				return fmt.Errorf("constant %d - testFloatObject failed with: %s", i, err)
+			}
 		case string:
 			err := testStringObject(constant, actual[i])
 
 			if err != nil {
 				return fmt.Errorf("constant %d - testStringObject failed with: %s", i, err)
 			}
+		case []interface{}:
+			array, ok := actual[i].(*object.Array)
+			if !ok {
+				return fmt.Errorf("constant %d - not an array. got=%T", i, actual[i])
+			}
+
+			err := testConstants(constant, array.Elements)
+			if err != nil {
+				return fmt.Errorf("constant %d - testConstants failed with: %s", i, err)
+			}
 		case []code.Instructions:
 			fun, ok := actual[i].(*object.CompiledFunction)
 			if !ok {
@@ -1071,8 +1844,167 @@ func testIntegerObject(expected int64, actual object.Object) error {
 	return nil
 }
 
+func testFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*values.Float)
+
+	if !ok {
+		return fmt.Errorf("object is not float. got=%T (%+v)", actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%v. expected=%v", result.Value, expected)
+	}
+
+	return nil
+}
+
 func parse(input string) *ast.Program {
 	l := lexer.Create(input)
 	p := parser.Create(l)
 	return p.Parse()
 }
+
+// parseCalls parses input with every call to the function name replaced by
+// what replace returns for it
+func parseCalls(input, name string, replace func(call *ast.CallExpression) ast.Expression) *ast.Program {
+	program := parse(input)
+
+	rewrite := func(e *ast.Expression) {
+		if call, ok := (*e).(*ast.CallExpression); ok {
+			if callee, ok := call.Function.(*ast.Identifier); ok && callee.Value == name {
+				*e = replace(call)
+			}
+		}
+	}
+
+	inspect(program, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.ExpressionStatement:
+			rewrite(&n.Expression)
+		case *ast.SuffixExpression:
+			rewrite(&n.Left)
+			rewrite(&n.Right)
+		case *ast.VariableDeclaration:
+			rewrite(&n.Value)
+		case *ast.Assign:
+			rewrite(&n.Value)
+		case *ast.Return:
+			rewrite(&n.Value)
+		case *ast.CallExpression:
+			for i := range n.Parameters {
+				rewrite(&n.Parameters[i])
+			}
+		case *ast.Array:
+			for i := range n.Elements {
+				rewrite(&n.Elements[i])
+			}
+		case *ast.IndexExpression:
+			rewrite(&n.Value)
+			rewrite(&n.Index)
+		case *syntax.Template:
+			for i := range n.Parts {
+				rewrite(&n.Parts[i])
+			}
+		}
+
+		return true
+	})
+
+	return program
+}
+
+// rewriteStatements replaces every statement of program and its blocks by
+// what replace returns for it
+func rewriteStatements(program *ast.Program, replace func(s ast.Statement) ast.Statement) *ast.Program {
+	rewrite := func(statements []ast.Statement) {
+		for i, s := range statements {
+			statements[i] = replace(s)
+		}
+	}
+
+	inspect(program, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Program:
+			rewrite(n.Statements)
+		case *ast.BlockStatement:
+			rewrite(n.Statements)
+		}
+
+		return true
+	})
+
+	return program
+}
+
+type programTest struct {
+	input    string
+	expected []string
+}
+
+// runPrograms runs every program parsed with parse at each optimization
+// level and checks the lines it prints
+func runPrograms(t *testing.T, tests []programTest, parse func(input string) *ast.Program) {
+	t.Helper()
+
+	for _, tc := range tests {
+		for _, level := range []int{0, 1, 2} {
+			m, err := run(compileProgramAt(t, parse(tc.input), level))
+			if err != nil {
+				t.Fatalf("run failed at -O%d for %q: %s", level, tc.input, err)
+			}
+
+			if len(m.output) != len(tc.expected) {
+				t.Fatalf("wrong output at -O%d for %q. got=%q. expected=%q", level, tc.input, m.output, tc.expected)
+			}
+
+			for i, line := range m.output {
+				if line != tc.expected[i] {
+					t.Errorf("wrong output at -O%d for %q. got=%q. expected=%q", level, tc.input, m.output, tc.expected)
+				}
+			}
+		}
+	}
+}
+
+// parseFloats parses input with every float("literal") turned into a float
+// literal, the parser doesn't know them yet
+func parseFloats(input string) *ast.Program {
+	return parseCalls(input, "float", func(call *ast.CallExpression) ast.Expression {
+		value, err := strconv.ParseFloat(call.Parameters[0].(*ast.String).Value, 64)
+		if err != nil {
+			panic(err)
+		}
+
+		return &syntax.Float{Value: value}
+	})
+}
+
+// parseLoops parses input with the statements "each(iterable, fun(variables)
+// { body })" turned into for-each loops and the statements "break" and
+// "continue" into break and continue statements, the parser doesn't know
+// them yet
+func parseLoops(input string) *ast.Program {
+	return rewriteStatements(parse(input), func(s ast.Statement) ast.Statement {
+		statement, ok := s.(*ast.ExpressionStatement)
+		if !ok {
+			return s
+		}
+
+		switch e := statement.Expression.(type) {
+		case *ast.Identifier:
+			switch e.Value {
+			case "break":
+				return &syntax.Break{}
+			case "continue":
+				return &syntax.Continue{}
+			}
+		case *ast.CallExpression:
+			if callee, ok := e.Function.(*ast.Identifier); ok && callee.Value == "each" {
+				body := e.Parameters[1].(*ast.Function)
+				statement.Expression = &syntax.ForEach{Variables: body.Parameters, Iterable: e.Parameters[0], Body: body.Body}
+			}
+		}
+
+		return s
+	})
+}
@@ -0,0 +1,53 @@
+package compiler
+
+import (
+	"github.com/looplanguage/compiler/ir"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/compiler/values"
+	"github.com/looplanguage/loop/models/ast"
+	"github.com/looplanguage/loop/models/object"
+)
+
+// constantValue returns the value of an expression if it is known at compile
+// time. Those are literals, constants with a known value and operators
+// applied to them. It returns nil for everything else, including operations
+// that fail, those fail when the program runs.
+func (c *Compiler) constantValue(node ast.Expression, root string) object.Object {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: node.Value}
+	case *syntax.Float:
+		return &values.Float{Value: node.Value}
+	case *ast.String:
+		return &object.String{Value: node.Value}
+	case *ast.Boolean:
+		return &object.Boolean{Value: node.Value}
+	case *ast.Identifier:
+		variable, _ := c.currentScope.find(node.Value, root)
+		if variable == nil || !variable.Inline {
+			return nil
+		}
+
+		return variable.Object
+	case *ast.SuffixExpression:
+		left := c.constantValue(node.Left, root)
+		right := c.constantValue(node.Right, root)
+
+		if left == nil || right == nil {
+			return nil
+		}
+
+		op, ok := operators[node.Operator]
+		if !ok {
+			return nil
+		}
+
+		if node.Operator == "<" {
+			left, right = right, left
+		}
+
+		return ir.Evaluate(op, left, right)
+	}
+
+	return nil
+}
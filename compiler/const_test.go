@@ -0,0 +1,208 @@
+package compiler
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+	"testing"
+)
+
+// parseConstants parses input with the first declaration of each of names
+// turned into a constant declaration, the parser doesn't know const yet
+func parseConstants(input string, names ...string) *ast.Program {
+	return declareConstants(parse(input), names...)
+}
+
+// declareConstants is parseConstants for a program that is already parsed
+func declareConstants(program *ast.Program, names ...string) *ast.Program {
+	constant := map[string]bool{}
+	for _, name := range names {
+		constant[name] = true
+	}
+
+	return rewriteStatements(program, func(s ast.Statement) ast.Statement {
+		d, ok := s.(*ast.VariableDeclaration)
+		if !ok || !constant[d.Identifier.Value] {
+			return s
+		}
+
+		delete(constant, d.Identifier.Value)
+		return syntax.Constant(d.Identifier.Value, d.Value)
+	})
+}
+
+func TestCompiler_Constants(t *testing.T) {
+	tests := []struct {
+		input                string
+		constants            []string
+		expectedConstants    []interface{}
+		expectedInstructions []code.Instructions
+	}{
+		{
+			input:             "var a = 2; a + a",
+			constants:         []string{"a"},
+			expectedConstants: []interface{}{2},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			// Only the value of the constant is added to the constant pool
+			input:             `var a = 2 * 3; var b = "a" + "b"; var c = a > 5; var d = a`,
+			constants:         []string{"a", "b", "c"},
+			expectedConstants: []interface{}{6, "ab", true},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+			},
+		},
+		{
+			// Constants with the same value share it
+			input:             "var a = 2; var b = 1 + 1; a + b",
+			constants:         []string{"a", "b"},
+			expectedConstants: []interface{}{2},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			// Constants aren't captured by closures
+			input:             "var n = 10; fun() { n }",
+			constants:         []string{"n"},
+			expectedConstants: []interface{}{10, []code.Instructions{codetest.Make(code.OpConstant, 0), codetest.Make(code.OpReturn)}},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			// The value isn't known at compile time, the constant is stored
+			// like a variable
+			input:             "var a = len([1]); a",
+			constants:         []string{"a"},
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpGetBuiltinFunction, 0),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpArray, 1),
+				codetest.Make(code.OpCall, 1),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			// Division by zero is left to the VM
+			input:             "var a = 1 / 0",
+			constants:         []string{"a"},
+			expectedConstants: []interface{}{1, 0},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpDivide),
+				codetest.Make(code.OpSetVar, 0),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		compiler := Create()
+
+		err := compiler.Compile(parseConstants(tc.input, tc.constants...), "", "", "")
+		if err != nil {
+			t.Fatalf("compiler error for %q: %s", tc.input, err)
+		}
+
+		bytecode := compiler.Bytecode()
+
+		err = testInstructions(tc.expectedInstructions, bytecode.Instructions)
+		if err != nil {
+			t.Fatalf("testInstructions failed for %q with: %s", tc.input, err)
+		}
+
+		err = testConstants(tc.expectedConstants, bytecode.Constants)
+		if err != nil {
+			t.Fatalf("testConstants failed for %q with: %s", tc.input, err)
+		}
+	}
+}
+
+func TestCompiler_FloatConstants(t *testing.T) {
+	// Mixing an integer with a float gives a float
+	input := `var a = 3; var b = a / float("2"); var c = b * 2; c`
+	bytecode := compileProgramAt(t, declareConstants(parseFloats(input), "a", "b", "c"), 0)
+
+	err := testInstructions([]code.Instructions{codetest.Make(code.OpConstant, 2), codetest.Make(code.OpPop)}, bytecode.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed for %q with: %s", input, err)
+	}
+
+	err = testConstants([]interface{}{3, 1.5, 3.0}, bytecode.Constants)
+	if err != nil {
+		t.Fatalf("testConstants failed for %q with: %s", input, err)
+	}
+}
+
+func TestCompiler_ConstantErrors(t *testing.T) {
+	tests := []struct {
+		input     string
+		constants []string
+		expected  string
+	}{
+		{"var a = 1; a = 2", []string{"a"}, "cannot assign to constant a"},
+		{"var a = len([]); a = 2", []string{"a"}, "cannot assign to constant a"},
+		{"var a = 1; fun() { a = 2 }", []string{"a"}, "cannot assign to constant a"},
+		{"var a = 1; if(true) { a = 2 }", []string{"a"}, "cannot assign to constant a"},
+		// Another variable with the same name can be assigned to
+		{"var a = 1; fun() { var a = 2; a = 3 }", []string{"a"}, ""},
+		{"var a = 1; fun(a) { a = 3 }", []string{"a"}, ""},
+	}
+
+	for _, tc := range tests {
+		for _, level := range []int{0, 1} {
+			compiler := Create()
+			compiler.OptimizationLevel = level
+
+			err := compiler.Compile(parseConstants(tc.input, tc.constants...), "", "", "")
+
+			if (err == nil && tc.expected != "") || (err != nil && err.Error() != tc.expected) {
+				t.Fatalf("incorrect error at -O%d for %q. got=%v. expected=%q", level, tc.input, err, tc.expected)
+			}
+		}
+	}
+}
+
+func TestCompiler_ConstantPrograms(t *testing.T) {
+	tests := []struct {
+		input     string
+		constants []string
+		expected  []string
+	}{
+		{"var n = 10; var f = fun(x) { x * n }; print(f(2))", []string{"n"}, []string{"20"}},
+		{"var a = 1; if(true) { var a = 2; print(a) }; print(a)", []string{"a"}, []string{"2", "1"}},
+		{`var greeting = "hello"; var f = fun() { greeting + " world" }; print(f())`, []string{"greeting"}, []string{"hello world"}},
+		{
+			"var fact = fun(n) { if(n > 1) { n * fact(n - 1) } else { 1 } }; print(fact(5))",
+			[]string{"fact"},
+			[]string{"120"},
+		},
+		{
+			"var f = fun() { var limit = 3; var g = fun(n) { n > limit }; g(5) }; print(f())",
+			[]string{"limit"},
+			[]string{"true"},
+		},
+	}
+
+	for _, tc := range tests {
+		runPrograms(t, []programTest{{tc.input, tc.expected}}, func(input string) *ast.Program {
+			return parseConstants(input, tc.constants...)
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package compiler
+
+import (
+	"encoding/gob"
+	"fmt"
+	"github.com/looplanguage/compiler/values"
+	"github.com/looplanguage/loop/models/object"
+	"math"
+	"reflect"
+)
+
+// ConstantKind describes an object type that is allowed in the constant pool.
+// Every kind listed in constantKinds can be written to both the gob and the
+// JSON output.
+type ConstantKind struct {
+	// Name of the kind in the JSON format
+	Name string
+	// Zero value of the object, registered with gob
+	Object object.Object
+}
+
+var constantKinds = []ConstantKind{
+	{Name: JSONInteger, Object: &object.Integer{}},
+	{Name: JSONString, Object: &object.String{}},
+	{Name: JSONBoolean, Object: &object.Boolean{}},
+	{Name: JSONNull, Object: &object.Null{}},
+	{Name: JSONFunction, Object: &object.CompiledFunction{}},
+	{Name: JSONArray, Object: &object.Array{}},
+	{Name: JSONFloat, Object: &values.Float{}},
+}
+
+// ConstantKinds returns all object types that can be stored in the constant pool
+func ConstantKinds() []ConstantKind {
+	return constantKinds
+}
+
+func lookupConstantKind(obj object.Object) (ConstantKind, bool) {
+	t := reflect.TypeOf(obj)
+
+	for _, kind := range constantKinds {
+		if reflect.TypeOf(kind.Object) == t {
+			return kind, true
+		}
+	}
+
+	return ConstantKind{}, false
+}
+
+// validateConstant checks that obj, and everything it contains, can be serialized
+func validateConstant(obj object.Object) error {
+	if obj == nil {
+		return fmt.Errorf("constant is nil")
+	}
+
+	if _, ok := lookupConstantKind(obj); !ok {
+		return fmt.Errorf("constant of type %s can not be serialized", obj.Type())
+	}
+
+	// JSON has no infinity or NaN
+	if float, ok := obj.(*values.Float); ok && (math.IsInf(float.Value, 0) || math.IsNaN(float.Value)) {
+		return fmt.Errorf("float constant %s can not be serialized", float.Inspect())
+	}
+
+	if array, ok := obj.(*object.Array); ok {
+		for _, element := range array.Elements {
+			err := validateConstant(element)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func RegisterGobTypes() {
+	for _, kind := range constantKinds {
+		gob.Register(kind.Object)
+	}
+}
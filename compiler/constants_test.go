@@ -0,0 +1,125 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/looplanguage/compiler/values"
+	"github.com/looplanguage/loop/models/object"
+	"math"
+	"testing"
+)
+
+func TestConstantKinds_Gob(t *testing.T) {
+	RegisterGobTypes()
+
+	for _, kind := range ConstantKinds() {
+		var buf bytes.Buffer
+
+		bytecode := &Bytecode{Constants: []object.Object{kind.Object}}
+
+		err := gob.NewEncoder(&buf).Encode(bytecode)
+		if err != nil {
+			t.Fatalf("unable to encode constant kind %q. error=%q", kind.Name, err)
+		}
+
+		decoded := &Bytecode{}
+		err = gob.NewDecoder(&buf).Decode(decoded)
+		if err != nil {
+			t.Fatalf("unable to decode constant kind %q. error=%q", kind.Name, err)
+		}
+
+		if len(decoded.Constants) != 1 || decoded.Constants[0].Type() != kind.Object.Type() {
+			t.Fatalf("constant kind %q did not survive a round trip. got=%+v", kind.Name, decoded.Constants)
+		}
+	}
+}
+
+func TestConstantKinds_JSON(t *testing.T) {
+	for _, kind := range ConstantKinds() {
+		var buf bytes.Buffer
+
+		err := EncodeJSON(&buf, &Bytecode{Constants: []object.Object{kind.Object}})
+		if err != nil {
+			t.Fatalf("unable to encode constant kind %q. error=%q", kind.Name, err)
+		}
+
+		_, err = DecodeJSON(&buf)
+		if err != nil {
+			t.Fatalf("unable to decode constant kind %q. error=%q", kind.Name, err)
+		}
+	}
+}
+
+func TestConstantKinds_FloatPrecision(t *testing.T) {
+	RegisterGobTypes()
+
+	floats := []float64{0.1, 0.30000000000000004, 1.0 / 3, -2.5e-300, math.MaxFloat64, math.SmallestNonzeroFloat64, 1e21, 3}
+
+	for _, f := range floats {
+		bytecode := &Bytecode{Constants: []object.Object{&values.Float{Value: f}}}
+
+		var gobBuf, jsonBuf bytes.Buffer
+
+		err := gob.NewEncoder(&gobBuf).Encode(bytecode)
+		if err != nil {
+			t.Fatalf("unable to encode %v with gob. error=%q", f, err)
+		}
+
+		fromGob := &Bytecode{}
+		err = gob.NewDecoder(&gobBuf).Decode(fromGob)
+		if err != nil {
+			t.Fatalf("unable to decode %v with gob. error=%q", f, err)
+		}
+
+		err = EncodeJSON(&jsonBuf, bytecode)
+		if err != nil {
+			t.Fatalf("unable to encode %v as json. error=%q", f, err)
+		}
+
+		fromJSON, err := DecodeJSON(&jsonBuf)
+		if err != nil {
+			t.Fatalf("unable to decode %v from json. error=%q", f, err)
+		}
+
+		for _, decoded := range []*Bytecode{fromGob, fromJSON} {
+			err = testFloatObject(f, decoded.Constants[0])
+			if err != nil {
+				t.Errorf("float %v did not survive a round trip: %s", f, err)
+			}
+		}
+	}
+}
+
+func TestCompiler_AddConstant(t *testing.T) {
+	tests := []struct {
+		constant object.Object
+		expected string
+	}{
+		{&object.Integer{Value: 1}, ""},
+		{&object.Array{Elements: []object.Object{&object.Integer{Value: 1}, &object.Null{}}}, ""},
+		{&values.Float{Value: 0.1}, ""},
+		{&values.Float{Value: math.Inf(-1)}, "float constant -Inf can not be serialized"},
+		{&values.Float{Value: math.NaN()}, "float constant NaN can not be serialized"},
+		{&object.Builtin{}, "constant of type BUILTIN can not be serialized"},
+		{&object.Array{Elements: []object.Object{&object.Builtin{}}}, "constant of type BUILTIN can not be serialized"},
+		{nil, "constant is nil"},
+	}
+
+	for _, tc := range tests {
+		compiler := Create()
+
+		_, err := compiler.addConstant(tc.constant)
+
+		if err == nil && tc.expected != "" {
+			t.Fatalf("expected error %q, got none", tc.expected)
+		}
+
+		if err != nil && err.Error() != tc.expected {
+			t.Fatalf("incorrect error. got=%q. expected=%q", err, tc.expected)
+		}
+
+		if err != nil && len(compiler.constants) != 0 {
+			t.Fatalf("invalid constant was added to the constant pool")
+		}
+	}
+}
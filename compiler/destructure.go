@@ -0,0 +1,132 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+	"github.com/looplanguage/loop/models/object"
+)
+
+// destructuredName is the name the value being destructured is stored as, it
+// can't be written in a program
+const destructuredName = "$destructured"
+
+// compileDestructuring stores the elements of a value in the variables bound
+// by a pattern. The variables of a declaration are defined before the value
+// is compiled, like those of a regular declaration.
+func (c *Compiler) compileDestructuring(pattern syntax.Pattern, value ast.Expression, declare bool, root, previous string) error {
+	err := checkDestructuring(pattern)
+	if err != nil {
+		return err
+	}
+
+	symbols := map[*ast.Identifier]Symbol{}
+	for _, name := range syntax.Bindings(pattern) {
+		if !declare {
+			symbols[name], err = c.assignee(name.Value, root)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		symbol := c.define(name.Value, root)
+
+		// The cell exists before the value, so closures in it capture it
+		if symbol.Cell {
+			c.emit(code.OpMakeCell, symbol.Index)
+		}
+
+		symbols[name] = symbol
+	}
+
+	err = c.Compile(value, root, "", previous)
+	if err != nil {
+		return err
+	}
+
+	// The value only needs a slot while it is destructured
+	c.enterBlock()
+
+	destructured := c.define(destructuredName, root)
+	c.storeSymbol(destructured)
+
+	err = c.destructure(pattern, func() { c.loadSymbol(destructured) }, symbols, root, previous)
+
+	c.leaveBlock()
+
+	return err
+}
+
+// destructure stores the parts of the value load pushes in the variables of a
+// pattern
+func (c *Compiler) destructure(pattern syntax.Pattern, load func(), symbols map[*ast.Identifier]Symbol, root, previous string) error {
+	switch pattern := pattern.(type) {
+	case *syntax.BindingPattern:
+		load()
+		c.storeSymbol(symbols[pattern.Name])
+	case *syntax.ArrayPattern:
+		for i, element := range pattern.Elements {
+			if _, ok := element.(*syntax.WildcardPattern); ok {
+				continue
+			}
+
+			index, err := c.internConstant(&object.Integer{Value: int64(i)})
+			if err != nil {
+				return err
+			}
+
+			err = c.destructure(element, c.indexed(load, func() { c.emit(code.OpConstant, index) }), symbols, root, previous)
+			if err != nil {
+				return err
+			}
+		}
+
+		if pattern.Rest != nil {
+			load()
+			c.emit(code.OpSlice, len(pattern.Elements))
+			c.storeSymbol(symbols[pattern.Rest])
+		}
+	case *syntax.HashPattern:
+		for i, value := range pattern.Values {
+			key := pattern.Keys[i]
+			loadKey := func() {
+				if err := c.compilePatternValue(key, root, previous); err != nil {
+					c.fail(err)
+				}
+			}
+
+			err := c.destructure(value, c.indexed(load, loadKey), symbols, root, previous)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkDestructuring returns an error for the parts of a pattern that can't be
+// destructured, which are the ones comparing with a value
+func checkDestructuring(pattern syntax.Pattern) error {
+	switch pattern := pattern.(type) {
+	case *syntax.LiteralPattern:
+		return fmt.Errorf("cannot destructure into %s", pattern)
+	case *syntax.ArrayPattern:
+		for _, element := range pattern.Elements {
+			if err := checkDestructuring(element); err != nil {
+				return err
+			}
+		}
+	case *syntax.HashPattern:
+		for _, value := range pattern.Values {
+			if err := checkDestructuring(value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
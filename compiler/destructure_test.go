@@ -0,0 +1,179 @@
+package compiler
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+	"testing"
+)
+
+// parseDestructuring parses input with every unpack(pattern, value) statement
+// turned into a destructuring declaration and every assign(pattern, value)
+// into a destructuring assignment, the parser doesn't know them yet. The
+// patterns are written like the ones of parseMatches.
+func parseDestructuring(input string) *ast.Program {
+	return rewriteStatements(parse(input), func(s ast.Statement) ast.Statement {
+		statement, ok := s.(*ast.ExpressionStatement)
+		if !ok {
+			return s
+		}
+
+		call, ok := statement.Expression.(*ast.CallExpression)
+		if !ok {
+			return s
+		}
+
+		switch call.Function.String() {
+		case "unpack":
+			return &syntax.Destructuring{Pattern: pattern(call.Parameters[0]), Value: call.Parameters[1]}
+		case "assign":
+			return &syntax.DestructuringAssign{Pattern: pattern(call.Parameters[0]), Value: call.Parameters[1]}
+		}
+
+		return s
+	})
+}
+
+func TestCompiler_Destructuring(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// The slot of the value is used again once it is destructured
+			input:             `unpack([a, b], [1, 2]); var c = a`,
+			expectedConstants: []interface{}{1, 2, 0, 1},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpArray, 2),
+				codetest.Make(code.OpSetVar, 2),
+				codetest.Make(code.OpGetVar, 2),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpIndex),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 2),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpIndex),
+				codetest.Make(code.OpSetVar, 1),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpSetVar, 2),
+			},
+			parse: parseDestructuring,
+		},
+		{
+			input:             `unpack([_, a, rest(r)], [1, 2, 3])`,
+			expectedConstants: []interface{}{1, 2, 3, 1},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpArray, 3),
+				codetest.Make(code.OpSetVar, 2),
+				codetest.Make(code.OpGetVar, 2),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpIndex),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 2),
+				codetest.Make(code.OpSlice, 2),
+				codetest.Make(code.OpSetVar, 1),
+			},
+			parse: parseDestructuring,
+		},
+		{
+			input:             `var point = {"x": 1, "y": 2}; unpack({"x": x, "y": y}, point)`,
+			expectedConstants: []interface{}{"x", 1, "y", 2, "x", "y"},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpHash, 4),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpSetVar, 3),
+				codetest.Make(code.OpGetVar, 3),
+				codetest.Make(code.OpConstant, 4),
+				codetest.Make(code.OpIndex),
+				codetest.Make(code.OpSetVar, 1),
+				codetest.Make(code.OpGetVar, 3),
+				codetest.Make(code.OpConstant, 5),
+				codetest.Make(code.OpIndex),
+				codetest.Make(code.OpSetVar, 2),
+			},
+			parse: parseDestructuring,
+		},
+		{
+			input: `fun(pair) { unpack([a, b], pair); a }`,
+			expectedConstants: []interface{}{0, 1, []code.Instructions{
+				codetest.Make(code.OpGetLocal, 0),
+				codetest.Make(code.OpSetLocal, 3),
+				codetest.Make(code.OpGetLocal, 3),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpIndex),
+				codetest.Make(code.OpSetLocal, 1),
+				codetest.Make(code.OpGetLocal, 3),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpIndex),
+				codetest.Make(code.OpSetLocal, 2),
+				codetest.Make(code.OpGetLocal, 1),
+				codetest.Make(code.OpReturn),
+			}},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseDestructuring,
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCompiler_DestructuringPrograms(t *testing.T) {
+	tests := []programTest{
+		{`unpack([a, b], [1, 2]); print(a + b)`, []string{"3"}},
+		{`var a = 1; var b = 2; assign([a, b], [b, a]); print([a, b])`, []string{"[2, 1]"}},
+		{`unpack([a, b, c], [1]); print([a, b, c])`, []string{"[1, null, null]"}},
+		{`unpack([h, rest(t)], [1, 2, 3]); print(t)`, []string{"[2, 3]"}},
+		{`unpack([x, y, rest(t)], [1]); print(t)`, []string{"[]"}},
+		{`unpack({"z": z}, {"x": 1}); print(z)`, []string{"null"}},
+		{
+			`var f = fun() { {"name": "p", "pos": [3, 4]} }; unpack({"name": name, "pos": [x, y]}, f()); print([name, x * y])`,
+			[]string{"[p, 12]"},
+		},
+		{`var f = fun(pair) { unpack([a, b], pair); fun() { a - b } }; print(f([5, 3])())`, []string{"2"}},
+		{
+			`var f = fun() { unpack([n], [0]); var inc = fun() { n = n + 1 }; inc(); inc(); n }; print(f())`,
+			[]string{"2"},
+		},
+		{
+			`var f = fun(xs) { var total = 0; var x = 0; var rest = xs; while(len(rest) > 0) { assign([x, rest(rest)], rest); total = total + x }; total };
+			print(f([1, 2, 3]))`,
+			[]string{"6"},
+		},
+	}
+
+	runPrograms(t, tests, parseDestructuring)
+}
+
+func TestCompiler_DestructuringErrors(t *testing.T) {
+	tests := []compilerTestCaseError{
+		{`unpack([1], [1])`, "cannot destructure into 1"},
+		{`unpack({"x": [x, "y"]}, {})`, `cannot destructure into "y"`},
+		{`assign([a], [1])`, "undefined variable a"},
+	}
+
+	for _, tc := range tests {
+		compiler := Create()
+
+		err := compiler.Compile(parseDestructuring(tc.input), "", "", "")
+		if err == nil || err.Error() != tc.expected {
+			t.Fatalf("incorrect error for %q. got=%v. expected=%q", tc.input, err, tc.expected)
+		}
+	}
+
+	// Values that can't be indexed fail when the program runs
+	_, err := run(compileProgramAt(t, parseDestructuring(`unpack([a], 5)`), 0))
+	if err == nil || err.Error() != "cannot index INTEGER" {
+		t.Fatalf("incorrect run error. got=%v. expected=%q", err, "cannot index INTEGER")
+	}
+}
@@ -0,0 +1,80 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/loop/models/object"
+	"strings"
+)
+
+// Disassemble returns the instructions of the bytecode followed by its
+// constant pool, with the instructions of every function indented below it
+func Disassemble(bytecode *Bytecode) string {
+	var out strings.Builder
+
+	out.WriteString(bytecode.Instructions.String())
+
+	if len(bytecode.Constants) == 0 {
+		return out.String()
+	}
+
+	out.WriteString("\nconstants:\n")
+
+	for i, constant := range bytecode.Constants {
+		function, ok := constant.(*object.CompiledFunction)
+		if !ok {
+			fmt.Fprintf(&out, "[%d] %s\n", i, describeConstant(constant))
+			continue
+		}
+
+		fmt.Fprintf(&out, "[%d] %s\n", i, describeFunction(function, bytecode.Functions[i]))
+
+		instructions := strings.TrimSuffix(code.Instructions(function.Instructions).String(), "\n")
+
+		for _, line := range strings.Split(instructions, "\n") {
+			fmt.Fprintf(&out, "    %s\n", line)
+		}
+	}
+
+	return out.String()
+}
+
+// describeConstant returns the kind of a constant and its value, strings are
+// quoted so their whitespace is visible
+func describeConstant(constant object.Object) string {
+	kind, ok := lookupConstantKind(constant)
+	if !ok {
+		return constant.Inspect()
+	}
+
+	switch constant := constant.(type) {
+	case *object.String:
+		return fmt.Sprintf("%s %q", kind.Name, constant.Value)
+	case *object.Null:
+		return kind.Name
+	case *object.CompiledFunction:
+		return fmt.Sprintf("%s locals=%d parameters=%d", kind.Name, constant.NumLocals, constant.NumParameters)
+	}
+
+	return kind.Name + " " + constant.Inspect()
+}
+
+// describeFunction returns describeConstant of a function followed by its
+// name, defaults and variadic flag, which are only written when it has them
+func describeFunction(function *object.CompiledFunction, metadata FunctionMetadata) string {
+	out := describeConstant(function)
+
+	if metadata.Name != "" {
+		out += " name=" + metadata.Name
+	}
+
+	if metadata.Defaults > 0 {
+		out += fmt.Sprintf(" defaults=%d", metadata.Defaults)
+	}
+
+	if metadata.Variadic {
+		out += " variadic"
+	}
+
+	return out
+}
@@ -0,0 +1,66 @@
+package compiler
+
+import (
+	"github.com/looplanguage/loop/models/ast"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		parse    func(string) *ast.Program
+	}{
+		{
+			`float("3.14") + float("2") + float("0.1")`,
+			"[0000] OpConstant 0\n[0003] OpConstant 1\n[0006] OpAdd\n[0007] OpConstant 2\n[0010] OpAdd\n[0011] OpPop\n" +
+				"\nconstants:\n[0] float 3.14\n[1] float 2.0\n[2] float 0.1\n",
+			nil,
+		},
+		{
+			// Floats are written with every digit they need to read back the
+			// same
+			`[float("0.30000000000000004"), float("1e21"), float("-1.5e-7")]`,
+			"[0000] OpConstant 0\n[0003] OpConstant 1\n[0006] OpConstant 2\n[0009] OpArray 3\n[0012] OpPop\n" +
+				"\nconstants:\n[0] float 0.30000000000000004\n[1] float 1e+21\n[2] float -1.5e-07\n",
+			nil,
+		},
+		{
+			`fun(a) { a * float("0.5") }; "a b"`,
+			"[0000] OpConstant 1\n[0003] OpPop\n[0004] OpConstant 2\n[0007] OpPop\n" +
+				"\nconstants:\n[0] float 0.5\n[1] function locals=1 parameters=1\n" +
+				"    [0000] OpGetLocal 0\n    [0002] OpConstant 0\n    [0005] OpMultiply\n    [0006] OpReturn\n" +
+				"[2] string \"a b\"\n",
+			nil,
+		},
+		{
+			`params(fun(a, b, r) { b }, _, 1, rest)`,
+			"[0000] OpConstant 1\n[0003] OpPop\n" +
+				"\nconstants:\n[0] integer 1\n[1] function locals=3 parameters=3 defaults=1 variadic\n" +
+				"    [0000] OpJumpIfArgument 1 9\n    [0004] OpConstant 0\n    [0007] OpSetLocal 1\n" +
+				"    [0009] OpGetLocal 1\n    [0011] OpReturn\n",
+			parseFunctions,
+		},
+		{
+			`declare(double, fun(n) { n * 2 })`,
+			"[0000] OpConstant 1\n[0003] OpSetVar 0\n" +
+				"\nconstants:\n[0] integer 2\n[1] function locals=1 parameters=1 name=double\n" +
+				"    [0000] OpGetLocal 0\n    [0002] OpConstant 0\n    [0005] OpMultiply\n    [0006] OpReturn\n",
+			parseDeclarations,
+		},
+		{"true", "[0000] OpTrue\n[0001] OpPop\n", nil},
+	}
+
+	for _, tc := range tests {
+		parse := tc.parse
+		if parse == nil {
+			parse = parseFloats
+		}
+
+		actual := Disassemble(compileProgramAt(t, parse(tc.input), 0))
+
+		if actual != tc.expected {
+			t.Errorf("wrong disassembly for %q. got=\n%s\nexpected=\n%s", tc.input, actual, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package compiler
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+)
+
+// cellVariables returns the parameters and variables of a function that are
+// captured by a closure in its body and assigned to anywhere, or captured by
+// the closure they are declared with. Those escape the function, it and its
+// closures share them through a cell. Variables that are captured but never
+// assigned to are copied into the closures instead, and the ones that aren't
+// captured at all can stay on the stack.
+func cellVariables(node *ast.Function) map[string]bool {
+	declared := map[string]bool{}
+	for _, p := range node.Parameters {
+		declared[p.Value] = true
+	}
+
+	inspect(node.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Function:
+			return false
+		case *ast.VariableDeclaration:
+			declared[n.Identifier.Value] = true
+		case *syntax.ConstantDeclaration:
+			declared[n.Identifier.Value] = true
+		case *syntax.FunctionDeclaration:
+			declared[n.Name.Value] = true
+		case *syntax.ForEach:
+			for _, v := range n.Variables {
+				declared[v.Value] = true
+			}
+		case *syntax.BindingPattern:
+			declared[n.Name.Value] = true
+		case *syntax.ArrayPattern:
+			if n.Rest != nil {
+				declared[n.Rest.Value] = true
+			}
+		}
+
+		return true
+	})
+
+	captured := map[string]bool{}
+	assigned := map[string]bool{}
+
+	// declaring is the variable whose value is walked, capturing it there
+	// captures it before it is assigned
+	var walk func(body ast.Node, visible map[string]bool, nested bool, declaring string)
+	walk = func(body ast.Node, visible map[string]bool, nested bool, declaring string) {
+		inspect(body, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.Function:
+				// Parameters of the closure shadow the variables of the
+				// function
+				inner := map[string]bool{}
+				for name := range visible {
+					inner[name] = true
+				}
+
+				for _, p := range n.Parameters {
+					delete(inner, p.Value)
+				}
+
+				walk(n.Body, inner, true, declaring)
+
+				return false
+			case *ast.VariableDeclaration:
+				if !nested {
+					walk(n.Value, visible, false, n.Identifier.Value)
+
+					return false
+				}
+			case *syntax.ConstantDeclaration:
+				if !nested {
+					walk(n.Value, visible, false, n.Identifier.Value)
+
+					return false
+				}
+			case *ast.Identifier:
+				if visible[n.Value] && nested {
+					captured[n.Value] = true
+
+					if n.Value == declaring {
+						assigned[n.Value] = true
+					}
+				}
+			case *ast.Assign:
+				if visible[n.Identifier.Value] {
+					assigned[n.Identifier.Value] = true
+				}
+			case *syntax.FunctionDeclaration:
+				// Declared functions exist from the start of their block,
+				// closures can capture them before they are assigned
+				if !nested && visible[n.Name.Value] {
+					assigned[n.Name.Value] = true
+				}
+			case *syntax.Destructuring:
+				// Closures in the value might capture the variables before
+				// they are assigned
+				destructured(n.Pattern, visible, assigned)
+			case *syntax.DestructuringAssign:
+				destructured(n.Pattern, visible, assigned)
+			}
+
+			return true
+		})
+	}
+
+	walk(node.Body, declared, false, "")
+
+	cells := map[string]bool{}
+	for name := range captured {
+		if assigned[name] {
+			cells[name] = true
+		}
+	}
+
+	return cells
+}
+
+// destructured marks the visible variables bound by a pattern as assigned
+func destructured(pattern syntax.Pattern, visible, assigned map[string]bool) {
+	for _, name := range syntax.Bindings(pattern) {
+		if visible[name.Value] {
+			assigned[name.Value] = true
+		}
+	}
+}
+
+// closureInstruction returns the instruction that creates a function value. A
+// function that captures nothing doesn't need a closure, it is loaded from the
+// constant pool as it is.
+func closureInstruction(index int, freeSymbols []Symbol) (code.OpCode, []int) {
+	if len(freeSymbols) == 0 {
+		return code.OpConstant, []int{index}
+	}
+
+	return code.OpClosure, []int{index, len(freeSymbols)}
+}
@@ -0,0 +1,198 @@
+package compiler
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"github.com/looplanguage/loop/models/ast"
+	"sort"
+	"testing"
+)
+
+func TestCellVariables(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"fun(a) { a }", nil},
+		{"fun(a) { a = 2 }", nil},
+		{"fun(a) { fun() { a } }", nil},
+		{"fun(a) { a = 1; fun() { a } }", []string{"a"}},
+		{"fun(a, b) { fun() { b = a } }", []string{"b"}},
+		{"fun(a, b) { fun() { fun() { a = b } } }", []string{"a"}},
+		// The parameter of the closure is another variable
+		{"fun(a) { fun(a) { a = 1 } }", nil},
+		{"fun(a) { fun(b) { a }; a = 1 }", []string{"a"}},
+		{"fun() { var x = 1; fun() { x } }", nil},
+		{"fun() { var x = 1; fun() { x = 2 } }", []string{"x"}},
+		// Captured by the closure it is declared with, before it is assigned
+		{"fun() { var f = fun() { f() } }", []string{"f"}},
+		{"fun() { var f = fun() { fun() { f } } }", []string{"f"}},
+		{"fun() { var f = fun(f) { f } }", nil},
+		// Declared functions exist before they are assigned
+		{"fun() { declare(f, fun() { 1 }); f() }", nil},
+		{"fun() { declare(f, fun() { f() }) }", []string{"f"}},
+		{"fun() { declare(f, fun() { g() }); declare(g, fun() { 1 }) }", []string{"g"}},
+		// Declaring a function in a closure doesn't assign the variable
+		{"fun() { var g = 1; fun() { declare(g, fun() { 1 }) }; fun() { g } }", nil},
+	}
+
+	for _, tc := range tests {
+		statement := parseDeclarations(tc.input).Statements[0].(*ast.ExpressionStatement)
+
+		var actual []string
+		for name := range cellVariables(statement.Expression.(*ast.Function)) {
+			actual = append(actual, name)
+		}
+
+		sort.Strings(actual)
+
+		if len(actual) != len(tc.expected) {
+			t.Fatalf("wrong cells for %q. got=%q. expected=%q", tc.input, actual, tc.expected)
+		}
+
+		for i, name := range actual {
+			if name != tc.expected[i] {
+				t.Errorf("wrong cells for %q. got=%q. expected=%q", tc.input, actual, tc.expected)
+			}
+		}
+	}
+}
+
+func TestCompiler_Escape(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// Nothing is captured, so no closure is created
+			input: "fun(a) { a }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			// Captured but never assigned to, copied into the closure
+			input: "fun(a) { fun() { a } }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					codetest.Make(code.OpGetFree, 0),
+					codetest.Make(code.OpReturn),
+				},
+				[]code.Instructions{
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpClosure, 0, 1),
+					codetest.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fun(a) { fun() { a = a + 1 }; a }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					codetest.Make(code.OpGetFree, 0),
+					codetest.Make(code.OpLoadCell),
+					codetest.Make(code.OpConstant, 0),
+					codetest.Make(code.OpAdd),
+					codetest.Make(code.OpGetFree, 0),
+					codetest.Make(code.OpStoreCell),
+					codetest.Make(code.OpReturn),
+				},
+				[]code.Instructions{
+					codetest.Make(code.OpMakeCell, 0),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpClosure, 1, 1),
+					codetest.Make(code.OpPop),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpLoadCell),
+					codetest.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCompiler_EscapeCells(t *testing.T) {
+	bytecode := compileAt(t, "fun(a, b, c) { fun() { c = b; a = c } }", 0)
+
+	expected := []int{0, 2}
+
+	cells := bytecode.Functions[1].Cells
+	if len(cells) != len(expected) {
+		t.Fatalf("wrong cells. got=%v. expected=%v", cells, expected)
+	}
+
+	for i, index := range cells {
+		if index != expected[i] {
+			t.Errorf("wrong cells. got=%v. expected=%v", cells, expected)
+		}
+	}
+}
+
+func TestCompiler_EscapeEquivalence(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"var counter = fun(n) { var inc = fun() { n = n + 1 }; inc(); inc(); n }; print(counter(1))", []string{"3"}},
+		{"var f = fun(a) { var g = fun() { a }; a = 5; g() }; print(f(1))", []string{"5"}},
+		{
+			// Every call has its own cell
+			"var make = fun(n) { return fun() { n = n + 1; n } }; var x = make(0); var y = make(10); x(); print(x()); print(y())",
+			[]string{"2", "11"},
+		},
+		{
+			"var outer = fun(n) { var middle = fun() { var inner = fun() { n = n * 2 }; inner() }; middle(); middle(); n }; print(outer(3))",
+			[]string{"12"},
+		},
+		{
+			// Calls to itself start over with new cells
+			"var f = fun(n, acc) { var add = fun() { acc = acc + n }; add(); if(n == 0) { acc } else { f(n - 1, acc) } }; print(f(3, 0))",
+			[]string{"6"},
+		},
+	}
+
+	for _, tc := range tests {
+		for _, level := range []int{0, 1, 2} {
+			for _, tailCalls := range []bool{false, true} {
+				compiler := Create()
+				compiler.OptimizationLevel = level
+				compiler.TailCalls = tailCalls
+
+				err := compiler.Compile(parse(tc.input), "", "", "")
+				if err != nil {
+					t.Fatalf("compiler error: %s", err)
+				}
+
+				m, err := run(compiler.Bytecode())
+				if err != nil {
+					t.Fatalf("run failed at -O%d for %q: %s", level, tc.input, err)
+				}
+
+				if len(m.output) != len(tc.expected) {
+					t.Fatalf("wrong output at -O%d for %q. got=%q. expected=%q", level, tc.input, m.output, tc.expected)
+				}
+
+				for i, line := range m.output {
+					if line != tc.expected[i] {
+						t.Errorf("wrong output at -O%d for %q. got=%q. expected=%q", level, tc.input, m.output, tc.expected)
+					}
+				}
+			}
+		}
+	}
+}
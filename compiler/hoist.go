@@ -0,0 +1,92 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/looplanguage/compiler/ir"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+)
+
+// hoist defines the variables of the functions declared in a block before
+// any of its statements is compiled, so the functions can call each other no
+// matter the order they are declared in. It returns the slots that are kept
+// in a cell, those have to be made before a closure captures them.
+func (c *Compiler) hoist(statements []ast.Statement, root string) ([]int, error) {
+	declared := map[string]bool{}
+	var cells []int
+
+	for _, s := range statements {
+		node, ok := s.(*syntax.FunctionDeclaration)
+		if !ok {
+			continue
+		}
+
+		if declared[node.Name.Value] {
+			return nil, fmt.Errorf("function %s is declared twice", node.Name.Value)
+		}
+
+		declared[node.Name.Value] = true
+
+		symbol := c.define(node.Name.Value, root)
+
+		if symbol.Cell {
+			cells = append(cells, symbol.Index)
+		}
+
+		c.hoisted[node] = symbol
+	}
+
+	return cells, nil
+}
+
+// declaredFunction returns the variable hoist defined for a declared function
+// and prepares the function to be compiled as its value
+func (c *Compiler) declaredFunction(node *syntax.FunctionDeclaration) (Symbol, error) {
+	symbol, ok := c.hoisted[node]
+	if !ok {
+		return Symbol{}, fmt.Errorf("function %s is not declared in a block", node.Name.Value)
+	}
+
+	c.declaring = &symbol
+	c.functionName = node.Name.Value
+
+	return symbol, nil
+}
+
+// compileFunctionDeclaration stores a declared function in its variable, the
+// cell of the variable was made by hoist
+func (c *Compiler) compileFunctionDeclaration(node *syntax.FunctionDeclaration, root, previous string) error {
+	symbol, err := c.declaredFunction(node)
+	if err != nil {
+		return err
+	}
+
+	err = c.Compile(node.Function, root, "", previous)
+	if err != nil {
+		return err
+	}
+
+	c.storeSymbol(symbol)
+	c.registerInlineCandidate(symbol, &ast.VariableDeclaration{Identifier: node.Name, Value: node.Function}, root)
+
+	return nil
+}
+
+// lowerFunctionDeclaration is compileFunctionDeclaration for the intermediate
+// representation
+func (c *Compiler) lowerFunctionDeclaration(b *ir.Builder, node *syntax.FunctionDeclaration, root, previous string) error {
+	symbol, err := c.declaredFunction(node)
+	if err != nil {
+		return err
+	}
+
+	err = c.lower(b, node.Function, root, previous)
+	if err != nil {
+		return err
+	}
+
+	lowerStoreSymbol(b, symbol)
+	c.registerInlineCandidate(symbol, &ast.VariableDeclaration{Identifier: node.Name, Value: node.Function}, root)
+
+	return nil
+}
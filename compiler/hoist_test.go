@@ -0,0 +1,199 @@
+package compiler
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+	"testing"
+)
+
+// parseDeclarations parses input like parseFunctions, with every statement
+// declare(name, function) turned into a function declaration, the parser
+// doesn't know them yet
+func parseDeclarations(input string) *ast.Program {
+	return rewriteStatements(parseFunctions(input), func(s ast.Statement) ast.Statement {
+		statement, ok := s.(*ast.ExpressionStatement)
+		if !ok {
+			return s
+		}
+
+		call, ok := statement.Expression.(*ast.CallExpression)
+		if !ok || call.Function.String() != "declare" {
+			return s
+		}
+
+		function, _ := functionOf(call.Parameters[1])
+		return &syntax.FunctionDeclaration{Name: call.Parameters[0].(*ast.Identifier), Function: function}
+	})
+}
+
+func TestCompiler_FunctionDeclarations(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// The variable is defined before anything else in its block
+			input: `var x = 1; declare(f, fun() { x }); f()`,
+			expectedConstants: []interface{}{1, []code.Instructions{
+				codetest.Make(code.OpGetVar, 1),
+				codetest.Make(code.OpReturn),
+			}},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 1),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpCall, 0),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseDeclarations,
+		},
+		{
+			// Functions declared in a function that call each other share
+			// cells, made before either closure is created
+			input: `fun() { declare(a, fun() { b() }); declare(b, fun() { a() }) }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					codetest.Make(code.OpGetFree, 0),
+					codetest.Make(code.OpLoadCell),
+					codetest.Make(code.OpCall, 0),
+					codetest.Make(code.OpReturn),
+				},
+				[]code.Instructions{
+					codetest.Make(code.OpGetFree, 0),
+					codetest.Make(code.OpLoadCell),
+					codetest.Make(code.OpCall, 0),
+					codetest.Make(code.OpReturn),
+				},
+				[]code.Instructions{
+					codetest.Make(code.OpMakeCell, 0),
+					codetest.Make(code.OpMakeCell, 1),
+					codetest.Make(code.OpGetLocal, 1),
+					codetest.Make(code.OpClosure, 0, 1),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpStoreCell),
+					codetest.Make(code.OpGetLocal, 0),
+					codetest.Make(code.OpClosure, 1, 1),
+					codetest.Make(code.OpGetLocal, 1),
+					codetest.Make(code.OpStoreCell),
+					codetest.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseDeclarations,
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCompiler_FunctionDeclarationsPrograms(t *testing.T) {
+	tests := []programTest{
+		{`declare(fib, fun(n) { if(n < 2) { return n }; fib(n - 1) + fib(n - 2) }); print(fib(10))`, []string{"55"}},
+		{
+			`declare(even, fun(n) { if(n == 0) { return true }; odd(n - 1) });
+			declare(odd, fun(n) { if(n == 0) { return false }; even(n - 1) });
+			print([even(10), odd(7), even(3)])`,
+			[]string{"[true, true, false]"},
+		},
+		{
+			`var f = fun(x) {
+				declare(even, fun(n) { if(n == 0) { return true }; odd(n - 1) });
+				declare(odd, fun(n) { if(n == 0) { return false }; even(n - 1) });
+				even(x)
+			};
+			print([f(4), f(5)])`,
+			[]string{"[true, false]"},
+		},
+		{`if(true) { declare(g, fun() { h() + 1 }); declare(h, fun() { 5 }); print(g()) }`, []string{"6"}},
+		{
+			// A closure created before the declaration calls the function
+			// declared later
+			`var f = fun() { var g = fun() { h() }; declare(h, fun() { 7 }); g() }; print(f())`,
+			[]string{"7"},
+		},
+		{`declare(greet, params(fun(name, greeting) { greeting + " " + name }, _, "hello")); print(greet("you"))`, []string{"hello you"}},
+		{`declare(double, fun(n) { n * 2 }); print(double(double(3)))`, []string{"12"}},
+	}
+
+	runPrograms(t, tests, parseDeclarations)
+}
+
+func TestCompiler_FunctionDeclarationsTailCalls(t *testing.T) {
+	input := `declare(even, fun(n) { if(n == 0) { return true }; odd(n - 1) });
+	declare(odd, fun(n) { if(n == 0) { return false }; even(n - 1) });
+	print(even(1000))`
+
+	compiler := Create()
+	compiler.TailCalls = true
+
+	err := compiler.Compile(parseDeclarations(input), "", "", "")
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	m, err := run(compiler.Bytecode())
+	if err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+
+	if len(m.output) != 1 || m.output[0] != "true" {
+		t.Errorf("wrong output. got=%q. expected=%q", m.output, "true")
+	}
+
+	if m.maxDepth != 1 {
+		t.Errorf("wrong call depth. got=%d. expected=%d", m.maxDepth, 1)
+	}
+}
+
+func TestCompiler_FunctionDeclarationsNames(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{`declare(f, fun() { fun() { 1 } })`, []string{"", "f"}},
+		{`var g = fun() { 1 }; fun() { 2 }`, []string{"g", ""}},
+		{`fun() { declare(inner, fun() { 1 }); inner }`, []string{"inner", ""}},
+	}
+
+	for _, tc := range tests {
+		bytecode := compileProgramAt(t, parseDeclarations(tc.input), 0)
+
+		var names []string
+		for i := range bytecode.Constants {
+			if metadata, ok := bytecode.Functions[i]; ok {
+				names = append(names, metadata.Name)
+			}
+		}
+
+		if len(names) != len(tc.expected) {
+			t.Fatalf("wrong names for %q. got=%q. expected=%q", tc.input, names, tc.expected)
+		}
+
+		for i, name := range names {
+			if name != tc.expected[i] {
+				t.Errorf("wrong names for %q. got=%q. expected=%q", tc.input, names, tc.expected)
+			}
+		}
+	}
+}
+
+func TestCompiler_FunctionDeclarationsErrors(t *testing.T) {
+	tests := []compilerTestCaseError{
+		{`declare(f, fun() { 1 }); declare(f, fun() { 2 })`, "function f is declared twice"},
+		{`fun() { declare(f, fun() { g() }) }; g()`, "undefined variable g"},
+		{`declare(f, fun() { 1 }); if(true) { declare(g, fun() { 2 }) }; g()`, "undefined variable g"},
+	}
+
+	for _, tc := range tests {
+		compiler := Create()
+
+		err := compiler.Compile(parseDeclarations(tc.input), "", "", "")
+		if err == nil || err.Error() != tc.expected {
+			t.Fatalf("incorrect error for %q. got=%v. expected=%q", tc.input, err, tc.expected)
+		}
+	}
+}
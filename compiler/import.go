@@ -160,8 +160,6 @@ func (c *Compiler) importPackageGithub(root string, node *ast.Import) error {
 	input, err = ioutil.ReadFile(targetDirectory + "/" + filename + ".lp")
 
 	return c.importString(root, string(input), node.Identifier, targetDirectory+"/"+filename+".lp")
-
-	return nil
 }
 
 func Unzip(src string, dest string) ([]string, error) {
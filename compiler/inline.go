@@ -0,0 +1,337 @@
+package compiler
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/ir"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+)
+
+// maxInlineSize is the most nodes the body of a function can have for calls
+// to it to be inlined
+const maxInlineSize = 32
+
+// maxInlineDepth limits how often calls in inlined bodies are inlined again,
+// so functions calling each other aren't expanded forever
+const maxInlineDepth = 4
+
+// inlineCandidate is a function that calls to can be replaced by its body
+type inlineCandidate struct {
+	function *ast.Function
+	// How the free variables of the body are loaded where the function is
+	// declared, calls are only inlined where they are loaded the same way
+	free map[string]binding
+}
+
+type binding struct {
+	op    code.OpCode
+	index int
+}
+
+// inspect calls f for node and everything in it, children are skipped when f
+// returns false
+func inspect(node ast.Node, f func(ast.Node) bool) {
+	if node == nil || !f(node) {
+		return
+	}
+
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			inspect(s, f)
+		}
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			inspect(s, f)
+		}
+	case *ast.ExpressionStatement:
+		inspect(node.Expression, f)
+	case *ast.SuffixExpression:
+		inspect(node.Left, f)
+		inspect(node.Right, f)
+	case *ast.While:
+		inspect(node.Condition, f)
+		inspect(node.Block, f)
+	case *syntax.Template:
+		for _, part := range node.Parts {
+			inspect(part, f)
+		}
+	case *syntax.ForEach:
+		for _, v := range node.Variables {
+			inspect(v, f)
+		}
+
+		inspect(node.Iterable, f)
+		inspect(node.Body, f)
+	case *syntax.Match:
+		inspect(node.Subject, f)
+
+		for _, arm := range node.Arms {
+			inspect(arm.Pattern, f)
+			inspect(arm.Body, f)
+		}
+	case *syntax.LiteralPattern:
+		inspect(node.Value, f)
+	case *syntax.BindingPattern:
+		inspect(node.Name, f)
+	case *syntax.ArrayPattern:
+		for _, element := range node.Elements {
+			inspect(element, f)
+		}
+
+		if node.Rest != nil {
+			inspect(node.Rest, f)
+		}
+	case *syntax.HashPattern:
+		for i, key := range node.Keys {
+			inspect(key, f)
+			inspect(node.Values[i], f)
+		}
+	case *ast.ConditionalStatement:
+		inspect(node.Condition, f)
+		inspect(node.Body, f)
+
+		if node.ElseCondition != nil {
+			inspect(node.ElseCondition, f)
+		}
+
+		if node.ElseStatement != nil {
+			inspect(node.ElseStatement, f)
+		}
+	case *ast.VariableDeclaration:
+		inspect(node.Identifier, f)
+		inspect(node.Value, f)
+	case *syntax.ConstantDeclaration:
+		inspect(node.Identifier, f)
+		inspect(node.Value, f)
+	case *syntax.Destructuring:
+		inspect(node.Pattern, f)
+		inspect(node.Value, f)
+	case *syntax.DestructuringAssign:
+		inspect(node.Pattern, f)
+		inspect(node.Value, f)
+	case *ast.Assign:
+		inspect(node.Identifier, f)
+		inspect(node.Value, f)
+	case *ast.IndexAssign:
+		inspect(node.Value, f)
+		inspect(node.Index, f)
+		inspect(node.Object, f)
+	case *ast.Array:
+		for _, element := range node.Elements {
+			inspect(element, f)
+		}
+	case *ast.IndexExpression:
+		inspect(node.Value, f)
+		inspect(node.Index, f)
+	case *ast.Hashmap:
+		for _, k := range sortedKeys(node) {
+			inspect(k, f)
+			inspect(node.Values[k], f)
+		}
+	case *ast.Function:
+		for _, p := range node.Parameters {
+			inspect(p, f)
+		}
+
+		inspect(node.Body, f)
+	case *syntax.Function:
+		// The defaults are evaluated by the function, not where it is
+		// created
+		inspect(withDefaults(node), f)
+	case *syntax.FunctionDeclaration:
+		inspect(node.Name, f)
+		inspect(node.Function, f)
+	case *ast.Return:
+		inspect(node.Value, f)
+	case *ast.CallExpression:
+		inspect(node.Function, f)
+
+		for _, arg := range node.Parameters {
+			inspect(arg, f)
+		}
+	case *ast.Export:
+		inspect(node.Expression, f)
+	}
+}
+
+// collectAssignments records every name that is assigned to in node, those
+// variables might not hold the function they were declared with anymore
+func (c *Compiler) collectAssignments(node ast.Node) {
+	inspect(node, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Assign:
+			c.reassigned[n.Identifier.Value] = true
+		case *syntax.DestructuringAssign:
+			for _, name := range syntax.Bindings(n.Pattern) {
+				c.reassigned[name.Value] = true
+			}
+		}
+
+		return true
+	})
+}
+
+// registerInlineCandidate remembers the function a variable is declared with
+// if calls to it can be inlined. Functions can't be inlined if they return
+// early, create closures, are recursive or are too big.
+func (c *Compiler) registerInlineCandidate(variable Symbol, node *ast.VariableDeclaration, root string) {
+	// Defaults and the variadic parameter are filled in by the call
+	function, ok := functionOf(node.Value)
+	if !ok || len(function.Defaults) > 0 || function.Variadic {
+		return
+	}
+
+	if c.OptimizationLevel < 2 || c.reassigned[node.Identifier.Value] || !canLower(function.Body, true) {
+		return
+	}
+
+	// Only globals are called the same way everywhere
+	if variable.Scope != GlobalScope {
+		return
+	}
+
+	local := map[string]bool{}
+	for _, p := range function.Parameters {
+		local[p.Value] = true
+	}
+
+	size := 0
+	eligible := true
+	var used []string
+
+	inspect(function.Body, func(n ast.Node) bool {
+		size++
+
+		switch n := n.(type) {
+		case *ast.Return, *ast.Function:
+			eligible = false
+		case *ast.VariableDeclaration:
+			local[n.Identifier.Value] = true
+		case *syntax.ConstantDeclaration:
+			local[n.Identifier.Value] = true
+		case *ast.Identifier:
+			used = append(used, n.Value)
+		}
+
+		return eligible
+	})
+
+	if !eligible || size > maxInlineSize {
+		return
+	}
+
+	free := map[string]binding{}
+
+	for _, name := range used {
+		if local[name] {
+			continue
+		}
+
+		// Calling itself, the function would be inlined into itself
+		if name == node.Identifier.Value {
+			return
+		}
+
+		b, ok := c.binding(name, root)
+		if !ok {
+			return
+		}
+
+		free[name] = b
+	}
+
+	c.inlineCandidates[variable.Index] = &inlineCandidate{function: &function.Function, free: free}
+}
+
+// binding returns how name is loaded in the current scope. Only globals,
+// builtins and constants are loaded the same way everywhere, locals and
+// captured variables can't be used by inlined bodies.
+func (c *Compiler) binding(name, root string) (binding, bool) {
+	s, ok := c.currentScope.lookup(name, root)
+	if !ok || (s.Scope != GlobalScope && s.Scope != BuiltinScope && s.Scope != ConstantScope) {
+		return binding{}, false
+	}
+
+	op, index := symbolInstruction(s)
+
+	return binding{op: op, index: index}, true
+}
+
+// inlineCall lowers a call to a candidate for inlining as the body of the
+// function, with its parameters as fresh variables. It returns false if the
+// call can't be inlined, without lowering anything.
+func (c *Compiler) inlineCall(b *ir.Builder, node *ast.CallExpression, root, previous string) (bool, error) {
+	if c.OptimizationLevel < 2 || c.inlineDepth >= maxInlineDepth {
+		return false, nil
+	}
+
+	callee, ok := node.Function.(*ast.Identifier)
+	if !ok || c.reassigned[callee.Value] {
+		return false, nil
+	}
+
+	variable, ok := c.currentScope.lookup(callee.Value, root)
+	if !ok || variable.Scope != GlobalScope {
+		return false, nil
+	}
+
+	candidate := c.inlineCandidates[variable.Index]
+	if candidate == nil || len(candidate.function.Parameters) != len(node.Parameters) {
+		return false, nil
+	}
+
+	for name, expected := range candidate.free {
+		if b, ok := c.binding(name, root); !ok || b != expected {
+			return false, nil
+		}
+	}
+
+	// Arguments are evaluated before the parameters exist, so they can't
+	// refer to them
+	parameters := c.deeperScope()
+	outer := c.currentScope
+
+	for i, arg := range node.Parameters {
+		err := c.lower(b, arg, root, previous)
+		if err != nil {
+			return true, err
+		}
+
+		c.currentScope = parameters
+		s := c.define(candidate.function.Parameters[i].Value, root)
+		c.currentScope = outer
+
+		if s.Cell {
+			b.Emit(code.OpMakeCell, s.Index)
+		}
+
+		lowerStoreSymbol(b, s)
+	}
+
+	c.currentScope = parameters
+	c.inlineDepth++
+
+	err := c.lower(b, candidate.function.Body, root, previous)
+
+	c.inlineDepth--
+	c.currentScope = outer
+	c.release(parameters)
+
+	if err != nil {
+		return true, err
+	}
+
+	// The value of the call is the value of the last expression, like the
+	// implicit return of a function
+	statements := candidate.function.Body.Statements
+	if len(statements) > 0 {
+		if _, ok := statements[len(statements)-1].(*ast.ExpressionStatement); ok && b.RemoveLastPop() {
+			return true, nil
+		}
+	}
+
+	b.Emit(code.OpNull)
+
+	return true, nil
+}
@@ -0,0 +1,193 @@
+package compiler
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"github.com/looplanguage/loop/models/ast"
+	"testing"
+)
+
+func compileAt(t testing.TB, input string, level int) *Bytecode {
+	t.Helper()
+
+	return compileProgramAt(t, parse(input), level)
+}
+
+func compileProgramAt(t testing.TB, program *ast.Program, level int) *Bytecode {
+	t.Helper()
+
+	compiler := Create()
+	compiler.OptimizationLevel = level
+
+	err := compiler.Compile(program, "", "", "")
+	if err != nil {
+		t.Fatalf("compiler error at -O%d for %q: %s", level, program.String(), err)
+	}
+
+	return compiler.Bytecode()
+}
+
+func TestCompiler_Inline(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "var double = fun(x) { x * 2 }; double(3)",
+			expectedConstants: []interface{}{2, []code.Instructions{
+				codetest.Make(code.OpGetLocal, 0),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpMultiply),
+				codetest.Make(code.OpReturn),
+			}, 3},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpSetVar, 1),
+				codetest.Make(code.OpGetVar, 1),
+				// The 2 of the inlined body is the one of the function
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpMultiply),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			// The argument refers to the x of the caller, not the parameter
+			input: "var f = fun(x) { print(x) }; var x = 1; f(x)",
+			expectedConstants: []interface{}{[]code.Instructions{
+				codetest.Make(code.OpGetBuiltinFunction, 1),
+				codetest.Make(code.OpGetLocal, 0),
+				codetest.Make(code.OpCall, 1),
+				codetest.Make(code.OpReturn),
+			}, 1},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpSetVar, 1),
+				codetest.Make(code.OpGetVar, 1),
+				codetest.Make(code.OpSetVar, 2),
+				codetest.Make(code.OpGetBuiltinFunction, 1),
+				codetest.Make(code.OpGetVar, 2),
+				codetest.Make(code.OpCall, 1),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			// Recursive functions are never inlined
+			input: "var f = fun(n) { f(n) }; f(1)",
+			expectedConstants: []interface{}{[]code.Instructions{
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpGetLocal, 0),
+				codetest.Make(code.OpCall, 1),
+				codetest.Make(code.OpReturn),
+			}, 1},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpCall, 1),
+				codetest.Make(code.OpPop),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		bytecode := compileAt(t, tc.input, 2)
+
+		err := testInstructions(tc.expectedInstructions, bytecode.Instructions)
+		if err != nil {
+			t.Errorf("testInstructions failed for %q with: %s", tc.input, err)
+		}
+
+		err = testConstants(tc.expectedConstants, bytecode.Constants)
+		if err != nil {
+			t.Errorf("testConstants failed for %q with: %s", tc.input, err)
+		}
+	}
+}
+
+func TestCompiler_InlineEquivalence(t *testing.T) {
+	tests := []struct {
+		input string
+		// Calls left at -O2, including builtins
+		calls int
+	}{
+		{"var double = fun(x) { x * 2 }; print(double(3))", 1},
+		{"var double = fun(x) { x * 2 }; var i = 0; var sum = 0; while(i < 10) { sum = sum + double(i); i = i + 1 }; print(sum)", 1},
+		{"var add = fun(a, b) { a + b }; var twice = fun(a) { add(a, a) }; print(twice(add(1, 2)))", 1},
+		{"var f = fun(a, b) { print(b); print(a); b }; f(print(1), print(2))", 4},
+		{"var f = fun() { }; print(f())", 1},
+		{"var f = fun() { var y = 2 }; print(f())", 1},
+		{"var f = fun(a) { if(a > 1) { a } else { 0 } }; print(f(5) + f(0))", 1},
+		{"var f = fun(a) { var i = 0; while(i < a) { i = i + 1 }; i }; print(f(4))", 1},
+		{"var x = 1; var f = fun() { x }; x = 2; print(f())", 1},
+		{"var f = fun() { 1 }; f = fun() { 2 }; print(f())", 2},
+		{"var f = fun(a) { if(a > 0) { return a }; 0 }; print(f(1))", 2},
+		{"var f = fun(n) { if(n > 0) { f(n - 1) } else { 7 } }; print(f(3))", 5},
+		{"var x = 1; var f = fun() { x }; if(true) { var x = 2; print(f()) }", 2},
+		{"var n = 1; var f = fun() { n = n + 1 }; f(); f(); print(n)", 1},
+		{"var print = fun(a) { a }; var f = fun() { print(3) }; len([f()])", 1},
+		{"var g = fun(a) { fun() { a }() }; print(g(1))", 3},
+		{"var f = fun(a) { a * 2 }; var g = fun(b) { f(b) + 1 }; print(g(4))", 1},
+		{
+			// Only four calls deep are inlined
+			"var f1 = fun() { 1 }; var f2 = fun() { f1() }; var f3 = fun() { f2() }; var f4 = fun() { f3() }; var f5 = fun() { f4() }; var f6 = fun() { f5() }; print(f6())",
+			2,
+		},
+		{"var f = fun(a) { [a, {\"a\": a}] }; print(f(1)[1][\"a\"])", 1},
+		// Slots of a block that ended don't keep the functions they held
+		{"if(true) { var f = fun(x) { x + 1 } }; var h = fun(x) { x * 2 }; print(h(3))", 1},
+		{"if(true) { var a = 0; var f = fun(x) { x + 1 } }; var g = fun(f) { f(1) }; print(g(fun(y) { y * 100 }))", 2},
+	}
+
+	for _, tc := range tests {
+		unoptimized, err := run(compileAt(t, tc.input, 1))
+		if err != nil {
+			t.Fatalf("run failed at -O1 for %q: %s", tc.input, err)
+		}
+
+		optimized, err := run(compileAt(t, tc.input, 2))
+		if err != nil {
+			t.Fatalf("run failed at -O2 for %q: %s", tc.input, err)
+		}
+
+		if len(optimized.output) != len(unoptimized.output) {
+			t.Fatalf("wrong output for %q. got=%q. expected=%q", tc.input, optimized.output, unoptimized.output)
+		}
+
+		for i, line := range optimized.output {
+			if line != unoptimized.output[i] {
+				t.Errorf("wrong output for %q. got=%q. expected=%q", tc.input, optimized.output, unoptimized.output)
+			}
+		}
+
+		if optimized.calls != tc.calls {
+			t.Errorf("wrong number of calls for %q. got=%d. expected=%d", tc.input, optimized.calls, tc.calls)
+		}
+	}
+}
+
+func BenchmarkCompiler_Inline(b *testing.B) {
+	input := `
+var double = fun(x) { x * 2 }
+var i = 0
+var sum = 0
+while(i < 1000) {
+	sum = sum + double(i)
+	i = i + 1
+}
+`
+
+	for _, level := range []int{1, 2} {
+		bytecode := compileAt(b, input, level)
+
+		b.Run(map[int]string{1: "O1", 2: "O2"}[level], func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := run(bytecode)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
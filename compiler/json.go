@@ -0,0 +1,319 @@
+package compiler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/values"
+	"github.com/looplanguage/loop/models/object"
+	"io"
+	"sort"
+)
+
+// JSONFormatVersion is the version of the JSON bytecode format, it is
+// increased whenever the layout described in schema/bytecode.schema.json
+// changes in an incompatible way.
+const JSONFormatVersion = 1
+
+// Constant kinds as they appear in the "kind" field of a JSON constant
+const (
+	JSONInteger  = "integer"
+	JSONString   = "string"
+	JSONBoolean  = "boolean"
+	JSONNull     = "null"
+	JSONFunction = "function"
+	JSONArray    = "array"
+	JSONFloat    = "float"
+)
+
+type jsonBytecode struct {
+	Version       int                 `json:"version"`
+	Instructions  []int               `json:"instructions"`
+	MaxStackDepth int                 `json:"maxStackDepth"`
+	NumVariables  int                 `json:"numVariables,omitempty"`
+	Constants     []jsonConstant      `json:"constants"`
+	Variables     []jsonVariableScope `json:"variables"`
+}
+
+type jsonConstant struct {
+	Kind  string          `json:"kind"`
+	Value json.RawMessage `json:"value,omitempty"`
+
+	// Only set for functions
+	Instructions  []int  `json:"instructions,omitempty"`
+	NumLocals     int    `json:"numLocals,omitempty"`
+	NumParameters int    `json:"numParameters,omitempty"`
+	MaxStackDepth int    `json:"maxStackDepth,omitempty"`
+	Cells         []int  `json:"cells,omitempty"`
+	Defaults      int    `json:"defaults,omitempty"`
+	Variadic      bool   `json:"variadic,omitempty"`
+	Name          string `json:"name,omitempty"`
+
+	// Only set for arrays
+	Elements []jsonConstant `json:"elements,omitempty"`
+}
+
+type jsonVariableScope struct {
+	Variables []jsonVariable `json:"variables"`
+}
+
+type jsonVariable struct {
+	Name  string        `json:"name"`
+	Index int           `json:"index"`
+	Value *jsonConstant `json:"value,omitempty"`
+}
+
+// EncodeJSON writes the bytecode to w in the JSON format described by
+// schema/bytecode.schema.json
+func EncodeJSON(w io.Writer, bytecode *Bytecode) error {
+	out := jsonBytecode{
+		Version:       JSONFormatVersion,
+		Instructions:  instructionsToJSON(bytecode.Instructions),
+		MaxStackDepth: bytecode.MaxStackDepth,
+		NumVariables:  bytecode.NumVariables,
+		Constants:     []jsonConstant{},
+		Variables:     []jsonVariableScope{},
+	}
+
+	for i, constant := range bytecode.Constants {
+		c, err := constantToJSON(constant)
+		if err != nil {
+			return fmt.Errorf("unable to encode constant %d. error=%q", i, err)
+		}
+
+		if metadata, ok := bytecode.Functions[i]; ok {
+			c.MaxStackDepth = metadata.MaxStackDepth
+			c.Cells = metadata.Cells
+			c.Defaults = metadata.Defaults
+			c.Variadic = metadata.Variadic
+			c.Name = metadata.Name
+		}
+
+		out.Constants = append(out.Constants, c)
+	}
+
+	for _, scope := range bytecode.Variables {
+		s, err := variableScopeToJSON(scope)
+		if err != nil {
+			return err
+		}
+
+		out.Variables = append(out.Variables, s)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(out)
+}
+
+// DecodeJSON reads bytecode written by EncodeJSON
+func DecodeJSON(r io.Reader) (*Bytecode, error) {
+	var in jsonBytecode
+
+	err := json.NewDecoder(r).Decode(&in)
+	if err != nil {
+		return nil, err
+	}
+
+	if in.Version != JSONFormatVersion {
+		return nil, fmt.Errorf("unsupported bytecode version. got=%d. expected=%d", in.Version, JSONFormatVersion)
+	}
+
+	instructions, err := instructionsFromJSON(in.Instructions)
+	if err != nil {
+		return nil, err
+	}
+
+	bytecode := &Bytecode{
+		Instructions:  instructions,
+		Constants:     []object.Object{},
+		MaxStackDepth: in.MaxStackDepth,
+		NumVariables:  in.NumVariables,
+		Functions:     map[int]FunctionMetadata{},
+	}
+
+	for i, c := range in.Constants {
+		constant, err := constantFromJSON(c)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode constant %d. error=%q", i, err)
+		}
+
+		if c.Kind == JSONFunction {
+			bytecode.Functions[i] = FunctionMetadata{
+				MaxStackDepth: c.MaxStackDepth,
+				Cells:         c.Cells,
+				Defaults:      c.Defaults,
+				Variadic:      c.Variadic,
+				Name:          c.Name,
+			}
+		}
+
+		bytecode.Constants = append(bytecode.Constants, constant)
+	}
+
+	for _, s := range in.Variables {
+		scope := VariableScope{Variables: map[int]Variable{}}
+
+		for _, v := range s.Variables {
+			variable := Variable{Name: v.Name, Index: v.Index, Object: &object.Null{}}
+
+			if v.Value != nil {
+				variable.Object, err = constantFromJSON(*v.Value)
+				if err != nil {
+					return nil, fmt.Errorf("unable to decode variable %q. error=%q", v.Name, err)
+				}
+			}
+
+			scope.Variables[v.Index] = variable
+		}
+
+		bytecode.Variables = append(bytecode.Variables, scope)
+	}
+
+	return bytecode, nil
+}
+
+func instructionsToJSON(ins code.Instructions) []int {
+	out := make([]int, len(ins))
+
+	for i, b := range ins {
+		out[i] = int(b)
+	}
+
+	return out
+}
+
+func instructionsFromJSON(in []int) (code.Instructions, error) {
+	ins := make(code.Instructions, len(in))
+
+	for i, b := range in {
+		if b < 0 || b > 255 {
+			return nil, fmt.Errorf("instruction byte out of range at %d. got=%d", i, b)
+		}
+
+		ins[i] = byte(b)
+	}
+
+	return ins, nil
+}
+
+func constantToJSON(obj object.Object) (jsonConstant, error) {
+	var value interface{}
+	c := jsonConstant{}
+
+	kind, ok := lookupConstantKind(obj)
+	if !ok {
+		return c, fmt.Errorf("unsupported constant type %T", obj)
+	}
+
+	c.Kind = kind.Name
+
+	switch obj := obj.(type) {
+	case *object.Integer:
+		value = obj.Value
+	case *object.String:
+		value = obj.Value
+	case *object.Boolean:
+		value = obj.Value
+	case *values.Float:
+		value = obj.Value
+	case *object.CompiledFunction:
+		c.Instructions = instructionsToJSON(obj.Instructions)
+		c.NumLocals = obj.NumLocals
+		c.NumParameters = obj.NumParameters
+	case *object.Array:
+		c.Elements = []jsonConstant{}
+
+		for _, element := range obj.Elements {
+			e, err := constantToJSON(element)
+			if err != nil {
+				return c, err
+			}
+
+			c.Elements = append(c.Elements, e)
+		}
+	}
+
+	if value != nil {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return c, err
+		}
+
+		c.Value = raw
+	}
+
+	return c, nil
+}
+
+func constantFromJSON(c jsonConstant) (object.Object, error) {
+	switch c.Kind {
+	case JSONInteger:
+		integer := &object.Integer{}
+		return integer, json.Unmarshal(c.Value, &integer.Value)
+	case JSONString:
+		str := &object.String{}
+		return str, json.Unmarshal(c.Value, &str.Value)
+	case JSONBoolean:
+		boolean := &object.Boolean{}
+		return boolean, json.Unmarshal(c.Value, &boolean.Value)
+	case JSONFloat:
+		float := &values.Float{}
+		return float, json.Unmarshal(c.Value, &float.Value)
+	case JSONNull:
+		return &object.Null{}, nil
+	case JSONFunction:
+		instructions, err := instructionsFromJSON(c.Instructions)
+		if err != nil {
+			return nil, err
+		}
+
+		return &object.CompiledFunction{
+			Instructions:  instructions,
+			NumLocals:     c.NumLocals,
+			NumParameters: c.NumParameters,
+		}, nil
+	case JSONArray:
+		array := &object.Array{Elements: []object.Object{}}
+
+		for _, e := range c.Elements {
+			element, err := constantFromJSON(e)
+			if err != nil {
+				return nil, err
+			}
+
+			array.Elements = append(array.Elements, element)
+		}
+
+		return array, nil
+	}
+
+	return nil, fmt.Errorf("unknown constant kind %q", c.Kind)
+}
+
+func variableScopeToJSON(scope VariableScope) (jsonVariableScope, error) {
+	out := jsonVariableScope{Variables: []jsonVariable{}}
+
+	for _, v := range scope.Variables {
+		variable := jsonVariable{Name: v.Name, Index: v.Index}
+
+		if v.Object != nil {
+			value, err := constantToJSON(v.Object)
+			if err != nil {
+				return out, fmt.Errorf("unable to encode variable %q. error=%q", v.Name, err)
+			}
+
+			variable.Value = &value
+		}
+
+		out.Variables = append(out.Variables, variable)
+	}
+
+	// Map iteration order is random, sort to keep the output stable
+	sort.Slice(out.Variables, func(i, j int) bool {
+		return out.Variables[i].Index < out.Variables[j].Index
+	})
+
+	return out, nil
+}
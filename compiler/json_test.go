@@ -0,0 +1,157 @@
+package compiler
+
+import (
+	"bytes"
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"github.com/looplanguage/loop/models/object"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSON_RoundTrip(t *testing.T) {
+	inputs := []string{
+		"1 + 2",
+		`"hello " + "world"`,
+		"var test = fun(a, b) { return a * b }; test(1, 2)",
+		"fun(a) { return fun(b) { return a + b } }",
+		"[1, 2, 3][1]",
+		"fun(a) { var f = fun() { a = a + 1 }; f(); a }",
+		"var a = 1; if(true) { var b = 2 }; var c = 3",
+		"var f = params(fun(a, b, r) { a }, _, 1, rest); f(1)",
+		"declare(f, fun(n) { if(n > 0) { f(n - 1) } }); f(2)",
+	}
+
+	for _, input := range inputs {
+		compiler := Create()
+
+		err := compiler.Compile(parseDeclarations(input), "", "", "")
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		expected := compiler.Bytecode()
+
+		var buf bytes.Buffer
+		err = EncodeJSON(&buf, expected)
+		if err != nil {
+			t.Fatalf("unable to encode %q. error=%q", input, err)
+		}
+
+		actual, err := DecodeJSON(&buf)
+		if err != nil {
+			t.Fatalf("unable to decode %q. error=%q", input, err)
+		}
+
+		if actual.MaxStackDepth != expected.MaxStackDepth {
+			t.Fatalf("wrong max stack depth for %q. got=%d. expected=%d", input, actual.MaxStackDepth, expected.MaxStackDepth)
+		}
+
+		if actual.NumVariables != expected.NumVariables {
+			t.Fatalf("wrong number of variables for %q. got=%d. expected=%d", input, actual.NumVariables, expected.NumVariables)
+		}
+
+		err = testInstructions([]code.Instructions{expected.Instructions}, actual.Instructions)
+		if err != nil {
+			t.Fatalf("testInstructions failed for %q with: %s", input, err)
+		}
+
+		if len(actual.Constants) != len(expected.Constants) {
+			t.Fatalf("wrong number of constants. got=%d. expected=%d", len(actual.Constants), len(expected.Constants))
+		}
+
+		for i, constant := range expected.Constants {
+			switch constant := constant.(type) {
+			case *object.Integer:
+				err = testIntegerObject(constant.Value, actual.Constants[i])
+			case *object.String:
+				err = testStringObject(constant.Value, actual.Constants[i])
+			case *object.CompiledFunction:
+				fun, ok := actual.Constants[i].(*object.CompiledFunction)
+				if !ok {
+					t.Fatalf("constant %d - not a function. got=%T", i, actual.Constants[i])
+				}
+
+				if !reflect.DeepEqual(actual.Functions[i], expected.Functions[i]) {
+					t.Fatalf("constant %d - wrong function metadata. got=%+v. expected=%+v", i, actual.Functions[i], expected.Functions[i])
+				}
+
+				if fun.NumLocals != constant.NumLocals || fun.NumParameters != constant.NumParameters {
+					t.Fatalf("constant %d - wrong function metadata. got=%+v. expected=%+v", i, fun, constant)
+				}
+
+				err = testInstructions([]code.Instructions{constant.Instructions}, fun.Instructions)
+			}
+
+			if err != nil {
+				t.Fatalf("constant %d of %q failed with: %s", i, input, err)
+			}
+		}
+	}
+}
+
+func TestJSON_Format(t *testing.T) {
+	bytecode := &Bytecode{
+		Instructions: codetest.Make(code.OpConstant, 0),
+		Constants: []object.Object{
+			&object.Integer{Value: 5},
+			&object.CompiledFunction{Instructions: codetest.Make(code.OpReturn), NumLocals: 1},
+		},
+	}
+
+	var buf bytes.Buffer
+	err := EncodeJSON(&buf, bytecode)
+	if err != nil {
+		t.Fatalf("unable to encode. error=%q", err)
+	}
+
+	expected := `{
+  "version": 1,
+  "instructions": [
+    0,
+    0,
+    0
+  ],
+  "maxStackDepth": 0,
+  "constants": [
+    {
+      "kind": "integer",
+      "value": 5
+    },
+    {
+      "kind": "function",
+      "instructions": [
+        20
+      ],
+      "numLocals": 1
+    }
+  ],
+  "variables": []
+}
+`
+
+	if buf.String() != expected {
+		t.Fatalf("wrong json. got=\n%s\nexpected=\n%s", buf.String(), expected)
+	}
+}
+
+func TestJSON_DecodeErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{"version": 2}`, "unsupported bytecode version. got=2. expected=1"},
+		{`{"version": 1, "instructions": [256]}`, "instruction byte out of range at 0. got=256"},
+		{`{"version": 1, "constants": [{"kind": "complex"}]}`, "unable to decode constant 0. error=\"unknown constant kind \\\"complex\\\"\""},
+		{`{"version": 1, "constants": [{"kind": "float", "value": "1.5"}]}`, "unable to decode constant 0. error=\"json: cannot unmarshal string into Go value of type float64\""},
+	}
+
+	for _, tc := range tests {
+		_, err := DecodeJSON(strings.NewReader(tc.input))
+
+		if err == nil || err.Error() != tc.expected {
+			t.Errorf("incorrect error. got=%q. expected=%q", err, tc.expected)
+		}
+	}
+}
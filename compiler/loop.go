@@ -0,0 +1,158 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/ir"
+	"github.com/looplanguage/compiler/syntax"
+)
+
+// loop is a loop being compiled, break and continue statements jump out of it
+type loop struct {
+	// Offset continue jumps to
+	next int
+	// Jumps of the break statements, changed to the end of the loop once it
+	// is known
+	breaks []int
+
+	// Blocks continue and break jump to when the loop is lowered
+	nextBlock, end *ir.Block
+}
+
+func (c *Compiler) enterLoop(l *loop) {
+	scope := &c.scopes[c.scopeIndex]
+	scope.loops = append(scope.loops, l)
+}
+
+// leaveLoop ends the innermost loop, its break statements jump to end
+func (c *Compiler) leaveLoop(end int) {
+	scope := &c.scopes[c.scopeIndex]
+	l := scope.loops[len(scope.loops)-1]
+
+	for _, jump := range l.breaks {
+		c.changeOperand(jump, end)
+	}
+
+	scope.loops = scope.loops[:len(scope.loops)-1]
+}
+
+// innermostLoop returns the loop a break or continue statement belongs to,
+// loops outside of the current function don't count
+func (c *Compiler) innermostLoop(statement string) (*loop, error) {
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil, fmt.Errorf("%s outside of a loop", statement)
+	}
+
+	return loops[len(loops)-1], nil
+}
+
+func (c *Compiler) compileBreak() error {
+	l, err := c.innermostLoop("break")
+	if err != nil {
+		return err
+	}
+
+	l.breaks = append(l.breaks, c.emitJump(code.OpJump))
+
+	return nil
+}
+
+func (c *Compiler) compileContinue() error {
+	l, err := c.innermostLoop("continue")
+	if err != nil {
+		return err
+	}
+
+	c.emit(code.OpJump, l.next)
+
+	return nil
+}
+
+// lowerBreak is compileBreak for the intermediate representation
+func (c *Compiler) lowerBreak(b *ir.Builder) error {
+	l, err := c.innermostLoop("break")
+	if err != nil {
+		return err
+	}
+
+	b.Jump(l.end)
+
+	return nil
+}
+
+// lowerContinue is compileContinue for the intermediate representation
+func (c *Compiler) lowerContinue(b *ir.Builder) error {
+	l, err := c.innermostLoop("continue")
+	if err != nil {
+		return err
+	}
+
+	b.Jump(l.nextBlock)
+
+	return nil
+}
+
+// compileForEach compiles a for-each loop. The iterator stays on the stack
+// while the loop runs, OpIterNext pushes the values of the variables on top
+// of it. Like a while loop, the loop evaluates to null.
+func (c *Compiler) compileForEach(node *syntax.ForEach, root, previous string) error {
+	if len(node.Variables) != 1 && len(node.Variables) != 2 {
+		return fmt.Errorf("wrong number of loop variables. got=%d. expected=1 or 2", len(node.Variables))
+	}
+
+	err := c.Compile(node.Iterable, root, "", previous)
+	if err != nil {
+		return err
+	}
+
+	c.emit(code.OpIterInit)
+
+	// The variables are only visible in the loop
+	c.enterBlock()
+
+	var symbols []Symbol
+	for _, v := range node.Variables {
+		symbols = append(symbols, c.define(v.Value, root))
+	}
+
+	start := len(c.currentInstructions())
+	next := c.emitJump(code.OpIterNext, len(symbols))
+
+	// Every iteration has variables of its own, closures in the body capture
+	// the ones of their iteration
+	for i := len(symbols) - 1; i >= 0; i-- {
+		if symbols[i].Cell {
+			c.emit(code.OpSetLocal, symbols[i].Index)
+			c.emit(code.OpMakeCell, symbols[i].Index)
+		} else {
+			c.storeSymbol(symbols[i])
+		}
+	}
+
+	c.enterLoop(&loop{next: start})
+
+	err = c.Compile(node.Body, root, "", previous)
+	if err != nil {
+		return err
+	}
+
+	c.emit(code.OpJump, start)
+
+	// OpIterNext jumps here with nulls for the variables on top of the
+	// iterator, break statements once they are stored
+	c.changeOperand(next, len(c.currentInstructions()))
+	for range symbols {
+		c.emit(code.OpPop)
+	}
+
+	c.leaveLoop(len(c.currentInstructions()))
+	c.leaveBlock()
+
+	c.emit(code.OpPop)
+	c.emit(code.OpNull)
+
+	c.patchRootReturns()
+
+	return nil
+}
@@ -0,0 +1,543 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/ir"
+	"github.com/looplanguage/compiler/peephole"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/compiler/values"
+	"github.com/looplanguage/loop/models/ast"
+	"github.com/looplanguage/loop/models/object"
+)
+
+// constantPool gives the ir package access to the constants of the compiler.
+// While a function is optimized, the constants it adds are kept aside until
+// it is emitted, so the ones that are folded away never get into the pool.
+type constantPool struct {
+	c *Compiler
+	// Constants waiting to be added, the one at index i is loaded with the
+	// index -i-1. Nil if constants are added right away.
+	pending *[]object.Object
+}
+
+// constantPool returns the constants for lowering a function. Without passes
+// nothing is folded away, so constants are added right away, in the order
+// Compile adds them.
+func (c *Compiler) constantPool() constantPool {
+	if len(c.passes) == 0 {
+		return constantPool{c: c}
+	}
+
+	return constantPool{c: c, pending: &[]object.Object{}}
+}
+
+func (p constantPool) Constant(index int) object.Object {
+	if index < 0 {
+		return (*p.pending)[-index-1]
+	}
+
+	return p.c.constants[index]
+}
+
+func (p constantPool) AddConstant(obj object.Object) (int, error) {
+	if p.pending == nil {
+		return p.c.addConstant(obj)
+	}
+
+	*p.pending = append(*p.pending, obj)
+
+	return -len(*p.pending), nil
+}
+
+// add adds the pending constants that f still loads to the pool of the
+// compiler, every value once
+func (p constantPool) add(f *ir.Function) error {
+	reachable := ir.Reachable(f)
+
+	for _, block := range f.Blocks {
+		if !reachable[block] {
+			continue
+		}
+
+		for _, ins := range block.Instructions {
+			if ins.Op != code.OpConstant || ins.Operands[0] >= 0 {
+				continue
+			}
+
+			index, err := p.c.internConstant(p.Constant(ins.Operands[0]))
+			if err != nil {
+				return err
+			}
+
+			ins.Operands[0] = index
+		}
+	}
+
+	return nil
+}
+
+// canLower reports whether lower supports everything in node. Imports,
+// exports and returns outside of a function are only supported by Compile.
+// Functions are compiled on their own, so their bodies aren't checked.
+func canLower(node ast.Node, inFunction bool) bool {
+	all := func(nodes ...ast.Node) bool {
+		for _, n := range nodes {
+			if !canLower(n, inFunction) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			if !canLower(s, inFunction) {
+				return false
+			}
+		}
+
+		return true
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			if !canLower(s, inFunction) {
+				return false
+			}
+		}
+
+		return true
+	case *ast.ExpressionStatement:
+		return all(node.Expression)
+	case *ast.SuffixExpression:
+		return all(node.Left, node.Right)
+	case *ast.IntegerLiteral, *syntax.Float, *ast.String, *ast.Boolean, *ast.Identifier, *ast.Function, *syntax.Function:
+		return true
+	case *ast.While:
+		return all(node.Condition, node.Block)
+	case *syntax.Break, *syntax.Continue:
+		return true
+	case *syntax.Template:
+		for _, part := range node.Parts {
+			if !canLower(part, inFunction) {
+				return false
+			}
+		}
+
+		return true
+	case *ast.ConditionalStatement:
+		if node.ElseCondition != nil && !all(node.ElseCondition) {
+			return false
+		}
+
+		if node.ElseStatement != nil && !all(node.ElseStatement) {
+			return false
+		}
+
+		return all(node.Condition, node.Body)
+	case *ast.VariableDeclaration:
+		return all(node.Value)
+	case *syntax.FunctionDeclaration:
+		return true
+	case *syntax.ConstantDeclaration:
+		return all(node.Value)
+	case *ast.Assign:
+		return all(node.Value)
+	case *ast.IndexAssign:
+		return all(node.Value, node.Index, node.Object)
+	case *ast.Array:
+		for _, element := range node.Elements {
+			if !all(element) {
+				return false
+			}
+		}
+
+		return true
+	case *ast.IndexExpression:
+		return all(node.Value, node.Index)
+	case *ast.Hashmap:
+		for k, v := range node.Values {
+			if !all(k, v) {
+				return false
+			}
+		}
+
+		return true
+	case *ast.Return:
+		return inFunction && all(node.Value)
+	case *ast.CallExpression:
+		for _, arg := range node.Parameters {
+			if !all(arg) {
+				return false
+			}
+		}
+
+		return all(node.Function)
+	}
+
+	return false
+}
+
+// emitLowered optimizes a lowered function and appends its instructions to
+// the current scope, which has to be empty for the jump targets to be right
+func (c *Compiler) emitLowered(b *ir.Builder, constants constantPool) error {
+	if err := b.Err(); err != nil {
+		return err
+	}
+
+	err := ir.Optimize(b.Function, constants, c.passes)
+	if err != nil {
+		return err
+	}
+
+	err = constants.add(b.Function)
+	if err != nil {
+		return err
+	}
+
+	list, err := ir.Emit(b.Function)
+	if err != nil {
+		return err
+	}
+
+	instructions, err := peephole.Encode(list)
+	if err != nil {
+		return err
+	}
+
+	c.addInstruction(instructions)
+
+	return nil
+}
+
+// lower is Compile for the intermediate representation, it appends the
+// instructions for node to b
+func (c *Compiler) lower(b *ir.Builder, node ast.Node, root, previous string) error {
+	switch node := node.(type) {
+	case *ast.Program:
+		// Globals are never kept in a cell
+		_, err := c.hoist(node.Statements, root)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range node.Statements {
+			err := c.lower(b, s, root, previous)
+			if err != nil {
+				return err
+			}
+		}
+	case *ast.ExpressionStatement:
+		err := c.lower(b, node.Expression, root, previous)
+		if err != nil {
+			return err
+		}
+
+		b.Emit(code.OpPop)
+	case *ast.SuffixExpression:
+		op, ok := operators[node.Operator]
+		if !ok {
+			return fmt.Errorf("unknown operator: %s", node.Operator)
+		}
+
+		left, right := node.Left, node.Right
+		if node.Operator == "<" {
+			left, right = right, left
+		}
+
+		err := c.lower(b, left, root, previous)
+		if err != nil {
+			return err
+		}
+
+		err = c.lower(b, right, root, previous)
+		if err != nil {
+			return err
+		}
+
+		b.Emit(op)
+	case *ast.IntegerLiteral:
+		b.EmitConstant(&object.Integer{Value: node.Value})
+	case *syntax.Float:
+		b.EmitConstant(&values.Float{Value: node.Value})
+	case *ast.String:
+		b.EmitConstant(&object.String{Value: node.Value})
+	case *ast.Boolean:
+		if node.Value {
+			b.Emit(code.OpTrue)
+		} else {
+			b.Emit(code.OpFalse)
+		}
+	case *ast.While:
+		condition, body, after := b.NewBlock(), b.NewBlock(), b.NewBlock()
+
+		b.Jump(condition)
+		b.SetBlock(condition)
+
+		err := c.lower(b, node.Condition, root, previous)
+		if err != nil {
+			return err
+		}
+
+		b.Branch(body, after)
+		b.SetBlock(body)
+
+		c.enterLoop(&loop{nextBlock: condition, end: after})
+
+		err = c.lower(b, node.Block, root, previous)
+		if err != nil {
+			return err
+		}
+
+		c.leaveLoop(0)
+
+		b.Jump(condition)
+		b.SetBlock(after)
+
+		b.Emit(code.OpNull)
+	case *ast.ConditionalStatement:
+		err := c.lower(b, node.Condition, root, previous)
+		if err != nil {
+			return err
+		}
+
+		consequence, alternative, after := b.NewBlock(), b.NewBlock(), b.NewBlock()
+
+		b.Branch(consequence, alternative)
+		b.SetBlock(consequence)
+
+		err = c.lower(b, node.Body, root, previous)
+		if err != nil {
+			return err
+		}
+
+		keepLoweredValue(b)
+		b.Jump(after)
+		b.SetBlock(alternative)
+
+		if node.ElseCondition == nil && node.ElseStatement == nil {
+			b.Emit(code.OpNull)
+		} else if node.ElseCondition != nil {
+			err := c.lower(b, node.ElseCondition, root, previous)
+			if err != nil {
+				return err
+			}
+
+			b.RemoveLastPop()
+		} else if node.ElseStatement != nil {
+			err := c.lower(b, node.ElseStatement, root, previous)
+			if err != nil {
+				return err
+			}
+
+			keepLoweredValue(b)
+		}
+
+		b.Jump(after)
+		b.SetBlock(after)
+	case *ast.BlockStatement:
+		c.enterBlock()
+
+		cells, err := c.hoist(node.Statements, root)
+		if err != nil {
+			return err
+		}
+
+		for _, index := range cells {
+			b.Emit(code.OpMakeCell, index)
+		}
+
+		for _, s := range node.Statements {
+			err := c.lower(b, s, root, previous)
+			if err != nil {
+				return err
+			}
+		}
+		c.leaveBlock()
+	case *ast.VariableDeclaration:
+		symbol := c.define(node.Identifier.Value, root)
+
+		return c.lowerDeclaration(b, node, symbol, root, previous)
+	case *syntax.FunctionDeclaration:
+		return c.lowerFunctionDeclaration(b, node, root, previous)
+	case *syntax.ConstantDeclaration:
+		symbol, err := c.defineConstant(node.Identifier.Value, root, c.constantValue(node.Value, root))
+		if err != nil || symbol.Scope == ConstantScope {
+			return err
+		}
+
+		return c.lowerDeclaration(b, &node.VariableDeclaration, symbol, root, previous)
+	case *ast.Assign:
+		symbol, err := c.assignee(node.Identifier.Value, root)
+		if err != nil {
+			return err
+		}
+
+		err = c.lower(b, node.Value, root, previous)
+		if err != nil {
+			return err
+		}
+
+		lowerStoreSymbol(b, symbol)
+	case *ast.IndexAssign:
+		for _, n := range []ast.Node{node.Value, node.Index, node.Object} {
+			err := c.lower(b, n, root, "")
+			if err != nil {
+				return err
+			}
+		}
+
+		b.Emit(code.OpSetIndex)
+	case *ast.Identifier:
+		symbol, ok := c.resolve(node.Value, root)
+		if !ok {
+			return fmt.Errorf("undefined variable %s", node.Value)
+		}
+
+		lowerLoadSymbol(b, symbol)
+	case *ast.Array:
+		for _, element := range node.Elements {
+			err := c.lower(b, element, root, previous)
+			if err != nil {
+				return err
+			}
+		}
+
+		b.Emit(code.OpArray, len(node.Elements))
+	case *ast.IndexExpression:
+		err := c.lower(b, node.Value, root, previous)
+		if err != nil {
+			return err
+		}
+
+		err = c.lower(b, node.Index, root, previous)
+		if err != nil {
+			return err
+		}
+
+		b.Emit(code.OpIndex)
+	case *ast.Hashmap:
+		for _, k := range sortedKeys(node) {
+			err := c.lower(b, k, root, previous)
+			if err != nil {
+				return err
+			}
+
+			err = c.lower(b, node.Values[k], root, previous)
+			if err != nil {
+				return err
+			}
+		}
+
+		b.Emit(code.OpHash, len(node.Values)*2)
+	case *ast.Function, *syntax.Function:
+		function, _ := functionOf(node)
+
+		index, freeSymbols, err := c.compileFunction(function, root, previous)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range freeSymbols {
+			b.Emit(symbolInstruction(s))
+		}
+
+		op, operands := closureInstruction(index, freeSymbols)
+		b.Emit(op, operands...)
+	case *syntax.Template:
+		return c.lowerTemplate(b, node, root, previous)
+	case *syntax.Break:
+		return c.lowerBreak(b)
+	case *syntax.Continue:
+		return c.lowerContinue(b)
+	case *ast.Return:
+		if c.currentScope.Outer == nil {
+			return fmt.Errorf("cannot have return statement in root scope")
+		}
+
+		err := c.lower(b, node.Value, root, previous)
+		if err != nil {
+			return err
+		}
+
+		b.ReturnValue()
+	case *ast.CallExpression:
+		if c.isTailCall(node) {
+			return c.lowerTailCall(b, node, root, previous)
+		}
+
+		if inlined, err := c.inlineCall(b, node, root, previous); inlined || err != nil {
+			return err
+		}
+
+		err := c.lower(b, node.Function, root, previous)
+		if err != nil {
+			return err
+		}
+
+		for _, arg := range node.Parameters {
+			err := c.lower(b, arg, root, previous)
+			if err != nil {
+				return err
+			}
+		}
+
+		b.Emit(code.OpCall, len(node.Parameters))
+	default:
+		return fmt.Errorf("can not lower %T", node)
+	}
+
+	return nil
+}
+
+// lowerDeclaration is compileDeclaration for the intermediate representation
+func (c *Compiler) lowerDeclaration(b *ir.Builder, node *ast.VariableDeclaration, symbol Symbol, root, previous string) error {
+	if _, ok := functionOf(node.Value); ok {
+		c.declaring = &symbol
+		c.functionName = node.Identifier.Value
+	}
+
+	if symbol.Cell {
+		b.Emit(code.OpMakeCell, symbol.Index)
+	}
+
+	err := c.lower(b, node.Value, root, previous)
+	if err != nil {
+		return err
+	}
+
+	lowerStoreSymbol(b, symbol)
+	c.registerInlineCandidate(symbol, node, root)
+
+	return nil
+}
+
+// keepLoweredValue is keepBlockValue for the intermediate representation
+func keepLoweredValue(b *ir.Builder) {
+	if !b.RemoveLastPop() && b.Reachable() {
+		b.Emit(code.OpNull)
+	}
+}
+
+// lowerLoadSymbol is loadSymbol for the intermediate representation
+func lowerLoadSymbol(b *ir.Builder, s Symbol) {
+	b.Emit(symbolInstruction(s))
+
+	if s.Cell {
+		b.Emit(code.OpLoadCell)
+	}
+}
+
+// lowerStoreSymbol is storeSymbol for the intermediate representation
+func lowerStoreSymbol(b *ir.Builder, s Symbol) {
+	switch {
+	case s.Cell:
+		b.Emit(symbolInstruction(s))
+		b.Emit(code.OpStoreCell)
+	case s.Scope == GlobalScope:
+		b.Emit(code.OpSetVar, s.Index)
+	default:
+		b.Emit(code.OpSetLocal, s.Index)
+	}
+}
@@ -0,0 +1,568 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/values"
+	"github.com/looplanguage/loop/models/object"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// machine is a small stack machine for the tests, it runs bytecode to check
+// that optimized programs behave the same as unoptimized ones
+type machine struct {
+	constants []object.Object
+	functions map[*object.CompiledFunction]FunctionMetadata
+	variables map[int]object.Object
+	globals   map[int]object.Object
+	stack     []object.Object
+	// Everything printed by the print builtin
+	output []string
+	// Calls executed, including the ones still running
+	calls int
+	// Instructions executed
+	dispatches int
+	// Deepest the calls got
+	depth, maxDepth int
+}
+
+type closure struct {
+	function *object.CompiledFunction
+	free     []object.Object
+}
+
+func (c *closure) Type() object.ObjectType { return object.CLOSURE }
+func (c *closure) Inspect() string         { return "closure" }
+
+// cell holds a local shared by a function and its closures
+type cell struct {
+	value object.Object
+}
+
+func (c *cell) Type() object.ObjectType { return "CELL" }
+func (c *cell) Inspect() string         { return "cell" }
+
+// iterator walks over the elements of an array or the pairs of a hashmap,
+// hashmaps in the order of their keys
+type iterator struct {
+	keys, values []object.Object
+	next         int
+	// A single variable is set to the keys of a hashmap, but to the values
+	// of an array
+	hashmap bool
+}
+
+func (i *iterator) Type() object.ObjectType { return "ITERATOR" }
+func (i *iterator) Inspect() string         { return "iterator" }
+
+type builtin struct {
+	index int
+}
+
+func (b *builtin) Type() object.ObjectType { return object.BUILTIN }
+func (b *builtin) Inspect() string         { return object.Builtins[b.index].Name }
+
+// maxSteps stops programs that don't terminate
+const maxSteps = 1000000
+
+// run executes a program on a new machine
+func run(bytecode *Bytecode) (*machine, error) {
+	m := &machine{
+		constants: bytecode.Constants,
+		functions: map[*object.CompiledFunction]FunctionMetadata{},
+		variables: map[int]object.Object{},
+		globals:   map[int]object.Object{},
+	}
+
+	for index, metadata := range bytecode.Functions {
+		m.functions[bytecode.Constants[index].(*object.CompiledFunction)] = metadata
+	}
+
+	_, err := m.execute(bytecode.Instructions, nil, nil, 0, &m.dispatches)
+
+	return m, err
+}
+
+func (m *machine) push(obj object.Object) {
+	m.stack = append(m.stack, obj)
+}
+
+func (m *machine) pop() object.Object {
+	obj := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+
+	return obj
+}
+
+// execute runs instructions, arguments is how many the call passed
+func (m *machine) execute(ins code.Instructions, locals, free []object.Object, arguments int, steps *int) (object.Object, error) {
+	base := len(m.stack)
+
+	for ip := 0; ip < len(ins); {
+		*steps++
+		if *steps > maxSteps {
+			return nil, fmt.Errorf("program doesn't terminate")
+		}
+
+		instruction, err := code.ReadInstruction(ins, ip)
+		if err != nil {
+			return nil, err
+		}
+
+		ip += instruction.Size
+		operands := instruction.Operands
+
+		switch instruction.Op {
+		case code.OpConstant:
+			m.push(m.constants[operands[0]])
+		case code.OpTrue:
+			m.push(&object.Boolean{Value: true})
+		case code.OpFalse:
+			m.push(&object.Boolean{Value: false})
+		case code.OpNull:
+			m.push(&object.Null{})
+		case code.OpPop:
+			m.pop()
+		case code.OpAdd, code.OpSubtract, code.OpMultiply, code.OpDivide, code.OpEquals, code.OpNotEquals, code.OpGreaterThan:
+			right, left := m.pop(), m.pop()
+
+			result, err := binary(instruction.Op, left, right)
+			if err != nil {
+				return nil, err
+			}
+
+			m.push(result)
+		case code.OpJump:
+			ip = operands[0]
+		case code.OpJumpIfArgument:
+			if operands[0] < arguments {
+				ip = operands[1]
+			}
+		case code.OpJumpIfNotTrue:
+			if condition, ok := m.pop().(*object.Boolean); !ok || !condition.Value {
+				ip = operands[0]
+			}
+		case code.OpSetVar:
+			m.variables[operands[0]] = m.pop()
+		case code.OpGetVar:
+			m.push(m.variable(m.variables, operands[0]))
+		case code.OpSetGlobal:
+			m.globals[operands[0]] = m.pop()
+		case code.OpGetGlobal:
+			m.push(m.variable(m.globals, operands[0]))
+		case code.OpSetLocal:
+			locals[operands[0]] = m.pop()
+		case code.OpGetLocal:
+			m.push(locals[operands[0]])
+		case code.OpGetFree:
+			m.push(free[operands[0]])
+		case code.OpGetBuiltinFunction:
+			m.push(&builtin{index: operands[0]})
+		case code.OpIncrementVar:
+			result, err := binary(code.OpAdd, m.variable(m.variables, operands[1]), m.constants[operands[0]])
+			if err != nil {
+				return nil, err
+			}
+
+			m.variables[operands[1]] = result
+		case code.OpJumpIfVarNotGreater, code.OpJumpIfConstantNotGreater:
+			left, right := m.variable(m.variables, operands[1]), m.constants[operands[0]]
+			if instruction.Op == code.OpJumpIfConstantNotGreater {
+				left, right = right, left
+			}
+
+			result, err := binary(code.OpGreaterThan, left, right)
+			if err != nil {
+				return nil, err
+			}
+
+			if !result.(*object.Boolean).Value {
+				ip = operands[2]
+			}
+		case code.OpArray:
+			elements := append([]object.Object{}, m.stack[len(m.stack)-operands[0]:]...)
+			m.stack = m.stack[:len(m.stack)-operands[0]]
+
+			m.push(&object.Array{Elements: elements})
+		case code.OpHash:
+			values := map[object.HashKey]object.HashPair{}
+
+			for i := len(m.stack) - operands[0]; i < len(m.stack); i += 2 {
+				values[hashKey(m.stack[i])] = object.HashPair{Key: m.stack[i], Value: m.stack[i+1]}
+			}
+
+			m.stack = m.stack[:len(m.stack)-operands[0]]
+			m.push(&object.Hashmap{Values: values})
+		case code.OpIndex:
+			index, value := m.pop(), m.pop()
+
+			result, err := m.index(value, index)
+			if err != nil {
+				return nil, err
+			}
+
+			m.push(result)
+		case code.OpSetIndex:
+			obj, index, value := m.pop(), m.pop(), m.pop()
+
+			switch obj := obj.(type) {
+			case *object.Array:
+				obj.Elements[index.(*object.Integer).Value] = value
+			case *object.Hashmap:
+				obj.Values[hashKey(index)] = object.HashPair{Key: index, Value: value}
+			default:
+				return nil, fmt.Errorf("cannot assign to an index of %s", obj.Type())
+			}
+		case code.OpClosure:
+			captured := append([]object.Object{}, m.stack[len(m.stack)-operands[1]:]...)
+			m.stack = m.stack[:len(m.stack)-operands[1]]
+
+			m.push(&closure{function: m.constants[operands[0]].(*object.CompiledFunction), free: captured})
+		case code.OpMakeCell:
+			locals[operands[0]] = &cell{value: locals[operands[0]]}
+		case code.OpLoadCell:
+			m.push(m.pop().(*cell).value)
+		case code.OpStoreCell:
+			c := m.pop().(*cell)
+			c.value = m.pop()
+		case code.OpConcat:
+			var out strings.Builder
+			for _, value := range m.stack[len(m.stack)-operands[0]:] {
+				out.WriteString(value.Inspect())
+			}
+
+			m.stack = m.stack[:len(m.stack)-operands[0]]
+			m.push(&object.String{Value: out.String()})
+		case code.OpJumpTable:
+			value := m.pop()
+
+			entries, err := code.TableEntries(ins, instruction, ip-instruction.Size)
+			if err != nil {
+				return nil, err
+			}
+
+			ip = operands[2]
+
+			for k, element := range m.constants[operands[0]].(*object.Array).Elements {
+				if equal, _ := binary(code.OpEquals, value, element); equal.(*object.Boolean).Value {
+					ip = entries[k]
+					break
+				}
+			}
+		case code.OpMatchArray:
+			array, ok := m.pop().(*object.Array)
+			if ok {
+				ok = len(array.Elements) == operands[0] || (operands[1] == 1 && len(array.Elements) > operands[0])
+			}
+
+			m.push(&object.Boolean{Value: ok})
+		case code.OpMatchKey:
+			key := m.pop()
+			hashmap, ok := m.pop().(*object.Hashmap)
+			if ok {
+				_, ok = hashmap.Values[hashKey(key)]
+			}
+
+			m.push(&object.Boolean{Value: ok})
+		case code.OpSlice:
+			value := m.pop()
+
+			array, ok := value.(*object.Array)
+			if !ok {
+				return nil, fmt.Errorf("cannot slice %s", value.Type())
+			}
+
+			elements := []object.Object{}
+			if operands[0] < len(array.Elements) {
+				elements = append(elements, array.Elements[operands[0]:]...)
+			}
+
+			m.push(&object.Array{Elements: elements})
+		case code.OpIterInit:
+			it, err := iterate(m.pop())
+			if err != nil {
+				return nil, err
+			}
+
+			m.push(it)
+		case code.OpIterNext:
+			it := m.stack[len(m.stack)-1].(*iterator)
+
+			if it.next == len(it.values) {
+				for i := 0; i < operands[0]; i++ {
+					m.push(&object.Null{})
+				}
+
+				ip = operands[1]
+				continue
+			}
+
+			switch {
+			case operands[0] == 2:
+				m.push(it.keys[it.next])
+				m.push(it.values[it.next])
+			case it.hashmap:
+				m.push(it.keys[it.next])
+			default:
+				m.push(it.values[it.next])
+			}
+
+			it.next++
+		case code.OpCall:
+			result, err := m.call(operands[0], steps)
+			if err != nil {
+				return nil, err
+			}
+
+			m.push(result)
+		case code.OpTailCall:
+			// The called function takes the place of the current one
+			m.depth--
+			result, err := m.call(operands[0], steps)
+			m.depth++
+
+			return result, err
+		case code.OpReturnValue:
+			return m.pop(), nil
+		case code.OpReturn:
+			// The value of the last expression is left on the stack
+			if len(m.stack) > base {
+				return m.pop(), nil
+			}
+
+			return &object.Null{}, nil
+		default:
+			return nil, fmt.Errorf("unsupported instruction %s", instruction.Def.Name)
+		}
+	}
+
+	return nil, nil
+}
+
+func (m *machine) variable(variables map[int]object.Object, index int) object.Object {
+	if obj, ok := variables[index]; ok {
+		return obj
+	}
+
+	return &object.Null{}
+}
+
+func (m *machine) call(arguments int, steps *int) (object.Object, error) {
+	args := append([]object.Object{}, m.stack[len(m.stack)-arguments:]...)
+	callee := m.stack[len(m.stack)-arguments-1]
+	m.stack = m.stack[:len(m.stack)-arguments-1]
+
+	m.calls++
+
+	// Functions that capture nothing are called without a closure
+	if function, ok := callee.(*object.CompiledFunction); ok {
+		callee = &closure{function: function}
+	}
+
+	switch callee := callee.(type) {
+	case *builtin:
+		switch object.Builtins[callee.index].Name {
+		case "print":
+			var out []string
+			for _, arg := range args {
+				out = append(out, arg.Inspect())
+			}
+
+			m.output = append(m.output, strings.Join(out, " "))
+
+			return &object.Null{}, nil
+		case "len":
+			switch arg := args[0].(type) {
+			case *object.String:
+				return &object.Integer{Value: int64(len(arg.Value))}, nil
+			case *object.Array:
+				return &object.Integer{Value: int64(len(arg.Elements))}, nil
+			}
+
+			return nil, fmt.Errorf("len does not accept %s", args[0].Type())
+		}
+	case *closure:
+		metadata := m.functions[callee.function]
+
+		min, max := metadata.Arity(callee.function)
+		switch {
+		case max < 0 && len(args) < min:
+			return nil, fmt.Errorf("wrong number of arguments. got=%d. expected at least %d", len(args), min)
+		case max >= 0 && min != max && (len(args) < min || len(args) > max):
+			return nil, fmt.Errorf("wrong number of arguments. got=%d. expected %d to %d", len(args), min, max)
+		case max >= 0 && min == max && len(args) != max:
+			return nil, fmt.Errorf("wrong number of arguments. got=%d. expected=%d", len(args), max)
+		}
+
+		// Parameters without an argument are null until their default is
+		// stored, the arguments after the other parameters are the array
+		// of the variadic one
+		locals := make([]object.Object, callee.function.NumLocals)
+		parameters := callee.function.NumParameters
+		for i := 0; i < parameters; i++ {
+			locals[i] = &object.Null{}
+		}
+
+		if metadata.Variadic {
+			rest := &object.Array{Elements: []object.Object{}}
+			if len(args) >= parameters {
+				rest.Elements = append(rest.Elements, args[parameters-1:]...)
+				args = args[:parameters-1]
+			}
+
+			locals[parameters-1] = rest
+		}
+
+		copy(locals, args)
+
+		m.depth++
+		if m.depth > m.maxDepth {
+			m.maxDepth = m.depth
+		}
+
+		// Returning discards what the function left on the stack, like the
+		// iterators of the loops it returns from
+		size := len(m.stack)
+		result, err := m.execute(callee.function.Instructions, locals, callee.free, len(args), steps)
+		m.stack = m.stack[:size]
+		m.depth--
+
+		return result, err
+	}
+
+	return nil, fmt.Errorf("cannot call %s", callee.Type())
+}
+
+func iterate(obj object.Object) (*iterator, error) {
+	it := &iterator{}
+
+	switch obj := obj.(type) {
+	case *object.Array:
+		for i, element := range obj.Elements {
+			it.keys = append(it.keys, &object.Integer{Value: int64(i)})
+			it.values = append(it.values, element)
+		}
+	case *object.Hashmap:
+		it.hashmap = true
+
+		pairs := make([]object.HashPair, 0, len(obj.Values))
+		for _, pair := range obj.Values {
+			pairs = append(pairs, pair)
+		}
+
+		sort.Slice(pairs, func(i, j int) bool {
+			return pairs[i].Key.Inspect() < pairs[j].Key.Inspect()
+		})
+
+		for _, pair := range pairs {
+			it.keys = append(it.keys, pair.Key)
+			it.values = append(it.values, pair.Value)
+		}
+	default:
+		return nil, fmt.Errorf("cannot iterate over %s", obj.Type())
+	}
+
+	return it, nil
+}
+
+func (m *machine) index(value, index object.Object) (object.Object, error) {
+	switch value := value.(type) {
+	case *object.Array:
+		i, ok := index.(*object.Integer)
+		if !ok || i.Value < 0 || int(i.Value) >= len(value.Elements) {
+			return &object.Null{}, nil
+		}
+
+		return value.Elements[i.Value], nil
+	case *object.Hashmap:
+		if pair, ok := value.Values[hashKey(index)]; ok {
+			return pair.Value, nil
+		}
+
+		return &object.Null{}, nil
+	}
+
+	return nil, fmt.Errorf("cannot index %s", value.Type())
+}
+
+func hashKey(obj object.Object) object.HashKey {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(obj.Inspect()))
+
+	return object.HashKey{Type: obj.Type(), Value: h.Sum64()}
+}
+
+func binary(op code.OpCode, left, right object.Object) (object.Object, error) {
+	if l, r, ok := values.Floats(left, right); ok {
+		return binaryFloats(op, l, r)
+	}
+
+	switch op {
+	case code.OpEquals:
+		return &object.Boolean{Value: left.Type() == right.Type() && left.Inspect() == right.Inspect()}, nil
+	case code.OpNotEquals:
+		return &object.Boolean{Value: left.Type() != right.Type() || left.Inspect() != right.Inspect()}, nil
+	}
+
+	switch left := left.(type) {
+	case *object.Integer:
+		right, ok := right.(*object.Integer)
+		if !ok {
+			break
+		}
+
+		switch op {
+		case code.OpAdd:
+			return &object.Integer{Value: left.Value + right.Value}, nil
+		case code.OpSubtract:
+			return &object.Integer{Value: left.Value - right.Value}, nil
+		case code.OpMultiply:
+			return &object.Integer{Value: left.Value * right.Value}, nil
+		case code.OpDivide:
+			if right.Value == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+
+			return &object.Integer{Value: left.Value / right.Value}, nil
+		case code.OpGreaterThan:
+			return &object.Boolean{Value: left.Value > right.Value}, nil
+		}
+	case *object.String:
+		if right, ok := right.(*object.String); ok && op == code.OpAdd {
+			return &object.String{Value: left.Value + right.Value}, nil
+		}
+	}
+
+	def, _ := code.Lookup(byte(op))
+
+	return nil, fmt.Errorf("unsupported operation %s on %s and %s", def.Name, left.Type(), right.Type())
+}
+
+func binaryFloats(op code.OpCode, left, right float64) (object.Object, error) {
+	switch op {
+	case code.OpAdd:
+		return &values.Float{Value: left + right}, nil
+	case code.OpSubtract:
+		return &values.Float{Value: left - right}, nil
+	case code.OpMultiply:
+		return &values.Float{Value: left * right}, nil
+	case code.OpDivide:
+		if right == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+
+		return &values.Float{Value: left / right}, nil
+	case code.OpEquals:
+		return &object.Boolean{Value: left == right}, nil
+	case code.OpNotEquals:
+		return &object.Boolean{Value: left != right}, nil
+	case code.OpGreaterThan:
+		return &object.Boolean{Value: left > right}, nil
+	}
+
+	def, _ := code.Lookup(byte(op))
+
+	return nil, fmt.Errorf("unsupported operation %s on floats", def.Name)
+}
@@ -0,0 +1,349 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+	"github.com/looplanguage/loop/models/object"
+)
+
+// minTableArms is the fewest literal arms a match needs to be compiled to a
+// jump table, fewer are compared one after the other
+const minTableArms = 3
+
+// subjectName is the name the subject of a match is stored as, it can't be
+// written in a program
+const subjectName = "$match"
+
+// compileMatch compiles a match expression. The subject is stored in a hidden
+// variable so the patterns can load it as often as they need, and like a
+// conditional every arm leaves its value on the stack.
+func (c *Compiler) compileMatch(node *syntax.Match, root, previous string) error {
+	err := c.Compile(node.Subject, root, "", previous)
+	if err != nil {
+		return err
+	}
+
+	c.enterBlock()
+
+	subject := c.define(subjectName, root)
+	c.storeSymbol(subject)
+
+	load := func() { c.loadSymbol(subject) }
+
+	if table, ok := c.jumpTable(node, root); ok {
+		err = c.compileJumpTable(node, table, load, root, previous)
+	} else {
+		err = c.compileArms(node.Arms, load, root, previous)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.leaveBlock()
+	c.patchRootReturns()
+
+	return nil
+}
+
+// jumpTable returns the values of the literal arms of a match that can be
+// compiled to OpJumpTable. Those are at least minTableArms distinct integers
+// that aren't spread out over more than twice their number, or distinct
+// strings, optionally followed by a single arm matching everything.
+func (c *Compiler) jumpTable(node *syntax.Match, root string) (*object.Array, bool) {
+	arms := node.Arms
+	if len(arms) > 0 && irrefutable(arms[len(arms)-1].Pattern) {
+		arms = arms[:len(arms)-1]
+	}
+
+	if len(arms) < minTableArms {
+		return nil, false
+	}
+
+	table := &object.Array{}
+	seen := map[string]bool{}
+
+	var kind object.ObjectType
+	var min, max int64
+
+	for i, arm := range arms {
+		literal, ok := arm.Pattern.(*syntax.LiteralPattern)
+		if !ok {
+			return nil, false
+		}
+
+		value := c.constantValue(literal.Value, root)
+		if value == nil || (i > 0 && value.Type() != kind) || seen[value.Inspect()] {
+			return nil, false
+		}
+
+		kind = value.Type()
+		seen[value.Inspect()] = true
+
+		switch value := value.(type) {
+		case *object.Integer:
+			if i == 0 || value.Value < min {
+				min = value.Value
+			}
+
+			if i == 0 || value.Value > max {
+				max = value.Value
+			}
+		case *object.String:
+		default:
+			return nil, false
+		}
+
+		table.Elements = append(table.Elements, value)
+	}
+
+	if kind == object.INTEGER && max-min+1 > int64(2*len(arms)) {
+		return nil, false
+	}
+
+	return table, true
+}
+
+// compileJumpTable compiles the arms of a match found by jumpTable. The table
+// is followed by a jump to the body of every literal arm, the body of the
+// last arm matching everything is where the table jumps to when none of the
+// values is equal to the subject.
+func (c *Compiler) compileJumpTable(node *syntax.Match, table *object.Array, load func(), root, previous string) error {
+	index, err := c.addConstant(table)
+	if err != nil {
+		return err
+	}
+
+	load()
+	lookup := c.emitJump(code.OpJumpTable, index, len(table.Elements))
+
+	var entries []int
+	for range table.Elements {
+		entries = append(entries, c.emitJump(code.OpJump))
+	}
+
+	var ends []int
+	for i, entry := range entries {
+		c.changeOperand(entry, len(c.currentInstructions()))
+
+		err := c.Compile(node.Arms[i].Body, root, "", previous)
+		if err != nil {
+			return err
+		}
+
+		c.keepBlockValue()
+		ends = append(ends, c.emitJump(code.OpJump))
+	}
+
+	c.changeOperand(lookup, len(c.currentInstructions()))
+
+	if len(node.Arms) > len(entries) {
+		err := c.compileArms(node.Arms[len(entries):], load, root, previous)
+		if err != nil {
+			return err
+		}
+	} else {
+		c.emit(code.OpNull)
+	}
+
+	for _, end := range ends {
+		c.changeOperand(end, len(c.currentInstructions()))
+	}
+
+	return nil
+}
+
+// compileArms compiles arms that are tried one after the other, a pattern
+// that doesn't match jumps to the next arm. Without a matching arm the match
+// evaluates to null.
+func (c *Compiler) compileArms(arms []*syntax.Arm, load func(), root, previous string) error {
+	var ends []int
+
+	for _, arm := range arms {
+		// Variables bound by the pattern are only visible in its arm
+		c.enterBlock()
+
+		var fails []int
+		err := c.compilePattern(arm.Pattern, load, &fails, root, previous)
+		if err != nil {
+			return err
+		}
+
+		err = c.Compile(arm.Body, root, "", previous)
+		if err != nil {
+			return err
+		}
+
+		c.keepBlockValue()
+		c.leaveBlock()
+
+		// Nothing after an arm matching everything is reached
+		if len(fails) == 0 {
+			for _, end := range ends {
+				c.changeOperand(end, len(c.currentInstructions()))
+			}
+
+			return nil
+		}
+
+		ends = append(ends, c.emitJump(code.OpJump))
+
+		for _, fail := range fails {
+			c.changeOperand(fail, len(c.currentInstructions()))
+		}
+	}
+
+	c.emit(code.OpNull)
+
+	for _, end := range ends {
+		c.changeOperand(end, len(c.currentInstructions()))
+	}
+
+	return nil
+}
+
+// compilePattern checks whether the value load pushes matches a pattern and
+// stores the parts it binds. The jumps taken when it doesn't match are
+// appended to fails, they leave the stack as it was.
+func (c *Compiler) compilePattern(pattern syntax.Pattern, load func(), fails *[]int, root, previous string) error {
+	switch pattern := pattern.(type) {
+	case *syntax.WildcardPattern:
+		return nil
+	case *syntax.BindingPattern:
+		symbol := c.define(pattern.Name.Value, root)
+
+		if symbol.Cell {
+			c.emit(code.OpMakeCell, symbol.Index)
+		}
+
+		load()
+		c.storeSymbol(symbol)
+
+		return nil
+	case *syntax.LiteralPattern:
+		load()
+
+		err := c.compilePatternValue(pattern.Value, root, previous)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpEquals)
+		*fails = append(*fails, c.emitJump(code.OpJumpIfNotTrue))
+
+		return nil
+	case *syntax.ArrayPattern:
+		// With a rest element the array can be longer
+		rest := 0
+		if pattern.Rest != nil {
+			rest = 1
+		}
+
+		load()
+		c.emit(code.OpMatchArray, len(pattern.Elements), rest)
+		*fails = append(*fails, c.emitJump(code.OpJumpIfNotTrue))
+
+		for i, element := range pattern.Elements {
+			if _, ok := element.(*syntax.WildcardPattern); ok {
+				continue
+			}
+
+			index, err := c.internConstant(&object.Integer{Value: int64(i)})
+			if err != nil {
+				return err
+			}
+
+			err = c.compilePattern(element, c.indexed(load, func() { c.emit(code.OpConstant, index) }), fails, root, previous)
+			if err != nil {
+				return err
+			}
+		}
+
+		if pattern.Rest != nil {
+			sliced := func() {
+				load()
+				c.emit(code.OpSlice, len(pattern.Elements))
+			}
+
+			return c.compilePattern(&syntax.BindingPattern{Name: pattern.Rest}, sliced, fails, root, previous)
+		}
+
+		return nil
+	case *syntax.HashPattern:
+		if len(pattern.Keys) == 0 {
+			return fmt.Errorf("hash pattern without keys")
+		}
+
+		for _, key := range pattern.Keys {
+			load()
+
+			err := c.compilePatternValue(key, root, previous)
+			if err != nil {
+				return err
+			}
+
+			c.emit(code.OpMatchKey)
+			*fails = append(*fails, c.emitJump(code.OpJumpIfNotTrue))
+		}
+
+		for i, value := range pattern.Values {
+			key := pattern.Keys[i]
+			loadKey := func() {
+				if err := c.compilePatternValue(key, root, previous); err != nil {
+					c.fail(err)
+				}
+			}
+
+			err := c.compilePattern(value, c.indexed(load, loadKey), fails, root, previous)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown pattern %T", pattern)
+}
+
+// compilePatternValue compiles a value compared with or used as a key by a
+// pattern. Patterns load the same values again and again, so values known at
+// compile time share a constant.
+func (c *Compiler) compilePatternValue(node ast.Expression, root, previous string) error {
+	if value := c.constantValue(node, root); value != nil {
+		if _, ok := value.(*object.Boolean); !ok {
+			index, err := c.internConstant(value)
+			if err != nil {
+				return err
+			}
+
+			c.emit(code.OpConstant, index)
+
+			return nil
+		}
+	}
+
+	return c.Compile(node, root, "", previous)
+}
+
+// indexed returns a function loading the element of the value load pushes
+// at the index loadIndex pushes
+func (c *Compiler) indexed(load, loadIndex func()) func() {
+	return func() {
+		load()
+		loadIndex()
+		c.emit(code.OpIndex)
+	}
+}
+
+// irrefutable reports whether a pattern matches every value
+func irrefutable(pattern syntax.Pattern) bool {
+	switch pattern.(type) {
+	case *syntax.WildcardPattern, *syntax.BindingPattern:
+		return true
+	}
+
+	return false
+}
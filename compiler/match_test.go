@@ -0,0 +1,373 @@
+package compiler
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"github.com/looplanguage/compiler/peephole"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+	"testing"
+)
+
+// parseMatches parses input with every match(subject, pattern, fun() { body },
+// ...) turned into a match expression, the parser doesn't know them yet. The
+// pattern _ matches everything, other names are bound and arrays and
+// hashmaps are destructured. rest(name) is the rest element of an array.
+func parseMatches(input string) *ast.Program {
+	return parseCalls(input, "match", func(call *ast.CallExpression) ast.Expression {
+		match := &syntax.Match{Subject: call.Parameters[0]}
+
+		for i := 1; i+1 < len(call.Parameters); i += 2 {
+			match.Arms = append(match.Arms, &syntax.Arm{
+				Pattern: pattern(call.Parameters[i]),
+				Body:    call.Parameters[i+1].(*ast.Function).Body,
+			})
+		}
+
+		return match
+	})
+}
+
+func pattern(e ast.Expression) syntax.Pattern {
+	switch e := e.(type) {
+	case *ast.Identifier:
+		if e.Value == "_" {
+			return &syntax.WildcardPattern{}
+		}
+
+		return &syntax.BindingPattern{Name: e}
+	case *ast.Array:
+		p := &syntax.ArrayPattern{}
+		for _, element := range e.Elements {
+			if call, ok := element.(*ast.CallExpression); ok && call.Function.String() == "rest" {
+				p.Rest = call.Parameters[0].(*ast.Identifier)
+				continue
+			}
+
+			p.Elements = append(p.Elements, pattern(element))
+		}
+
+		return p
+	case *ast.Hashmap:
+		p := &syntax.HashPattern{}
+		for _, key := range sortedKeys(e) {
+			p.Keys = append(p.Keys, key)
+			p.Values = append(p.Values, pattern(e.Values[key]))
+		}
+
+		return p
+	}
+
+	return &syntax.LiteralPattern{Value: e}
+}
+
+func TestCompiler_Match(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// Dense integers are looked up in a jump table
+			input:             `var x = 2; match(x, 1, fun() { "a" }, 2, fun() { "b" }, 3, fun() { "c" }, _, fun() { "d" })`,
+			expectedConstants: []interface{}{2, []interface{}{1, 2, 3}, "a", "b", "c", "d"},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpSetVar, 1),
+				codetest.Make(code.OpGetVar, 1),
+				codetest.Make(code.OpJumpTable, 1, 3, 49),
+				codetest.Make(code.OpJump, 31),
+				codetest.Make(code.OpJump, 37),
+				codetest.Make(code.OpJump, 43),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpJump, 52),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpJump, 52),
+				codetest.Make(code.OpConstant, 4),
+				codetest.Make(code.OpJump, 52),
+				codetest.Make(code.OpConstant, 5),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseMatches,
+		},
+		{
+			// Without a default arm a value missing from the table is null
+			input:             `match("b", "a", fun() { 1 }, "b", fun() { 2 }, "c", fun() { 3 })`,
+			expectedConstants: []interface{}{"b", []interface{}{"a", "b", "c"}, 1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpJumpTable, 1, 3, 43),
+				codetest.Make(code.OpJump, 25),
+				codetest.Make(code.OpJump, 31),
+				codetest.Make(code.OpJump, 37),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpJump, 44),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpJump, 44),
+				codetest.Make(code.OpConstant, 4),
+				codetest.Make(code.OpJump, 44),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseMatches,
+		},
+		{
+			// Sparse integers are compared one after the other
+			input:             `match(5, 1, fun() { 1 }, 100, fun() { 2 }, 1000, fun() { 3 })`,
+			expectedConstants: []interface{}{5, 1, 1, 100, 2, 1000, 3},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpEquals),
+				codetest.Make(code.OpJumpIfNotTrue, 22),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpJump, 55),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpEquals),
+				codetest.Make(code.OpJumpIfNotTrue, 38),
+				codetest.Make(code.OpConstant, 4),
+				codetest.Make(code.OpJump, 55),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 5),
+				codetest.Make(code.OpEquals),
+				codetest.Make(code.OpJumpIfNotTrue, 54),
+				codetest.Make(code.OpConstant, 6),
+				codetest.Make(code.OpJump, 55),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseMatches,
+		},
+		{
+			input:             `var p = [1, 2]; match(p, [a, _], fun() { a }, _, fun() { 0 })`,
+			expectedConstants: []interface{}{1, 2, 0, 0},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpArray, 2),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpSetVar, 1),
+				codetest.Make(code.OpGetVar, 1),
+				codetest.Make(code.OpMatchArray, 2, 0),
+				codetest.Make(code.OpJumpIfNotTrue, 44),
+				codetest.Make(code.OpGetVar, 1),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpIndex),
+				codetest.Make(code.OpSetVar, 2),
+				codetest.Make(code.OpGetVar, 2),
+				codetest.Make(code.OpJump, 47),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseMatches,
+		},
+		{
+			// The key is checked and loaded with the same constant
+			input:             `match({"x": 1}, {"x": x}, fun() { x })`,
+			expectedConstants: []interface{}{"x", 1, "x"},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpHash, 2),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpMatchKey),
+				codetest.Make(code.OpJumpIfNotTrue, 38),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpIndex),
+				codetest.Make(code.OpSetVar, 1),
+				codetest.Make(code.OpGetVar, 1),
+				codetest.Make(code.OpJump, 39),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseMatches,
+		},
+		{
+			// A rest element matches longer arrays and gets the elements
+			// after the others
+			input:             `match([1], [h, rest(t)], fun() { t })`,
+			expectedConstants: []interface{}{1, 0},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpArray, 1),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpMatchArray, 1, 1),
+				codetest.Make(code.OpJumpIfNotTrue, 44),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpIndex),
+				codetest.Make(code.OpSetVar, 1),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpSlice, 1),
+				codetest.Make(code.OpSetVar, 2),
+				codetest.Make(code.OpGetVar, 2),
+				codetest.Make(code.OpJump, 45),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseMatches,
+		},
+		{
+			// Arms comparing with the same value and indexing the same
+			// element share their constants
+			input:             `match([1], [1], fun() { 0 }, [1], fun() { 0 })`,
+			expectedConstants: []interface{}{1, 0, 1, 0, 0},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpArray, 1),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpMatchArray, 1, 0),
+				codetest.Make(code.OpJumpIfNotTrue, 39),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpIndex),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpEquals),
+				codetest.Make(code.OpJumpIfNotTrue, 39),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpJump, 70),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpMatchArray, 1, 0),
+				codetest.Make(code.OpJumpIfNotTrue, 69),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpIndex),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpEquals),
+				codetest.Make(code.OpJumpIfNotTrue, 69),
+				codetest.Make(code.OpConstant, 4),
+				codetest.Make(code.OpJump, 70),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseMatches,
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCompiler_MatchPrograms(t *testing.T) {
+	tests := []programTest{
+		{
+			`var name = fun(n) { match(n, 0, fun() { "zero" }, 1, fun() { "one" }, 2, fun() { "two" }, _, fun() { "many" }) };
+			print([name(0), name(1), name(2), name(7), name("2")])`,
+			[]string{"[zero, one, two, many, many]"},
+		},
+		{
+			`var f = fun(s) { match(s, "a", fun() { 1 }, "b", fun() { 2 }, "c", fun() { 3 }) }; print([f("a"), f("c"), f("d")])`,
+			[]string{"[1, 3, null]"},
+		},
+		{
+			`var f = fun(v) { match(v, [x, 0], fun() { x }, [_, [y]], fun() { y * 2 }, {"k": k}, fun() { k + 1 }, other, fun() { other }) };
+			print([f([5, 0]), f([1, [4]]), f({"k": 9, "j": 0}), f([1, 2, 3]), f(7)])`,
+			[]string{"[5, 8, 10, [1, 2, 3], 7]"},
+		},
+		{
+			// Bound variables are only visible in their arm
+			`var x = 1; print(match(2, x, fun() { x }, _, fun() { 0 }) + x)`,
+			[]string{"3"},
+		},
+		{
+			`var sum = fun(xs, n) { match(xs, [], fun() { n }, [a], fun() { n + a }, [a, b], fun() { sum([b], n + a) }) }; print(sum([1, 2], 0))`,
+			[]string{"3"},
+		},
+		{
+			`var capture = fun(v) { match(v, [x], fun() { fun() { x } }) }; print(capture([1])() + capture([2])())`,
+			[]string{"3"},
+		},
+		{
+			`var f = fun(n) { while(true) { match(n, 1, fun() { return "one" }, 2, fun() { return "two" }, 3, fun() { return "three" }); n = n + 1 } };
+			print([f(1), f(3), f(0)])`,
+			[]string{"[one, three, one]"},
+		},
+		{
+			`var sum = fun(xs) { match(xs, [], fun() { 0 }, [h, rest(t)], fun() { h + sum(t) }) }; print(sum([1, 2, 3]))`,
+			[]string{"6"},
+		},
+		{
+			`var f = fun(xs) { match(xs, [a, b, rest(r)], fun() { [a, b, r] }, _, fun() { "short" }) }; print([f([1]), f([1, 2]), f([1, 2, 3, 4])])`,
+			[]string{"[short, [1, 2, []], [1, 2, [3, 4]]]"},
+		},
+		{
+			`var f = fun(x) { match(x, [rest(r)], fun() { len(r) }, _, fun() { "none" }) }; print([f([]), f([1, 2]), f(5)])`,
+			[]string{"[0, 2, none]"},
+		},
+	}
+
+	runPrograms(t, tests, parseMatches)
+}
+
+func TestCompiler_MatchPeephole(t *testing.T) {
+	input := `var f = fun(n) { match(n, 1, fun() { "a" }, 2, fun() { "b" }, 3, fun() { "c" }) }; print([f(1), f(3), f(4)])`
+
+	compiler := Create()
+	compiler.Rules = peephole.Rules
+	compiler.Superinstructions = true
+
+	err := compiler.Compile(parseMatches(input), "", "", "")
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	m, err := run(compiler.Bytecode())
+	if err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+
+	if len(m.output) != 1 || m.output[0] != "[a, c, null]" {
+		t.Errorf("wrong output. got=%q. expected=%q", m.output, "[a, c, null]")
+	}
+}
+
+func TestCompiler_MatchErrors(t *testing.T) {
+	tests := []compilerTestCaseError{
+		{`match(1, x, fun() { x }); x`, "undefined variable x"},
+		{`match({}, {}, fun() { 1 })`, "hash pattern without keys"},
+	}
+
+	for _, tc := range tests {
+		compiler := Create()
+
+		err := compiler.Compile(parseMatches(tc.input), "", "", "")
+		if err == nil || err.Error() != tc.expected {
+			t.Fatalf("incorrect error for %q. got=%v. expected=%q", tc.input, err, tc.expected)
+		}
+	}
+}
+
+func TestCompiler_MatchTailCalls(t *testing.T) {
+	// The subject is kept in a variable, so calls ending an arm are in tail
+	// position
+	input := `var count = fun(n) { match(n, 0, fun() { "done" }, _, fun() { count(n - 1) }) }; print(count(500))`
+
+	compiler := Create()
+	compiler.TailCalls = true
+
+	err := compiler.Compile(parseMatches(input), "", "", "")
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	m, err := run(compiler.Bytecode())
+	if err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+
+	if len(m.output) != 1 || m.output[0] != "done" {
+		t.Errorf("wrong output. got=%q. expected=%q", m.output, "done")
+	}
+
+	if m.maxDepth != 1 {
+		t.Errorf("wrong call depth. got=%d. expected=%d", m.maxDepth, 1)
+	}
+}
@@ -0,0 +1,104 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+)
+
+// functionOf returns a function node as a *syntax.Function, the functions of
+// the parser have neither default values nor a variadic parameter
+func functionOf(node ast.Node) (*syntax.Function, bool) {
+	switch node := node.(type) {
+	case *ast.Function:
+		return &syntax.Function{Function: *node}, true
+	case *syntax.Function:
+		return node, true
+	}
+
+	return nil, false
+}
+
+// defaultOf returns the default value of the i-th parameter, or nil
+func defaultOf(node *syntax.Function, i int) ast.Expression {
+	if i < len(node.Defaults) {
+		return node.Defaults[i]
+	}
+
+	return nil
+}
+
+// checkParameters returns how many parameters have a default value. Those
+// have to come after the ones without, the variadic parameter can't have one.
+func checkParameters(node *syntax.Function) (int, error) {
+	parameters := node.Parameters
+
+	if node.Variadic {
+		if len(parameters) == 0 {
+			return 0, fmt.Errorf("variadic function without parameters")
+		}
+
+		last := parameters[len(parameters)-1]
+		if defaultOf(node, len(parameters)-1) != nil {
+			return 0, fmt.Errorf("variadic parameter %s can not have a default value", last.Value)
+		}
+
+		parameters = parameters[:len(parameters)-1]
+	}
+
+	defaults := 0
+	for i, p := range parameters {
+		if defaultOf(node, i) != nil {
+			defaults++
+		} else if defaults > 0 {
+			return 0, fmt.Errorf("parameter %s without a default value follows one with a default value", p.Value)
+		}
+	}
+
+	return defaults, nil
+}
+
+// withDefaults returns the function with the default values of its parameters
+// at the start of its body, which is where they are evaluated
+func withDefaults(node *syntax.Function) *ast.Function {
+	if len(node.Defaults) == 0 {
+		return &node.Function
+	}
+
+	body := &ast.BlockStatement{}
+
+	for _, value := range node.Defaults {
+		if value != nil {
+			body.Statements = append(body.Statements, &ast.ExpressionStatement{Expression: value})
+		}
+	}
+
+	body.Statements = append(body.Statements, node.Body.Statements...)
+
+	return &ast.Function{Parameters: node.Parameters, Body: body}
+}
+
+// compileDefaults stores the default values of the parameters a call left out
+// of its arguments
+func (c *Compiler) compileDefaults(node *syntax.Function, parameters []Symbol, root, previous string) error {
+	for i := range node.Parameters {
+		value := defaultOf(node, i)
+		if value == nil {
+			continue
+		}
+
+		skip := c.emitJump(code.OpJumpIfArgument, i)
+
+		err := c.Compile(value, root, "", previous)
+		if err != nil {
+			return err
+		}
+
+		c.storeSymbol(parameters[i])
+
+		c.changeOperand(skip, len(c.currentInstructions()))
+	}
+
+	return nil
+}
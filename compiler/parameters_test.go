@@ -0,0 +1,210 @@
+package compiler
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+	"github.com/looplanguage/loop/models/object"
+	"testing"
+)
+
+// parseFunctions parses input with every params(fun(...) { body }, ...) turned
+// into a function with default values, the parser doesn't know them yet. The
+// arguments after the function are the defaults of its parameters, _ for
+// none, and a last argument rest makes the last parameter variadic.
+func parseFunctions(input string) *ast.Program {
+	return parseCalls(input, "params", func(call *ast.CallExpression) ast.Expression {
+		function := &syntax.Function{Function: *call.Parameters[0].(*ast.Function)}
+
+		for _, value := range call.Parameters[1:] {
+			if name, ok := value.(*ast.Identifier); ok {
+				switch name.Value {
+				case "_":
+					value = nil
+				case "rest":
+					function.Variadic = true
+					continue
+				}
+			}
+
+			function.Defaults = append(function.Defaults, value)
+		}
+
+		return function
+	})
+}
+
+func TestCompiler_Defaults(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `params(fun(a, b) { a + b }, _, 2)`,
+			expectedConstants: []interface{}{2, []code.Instructions{
+				codetest.Make(code.OpJumpIfArgument, 1, 9),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetLocal, 1),
+				codetest.Make(code.OpGetLocal, 0),
+				codetest.Make(code.OpGetLocal, 1),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpReturn),
+			}},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseFunctions,
+		},
+		{
+			// Defaults can use the parameters before them
+			input: `params(fun(a, b, c) { c }, _, a, b * 2)`,
+			expectedConstants: []interface{}{2, []code.Instructions{
+				codetest.Make(code.OpJumpIfArgument, 1, 8),
+				codetest.Make(code.OpGetLocal, 0),
+				codetest.Make(code.OpSetLocal, 1),
+				codetest.Make(code.OpJumpIfArgument, 2, 20),
+				codetest.Make(code.OpGetLocal, 1),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpMultiply),
+				codetest.Make(code.OpSetLocal, 2),
+				codetest.Make(code.OpGetLocal, 2),
+				codetest.Make(code.OpReturn),
+			}},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseFunctions,
+		},
+		{
+			// The variadic parameter is filled in by the call
+			input: `params(fun(a, r) { r }, rest)`,
+			expectedConstants: []interface{}{[]code.Instructions{
+				codetest.Make(code.OpGetLocal, 1),
+				codetest.Make(code.OpReturn),
+			}},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseFunctions,
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCompiler_DefaultsMetadata(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected FunctionMetadata
+		min, max int
+	}{
+		{`fun(a, b) { a }`, FunctionMetadata{MaxStackDepth: 1}, 2, 2},
+		{`params(fun(a, b) { a }, _, 2)`, FunctionMetadata{MaxStackDepth: 1, Defaults: 1}, 1, 2},
+		{`params(fun(a, r) { a }, rest)`, FunctionMetadata{MaxStackDepth: 1, Variadic: true}, 1, -1},
+		{`params(fun(a, b, r) { a }, 1, 2, rest)`, FunctionMetadata{MaxStackDepth: 1, Defaults: 2, Variadic: true}, 0, -1},
+	}
+
+	for _, tc := range tests {
+		bytecode := compileProgramAt(t, parseFunctions(tc.input), 0)
+
+		metadata := bytecode.Functions[len(bytecode.Constants)-1]
+		if metadata.Defaults != tc.expected.Defaults || metadata.Variadic != tc.expected.Variadic {
+			t.Errorf("wrong metadata for %q. got=%+v. expected=%+v", tc.input, metadata, tc.expected)
+		}
+
+		min, max := metadata.Arity(bytecode.Constants[len(bytecode.Constants)-1].(*object.CompiledFunction))
+		if min != tc.min || max != tc.max {
+			t.Errorf("wrong arity for %q. got=%d to %d. expected=%d to %d", tc.input, min, max, tc.min, tc.max)
+		}
+	}
+}
+
+func TestCompiler_DefaultsPrograms(t *testing.T) {
+	tests := []programTest{
+		{`var add = params(fun(a, b) { a + b }, _, 10); print([add(1), add(1, 2)])`, []string{"[11, 3]"}},
+		{`var f = params(fun(a, b, c) { [a, b, c] }, _, a, b * 2); print([f(1), f(1, 2), f(1, 2, 5)])`, []string{"[[1, 1, 2], [1, 2, 4], [1, 2, 5]]"}},
+		{
+			// Defaults are only evaluated when the argument is missing
+			`var count = 0; var next = fun() { count = count + 1 }; var f = params(fun(a) { a }, next()); f(); f(5); f(); print(count)`,
+			[]string{"2"},
+		},
+		{`var f = params(fun(a, r) { [a, r] }, rest); print([f(1), f(1, 2), f(1, 2, 3)])`, []string{"[[1, []], [1, [2]], [1, [2, 3]]]"}},
+		{`var f = params(fun(a, b, r) { [a, b, len(r)] }, _, 0, rest); print([f(1), f(1, 2, 3, 4)])`, []string{"[[1, 0, 0], [1, 2, 2]]"}},
+		{
+			// A default captured by a closure is kept in a cell like the
+			// parameter
+			`var f = params(fun(n) { var inc = fun() { n = n + 1 }; inc(); n }, 41); print([f(), f(1)])`,
+			[]string{"[42, 2]"},
+		},
+		{`var f = params(fun(a, g) { g() }, _, fun() { a * 2 }); print([f(3), f(3, fun() { 0 })])`, []string{"[6, 0]"}},
+		{
+			// Recursion with defaults is a regular call, not a jump back
+			// to the start of the function
+			`var sum = params(fun(n, total) { if(n == 0) { return total }; sum(n - 1, total + n) }, _, 0); print(sum(10))`,
+			[]string{"55"},
+		},
+	}
+
+	runPrograms(t, tests, parseFunctions)
+}
+
+func TestCompiler_DefaultsErrors(t *testing.T) {
+	tests := []compilerTestCaseError{
+		{`params(fun(a, b) { a }, 1, _)`, "parameter b without a default value follows one with a default value"},
+		{`params(fun(a, r) { a }, _, 1, rest)`, "variadic parameter r can not have a default value"},
+		{`params(fun() { 1 }, rest)`, "variadic function without parameters"},
+	}
+
+	for _, tc := range tests {
+		compiler := Create()
+
+		err := compiler.Compile(parseFunctions(tc.input), "", "", "")
+		if err == nil || err.Error() != tc.expected {
+			t.Fatalf("incorrect error for %q. got=%v. expected=%q", tc.input, err, tc.expected)
+		}
+	}
+
+	runErrors := []struct {
+		input    string
+		expected string
+	}{
+		{`var f = params(fun(a, b) { a }, _, 1); f()`, "wrong number of arguments. got=0. expected 1 to 2"},
+		{`var f = params(fun(a, b) { a }, _, 1); f(1, 2, 3)`, "wrong number of arguments. got=3. expected 1 to 2"},
+		{`var f = params(fun(a, r) { a }, rest); f()`, "wrong number of arguments. got=0. expected at least 1"},
+	}
+
+	for _, tc := range runErrors {
+		_, err := run(compileProgramAt(t, parseFunctions(tc.input), 0))
+		if err == nil || err.Error() != tc.expected {
+			t.Fatalf("incorrect run error for %q. got=%v. expected=%q", tc.input, err, tc.expected)
+		}
+	}
+}
+
+func TestCompiler_DefaultsTailCalls(t *testing.T) {
+	// Calls of a function with defaults to itself don't jump back to its
+	// start, but they are still tail calls
+	input := `var count = params(fun(n, total) { if(n == 0) { return total }; count(n - 1, total + 1) }, _, 0); print(count(500))`
+
+	compiler := Create()
+	compiler.TailCalls = true
+
+	err := compiler.Compile(parseFunctions(input), "", "", "")
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	m, err := run(compiler.Bytecode())
+	if err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+
+	if len(m.output) != 1 || m.output[0] != "500" {
+		t.Errorf("wrong output. got=%q. expected=%q", m.output, "500")
+	}
+
+	if m.maxDepth != 1 {
+		t.Errorf("wrong call depth. got=%d. expected=%d", m.maxDepth, 1)
+	}
+}
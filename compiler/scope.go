@@ -0,0 +1,365 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/looplanguage/loop/models/object"
+)
+
+type SymbolScope string
+
+const (
+	GlobalScope  SymbolScope = "GLOBAL"
+	LocalScope   SymbolScope = "LOCAL"
+	BuiltinScope SymbolScope = "BUILTIN"
+	FreeScope    SymbolScope = "FREE"
+	// A constant known at compile time, loaded from the constant pool
+	ConstantScope SymbolScope = "CONSTANT"
+)
+
+// Symbol is how a variable is loaded where it is used
+type Symbol struct {
+	Name  string
+	Scope SymbolScope
+	Index int
+	// The local or free variable holds a cell with the value, see OpMakeCell
+	Cell bool
+}
+
+type Variable struct {
+	Name   string
+	Index  int
+	Scope  int
+	Object object.Object
+	// Kept in a cell, see OpMakeCell
+	Cell bool
+	// Declared with const, it can't be assigned to
+	Constant bool
+	// The value of the constant is known at compile time, Index is its index
+	// in the constant pool instead of a slot
+	Inline bool
+}
+
+// VariableScope holds the variables declared in a block. The scopes of a
+// function share its frame and hold its locals, variables declared outside of
+// any function are globals.
+//
+// A name refers to the variable found first by these rules:
+//   - the innermost scope declaring it wins over the scopes around it
+//   - in a scope, a variable of the file being compiled wins over a variable
+//     of the main program with the same name
+//   - a variable declared again in the same scope replaces the earlier one
+//   - names that aren't declared in any scope are builtins
+type VariableScope struct {
+	Variables map[int]Variable
+	Outer     *VariableScope
+
+	// Variables by the name they are stored as, including the constants
+	// that don't have a slot. Built from Variables when it is nil.
+	names map[string]Variable
+
+	frame *frame
+	// First slot of the block, the slots from here on are used again once
+	// it ends
+	start int
+}
+
+// slots hands out the slots of the variables of a frame or of the globals
+type slots struct {
+	next int
+	// Most slots in use at once
+	max int
+	// Slots below this are never used again, they hold globals that
+	// functions can read after the block declaring them ended
+	kept int
+}
+
+func (s *slots) allocate() int {
+	index := s.next
+
+	s.next++
+	if s.next > s.max {
+		s.max = s.next
+	}
+
+	return index
+}
+
+// release frees the slots from start on
+func (s *slots) release(start int) {
+	if start < s.kept {
+		start = s.kept
+	}
+
+	if start < s.next {
+		s.next = start
+	}
+}
+
+// frame is what a function keeps for a call, its locals and the variables
+// it captures
+type frame struct {
+	// Scope the function is declared in
+	outer *VariableScope
+	// Slots of the locals
+	slots slots
+	// How the declaring function loads each captured variable, in the order
+	// the closure captures them
+	free []Symbol
+	// Names of the locals kept in a cell, and their slots
+	cells     map[string]bool
+	cellSlots []int
+}
+
+func (vs *VariableScope) FindByName(name, root string) *Variable {
+	variable, _ := vs.find(name, root)
+
+	return variable
+}
+
+// find returns the variable a name refers to and the scope it is declared in
+func (vs *VariableScope) find(name, root string) (*Variable, *VariableScope) {
+	for scope := vs; scope != nil; scope = scope.Outer {
+		if root != "" {
+			if variable, ok := scope.byName(variableName(name, root)); ok {
+				return variable, scope
+			}
+		}
+
+		if variable, ok := scope.byName(name); ok {
+			return variable, scope
+		}
+	}
+
+	return nil, nil
+}
+
+func (vs *VariableScope) byName(name string) (*Variable, bool) {
+	variable, ok := vs.index()[name]
+	if !ok {
+		return nil, false
+	}
+
+	return &variable, true
+}
+
+// index returns the variables by name. A name declared more than once in the
+// scope gets the last declaration, which has the highest slot.
+func (vs *VariableScope) index() map[string]Variable {
+	if vs.names != nil {
+		return vs.names
+	}
+
+	vs.names = make(map[string]Variable, len(vs.Variables))
+
+	for index, v := range vs.Variables {
+		if current, ok := vs.names[v.Name]; !ok || index > current.Index {
+			vs.names[v.Name] = v
+		}
+	}
+
+	return vs.names
+}
+
+// Resolve returns how a name is loaded in this scope. Variables of enclosing
+// functions are captured as free variables of every function in between,
+// names that aren't declared anywhere can be builtins.
+func (vs *VariableScope) Resolve(name, root string) (Symbol, bool) {
+	variable, scope := vs.find(name, root)
+	if variable == nil {
+		return resolveBuiltin(name)
+	}
+
+	return vs.capture(*variable, scope.frame), true
+}
+
+// lookup is Resolve without capturing anything, variables of enclosing
+// functions are returned as locals of the function declaring them
+func (vs *VariableScope) lookup(name, root string) (Symbol, bool) {
+	variable, scope := vs.find(name, root)
+	if variable == nil {
+		return resolveBuiltin(name)
+	}
+
+	return symbolOf(*variable, scope.frame), true
+}
+
+// capture returns the symbol of a variable declared in the frame owner, as
+// a free variable if it belongs to an enclosing function
+func (vs *VariableScope) capture(variable Variable, owner *frame) Symbol {
+	if owner == nil || owner == vs.frame || variable.Inline {
+		return symbolOf(variable, owner)
+	}
+
+	outer := vs.frame.outer.capture(variable, owner)
+
+	for i, s := range vs.frame.free {
+		if s == outer {
+			return Symbol{Name: variable.Name, Scope: FreeScope, Index: i, Cell: variable.Cell}
+		}
+	}
+
+	vs.frame.free = append(vs.frame.free, outer)
+
+	return Symbol{Name: variable.Name, Scope: FreeScope, Index: len(vs.frame.free) - 1, Cell: variable.Cell}
+}
+
+func symbolOf(variable Variable, owner *frame) Symbol {
+	if variable.Inline {
+		return Symbol{Name: variable.Name, Scope: ConstantScope, Index: variable.Index}
+	}
+
+	if owner == nil {
+		return Symbol{Name: variable.Name, Scope: GlobalScope, Index: variable.Index}
+	}
+
+	return Symbol{Name: variable.Name, Scope: LocalScope, Index: variable.Index, Cell: variable.Cell}
+}
+
+func resolveBuiltin(name string) (Symbol, bool) {
+	for i, b := range object.Builtins {
+		if b.Name == name {
+			return Symbol{Name: name, Scope: BuiltinScope, Index: i}, true
+		}
+	}
+
+	return Symbol{}, false
+}
+
+// define declares a variable in the current scope. Inside a function it gets
+// the next slot of the frame, outside of functions the next global.
+func (c *Compiler) define(name, root string) Symbol {
+	scope := c.currentScope
+
+	index := c.slots(scope).allocate()
+	cell := false
+
+	if scope.frame != nil {
+		cell = scope.frame.cells[name]
+		if cell {
+			scope.frame.cellSlots = append(scope.frame.cellSlots, index)
+		}
+	} else {
+		// The slot might have held a function calls are inlined to
+		delete(c.inlineCandidates, index)
+	}
+
+	variable := Variable{
+		Name:   variableName(name, root),
+		Index:  index,
+		Object: &object.Null{},
+		Cell:   cell,
+	}
+
+	scope.Variables[index] = variable
+	scope.index()[variable.Name] = variable
+
+	return symbolOf(variable, scope.frame)
+}
+
+// defineConstant declares a constant in the current scope. Constants with a
+// value known at compile time are added to the constant pool and don't get a
+// slot, the others are variables that can't be assigned to.
+func (c *Compiler) defineConstant(name, root string, value object.Object) (Symbol, error) {
+	scope := c.currentScope
+
+	if value == nil {
+		symbol := c.define(name, root)
+
+		variable := scope.Variables[symbol.Index]
+		variable.Constant = true
+
+		scope.Variables[symbol.Index] = variable
+		scope.index()[variable.Name] = variable
+
+		return symbol, nil
+	}
+
+	index, err := c.internConstant(value)
+	if err != nil {
+		return Symbol{}, err
+	}
+
+	variable := Variable{
+		Name:     variableName(name, root),
+		Index:    index,
+		Object:   value,
+		Constant: true,
+		Inline:   true,
+	}
+
+	scope.index()[variable.Name] = variable
+
+	return symbolOf(variable, scope.frame), nil
+}
+
+// assignee resolves the variable an assignment to name stores in
+func (c *Compiler) assignee(name, root string) (Symbol, error) {
+	if variable, _ := c.currentScope.find(name, root); variable != nil && variable.Constant {
+		return Symbol{}, fmt.Errorf("cannot assign to constant %s", name)
+	}
+
+	symbol, ok := c.resolve(name, root)
+	if !ok || symbol.Scope == BuiltinScope {
+		return Symbol{}, fmt.Errorf("undefined variable %s", name)
+	}
+
+	return symbol, nil
+}
+
+// variableName is the name a variable declared in root is stored as
+func variableName(name, root string) string {
+	if root != "" {
+		return "_INTERNAL_" + root + "" + name
+	}
+
+	return name
+}
+
+// slots returns the slots the variables of a scope are stored in
+func (c *Compiler) slots(scope *VariableScope) *slots {
+	if scope.frame != nil {
+		return &scope.frame.slots
+	}
+
+	return &c.globals
+}
+
+// enterBlock starts a scope for the variables of a block
+func (c *Compiler) enterBlock() {
+	c.currentScope = c.deeperScope()
+}
+
+// leaveBlock ends the scope of a block, its variables aren't visible anymore
+// and their slots are used again
+func (c *Compiler) leaveBlock() {
+	scope := c.currentScope
+
+	c.currentScope = scope.Outer
+	c.release(scope)
+}
+
+// release frees the slots of a scope that ended. Calls to the functions its
+// globals held can't be inlined anymore, the slots get other variables.
+func (c *Compiler) release(scope *VariableScope) {
+	if scope.frame == nil {
+		for index := range c.inlineCandidates {
+			if index >= scope.start {
+				delete(c.inlineCandidates, index)
+			}
+		}
+	}
+
+	c.slots(scope).release(scope.start)
+}
+
+// resolve resolves a name in the current scope. Globals used in a function
+// keep their slot, the function might be called after their block ended.
+func (c *Compiler) resolve(name, root string) (Symbol, bool) {
+	symbol, ok := c.currentScope.Resolve(name, root)
+
+	if ok && symbol.Scope == GlobalScope && c.currentScope.frame != nil && c.globals.kept <= symbol.Index {
+		c.globals.kept = symbol.Index + 1
+	}
+
+	return symbol, ok
+}
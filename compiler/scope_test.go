@@ -0,0 +1,427 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"github.com/looplanguage/loop/models/object"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestVariableScope_Define(t *testing.T) {
+	compiler := Create()
+
+	expected := []Symbol{
+		{Name: "a", Scope: GlobalScope, Index: 0},
+		{Name: "b", Scope: GlobalScope, Index: 1},
+		{Name: "c", Scope: LocalScope, Index: 0},
+		{Name: "d", Scope: LocalScope, Index: 1},
+		{Name: "e", Scope: LocalScope, Index: 0},
+		{Name: "f", Scope: LocalScope, Index: 1},
+		{Name: "g", Scope: GlobalScope, Index: 2},
+	}
+
+	var actual []Symbol
+
+	actual = append(actual, compiler.define("a", ""), compiler.define("b", ""))
+
+	compiler.enterScope()
+	actual = append(actual, compiler.define("c", ""))
+
+	// Blocks of a function use the slots of its frame
+	compiler.currentScope = compiler.deeperScope()
+	actual = append(actual, compiler.define("d", ""))
+	compiler.currentScope = compiler.currentScope.Outer
+
+	compiler.enterScope()
+	actual = append(actual, compiler.define("e", ""), compiler.define("f", ""))
+	compiler.leaveScope()
+
+	compiler.leaveScope()
+	actual = append(actual, compiler.define("g", ""))
+
+	for i, sym := range expected {
+		if actual[i] != sym {
+			t.Errorf("wrong symbol for %s. got=%+v. expected=%+v", sym.Name, actual[i], sym)
+		}
+	}
+}
+
+func TestVariableScope_Resolve(t *testing.T) {
+	compiler := Create()
+	compiler.define("a", "")
+	compiler.define("b", "")
+
+	compiler.enterScope()
+	compiler.define("c", "")
+	compiler.define("d", "")
+	first := compiler.currentScope
+
+	compiler.enterScope()
+	compiler.define("e", "")
+	compiler.define("f", "")
+	second := compiler.currentScope
+
+	tests := []struct {
+		scope    *VariableScope
+		expected []Symbol
+	}{
+		{
+			first,
+			[]Symbol{
+				{Name: "a", Scope: GlobalScope, Index: 0},
+				{Name: "b", Scope: GlobalScope, Index: 1},
+				{Name: "c", Scope: LocalScope, Index: 0},
+				{Name: "d", Scope: LocalScope, Index: 1},
+			},
+		},
+		{
+			second,
+			[]Symbol{
+				{Name: "a", Scope: GlobalScope, Index: 0},
+				{Name: "b", Scope: GlobalScope, Index: 1},
+				{Name: "d", Scope: FreeScope, Index: 0},
+				{Name: "c", Scope: FreeScope, Index: 1},
+				{Name: "e", Scope: LocalScope, Index: 0},
+				{Name: "f", Scope: LocalScope, Index: 1},
+				{Name: "d", Scope: FreeScope, Index: 0},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		for _, sym := range tc.expected {
+			result, ok := tc.scope.Resolve(sym.Name, "")
+			if !ok {
+				t.Errorf("name %s not resolvable", sym.Name)
+				continue
+			}
+
+			if result != sym {
+				t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+			}
+		}
+	}
+
+	expectedFree := []Symbol{
+		{Name: "d", Scope: LocalScope, Index: 1},
+		{Name: "c", Scope: LocalScope, Index: 0},
+	}
+
+	free := second.frame.free
+	if len(free) != len(expectedFree) {
+		t.Fatalf("wrong number of free symbols. got=%d, want=%d", len(free), len(expectedFree))
+	}
+
+	for i, sym := range expectedFree {
+		if free[i] != sym {
+			t.Errorf("wrong free symbol. got=%+v, want=%+v", free[i], sym)
+		}
+	}
+
+	for _, name := range []string{"x", "y"} {
+		if _, ok := second.Resolve(name, ""); ok {
+			t.Errorf("name %s resolved, but was expected not to", name)
+		}
+	}
+}
+
+func TestVariableScope_ResolveNestedFree(t *testing.T) {
+	compiler := Create()
+
+	compiler.enterScope()
+	compiler.define("a", "")
+	compiler.currentScope.frame.cells = map[string]bool{"b": true}
+	compiler.define("b", "")
+
+	compiler.enterScope()
+	middle := compiler.currentScope
+
+	compiler.enterScope()
+	inner := compiler.currentScope
+
+	expected := []Symbol{
+		{Name: "b", Scope: FreeScope, Index: 0, Cell: true},
+		{Name: "a", Scope: FreeScope, Index: 1},
+	}
+
+	for _, sym := range expected {
+		result, ok := inner.Resolve(sym.Name, "")
+		if !ok {
+			t.Errorf("name %s not resolvable", sym.Name)
+			continue
+		}
+
+		if result != sym {
+			t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+		}
+	}
+
+	// The function in between captures the variables for the inner one
+	expectedMiddle := []Symbol{
+		{Name: "b", Scope: LocalScope, Index: 1, Cell: true},
+		{Name: "a", Scope: LocalScope, Index: 0},
+	}
+
+	for i, sym := range expectedMiddle {
+		if middle.frame.free[i] != sym {
+			t.Errorf("wrong free symbol. got=%+v, want=%+v", middle.frame.free[i], sym)
+		}
+	}
+}
+
+func TestVariableScope_ResolveBuiltins(t *testing.T) {
+	compiler := Create()
+	global := compiler.currentScope
+
+	compiler.enterScope()
+	local := compiler.currentScope
+
+	for _, scope := range []*VariableScope{global, local} {
+		result, ok := scope.Resolve("len", "")
+		if !ok {
+			t.Fatalf("builtin len not resolvable")
+		}
+
+		expected := Symbol{Name: "len", Scope: BuiltinScope, Index: 0}
+		if result != expected {
+			t.Errorf("wrong symbol for len. expected=%+v. got=%+v", expected, result)
+		}
+	}
+
+	// Variables shadow builtins
+	compiler.define("len", "")
+
+	result, _ := local.Resolve("len", "")
+
+	expected := Symbol{Name: "len", Scope: LocalScope, Index: 0}
+	if result != expected {
+		t.Errorf("wrong symbol for len. expected=%+v. got=%+v", expected, result)
+	}
+}
+
+func TestVariableScope_ResolveRoot(t *testing.T) {
+	compiler := Create()
+	compiler.define("a", "lib.lp")
+
+	result, ok := compiler.currentScope.Resolve("a", "lib.lp")
+	if !ok {
+		t.Fatalf("name a not resolvable")
+	}
+
+	expected := Symbol{Name: "_INTERNAL_lib.lpa", Scope: GlobalScope, Index: 0}
+	if result != expected {
+		t.Errorf("wrong symbol for a. expected=%+v. got=%+v", expected, result)
+	}
+
+	if _, ok := compiler.currentScope.Resolve("a", ""); ok {
+		t.Errorf("name a of another file resolved")
+	}
+}
+
+func TestVariableScope_Precedence(t *testing.T) {
+	compiler := Create()
+	compiler.define("a", "")
+	compiler.define("a", "lib.lp")
+	compiler.define("b", "")
+	compiler.define("b", "")
+
+	compiler.enterBlock()
+	compiler.define("c", "")
+
+	compiler.enterBlock()
+	compiler.define("b", "")
+	compiler.define("c", "lib.lp")
+
+	tests := []struct {
+		name     string
+		root     string
+		expected Symbol
+	}{
+		// The variable of the file wins over the one of the main program
+		{"a", "lib.lp", Symbol{Name: "_INTERNAL_lib.lpa", Scope: GlobalScope, Index: 1}},
+		{"a", "", Symbol{Name: "a", Scope: GlobalScope, Index: 0}},
+		// The last declaration in a scope wins
+		{"b", "lib.lp", Symbol{Name: "b", Scope: GlobalScope, Index: 5}},
+		// The innermost scope wins
+		{"c", "", Symbol{Name: "c", Scope: GlobalScope, Index: 4}},
+		{"c", "lib.lp", Symbol{Name: "_INTERNAL_lib.lpc", Scope: GlobalScope, Index: 6}},
+	}
+
+	for _, tc := range tests {
+		// Every lookup has to give the same result
+		for i := 0; i < 10; i++ {
+			result, ok := compiler.currentScope.Resolve(tc.name, tc.root)
+			if !ok {
+				t.Fatalf("name %s not resolvable", tc.name)
+			}
+
+			if result != tc.expected {
+				t.Fatalf("wrong symbol for %s in %q. got=%+v. expected=%+v", tc.name, tc.root, result, tc.expected)
+			}
+		}
+	}
+
+	compiler.leaveBlock()
+
+	result, _ := compiler.currentScope.Resolve("b", "")
+	if expected := (Symbol{Name: "b", Scope: GlobalScope, Index: 3}); result != expected {
+		t.Errorf("wrong symbol for b after the block. got=%+v. expected=%+v", result, expected)
+	}
+}
+
+func TestVariableScope_PrecedenceState(t *testing.T) {
+	// Scopes of earlier programs don't have an index yet
+	scope := &VariableScope{Variables: map[int]Variable{
+		0: {Name: "x", Index: 0},
+		2: {Name: "x", Index: 2},
+		1: {Name: "x", Index: 1},
+	}}
+
+	compiler := CreateWithState(scope, nil)
+
+	result, ok := compiler.currentScope.Resolve("x", "")
+	if !ok {
+		t.Fatalf("name x not resolvable")
+	}
+
+	if expected := (Symbol{Name: "x", Scope: GlobalScope, Index: 2}); result != expected {
+		t.Errorf("wrong symbol for x. got=%+v. expected=%+v", result, expected)
+	}
+
+	compiler.define("x", "")
+
+	result, _ = compiler.currentScope.Resolve("x", "")
+	if expected := (Symbol{Name: "x", Scope: GlobalScope, Index: 3}); result != expected {
+		t.Errorf("wrong symbol for x. got=%+v. expected=%+v", result, expected)
+	}
+}
+
+func TestVariableScope_Programs(t *testing.T) {
+	tests := []programTest{
+		// Parameters shadow variables declared outside of the function
+		{"var x = 1; var f = fun(x) { x }; print(f(2))", []string{"2"}},
+		{"var f = fun() { var x = 1; if(true) { var x = 2; print(x) }; x }; print(f())", []string{"2", "1"}},
+		// Every call has its own locals
+		{"var f = fun(n) { var x = n; if(n > 0) { f(n - 1) }; print(x) }; f(2)", []string{"0", "1", "2"}},
+		{"var f = fun() { var fact = fun(n) { if(n > 1) { n * fact(n - 1) } else { 1 } }; fact(5) }; print(f())", []string{"120"}},
+		{"var f = fun(a) { var g = fun(b) { var h = fun() { a + b }; h() }; g(2) }; print(f(1))", []string{"3"}},
+	}
+
+	runPrograms(t, tests, parse)
+}
+
+func TestVariableScope_NumLocals(t *testing.T) {
+	bytecode := compileAt(t, "var g = 1; fun(a, b) { var c = 1; if(true) { var d = 2 } }", 0)
+
+	fn, ok := bytecode.Constants[3].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant 3 is not a function. got=%T", bytecode.Constants[3])
+	}
+
+	if fn.NumLocals != 4 {
+		t.Errorf("wrong number of locals. got=%d. expected=%d", fn.NumLocals, 4)
+	}
+}
+
+func TestVariableScope_Blocks(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// The slot of a is used again once its block ended
+			input:             "if(true) { var a = 1 }; var b = 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpIfNotTrue, 14),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpJump, 15),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpSetVar, 0),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestVariableScope_BlockSlots(t *testing.T) {
+	tests := []struct {
+		input        string
+		numVariables int
+		numLocals    int
+	}{
+		{"var a = 1; var b = 2", 2, 0},
+		{"if(true) { var a = 1 }; var b = 2", 1, 0},
+		{"var a = 1; if(true) { var b = 2; if(true) { var c = 3 }; var d = 4 }; var e = 5", 3, 0},
+		{"fun() { if(true) { var a = 1 }; var b = 2 }", 0, 1},
+		{"fun(a) { if(true) { var b = 1 } else { var c = 2; var d = 3 } }", 0, 3},
+		// Functions can read a after its block ended, so its slot is kept
+		{"var f = 0; if(true) { var a = 1; f = fun() { a } }; var b = 2", 3, 0},
+	}
+
+	for _, tc := range tests {
+		bytecode := compileAt(t, tc.input, 0)
+
+		if bytecode.NumVariables != tc.numVariables {
+			t.Errorf("wrong number of variables for %q. got=%d. expected=%d", tc.input, bytecode.NumVariables, tc.numVariables)
+		}
+
+		for _, constant := range bytecode.Constants {
+			if fn, ok := constant.(*object.CompiledFunction); ok && fn.NumLocals != tc.numLocals {
+				t.Errorf("wrong number of locals for %q. got=%d. expected=%d", tc.input, fn.NumLocals, tc.numLocals)
+			}
+		}
+	}
+}
+
+func TestVariableScope_BlockPrograms(t *testing.T) {
+	tests := []programTest{
+		{"var a = 1; if(true) { var b = 2; print(a + b) }; var c = 3; print(a + c)", []string{"3", "4"}},
+		{"var f = 0; if(true) { var x = 1; f = fun() { x } }; var y = 2; print(f(), y)", []string{"1 2"}},
+		{"var f = fun() { if(true) { var a = 1; print(a) }; var b = 2; b }; print(f())", []string{"1", "2"}},
+		// The function declared in the slot before isn't inlined
+		{"if(true) { var f = fun() { 1 } }; if(true) { var g = fun() { 2 }; print(g()) }", []string{"2"}},
+		// Nor the one in the slot an inlined parameter gets
+		{"if(true) { var a = 0; var f = fun(x) { x + 1 } }; var g = fun(f) { f(1) }; print(g(fun(y) { y * 100 }))", []string{"100"}},
+	}
+
+	runPrograms(t, tests, parse)
+}
+
+func TestVariableScope_BlockVisibility(t *testing.T) {
+	tests := []compilerTestCaseError{
+		{"if(true) { var a = 1 }; a", "undefined variable a"},
+		{"fun() { if(true) { var a = 1 }; a = 2 }", "undefined variable a"},
+	}
+
+	runCompilerTestsErrors(t, tests)
+}
+
+// Compiles programs with many variables, each used right after it is declared
+func BenchmarkVariableScope_ManyVariables(b *testing.B) {
+	for _, count := range []int{1000, 5000} {
+		var source strings.Builder
+		for i := 0; i < count; i++ {
+			fmt.Fprintf(&source, "var v%d = %d; v%d + v0;\n", i, i, i)
+		}
+
+		program := parse(source.String())
+
+		b.Run(strconv.Itoa(count), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				compiler := Create()
+
+				err := compiler.Compile(program, "", "", "")
+				if err != nil {
+					b.Fatalf("compiler error: %s", err)
+				}
+			}
+		})
+	}
+}
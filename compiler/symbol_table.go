@@ -1,90 +0,0 @@
-package compiler
-
-type SymbolScope string
-
-const (
-	GlobalScope  SymbolScope = "GLOBAL"
-	LocalScope   SymbolScope = "LOCAL"
-	BuiltinScope SymbolScope = "BUILTIN"
-	FreeScope    SymbolScope = "FREE"
-)
-
-type Symbol struct {
-	Name  string
-	Scope SymbolScope
-	Index int
-}
-
-type SymbolTable struct {
-	Outer *SymbolTable
-
-	store          map[string]Symbol
-	FreeSymbols    []Symbol
-	numDefinitions int
-}
-
-func CreateSymbolTable() *SymbolTable {
-	s := make(map[string]Symbol)
-	return &SymbolTable{store: s}
-}
-
-func CreateEnclosedSymbolTable(t *SymbolTable) *SymbolTable {
-	s := make(map[string]Symbol)
-	return &SymbolTable{Outer: t, store: s}
-}
-
-func (s *SymbolTable) defineFree(original Symbol) Symbol {
-	s.FreeSymbols = append(s.FreeSymbols, original)
-
-	symbol := Symbol{Name: original.Name, Index: len(s.FreeSymbols) - 1}
-	symbol.Scope = FreeScope
-
-	s.store[original.Name] = symbol
-
-	return symbol
-}
-
-func (s *SymbolTable) Define(name string) Symbol {
-	symbol := Symbol{Name: name, Index: s.numDefinitions}
-
-	if s.Outer == nil {
-		symbol.Scope = GlobalScope
-
-		if _, exists := s.store[name]; exists {
-			return s.store[name]
-		}
-
-	} else {
-		symbol.Scope = LocalScope
-	}
-
-	s.store[name] = symbol
-	s.numDefinitions++
-	return symbol
-}
-
-func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
-	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
-	s.store[name] = symbol
-	return symbol
-}
-
-func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
-	obj, ok := s.store[name]
-
-	if !ok && s.Outer != nil {
-		obj, ok := s.Outer.Resolve(name)
-		if !ok {
-			return obj, ok
-		}
-
-		if obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
-			return obj, ok
-		}
-
-		free := s.defineFree(obj)
-		return free, true
-	}
-
-	return obj, ok
-}
@@ -1,250 +0,0 @@
-package compiler
-
-import "testing"
-
-func TestSymbolTable_VariableDeclaration(t *testing.T) {
-	expected := map[string]Symbol{
-		"a": Symbol{Name: "a", Scope: GlobalScope, Index: 0},
-		"b": Symbol{Name: "b", Scope: GlobalScope, Index: 1},
-		"c": Symbol{Name: "c", Scope: LocalScope, Index: 0},
-		"d": Symbol{Name: "d", Scope: LocalScope, Index: 1},
-		"e": Symbol{Name: "e", Scope: LocalScope, Index: 0},
-		"f": Symbol{Name: "f", Scope: LocalScope, Index: 1},
-	}
-	global := CreateSymbolTable()
-	a := global.Define("a")
-	if a != expected["a"] {
-		t.Errorf("expected a=%+v, got=%+v", expected["a"], a)
-	}
-	b := global.Define("b")
-	if b != expected["b"] {
-		t.Errorf("expected b=%+v, got=%+v", expected["b"], b)
-	}
-	firstLocal := CreateEnclosedSymbolTable(global)
-	c := firstLocal.Define("c")
-	if c != expected["c"] {
-		t.Errorf("expected c=%+v, got=%+v", expected["c"], c)
-	}
-	d := firstLocal.Define("d")
-	if d != expected["d"] {
-		t.Errorf("expected d=%+v, got=%+v", expected["d"], d)
-	}
-	secondLocal := CreateEnclosedSymbolTable(firstLocal)
-	e := secondLocal.Define("e")
-	if e != expected["e"] {
-		t.Errorf("expected e=%+v, got=%+v", expected["e"], e)
-	}
-	f := secondLocal.Define("f")
-	if f != expected["f"] {
-		t.Errorf("expected f=%+v, got=%+v", expected["f"], f)
-	}
-}
-
-func TestSymbolTable_Resolve(t *testing.T) {
-	global := CreateSymbolTable()
-	global.Define("a")
-	global.Define("b")
-
-	expected := map[string]Symbol{
-		"a": Symbol{Name: "a", Scope: GlobalScope, Index: 0},
-		"b": Symbol{Name: "b", Scope: GlobalScope, Index: 1},
-	}
-
-	for _, sym := range expected {
-		result, ok := global.Resolve(sym.Name)
-		if !ok {
-			t.Errorf("name %s not resolvable", sym.Name)
-			continue
-		}
-		if result != sym {
-			t.Errorf("expected %s to resolve to %+v, got=%+v",
-				sym.Name, sym, result)
-		}
-	}
-}
-
-func TestSymbolTable_ResolveLocal(t *testing.T) {
-	global := CreateSymbolTable()
-	global.Define("a")
-	global.Define("b")
-
-	local := CreateEnclosedSymbolTable(global)
-	local.Define("c")
-	local.Define("d")
-
-	expected := []Symbol{
-		{Name: "a", Scope: GlobalScope, Index: 0},
-		{Name: "b", Scope: GlobalScope, Index: 1},
-		{Name: "c", Scope: LocalScope, Index: 0},
-		{Name: "d", Scope: LocalScope, Index: 1},
-	}
-
-	for _, sym := range expected {
-		result, ok := local.Resolve(sym.Name)
-		if !ok {
-			t.Errorf("name %s not resolvable", sym.Name)
-			continue
-		}
-		if result != sym {
-			t.Errorf("expected %s to resolve to %+v, got=%+v",
-				sym.Name, sym, result)
-		}
-	}
-}
-
-func TestSymbolTable_ResolveLocalNested(t *testing.T) {
-	global := CreateSymbolTable()
-	global.Define("a")
-	global.Define("b")
-
-	local := CreateEnclosedSymbolTable(global)
-	local.Define("c")
-	local.Define("d")
-
-	moreLocal := CreateEnclosedSymbolTable(local)
-	moreLocal.Define("e")
-	moreLocal.Define("f")
-
-	tests := []struct {
-		table           *SymbolTable
-		expectedSymbols []Symbol
-	}{
-		{
-			local,
-			[]Symbol{
-				{Name: "a", Scope: GlobalScope, Index: 0},
-				{Name: "b", Scope: GlobalScope, Index: 1},
-				{Name: "c", Scope: LocalScope, Index: 0},
-				{Name: "d", Scope: LocalScope, Index: 1},
-			},
-		},
-		{
-			moreLocal,
-			[]Symbol{
-				{Name: "a", Scope: GlobalScope, Index: 0},
-				{Name: "b", Scope: GlobalScope, Index: 1},
-				{Name: "e", Scope: LocalScope, Index: 0},
-				{Name: "f", Scope: LocalScope, Index: 1},
-			},
-		},
-	}
-
-	for _, tc := range tests {
-		for _, sym := range tc.expectedSymbols {
-			result, ok := tc.table.Resolve(sym.Name)
-			if !ok {
-				t.Errorf("name %s not resolvable", sym.Name)
-				continue
-			}
-			if result != sym {
-				t.Errorf("expected %s to resolve to %+v, got=%+v",
-					sym.Name, sym, result)
-			}
-		}
-	}
-}
-
-func TestSymbolTable_ResolveFree(t *testing.T) {
-	global := CreateSymbolTable()
-	global.Define("a")
-	global.Define("b")
-	firstLocal := CreateEnclosedSymbolTable(global)
-	firstLocal.Define("c")
-	firstLocal.Define("d")
-	secondLocal := CreateEnclosedSymbolTable(firstLocal)
-	secondLocal.Define("e")
-	secondLocal.Define("f")
-	tests := []struct {
-		table               *SymbolTable
-		expectedSymbols     []Symbol
-		expectedFreeSymbols []Symbol
-	}{
-		{
-			firstLocal,
-			[]Symbol{
-				Symbol{Name: "a", Scope: GlobalScope, Index: 0},
-				Symbol{Name: "b", Scope: GlobalScope, Index: 1},
-				Symbol{Name: "c", Scope: LocalScope, Index: 0},
-				Symbol{Name: "d", Scope: LocalScope, Index: 1},
-			},
-			[]Symbol{},
-		},
-		{
-			secondLocal,
-			[]Symbol{
-				Symbol{Name: "a", Scope: GlobalScope, Index: 0},
-				Symbol{Name: "b", Scope: GlobalScope, Index: 1},
-				Symbol{Name: "c", Scope: FreeScope, Index: 0},
-				Symbol{Name: "d", Scope: FreeScope, Index: 1},
-				Symbol{Name: "e", Scope: LocalScope, Index: 0},
-				Symbol{Name: "f", Scope: LocalScope, Index: 1},
-			},
-			[]Symbol{
-				Symbol{Name: "c", Scope: LocalScope, Index: 0},
-				Symbol{Name: "d", Scope: LocalScope, Index: 1},
-			},
-		},
-	}
-	for _, tt := range tests {
-		for _, sym := range tt.expectedSymbols {
-			result, ok := tt.table.Resolve(sym.Name)
-			if !ok {
-				t.Errorf("name %s not resolvable", sym.Name)
-				continue
-			}
-			if result != sym {
-				t.Errorf("expected %s to resolve to %+v, got=%+v",
-					sym.Name, sym, result)
-			}
-		}
-		if len(tt.table.FreeSymbols) != len(tt.expectedFreeSymbols) {
-			t.Errorf("wrong number of free symbols. got=%d, want=%d",
-				len(tt.table.FreeSymbols), len(tt.expectedFreeSymbols))
-			continue
-		}
-		for i, sym := range tt.expectedFreeSymbols {
-			result := tt.table.FreeSymbols[i]
-			if result != sym {
-				t.Errorf("wrong free symbol. got=%+v, want=%+v",
-					result, sym)
-			}
-		}
-	}
-}
-
-func TestSymbolTable_UnresolveFree(t *testing.T) {
-	global := CreateSymbolTable()
-	global.Define("a")
-	firstLocal := CreateEnclosedSymbolTable(global)
-	firstLocal.Define("c")
-	secondLocal := CreateEnclosedSymbolTable(firstLocal)
-	secondLocal.Define("e")
-	secondLocal.Define("f")
-	expected := []Symbol{
-		Symbol{Name: "a", Scope: GlobalScope, Index: 0},
-		Symbol{Name: "c", Scope: FreeScope, Index: 0},
-		Symbol{Name: "e", Scope: LocalScope, Index: 0},
-		Symbol{Name: "f", Scope: LocalScope, Index: 1},
-	}
-	for _, sym := range expected {
-		result, ok := secondLocal.Resolve(sym.Name)
-		if !ok {
-			t.Errorf("name %s not resolvable", sym.Name)
-			continue
-		}
-		if result != sym {
-			t.Errorf("expected %s to resolve to %+v, got=%+v",
-				sym.Name, sym, result)
-		}
-	}
-	expectedUnresolvable := []string{
-		"b",
-		"d",
-	}
-	for _, name := range expectedUnresolvable {
-		_, ok := secondLocal.Resolve(name)
-		if ok {
-			t.Errorf("name %s resolved, but was expected not to", name)
-		}
-	}
-}
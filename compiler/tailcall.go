@@ -0,0 +1,146 @@
+package compiler
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/ir"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+)
+
+// markTailCalls records the calls in tail position of a function body, whose
+// value is returned right away. Only calls reached without any values on the
+// stack are recorded, those are returned calls and calls that are the last
+// expression of the body or of a conditional that is.
+func (c *Compiler) markTailCalls(statements []ast.Statement, last bool) {
+	for i, s := range statements {
+		isLast := last && i == len(statements)-1
+
+		switch s := s.(type) {
+		case *ast.Return:
+			if call, ok := s.Value.(*ast.CallExpression); ok {
+				c.tailPositions[call] = true
+			}
+		case *ast.ExpressionStatement:
+			switch e := s.Expression.(type) {
+			case *ast.CallExpression:
+				if isLast {
+					c.tailPositions[e] = true
+				}
+			case *ast.ConditionalStatement:
+				c.markConditionalTailCalls(e, isLast)
+			case *ast.While:
+				c.markTailCalls(e.Block.Statements, false)
+			case *syntax.Match:
+				// The subject is kept in a variable, not on the stack
+				for _, arm := range e.Arms {
+					c.markTailCalls(arm.Body.Statements, isLast)
+				}
+			}
+		}
+	}
+}
+
+func (c *Compiler) markConditionalTailCalls(node *ast.ConditionalStatement, last bool) {
+	c.markTailCalls(node.Body.Statements, last)
+
+	if node.ElseCondition != nil {
+		c.markConditionalTailCalls(node.ElseCondition, last)
+	} else if node.ElseStatement != nil {
+		c.markTailCalls(node.ElseStatement.Statements, last)
+	}
+}
+
+// isTailCall reports whether a call is compiled as a tail call. Calls in
+// inlined bodies aren't in tail position of the function they are inlined in.
+func (c *Compiler) isTailCall(node *ast.CallExpression) bool {
+	return c.TailCalls && c.inlineDepth == 0 && c.tailPositions[node]
+}
+
+// isSelfCall reports whether a call calls the function being compiled with
+// all of its parameters, which can jump back to the start of the function
+func (c *Compiler) isSelfCall(node *ast.CallExpression, root string) bool {
+	callee, ok := node.Function.(*ast.Identifier)
+	if !ok || c.reassigned[callee.Value] {
+		return false
+	}
+
+	scope := c.scopes[c.scopeIndex]
+	if scope.variable == nil || len(node.Parameters) != scope.parameters {
+		return false
+	}
+
+	// The callee has to be the variable the function is declared as, not a
+	// variable of the function itself with the same name
+	variable, declared := c.currentScope.find(callee.Value, root)
+	if variable == nil || declared.frame != c.currentScope.frame.outer.frame {
+		return false
+	}
+
+	return symbolOf(*variable, declared.frame) == *scope.variable
+}
+
+// compileTailCall compiles a call in tail position. Calls of a function to
+// itself store the arguments in the parameters and jump to the start of the
+// function, other calls use OpTailCall. Nothing follows in the function, so
+// whatever is compiled after the call is never executed.
+func (c *Compiler) compileTailCall(node *ast.CallExpression, root, previous string) error {
+	self := c.isSelfCall(node, root)
+
+	if !self {
+		err := c.Compile(node.Function, root, "", previous)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, arg := range node.Parameters {
+		err := c.Compile(arg, root, "", previous)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !self {
+		c.emit(code.OpTailCall, len(node.Parameters))
+		return nil
+	}
+
+	for i := len(node.Parameters) - 1; i >= 0; i-- {
+		c.emit(code.OpSetLocal, i)
+	}
+
+	c.emit(code.OpJump, 0)
+
+	return nil
+}
+
+// lowerTailCall is compileTailCall for the intermediate representation
+func (c *Compiler) lowerTailCall(b *ir.Builder, node *ast.CallExpression, root, previous string) error {
+	self := c.isSelfCall(node, root)
+
+	if !self {
+		err := c.lower(b, node.Function, root, previous)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, arg := range node.Parameters {
+		err := c.lower(b, arg, root, previous)
+		if err != nil {
+			return err
+		}
+	}
+
+	if self {
+		for i := len(node.Parameters) - 1; i >= 0; i-- {
+			b.Emit(code.OpSetLocal, i)
+		}
+
+		b.Jump(b.Function.Blocks[0])
+	} else {
+		b.TailCall(len(node.Parameters))
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package compiler
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"testing"
+)
+
+func TestCompiler_TailCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "var f = fun(n, acc) { if(n == 0) { acc } else { f(n - 1, acc * n) } }; f(5, 2)",
+			expectedConstants: []interface{}{0, 1, []code.Instructions{
+				codetest.Make(code.OpGetLocal, 0),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpEquals),
+				codetest.Make(code.OpJumpIfNotTrue, 14),
+				codetest.Make(code.OpGetLocal, 1),
+				codetest.Make(code.OpJump, 32),
+				codetest.Make(code.OpGetLocal, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpSubtract),
+				codetest.Make(code.OpGetLocal, 1),
+				codetest.Make(code.OpGetLocal, 0),
+				codetest.Make(code.OpMultiply),
+				codetest.Make(code.OpSetLocal, 1),
+				codetest.Make(code.OpSetLocal, 0),
+				codetest.Make(code.OpJump, 0),
+				codetest.Make(code.OpReturn),
+			}, 5, 2},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 3),
+				codetest.Make(code.OpConstant, 4),
+				codetest.Make(code.OpCall, 2),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			input: "var apply = fun(g) { return g(1) }",
+			expectedConstants: []interface{}{1, []code.Instructions{
+				codetest.Make(code.OpGetLocal, 0),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpTailCall, 1),
+			}},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpSetVar, 0),
+			},
+		},
+		{
+			// Neither the call with missing arguments, nor the call whose
+			// value is used are tail calls
+			input: "var f = fun(n) { f(n) + 1; f() }",
+			expectedConstants: []interface{}{1, []code.Instructions{
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpGetLocal, 0),
+				codetest.Make(code.OpCall, 1),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpTailCall, 0),
+				codetest.Make(code.OpReturn),
+			}},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpSetVar, 0),
+			},
+		},
+		{
+			// f might not be the function itself anymore
+			input: "var f = fun(n) { return f(n) }; f = 1",
+			expectedConstants: []interface{}{[]code.Instructions{
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpGetLocal, 0),
+				codetest.Make(code.OpTailCall, 1),
+			}, 1},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpSetVar, 0),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		for _, level := range []int{0, 1} {
+			compiler := Create()
+			compiler.OptimizationLevel = level
+			compiler.TailCalls = true
+
+			err := compiler.Compile(parse(tc.input), "", "", "")
+			if err != nil {
+				t.Fatalf("compiler error at -O%d: %s", level, err)
+			}
+
+			bytecode := compiler.Bytecode()
+
+			err = testInstructions(tc.expectedInstructions, bytecode.Instructions)
+			if err != nil {
+				t.Errorf("testInstructions failed at -O%d for %q with: %s", level, tc.input, err)
+			}
+
+			// The intermediate representation leaves out what follows a tail
+			// call, so only the unoptimized functions are compared
+			if level == 0 {
+				err = testConstants(tc.expectedConstants, bytecode.Constants)
+				if err != nil {
+					t.Errorf("testConstants failed for %q with: %s", tc.input, err)
+				}
+			}
+		}
+	}
+}
+
+func TestCompiler_TailCallEquivalence(t *testing.T) {
+	tests := []struct {
+		input string
+		// Deepest the calls get with tail calls
+		depth int
+	}{
+		{"var f = fun(n, acc) { if(n == 0) { acc } else { f(n - 1, acc * n) } }; print(f(10, 1))", 1},
+		{"var count = fun(n) { if(n > 0) { return count(n - 1) }; n }; print(count(500))", 1},
+		{"var count = fun(n) { if(n > 0) { count(n - 1) } else if(n == 0) { \"done\" } }; print(count(500))", 1},
+		{"var f = fun(a) { if(a) { return 1 } else { return 2 }; 3 }; print(f(true))", 1},
+		{"var loop = fun(n) { while(true) { if(n > 3) { return n }; return loop(n + 1) } }; print(loop(0))", 1},
+		{"var f = fun(a, b) { if(a > 0) { print(a, b); f(a - 1, a) } else { b } }; print(f(3, 0))", 1},
+		{"var sum = fun(n) { if(n == 0) { 0 } else { n + sum(n - 1) } }; print(sum(20))", 21},
+		{"var adder = fun(n) { fun(m) { n + m } }; var f = fun(n) { if(n > 2) { adder(n)(1) } else { f(n + 1) } }; print(f(0))", 2},
+	}
+
+	for _, tc := range tests {
+		for _, level := range []int{0, 1, 2} {
+			plain := Create()
+			plain.OptimizationLevel = level
+
+			err := plain.Compile(parse(tc.input), "", "", "")
+			if err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			expected, err := run(plain.Bytecode())
+			if err != nil {
+				t.Fatalf("run failed at -O%d for %q: %s", level, tc.input, err)
+			}
+
+			tail := Create()
+			tail.OptimizationLevel = level
+			tail.TailCalls = true
+
+			err = tail.Compile(parse(tc.input), "", "", "")
+			if err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			actual, err := run(tail.Bytecode())
+			if err != nil {
+				t.Fatalf("run failed with tail calls at -O%d for %q: %s", level, tc.input, err)
+			}
+
+			if len(actual.output) != len(expected.output) {
+				t.Fatalf("wrong output at -O%d for %q. got=%q. expected=%q", level, tc.input, actual.output, expected.output)
+			}
+
+			for i, line := range actual.output {
+				if line != expected.output[i] {
+					t.Errorf("wrong output at -O%d for %q. got=%q. expected=%q", level, tc.input, actual.output, expected.output)
+				}
+			}
+
+			if actual.maxDepth != tc.depth {
+				t.Errorf("wrong call depth at -O%d for %q. got=%d. expected=%d", level, tc.input, actual.maxDepth, tc.depth)
+			}
+		}
+	}
+}
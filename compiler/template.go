@@ -0,0 +1,90 @@
+package compiler
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/ir"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+)
+
+// templateParts returns the parts of a template string that are left for
+// OpConcat. Parts known at compile time are converted to text and merged with
+// the text around them, empty text is left out.
+func (c *Compiler) templateParts(node *syntax.Template, root string) []ast.Expression {
+	var parts []ast.Expression
+
+	for _, part := range node.Parts {
+		value := c.constantValue(part, root)
+		if value == nil {
+			parts = append(parts, part)
+			continue
+		}
+
+		text := value.Inspect()
+		if text == "" {
+			continue
+		}
+
+		if len(parts) > 0 {
+			if last, ok := parts[len(parts)-1].(*ast.String); ok {
+				parts[len(parts)-1] = &ast.String{Value: last.Value + text}
+				continue
+			}
+		}
+
+		parts = append(parts, &ast.String{Value: text})
+	}
+
+	// Text alone doesn't need OpConcat
+	if len(parts) == 0 {
+		return []ast.Expression{&ast.String{}}
+	}
+
+	return parts
+}
+
+// concatenates reports whether the parts of a template need OpConcat
+func concatenates(parts []ast.Expression) bool {
+	if len(parts) != 1 {
+		return true
+	}
+
+	_, text := parts[0].(*ast.String)
+
+	return !text
+}
+
+func (c *Compiler) compileTemplate(node *syntax.Template, root, previous string) error {
+	parts := c.templateParts(node, root)
+
+	for _, part := range parts {
+		err := c.Compile(part, root, "", previous)
+		if err != nil {
+			return err
+		}
+	}
+
+	if concatenates(parts) {
+		c.emit(code.OpConcat, len(parts))
+	}
+
+	return nil
+}
+
+// lowerTemplate is compileTemplate for the intermediate representation
+func (c *Compiler) lowerTemplate(b *ir.Builder, node *syntax.Template, root, previous string) error {
+	parts := c.templateParts(node, root)
+
+	for _, part := range parts {
+		err := c.lower(b, part, root, previous)
+		if err != nil {
+			return err
+		}
+	}
+
+	if concatenates(parts) {
+		b.Emit(code.OpConcat, len(parts))
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package compiler
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+	"testing"
+)
+
+// parseTemplates parses input with every template(parts...) turned into a
+// template string, the parser doesn't know them yet
+func parseTemplates(input string) *ast.Program {
+	return parseCalls(input, "template", func(call *ast.CallExpression) ast.Expression {
+		return &syntax.Template{Parts: call.Parameters}
+	})
+}
+
+func TestCompiler_Templates(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `var name = "x"; template("hello ", name, "!")`,
+			expectedConstants: []interface{}{"x", "hello ", "!"},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpConcat, 3),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseTemplates,
+		},
+		{
+			// Parts known at compile time are merged with the text around them
+			input:             `var x = 1; template("a", "b", 1 + 2, x, "c", true)`,
+			expectedConstants: []interface{}{1, "ab3", "ctrue"},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 2),
+				codetest.Make(code.OpConcat, 3),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseTemplates,
+		},
+		{
+			input:             `template("n = ", 4 * 2)`,
+			expectedConstants: []interface{}{"n = 8"},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseTemplates,
+		},
+		{
+			input:             `template("", "")`,
+			expectedConstants: []interface{}{""},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseTemplates,
+		},
+		{
+			// A value that isn't text still has to be converted
+			input:             `var x = 1; template("", x)`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConcat, 1),
+				codetest.Make(code.OpPop),
+			},
+			parse: parseTemplates,
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCompiler_TemplatePrograms(t *testing.T) {
+	tests := []programTest{
+		{`var name = "world"; print(template("hello ", name, "!"))`, []string{"hello world!"}},
+		{
+			`var f = fun(n) { template(n, " items in ", [1, 2], ", ok: ", n > 1) }; print(f(3))`,
+			[]string{"3 items in [1, 2], ok: true"},
+		},
+		{`var f = fun(a, b) { template(a, b) }; print(f("x", 1) + "!")`, []string{"x1!"}},
+		{`var x = 2; print(template(x, " * ", x, " = ", x * x))`, []string{"2 * 2 = 4"}},
+		{`print(template("nested ", template("a", len("bc"))))`, []string{"nested a2"}},
+	}
+
+	runPrograms(t, tests, parseTemplates)
+}
+
+func TestCompiler_TemplateConstants(t *testing.T) {
+	// Constants are text known at compile time
+	input := `var greeting = "hi"; var n = 3; template(greeting, " ", n)`
+	bytecode := compileProgramAt(t, declareConstants(parseTemplates(input), "greeting", "n"), 0)
+
+	err := testInstructions([]code.Instructions{codetest.Make(code.OpConstant, 2), codetest.Make(code.OpPop)}, bytecode.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed for %q with: %s", input, err)
+	}
+
+	err = testConstants([]interface{}{"hi", 3, "hi 3"}, bytecode.Constants)
+	if err != nil {
+		t.Fatalf("testConstants failed for %q with: %s", input, err)
+	}
+}
@@ -0,0 +1,310 @@
+package ir
+
+import (
+	"fmt"
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/loop/models/object"
+)
+
+// Builder appends instructions to a function the way they would be executed
+// on a stack machine. It keeps track of the values on the stack, so every
+// instruction takes its arguments from the top of the stack and jumps pass
+// the whole stack to the parameters of their target.
+type Builder struct {
+	Function *Function
+
+	constants Constants
+	block     *Block
+	stack     []Value
+	err       error
+}
+
+// NewBuilder returns a builder appending to the entry block of a new function
+func NewBuilder(constants Constants) *Builder {
+	f := NewFunction()
+
+	return &Builder{
+		Function:  f,
+		constants: constants,
+		block:     f.Blocks[0],
+	}
+}
+
+// Err returns the first error that occurred while building
+func (b *Builder) Err() error {
+	return b.err
+}
+
+func (b *Builder) fail(format string, a ...interface{}) {
+	if b.err == nil {
+		b.err = fmt.Errorf(format, a...)
+	}
+}
+
+// Reachable reports whether the instructions appended next can be executed,
+// which isn't the case after a return until another block is started
+func (b *Builder) Reachable() bool {
+	return b.block != nil && b.block.bound
+}
+
+// NewBlock returns an empty block, which is added to the function once the
+// builder switches to it. Blocks are emitted in the order they are started.
+func (b *Builder) NewBlock() *Block {
+	return b.Function.newBlock()
+}
+
+// SetBlock continues appending to block, with its parameters on the stack
+func (b *Builder) SetBlock(block *Block) {
+	b.block = block
+	b.stack = append([]Value{}, block.Params...)
+
+	for _, existing := range b.Function.Blocks {
+		if existing == block {
+			return
+		}
+	}
+
+	b.Function.Blocks = append(b.Function.Blocks, block)
+}
+
+func (b *Builder) current() *Block {
+	// Instructions after a terminator go into a block nothing jumps to
+	if b.block == nil {
+		b.SetBlock(b.NewBlock())
+	}
+
+	return b.block
+}
+
+// EmitConstant adds obj to the constants and emits an OpConstant loading it
+func (b *Builder) EmitConstant(obj object.Object) Value {
+	index, err := b.constants.AddConstant(obj)
+	if err != nil {
+		b.fail("%s", err)
+		return NoValue
+	}
+
+	return b.Emit(code.OpConstant, index)
+}
+
+// Emit appends an instruction, taking its arguments off the stack and
+// pushing its result
+func (b *Builder) Emit(op code.OpCode, operands ...int) Value {
+	def, err := code.Lookup(byte(op))
+	if err != nil {
+		b.fail("%s", err)
+		return NoValue
+	}
+
+	if def.Is(code.Jump) || def.Is(code.Terminator) || def.Is(code.Prefix) {
+		b.fail("%s can not be emitted as an instruction", def.Name)
+		return NoValue
+	}
+
+	block := b.current()
+	pops, pushes := def.StackEffect(operands)
+
+	b.fillUnreachable(pops)
+
+	if len(b.stack) < pops {
+		b.fail("stack underflow emitting %s", def.Name)
+		return NoValue
+	}
+
+	args := append([]Value{}, b.stack[len(b.stack)-pops:]...)
+	b.stack = b.stack[:len(b.stack)-pops]
+
+	ins := &Instruction{Op: op, Operands: operands, Args: args, Result: NoValue}
+
+	if pushes > 0 {
+		ins.Result = b.Function.NewValue(b.resultType(op, operands, args))
+		b.stack = append(b.stack, ins.Result)
+	}
+
+	block.Instructions = append(block.Instructions, ins)
+
+	return ins.Result
+}
+
+func (b *Builder) resultType(op code.OpCode, operands []int, args []Value) Type {
+	switch op {
+	case code.OpConstant:
+		if b.constants != nil {
+			return TypeOf(b.constants.Constant(operands[0]))
+		}
+	case code.OpTrue, code.OpFalse, code.OpEquals, code.OpNotEquals, code.OpGreaterThan:
+		return TypeBoolean
+	case code.OpNull:
+		return TypeNull
+	case code.OpArray:
+		return TypeArray
+	case code.OpHash:
+		return TypeHashmap
+	case code.OpClosure, code.OpGetBuiltinFunction:
+		return TypeFunction
+	case code.OpConcat:
+		return TypeString
+	case code.OpAdd:
+		left, right := b.Function.TypeOf(args[0]), b.Function.TypeOf(args[1])
+		if left == TypeString && right == TypeString {
+			return TypeString
+		}
+
+		return arithmetic(left, right)
+	case code.OpSubtract, code.OpMultiply, code.OpDivide:
+		return arithmetic(b.Function.TypeOf(args[0]), b.Function.TypeOf(args[1]))
+	}
+
+	return TypeAny
+}
+
+// arithmetic returns the type of arithmetic on two numbers, a float if
+// either of them is one
+func arithmetic(left, right Type) Type {
+	if (left != TypeInteger && left != TypeFloat) || (right != TypeInteger && right != TypeFloat) {
+		return TypeAny
+	}
+
+	if left == TypeFloat || right == TypeFloat {
+		return TypeFloat
+	}
+
+	return TypeInteger
+}
+
+// RemoveLastPop removes the last instruction if it is an OpPop, which leaves
+// the value it popped on the stack
+func (b *Builder) RemoveLastPop() bool {
+	if b.block == nil || len(b.block.Instructions) == 0 {
+		return false
+	}
+
+	last := b.block.Instructions[len(b.block.Instructions)-1]
+	if last.Op != code.OpPop {
+		return false
+	}
+
+	b.block.Instructions = b.block.Instructions[:len(b.block.Instructions)-1]
+	b.stack = append(b.stack, last.Args...)
+
+	return true
+}
+
+// Jump ends the current block with a jump to target
+func (b *Builder) Jump(target *Block) {
+	b.terminate(Terminator{Kind: Jump, Value: NoValue, Then: target})
+}
+
+// Branch takes a condition off the stack and ends the current block with a
+// branch on it
+func (b *Builder) Branch(then, els *Block) {
+	condition := b.pop()
+	b.terminate(Terminator{Kind: Branch, Value: condition, Then: then, Else: els})
+}
+
+// Return ends the current block by returning null
+func (b *Builder) Return() {
+	b.terminate(Terminator{Kind: Return, Value: NoValue})
+}
+
+// ReturnValue takes a value off the stack and ends the current block by
+// returning it
+func (b *Builder) ReturnValue() {
+	value := b.pop()
+	b.terminate(Terminator{Kind: ReturnValue, Value: value})
+}
+
+// TailCall takes a function and its arguments off the stack and ends the
+// current block by calling it in place of the current function
+func (b *Builder) TailCall(arguments int) {
+	b.current()
+	b.fillUnreachable(arguments + 1)
+
+	if len(b.stack) < arguments+1 {
+		b.fail("stack underflow ending block %d", b.current().ID)
+		return
+	}
+
+	args := append([]Value{}, b.stack[len(b.stack)-arguments-1:]...)
+	b.stack = b.stack[:len(b.stack)-arguments-1]
+
+	b.terminate(Terminator{Kind: TailCall, Value: NoValue, Args: args})
+}
+
+// Exit ends the current block and with it the top-level program
+func (b *Builder) Exit() {
+	b.terminate(Terminator{Kind: Exit, Value: NoValue})
+}
+
+// fillUnreachable gives unreachable code the values it expects on the stack,
+// like the value of an if whose branches both return. Unreachable blocks are
+// never emitted, so these values never have to exist.
+func (b *Builder) fillUnreachable(values int) {
+	if b.Reachable() {
+		return
+	}
+
+	for len(b.stack) < values {
+		b.stack = append([]Value{b.Function.NewValue(TypeAny)}, b.stack...)
+	}
+}
+
+func (b *Builder) pop() Value {
+	b.fillUnreachable(1)
+
+	if len(b.stack) == 0 {
+		b.fail("stack underflow ending block %d", b.current().ID)
+		return NoValue
+	}
+
+	value := b.stack[len(b.stack)-1]
+	b.stack = b.stack[:len(b.stack)-1]
+
+	return value
+}
+
+func (b *Builder) terminate(t Terminator) {
+	block := b.current()
+
+	if t.Kind == Jump || t.Kind == Branch {
+		t.Args = b.stack
+
+		if block.bound {
+			for _, target := range t.Successors() {
+				b.bind(target, t.Args)
+			}
+		}
+	}
+
+	block.Terminator = t
+
+	b.block = nil
+	b.stack = nil
+}
+
+// bind passes args to the parameters of target, creating them for the first
+// jump to target
+func (b *Builder) bind(target *Block, args []Value) {
+	if !target.bound {
+		target.bound = true
+
+		target.Params = make([]Value, len(args))
+		for i, arg := range args {
+			target.Params[i] = b.Function.NewValue(b.Function.TypeOf(arg))
+		}
+
+		return
+	}
+
+	if len(target.Params) != len(args) {
+		b.fail("block %d expects %d values on the stack. got=%d", target.ID, len(target.Params), len(args))
+		return
+	}
+
+	// A parameter receiving values of different types can be either
+	for i, param := range target.Params {
+		if b.Function.TypeOf(args[i]) != b.Function.TypeOf(param) {
+			b.Function.Types[param] = TypeAny
+		}
+	}
+}
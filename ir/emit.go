@@ -0,0 +1,156 @@
+package ir
+
+import (
+	"fmt"
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/peephole"
+)
+
+// Emit turns a function into instructions, with a label for every block
+// that is jumped to. Unreachable blocks are left out. It returns an error if
+// values aren't used in the order they are on the stack.
+func Emit(f *Function) ([]peephole.Instruction, error) {
+	reachable := Reachable(f)
+
+	var layout []*Block
+	for _, block := range f.Blocks {
+		if reachable[block] {
+			layout = append(layout, block)
+		}
+	}
+
+	exitLabel := f.nextBlock
+	var out []peephole.Instruction
+
+	for i, block := range layout {
+		var next *Block
+		if i+1 < len(layout) {
+			next = layout[i+1]
+		}
+
+		out = append(out, peephole.Label(block.ID))
+
+		stack := append([]Value{}, block.Params...)
+
+		for _, ins := range block.Instructions {
+			if !onTop(stack, ins.Args) {
+				return nil, fmt.Errorf("%s in block %d uses values that are not on top of the stack", name(ins.Op), block.ID)
+			}
+
+			stack = stack[:len(stack)-len(ins.Args)]
+
+			if ins.Result != NoValue {
+				stack = append(stack, ins.Result)
+			}
+
+			out = append(out, peephole.Make(ins.Op, ins.Operands...))
+		}
+
+		t := block.Terminator
+
+		if t.Kind == Branch || t.Kind == ReturnValue {
+			if !onTop(stack, []Value{t.Value}) {
+				return nil, fmt.Errorf("terminator of block %d uses a value that is not on top of the stack", block.ID)
+			}
+
+			stack = stack[:len(stack)-1]
+		}
+
+		if t.Kind == TailCall {
+			if !onTop(stack, t.Args) {
+				return nil, fmt.Errorf("terminator of block %d uses a value that is not on top of the stack", block.ID)
+			}
+
+			stack = stack[:len(stack)-len(t.Args)]
+		}
+
+		if t.Kind == Jump || t.Kind == Branch {
+			if len(stack) != len(t.Args) || !onTop(stack, t.Args) {
+				return nil, fmt.Errorf("block %d does not pass the stack to its successors", block.ID)
+			}
+
+			for _, successor := range t.Successors() {
+				if len(successor.Params) != len(t.Args) {
+					return nil, fmt.Errorf("block %d expects %d values on the stack. got=%d", successor.ID, len(successor.Params), len(t.Args))
+				}
+			}
+		}
+
+		switch t.Kind {
+		case Exit:
+			if next != nil {
+				out = append(out, peephole.Make(code.OpJump, exitLabel))
+			}
+		case Jump:
+			if t.Then != next {
+				out = append(out, peephole.Make(code.OpJump, t.Then.ID))
+			}
+		case Branch:
+			out = append(out, peephole.Make(code.OpJumpIfNotTrue, t.Else.ID))
+
+			if t.Then != next {
+				out = append(out, peephole.Make(code.OpJump, t.Then.ID))
+			}
+		case Return:
+			out = append(out, peephole.Make(code.OpReturn))
+		case ReturnValue:
+			out = append(out, peephole.Make(code.OpReturnValue))
+		case TailCall:
+			out = append(out, peephole.Make(code.OpTailCall, len(t.Args)-1))
+		}
+	}
+
+	out = append(out, peephole.Label(exitLabel))
+
+	return out, nil
+}
+
+// Reachable returns the blocks that can be reached from the entry block
+func Reachable(f *Function) map[*Block]bool {
+	reachable := map[*Block]bool{}
+
+	if len(f.Blocks) == 0 {
+		return reachable
+	}
+
+	work := []*Block{f.Blocks[0]}
+	reachable[f.Blocks[0]] = true
+
+	for len(work) > 0 {
+		block := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		for _, successor := range block.Terminator.Successors() {
+			if !reachable[successor] {
+				reachable[successor] = true
+				work = append(work, successor)
+			}
+		}
+	}
+
+	return reachable
+}
+
+func onTop(stack []Value, values []Value) bool {
+	if len(stack) < len(values) {
+		return false
+	}
+
+	top := stack[len(stack)-len(values):]
+	for i, v := range values {
+		if top[i] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func name(op code.OpCode) string {
+	def, err := code.Lookup(byte(op))
+	if err != nil {
+		return err.Error()
+	}
+
+	return def.Name
+}
@@ -0,0 +1,270 @@
+// Package ir is the intermediate representation between the AST and
+// bytecode. A function is a list of basic blocks, each ending in a terminator
+// that makes its control flow explicit. Instructions are the opcodes of the
+// code package, but they take their operands as values instead of from an
+// implicit stack.
+//
+// Values are in SSA form, a value that flows from one block into another is
+// passed to a parameter of that block. Because the backend emits instructions
+// for a stack machine, values are used exactly once and in the order they are
+// defined, like the operand stack would.
+package ir
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/values"
+	"github.com/looplanguage/loop/models/object"
+)
+
+// Type is the static type of a value, TypeAny if it isn't known
+type Type int
+
+const (
+	TypeAny Type = iota
+	TypeInteger
+	TypeFloat
+	TypeString
+	TypeBoolean
+	TypeNull
+	TypeArray
+	TypeHashmap
+	TypeFunction
+)
+
+var typeNames = map[Type]string{
+	TypeAny:      "any",
+	TypeInteger:  "int",
+	TypeFloat:    "float",
+	TypeString:   "string",
+	TypeBoolean:  "bool",
+	TypeNull:     "null",
+	TypeArray:    "array",
+	TypeHashmap:  "hashmap",
+	TypeFunction: "function",
+}
+
+func (t Type) String() string {
+	return typeNames[t]
+}
+
+// TypeOf returns the type of a constant
+func TypeOf(obj object.Object) Type {
+	switch obj.(type) {
+	case *object.Integer:
+		return TypeInteger
+	case *values.Float:
+		return TypeFloat
+	case *object.String:
+		return TypeString
+	case *object.Boolean:
+		return TypeBoolean
+	case *object.Null:
+		return TypeNull
+	case *object.Array:
+		return TypeArray
+	case *object.Hashmap:
+		return TypeHashmap
+	case *object.CompiledFunction:
+		return TypeFunction
+	}
+
+	return TypeAny
+}
+
+// Value is the result of an instruction or a parameter of a block
+type Value int
+
+// NoValue is the result of instructions that don't push anything
+const NoValue Value = -1
+
+type Instruction struct {
+	Op code.OpCode
+	// Operands of the opcode itself, like the index of a constant
+	Operands []int
+	// Values the instruction pops off the stack, the last one is the top
+	Args   []Value
+	Result Value
+}
+
+type TerminatorKind int
+
+const (
+	// Exit ends the top-level program
+	Exit TerminatorKind = iota
+	// Jump continues with Then
+	Jump
+	// Branch continues with Then if Value is true and with Else otherwise
+	Branch
+	// Return returns from a function without taking a value off the stack
+	Return
+	// ReturnValue returns Value from a function
+	ReturnValue
+	// TailCall calls the function in Args with the rest of Args as its
+	// arguments, in place of the current function
+	TailCall
+)
+
+type Terminator struct {
+	Kind  TerminatorKind
+	Value Value
+	Then  *Block
+	Else  *Block
+	// Values passed to the parameters of Then and Else, or the function and
+	// arguments of a tail call
+	Args []Value
+}
+
+// Successors returns the blocks the terminator can continue with
+func (t *Terminator) Successors() []*Block {
+	switch t.Kind {
+	case Jump:
+		return []*Block{t.Then}
+	case Branch:
+		return []*Block{t.Then, t.Else}
+	}
+
+	return nil
+}
+
+type Block struct {
+	ID           int
+	Params       []Value
+	Instructions []*Instruction
+	Terminator   Terminator
+
+	// Whether any reachable block jumps to this block, which fixes its
+	// parameters
+	bound bool
+}
+
+type Function struct {
+	// Blocks in the order they are emitted, the first block is the entry
+	Blocks []*Block
+	// Type of every value
+	Types []Type
+
+	nextBlock int
+}
+
+// NewFunction returns a function with only an entry block
+func NewFunction() *Function {
+	f := &Function{}
+
+	entry := f.NewBlock()
+	entry.bound = true
+
+	return f
+}
+
+// NewBlock appends an empty block to the function
+func (f *Function) NewBlock() *Block {
+	block := f.newBlock()
+	f.Blocks = append(f.Blocks, block)
+
+	return block
+}
+
+// newBlock returns an empty block that isn't part of the function yet
+func (f *Function) newBlock() *Block {
+	block := &Block{ID: f.nextBlock}
+	f.nextBlock++
+
+	return block
+}
+
+// NewValue returns a new value of the given type
+func (f *Function) NewValue(t Type) Value {
+	f.Types = append(f.Types, t)
+	return Value(len(f.Types) - 1)
+}
+
+// TypeOf returns the type of a value
+func (f *Function) TypeOf(v Value) Type {
+	if v < 0 || int(v) >= len(f.Types) {
+		return TypeAny
+	}
+
+	return f.Types[v]
+}
+
+func (f *Function) String() string {
+	var out bytes.Buffer
+
+	for _, block := range f.Blocks {
+		fmt.Fprintf(&out, "b%d%s:\n", block.ID, valueList(block.Params))
+
+		for _, ins := range block.Instructions {
+			out.WriteString("  ")
+
+			if ins.Result != NoValue {
+				fmt.Fprintf(&out, "v%d %s = ", ins.Result, f.TypeOf(ins.Result))
+			}
+
+			def, err := code.Lookup(byte(ins.Op))
+			if err != nil {
+				fmt.Fprintf(&out, "%s\n", err)
+				continue
+			}
+
+			out.WriteString(def.Name)
+
+			for _, operand := range ins.Operands {
+				fmt.Fprintf(&out, " %d", operand)
+			}
+
+			for _, arg := range ins.Args {
+				fmt.Fprintf(&out, " v%d", arg)
+			}
+
+			out.WriteString("\n")
+		}
+
+		t := block.Terminator
+
+		switch t.Kind {
+		case Exit:
+			out.WriteString("  exit\n")
+		case Jump:
+			fmt.Fprintf(&out, "  jump b%d%s\n", t.Then.ID, valueList(t.Args))
+		case Branch:
+			fmt.Fprintf(&out, "  branch v%d b%d b%d%s\n", t.Value, t.Then.ID, t.Else.ID, valueList(t.Args))
+		case Return:
+			out.WriteString("  return\n")
+		case ReturnValue:
+			fmt.Fprintf(&out, "  return v%d\n", t.Value)
+		case TailCall:
+			fmt.Fprintf(&out, "  tailcall%s\n", valueList(t.Args))
+		}
+	}
+
+	return out.String()
+}
+
+func valueList(values []Value) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	var out bytes.Buffer
+	out.WriteString("(")
+
+	for i, v := range values {
+		if i > 0 {
+			out.WriteString(", ")
+		}
+
+		fmt.Fprintf(&out, "v%d", v)
+	}
+
+	out.WriteString(")")
+
+	return out.String()
+}
+
+// Constants gives access to the constant pool of the compiler
+type Constants interface {
+	Constant(index int) object.Object
+	AddConstant(obj object.Object) (int, error)
+}
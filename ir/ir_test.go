@@ -0,0 +1,241 @@
+package ir
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"github.com/looplanguage/compiler/peephole"
+	"github.com/looplanguage/loop/models/object"
+	"testing"
+)
+
+type testConstants []object.Object
+
+func (c *testConstants) Constant(index int) object.Object {
+	return (*c)[index]
+}
+
+func (c *testConstants) AddConstant(obj object.Object) (int, error) {
+	*c = append(*c, obj)
+	return len(*c) - 1, nil
+}
+
+// buildConditional builds 1 + if(true) { 2 } else { 3 }
+func buildConditional() (*Builder, *testConstants) {
+	constants := &testConstants{
+		&object.Integer{Value: 1},
+		&object.Integer{Value: 2},
+		&object.Integer{Value: 3},
+	}
+
+	b := NewBuilder(constants)
+	consequence, alternative, after := b.NewBlock(), b.NewBlock(), b.NewBlock()
+
+	b.Emit(code.OpConstant, 0)
+	b.Emit(code.OpTrue)
+	b.Branch(consequence, alternative)
+
+	b.SetBlock(consequence)
+	b.Emit(code.OpConstant, 1)
+	b.Jump(after)
+
+	b.SetBlock(alternative)
+	b.Emit(code.OpConstant, 2)
+	b.Jump(after)
+
+	b.SetBlock(after)
+	b.Emit(code.OpAdd)
+	b.Emit(code.OpPop)
+	b.Exit()
+
+	return b, constants
+}
+
+func TestBuilder(t *testing.T) {
+	b, _ := buildConditional()
+	if b.Err() != nil {
+		t.Fatalf("unable to build. error=%q", b.Err())
+	}
+
+	expected := `b0:
+  v0 int = OpConstant 0
+  v1 bool = OpTrue
+  branch v1 b1 b2(v0)
+b1(v2):
+  v4 int = OpConstant 1
+  jump b3(v2, v4)
+b2(v3):
+  v7 int = OpConstant 2
+  jump b3(v3, v7)
+b3(v5, v6):
+  v8 int = OpAdd v5 v6
+  OpPop v8
+  exit
+`
+
+	if b.Function.String() != expected {
+		t.Fatalf("wrong function. got=\n%s\nexpected=\n%s", b.Function, expected)
+	}
+}
+
+func TestBuilder_Errors(t *testing.T) {
+	tests := []struct {
+		build    func(b *Builder)
+		expected string
+	}{
+		{
+			func(b *Builder) { b.Emit(code.OpPop) },
+			"stack underflow emitting OpPop",
+		},
+		{
+			func(b *Builder) { b.Emit(code.OpJump, 0) },
+			"OpJump can not be emitted as an instruction",
+		},
+		{
+			func(b *Builder) {
+				after, other := b.NewBlock(), b.NewBlock()
+
+				b.Emit(code.OpTrue)
+				b.Branch(other, after)
+
+				b.SetBlock(other)
+				b.Emit(code.OpNull)
+				b.Jump(after)
+			},
+			"block 1 expects 0 values on the stack. got=1",
+		},
+	}
+
+	for _, tc := range tests {
+		b := NewBuilder(&testConstants{})
+		tc.build(b)
+
+		if b.Err() == nil || b.Err().Error() != tc.expected {
+			t.Errorf("incorrect error. got=%q. expected=%q", b.Err(), tc.expected)
+		}
+	}
+}
+
+func TestBuilder_Unreachable(t *testing.T) {
+	b := NewBuilder(&testConstants{})
+
+	b.Emit(code.OpNull)
+	b.ReturnValue()
+
+	if b.Reachable() {
+		t.Fatalf("instructions after a return are reachable")
+	}
+
+	// Unreachable blocks don't decide what the parameters of a block are
+	after := b.NewBlock()
+	b.Emit(code.OpNull)
+	b.Jump(after)
+
+	b.SetBlock(after)
+
+	if b.Reachable() || len(after.Params) != 0 {
+		t.Fatalf("block only jumped to by unreachable blocks is reachable")
+	}
+
+	// Unreachable code can use values that were never pushed
+	b.Emit(code.OpPop)
+	b.ReturnValue()
+
+	if err := b.Err(); err != nil {
+		t.Fatalf("unreachable code failed to build. error=%q", err)
+	}
+}
+
+func TestEmit(t *testing.T) {
+	b, _ := buildConditional()
+
+	list, err := Emit(b.Function)
+	if err != nil {
+		t.Fatalf("unable to emit. error=%q", err)
+	}
+
+	actual, err := peephole.Encode(list)
+	if err != nil {
+		t.Fatalf("unable to encode. error=%q", err)
+	}
+
+	expected := concat(
+		codetest.Make(code.OpConstant, 0),
+		codetest.Make(code.OpTrue),
+		codetest.Make(code.OpJumpIfNotTrue, 13),
+		codetest.Make(code.OpConstant, 1),
+		codetest.Make(code.OpJump, 16),
+		codetest.Make(code.OpConstant, 2),
+		codetest.Make(code.OpAdd),
+		codetest.Make(code.OpPop),
+	)
+
+	if actual.String() != expected.String() {
+		t.Fatalf("wrong instructions. want=\n%s\ngot=\n%s", expected, actual)
+	}
+}
+
+func TestEmit_TailCall(t *testing.T) {
+	b := NewBuilder(nil)
+
+	b.Emit(code.OpGetLocal, 0)
+	b.Emit(code.OpConstant, 0)
+	b.Emit(code.OpConstant, 1)
+	b.TailCall(2)
+
+	if err := b.Err(); err != nil {
+		t.Fatalf("unable to build. error=%q", err)
+	}
+
+	expected := "b0:\n  v0 any = OpGetLocal 0\n  v1 any = OpConstant 0\n  v2 any = OpConstant 1\n  tailcall(v0, v1, v2)\n"
+	if b.Function.String() != expected {
+		t.Fatalf("wrong function. want=\n%s\ngot=\n%s", expected, b.Function)
+	}
+
+	list, err := Emit(b.Function)
+	if err != nil {
+		t.Fatalf("unable to emit. error=%q", err)
+	}
+
+	actual, err := peephole.Encode(list)
+	if err != nil {
+		t.Fatalf("unable to encode. error=%q", err)
+	}
+
+	want := concat(
+		codetest.Make(code.OpGetLocal, 0),
+		codetest.Make(code.OpConstant, 0),
+		codetest.Make(code.OpConstant, 1),
+		codetest.Make(code.OpTailCall, 2),
+	)
+
+	if actual.String() != want.String() {
+		t.Fatalf("wrong instructions. want=\n%s\ngot=\n%s", want, actual)
+	}
+}
+
+func TestEmit_Errors(t *testing.T) {
+	f := NewFunction()
+	a, b := f.NewValue(TypeInteger), f.NewValue(TypeInteger)
+
+	f.Blocks[0].Instructions = []*Instruction{
+		{Op: code.OpConstant, Operands: []int{0}, Result: a},
+		{Op: code.OpConstant, Operands: []int{1}, Result: b},
+		{Op: code.OpSubtract, Args: []Value{b, a}, Result: f.NewValue(TypeInteger)},
+	}
+
+	expected := "OpSubtract in block 0 uses values that are not on top of the stack"
+
+	_, err := Emit(f)
+	if err == nil || err.Error() != expected {
+		t.Fatalf("incorrect error. got=%q. expected=%q", err, expected)
+	}
+}
+
+func concat(s ...code.Instructions) code.Instructions {
+	out := code.Instructions{}
+	for _, ins := range s {
+		out = append(out, ins...)
+	}
+
+	return out
+}
@@ -0,0 +1,472 @@
+package ir
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/values"
+	"github.com/looplanguage/loop/models/object"
+	"math"
+)
+
+// Pass is an optimization, it reports whether it changed the function
+type Pass func(f *Function, constants Constants) (bool, error)
+
+// Passes are the optimizations Optimize runs, in order
+var Passes = []Pass{
+	FoldConstants,
+	FoldBranches,
+	RemoveUnusedValues,
+	SimplifyBlocks,
+}
+
+// Optimize runs passes until none of them changes the function anymore
+func Optimize(f *Function, constants Constants, passes []Pass) error {
+	for {
+		changed := false
+
+		for _, pass := range passes {
+			c, err := pass(f, constants)
+			if err != nil {
+				return err
+			}
+
+			changed = changed || c
+		}
+
+		if !changed {
+			return nil
+		}
+	}
+}
+
+// definitions returns the instruction defining every value of a block
+func definitions(block *Block) map[Value]*Instruction {
+	defs := map[Value]*Instruction{}
+
+	for _, ins := range block.Instructions {
+		if ins.Result != NoValue {
+			defs[ins.Result] = ins
+		}
+	}
+
+	return defs
+}
+
+// remove removes the given instructions from a block
+func remove(block *Block, removed map[*Instruction]bool) {
+	if len(removed) == 0 {
+		return
+	}
+
+	kept := block.Instructions[:0]
+
+	for _, ins := range block.Instructions {
+		if !removed[ins] {
+			kept = append(kept, ins)
+		}
+	}
+
+	block.Instructions = kept
+}
+
+// FoldConstants evaluates arithmetic and comparisons of constants. Because
+// values are used in stack order, the instructions defining the operands can
+// be removed and the result takes their place on the stack.
+func FoldConstants(f *Function, constants Constants) (bool, error) {
+	changed := false
+
+	for _, block := range f.Blocks {
+		defs := definitions(block)
+		removed := map[*Instruction]bool{}
+
+		for _, ins := range block.Instructions {
+			if removed[ins] || len(ins.Args) != 2 {
+				continue
+			}
+
+			left, right := defs[ins.Args[0]], defs[ins.Args[1]]
+			if left == nil || right == nil {
+				continue
+			}
+
+			op, operands, ok, err := fold(ins.Op, constant(left, constants), constant(right, constants), constants)
+			if err != nil {
+				return changed, err
+			}
+
+			if !ok {
+				continue
+			}
+
+			removed[left] = true
+			removed[right] = true
+
+			ins.Op = op
+			ins.Operands = operands
+			ins.Args = nil
+			f.Types[ins.Result] = resultOf(op, operands, constants)
+
+			changed = true
+		}
+
+		remove(block, removed)
+	}
+
+	return changed, nil
+}
+
+// constant returns the object an instruction pushes if it is a constant
+func constant(ins *Instruction, constants Constants) object.Object {
+	switch ins.Op {
+	case code.OpConstant:
+		return constants.Constant(ins.Operands[0])
+	case code.OpTrue:
+		return &object.Boolean{Value: true}
+	case code.OpFalse:
+		return &object.Boolean{Value: false}
+	}
+
+	return nil
+}
+
+func resultOf(op code.OpCode, operands []int, constants Constants) Type {
+	if op == code.OpConstant {
+		return TypeOf(constants.Constant(operands[0]))
+	}
+
+	return TypeBoolean
+}
+
+func fold(op code.OpCode, left, right object.Object, constants Constants) (code.OpCode, []int, bool, error) {
+	return folded(Evaluate(op, left, right), constants)
+}
+
+// Evaluate applies the operation of op to two values known at compile time.
+// It returns nil if it can't, operations that fail are left to the VM.
+func Evaluate(op code.OpCode, left, right object.Object) object.Object {
+	if l, r, ok := values.Floats(left, right); ok {
+		return evaluateFloats(op, l, r)
+	}
+
+	switch left := left.(type) {
+	case *object.Integer:
+		right, ok := right.(*object.Integer)
+		if !ok {
+			return nil
+		}
+
+		switch op {
+		case code.OpAdd:
+			return &object.Integer{Value: left.Value + right.Value}
+		case code.OpSubtract:
+			return &object.Integer{Value: left.Value - right.Value}
+		case code.OpMultiply:
+			return &object.Integer{Value: left.Value * right.Value}
+		case code.OpDivide:
+			// Division by zero is left to the VM
+			if right.Value == 0 {
+				return nil
+			}
+
+			return &object.Integer{Value: left.Value / right.Value}
+		case code.OpEquals:
+			return &object.Boolean{Value: left.Value == right.Value}
+		case code.OpNotEquals:
+			return &object.Boolean{Value: left.Value != right.Value}
+		case code.OpGreaterThan:
+			return &object.Boolean{Value: left.Value > right.Value}
+		}
+	case *object.String:
+		if right, ok := right.(*object.String); ok && op == code.OpAdd {
+			return &object.String{Value: left.Value + right.Value}
+		}
+	case *object.Boolean:
+		right, ok := right.(*object.Boolean)
+		if !ok {
+			return nil
+		}
+
+		switch op {
+		case code.OpEquals:
+			return &object.Boolean{Value: left.Value == right.Value}
+		case code.OpNotEquals:
+			return &object.Boolean{Value: left.Value != right.Value}
+		}
+	}
+
+	return nil
+}
+
+// evaluateFloats is Evaluate for two numbers of which at least one is a
+// float, the integer is converted to a float
+func evaluateFloats(op code.OpCode, left, right float64) object.Object {
+	var result float64
+
+	switch op {
+	case code.OpAdd:
+		result = left + right
+	case code.OpSubtract:
+		result = left - right
+	case code.OpMultiply:
+		result = left * right
+	case code.OpDivide:
+		// Division by zero is left to the VM
+		if right == 0 {
+			return nil
+		}
+
+		result = left / right
+	case code.OpEquals:
+		return &object.Boolean{Value: left == right}
+	case code.OpNotEquals:
+		return &object.Boolean{Value: left != right}
+	case code.OpGreaterThan:
+		return &object.Boolean{Value: left > right}
+	default:
+		return nil
+	}
+
+	// The constant pool can't hold infinity, overflows are left to the VM
+	if math.IsInf(result, 0) {
+		return nil
+	}
+
+	return &values.Float{Value: result}
+}
+
+// folded returns the instruction pushing the result of a folded operation,
+// nil if it couldn't be folded
+func folded(result object.Object, constants Constants) (code.OpCode, []int, bool, error) {
+	switch result := result.(type) {
+	case nil:
+		return 0, nil, false, nil
+	case *object.Boolean:
+		return boolean(result.Value), nil, true, nil
+	}
+
+	index, err := constants.AddConstant(result)
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	return code.OpConstant, []int{index}, true, nil
+}
+
+func boolean(value bool) code.OpCode {
+	if value {
+		return code.OpTrue
+	}
+
+	return code.OpFalse
+}
+
+// FoldBranches replaces branches on a constant condition by a jump
+func FoldBranches(f *Function, constants Constants) (bool, error) {
+	changed := false
+
+	for _, block := range f.Blocks {
+		t := &block.Terminator
+		if t.Kind != Branch {
+			continue
+		}
+
+		condition := definitions(block)[t.Value]
+		if condition == nil || (condition.Op != code.OpTrue && condition.Op != code.OpFalse) {
+			continue
+		}
+
+		target := t.Then
+		if condition.Op == code.OpFalse {
+			target = t.Else
+		}
+
+		remove(block, map[*Instruction]bool{condition: true})
+		*t = Terminator{Kind: Jump, Value: NoValue, Then: target, Args: t.Args}
+
+		changed = true
+	}
+
+	return changed, nil
+}
+
+// pure opcodes have no effect other than pushing their result
+var pure = map[code.OpCode]bool{
+	code.OpConstant:           true,
+	code.OpTrue:               true,
+	code.OpFalse:              true,
+	code.OpNull:               true,
+	code.OpGetVar:             true,
+	code.OpGetLocal:           true,
+	code.OpGetGlobal:          true,
+	code.OpGetFree:            true,
+	code.OpGetBuiltinFunction: true,
+	code.OpClosure:            true,
+	code.OpLoadCell:           true,
+	code.OpArray:              true,
+	code.OpHash:               true,
+	code.OpConcat:             true,
+}
+
+// RemoveUnusedValues removes values that are only popped, together with
+// everything that computed them as long as it has no other effects
+func RemoveUnusedValues(f *Function, constants Constants) (bool, error) {
+	changed := false
+
+	for _, block := range f.Blocks {
+		defs := definitions(block)
+		removed := map[*Instruction]bool{}
+
+		var unused func(v Value) bool
+		unused = func(v Value) bool {
+			def := defs[v]
+			if def == nil || !pure[def.Op] {
+				return false
+			}
+
+			for _, arg := range def.Args {
+				if !unused(arg) {
+					return false
+				}
+			}
+
+			return true
+		}
+
+		var mark func(v Value)
+		mark = func(v Value) {
+			def := defs[v]
+			removed[def] = true
+
+			for _, arg := range def.Args {
+				mark(arg)
+			}
+		}
+
+		for _, ins := range block.Instructions {
+			if ins.Op == code.OpPop && unused(ins.Args[0]) {
+				removed[ins] = true
+				mark(ins.Args[0])
+				changed = true
+			}
+		}
+
+		remove(block, removed)
+	}
+
+	return changed, nil
+}
+
+// SimplifyBlocks removes unreachable blocks, skips blocks that only jump
+// elsewhere and merges blocks into their only predecessor
+func SimplifyBlocks(f *Function, constants Constants) (bool, error) {
+	changed := removeUnreachable(f)
+
+	// Skip empty blocks that only jump elsewhere
+	for _, block := range f.Blocks {
+		t := &block.Terminator
+
+		for _, target := range []**Block{&t.Then, &t.Else} {
+			// Blocks that only jump to each other loop forever, which is left
+			// alone by giving up after visiting every block once
+			for hops := 0; *target != nil && isForwarder(*target) && hops < len(f.Blocks); hops++ {
+				*target = (*target).Terminator.Then
+				changed = true
+			}
+		}
+	}
+
+	changed = removeUnreachable(f) || changed
+
+	for {
+		predecessors := map[*Block]int{}
+		for _, block := range f.Blocks {
+			for _, successor := range block.Terminator.Successors() {
+				predecessors[successor]++
+			}
+		}
+
+		merged := false
+
+		for _, block := range f.Blocks {
+			t := block.Terminator
+			if t.Kind != Jump || t.Then == block || t.Then == f.Blocks[0] || predecessors[t.Then] != 1 {
+				continue
+			}
+
+			mergeInto(block, t.Then)
+			removeBlock(f, t.Then)
+
+			merged = true
+			break
+		}
+
+		if !merged {
+			return changed, nil
+		}
+
+		changed = true
+	}
+}
+
+func isForwarder(block *Block) bool {
+	t := block.Terminator
+
+	return len(block.Instructions) == 0 && len(block.Params) == 0 && t.Kind == Jump && len(t.Args) == 0 && t.Then != block
+}
+
+// mergeInto appends the instructions of successor to block, which is its only
+// predecessor. The parameters of successor are replaced by what block passes.
+func mergeInto(block, successor *Block) {
+	replace := map[Value]Value{}
+	for i, param := range successor.Params {
+		replace[param] = block.Terminator.Args[i]
+	}
+
+	substitute := func(v Value) Value {
+		if r, ok := replace[v]; ok {
+			return r
+		}
+
+		return v
+	}
+
+	for _, ins := range successor.Instructions {
+		for i, arg := range ins.Args {
+			ins.Args[i] = substitute(arg)
+		}
+	}
+
+	t := successor.Terminator
+	t.Value = substitute(t.Value)
+
+	args := make([]Value, len(t.Args))
+	for i, arg := range t.Args {
+		args[i] = substitute(arg)
+	}
+	t.Args = args
+
+	block.Instructions = append(block.Instructions, successor.Instructions...)
+	block.Terminator = t
+}
+
+func removeUnreachable(f *Function) bool {
+	reachable := Reachable(f)
+	changed := false
+
+	for _, block := range append([]*Block{}, f.Blocks...) {
+		if !reachable[block] {
+			removeBlock(f, block)
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+func removeBlock(f *Function, removed *Block) {
+	for i, block := range f.Blocks {
+		if block == removed {
+			f.Blocks = append(f.Blocks[:i], f.Blocks[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package ir
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/values"
+	"github.com/looplanguage/loop/models/object"
+	"testing"
+)
+
+func TestFoldConstants(t *testing.T) {
+	tests := []struct {
+		constants []object.Object
+		build     func(b *Builder)
+		expected  string
+	}{
+		{
+			// 1 + 2 * 3
+			[]object.Object{&object.Integer{Value: 1}, &object.Integer{Value: 2}, &object.Integer{Value: 3}},
+			func(b *Builder) {
+				b.Emit(code.OpConstant, 0)
+				b.Emit(code.OpConstant, 1)
+				b.Emit(code.OpConstant, 2)
+				b.Emit(code.OpMultiply)
+				b.Emit(code.OpAdd)
+				b.Emit(code.OpPop)
+			},
+			"b0:\n  v4 int = OpConstant 4\n  OpPop v4\n  exit\n",
+		},
+		{
+			// "a" + "b" == "ab", only the concatenation of strings is folded
+			[]object.Object{&object.String{Value: "a"}, &object.String{Value: "b"}, &object.String{Value: "ab"}},
+			func(b *Builder) {
+				b.Emit(code.OpConstant, 0)
+				b.Emit(code.OpConstant, 1)
+				b.Emit(code.OpAdd)
+				b.Emit(code.OpConstant, 2)
+				b.Emit(code.OpEquals)
+				b.Emit(code.OpPop)
+			},
+			"b0:\n  v2 string = OpConstant 3\n  v3 string = OpConstant 2\n  v4 bool = OpEquals v2 v3\n  OpPop v4\n  exit\n",
+		},
+		{
+			// 1 > 2
+			[]object.Object{&object.Integer{Value: 1}, &object.Integer{Value: 2}},
+			func(b *Builder) {
+				b.Emit(code.OpConstant, 0)
+				b.Emit(code.OpConstant, 1)
+				b.Emit(code.OpGreaterThan)
+				b.Emit(code.OpPop)
+			},
+			"b0:\n  v2 bool = OpFalse\n  OpPop v2\n  exit\n",
+		},
+		{
+			// Division by zero is left to the VM
+			[]object.Object{&object.Integer{Value: 1}, &object.Integer{Value: 0}},
+			func(b *Builder) {
+				b.Emit(code.OpConstant, 0)
+				b.Emit(code.OpConstant, 1)
+				b.Emit(code.OpDivide)
+				b.Emit(code.OpPop)
+			},
+			"b0:\n  v0 int = OpConstant 0\n  v1 int = OpConstant 1\n  v2 int = OpDivide v0 v1\n  OpPop v2\n  exit\n",
+		},
+		{
+			// 1 + 0.5, the integer is converted to a float
+			[]object.Object{&object.Integer{Value: 1}, &values.Float{Value: 0.5}},
+			func(b *Builder) {
+				b.Emit(code.OpConstant, 0)
+				b.Emit(code.OpConstant, 1)
+				b.Emit(code.OpAdd)
+				b.Emit(code.OpPop)
+			},
+			"b0:\n  v2 float = OpConstant 2\n  OpPop v2\n  exit\n",
+		},
+		{
+			// 0.5 > 1
+			[]object.Object{&values.Float{Value: 0.5}, &object.Integer{Value: 1}},
+			func(b *Builder) {
+				b.Emit(code.OpConstant, 0)
+				b.Emit(code.OpConstant, 1)
+				b.Emit(code.OpGreaterThan)
+				b.Emit(code.OpPop)
+			},
+			"b0:\n  v2 bool = OpFalse\n  OpPop v2\n  exit\n",
+		},
+		{
+			// 1e308 * 10 overflows to infinity, which is left to the VM
+			[]object.Object{&values.Float{Value: 1e308}, &object.Integer{Value: 10}},
+			func(b *Builder) {
+				b.Emit(code.OpConstant, 0)
+				b.Emit(code.OpConstant, 1)
+				b.Emit(code.OpMultiply)
+				b.Emit(code.OpPop)
+			},
+			"b0:\n  v0 float = OpConstant 0\n  v1 int = OpConstant 1\n  v2 float = OpMultiply v0 v1\n  OpPop v2\n  exit\n",
+		},
+	}
+
+	for _, tc := range tests {
+		constants := testConstants(tc.constants)
+		b := NewBuilder(&constants)
+
+		tc.build(b)
+		b.Exit()
+
+		_, err := FoldConstants(b.Function, &constants)
+		if err != nil {
+			t.Fatalf("unable to fold constants. error=%q", err)
+		}
+
+		if b.Function.String() != tc.expected {
+			t.Errorf("wrong function. got=\n%s\nexpected=\n%s", b.Function, tc.expected)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		op          code.OpCode
+		left, right object.Object
+		// Inspect of the result, "" if it isn't evaluated
+		expected string
+	}{
+		{code.OpAdd, &object.Integer{Value: 1}, &object.Integer{Value: 2}, "3"},
+		{code.OpSubtract, &object.Integer{Value: 1}, &object.Integer{Value: 2}, "-1"},
+		{code.OpMultiply, &object.Integer{Value: 3}, &object.Integer{Value: 2}, "6"},
+		{code.OpDivide, &object.Integer{Value: 7}, &object.Integer{Value: 2}, "3"},
+		{code.OpDivide, &object.Integer{Value: 7}, &object.Integer{Value: 0}, ""},
+		{code.OpGreaterThan, &object.Integer{Value: 2}, &object.Integer{Value: 1}, "true"},
+		{code.OpEquals, &object.Integer{Value: 2}, &object.Integer{Value: 1}, "false"},
+		{code.OpAdd, &object.String{Value: "a"}, &object.String{Value: "b"}, "ab"},
+		{code.OpSubtract, &object.String{Value: "a"}, &object.String{Value: "b"}, ""},
+		{code.OpNotEquals, &object.Boolean{Value: true}, &object.Boolean{Value: false}, "true"},
+		{code.OpGreaterThan, &object.Boolean{Value: true}, &object.Boolean{Value: false}, ""},
+		{code.OpAdd, &object.Integer{Value: 1}, &object.String{Value: "b"}, ""},
+		{code.OpAdd, &values.Float{Value: 0.5}, &object.Integer{Value: 1}, "1.5"},
+		{code.OpDivide, &object.Integer{Value: 1}, &values.Float{Value: 4}, "0.25"},
+		{code.OpGreaterThan, &object.Integer{Value: 1}, &values.Float{Value: 0.5}, "true"},
+		{code.OpDivide, &values.Float{Value: 1}, &values.Float{Value: 0}, ""},
+		{code.OpMultiply, &values.Float{Value: 1e308}, &values.Float{Value: 10}, ""},
+	}
+
+	for _, tc := range tests {
+		result := Evaluate(tc.op, tc.left, tc.right)
+
+		got := ""
+		if result != nil {
+			got = result.Inspect()
+		}
+
+		if got != tc.expected {
+			t.Errorf("wrong result for %s op %d %s. got=%q. expected=%q", tc.left.Inspect(), tc.op, tc.right.Inspect(), got, tc.expected)
+		}
+	}
+}
+
+func TestRemoveUnusedValues(t *testing.T) {
+	constants := &testConstants{&object.Integer{Value: 1}}
+	b := NewBuilder(constants)
+
+	// [1, 1] is never used, len(1) might fail
+	b.Emit(code.OpConstant, 0)
+	b.Emit(code.OpConstant, 0)
+	b.Emit(code.OpArray, 2)
+	b.Emit(code.OpPop)
+	b.Emit(code.OpGetBuiltinFunction, 0)
+	b.Emit(code.OpConstant, 0)
+	b.Emit(code.OpCall, 1)
+	b.Emit(code.OpPop)
+	b.Exit()
+
+	_, err := RemoveUnusedValues(b.Function, constants)
+	if err != nil {
+		t.Fatalf("unable to remove unused values. error=%q", err)
+	}
+
+	expected := "b0:\n  v3 function = OpGetBuiltinFunction 0\n  v4 int = OpConstant 0\n  v5 any = OpCall 1 v3 v4\n  OpPop v5\n  exit\n"
+
+	if b.Function.String() != expected {
+		t.Errorf("wrong function. got=\n%s\nexpected=\n%s", b.Function, expected)
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	b, constants := buildConditional()
+
+	err := Optimize(b.Function, constants, Passes)
+	if err != nil {
+		t.Fatalf("unable to optimize. error=%q", err)
+	}
+
+	// The branch always takes the first block, after which 1 + 2 is folded
+	// and never used
+	expected := "b0:\n  exit\n"
+
+	if b.Function.String() != expected {
+		t.Fatalf("wrong function. got=\n%s\nexpected=\n%s", b.Function, expected)
+	}
+}
+
+func TestSimplifyBlocks(t *testing.T) {
+	constants := &testConstants{}
+	b := NewBuilder(constants)
+
+	loop, body, after := b.NewBlock(), b.NewBlock(), b.NewBlock()
+	empty := b.NewBlock()
+
+	// while(x) { }, with the loop going through an empty block
+	b.Jump(loop)
+	b.SetBlock(loop)
+	b.Emit(code.OpGetVar, 0)
+	b.Branch(body, after)
+
+	b.SetBlock(body)
+	b.Jump(empty)
+	b.SetBlock(empty)
+	b.Jump(loop)
+
+	b.SetBlock(after)
+	b.Exit()
+
+	_, err := SimplifyBlocks(b.Function, constants)
+	if err != nil {
+		t.Fatalf("unable to simplify blocks. error=%q", err)
+	}
+
+	expected := "b0:\n  jump b1\nb1:\n  v0 any = OpGetVar 0\n  branch v0 b1 b3\nb3:\n  exit\n"
+
+	if b.Function.String() != expected {
+		t.Fatalf("wrong function. got=\n%s\nexpected=\n%s", b.Function, expected)
+	}
+}
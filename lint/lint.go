@@ -0,0 +1,607 @@
+// Package lint reports code that is valid but most likely a mistake, like
+// variables that are never used or that shadow another variable
+package lint
+
+import (
+	"fmt"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+	"sort"
+	"strings"
+)
+
+type Category int
+
+const (
+	UnusedVariable Category = iota
+	UnusedImport
+	UnusedParameter
+	Shadow
+	UnusedAssignment
+	NonExhaustiveMatch
+)
+
+// Categories are all categories, in the order they are documented
+var Categories = []Category{UnusedVariable, UnusedImport, UnusedParameter, Shadow, UnusedAssignment, NonExhaustiveMatch}
+
+var categoryNames = map[Category]string{
+	UnusedVariable:     "unused-variable",
+	UnusedImport:       "unused-import",
+	UnusedParameter:    "unused-parameter",
+	Shadow:             "shadow",
+	UnusedAssignment:   "unused-assignment",
+	NonExhaustiveMatch: "non-exhaustive-match",
+}
+
+// String returns the name of the category, as used by -W
+func (c Category) String() string {
+	return categoryNames[c]
+}
+
+// Warning is a mistake found in a program
+type Warning struct {
+	Category Category
+	// Node is the statement or expression the mistake is in
+	Node    ast.Node
+	Message string
+}
+
+// String describes the warning with the start of the node it is in. The
+// parser doesn't record where nodes are in the source, so there is no line to
+// point to.
+func (w Warning) String() string {
+	return fmt.Sprintf("warning: %s in %s [-W%s]", w.Message, describe(w.Node), w.Category)
+}
+
+// maxDescription is how many characters of a node a warning shows
+const maxDescription = 40
+
+// describe returns the start of a node, the part declaring something for
+// declarations, functions and loops
+func describe(node ast.Node) string {
+	var out string
+
+	switch node := node.(type) {
+	case *ast.VariableDeclaration:
+		out = "var " + node.Identifier.Value
+	case *syntax.ConstantDeclaration:
+		out = "const " + node.Identifier.Value
+	case *syntax.Destructuring:
+		out = "var " + node.Pattern.String()
+	case *syntax.FunctionDeclaration:
+		out = "fun " + node.Name.Value + strings.TrimPrefix(describe(node.Function), "fun")
+	case *ast.Function:
+		out = strings.TrimSuffix(node.String(), " "+node.Body.String())
+	case *syntax.Function:
+		out = strings.TrimSuffix(node.String(), " "+node.Body.String())
+	case *syntax.ForEach:
+		out = strings.TrimSuffix(node.String(), " "+node.Body.String())
+	case *syntax.Match:
+		out = "match (" + node.Subject.String() + ")"
+	default:
+		out = node.String()
+	}
+
+	if runes := []rune(out); len(runes) > maxDescription {
+		return string(runes[:maxDescription-3]) + "..."
+	}
+
+	return out
+}
+
+type kind int
+
+const (
+	declaredVariable kind = iota
+	declaredParameter
+	declaredImport
+)
+
+type variable struct {
+	name string
+	kind kind
+	// node declaring the variable
+	node ast.Node
+	// depth of the function declaring the variable
+	depth int
+	used  bool
+	// Variables used or assigned by a nested function can be read at any
+	// time, so their assignments are never reported
+	captured    bool
+	assignments []*ast.Assign
+}
+
+type scope struct {
+	variables map[string]*variable
+	// order the variables were declared in, so warnings are reported in a
+	// fixed order
+	order []*variable
+	outer *scope
+}
+
+func (s *scope) find(name string) *variable {
+	for ; s != nil; s = s.outer {
+		if v, ok := s.variables[name]; ok {
+			return v
+		}
+	}
+
+	return nil
+}
+
+type linter struct {
+	enabled  map[Category]bool
+	warnings []Warning
+
+	scope *scope
+	depth int
+	// Assignments that might still be read, by variable
+	pending map[*variable][]*ast.Assign
+	read    map[*ast.Assign]bool
+	// Assignments standing for the variables of destructuring assignments
+	destructured map[*ast.Identifier]*ast.Assign
+	// Every variable with an assignment, in declaration order
+	assigned []*variable
+	// Declarations aren't reported while this is above zero
+	silent int
+}
+
+// Lint returns the warnings of the given categories in a program, or of
+// every category if none are given. Names starting with an underscore are
+// never reported as unused.
+func Lint(program *ast.Program, categories ...Category) []Warning {
+	if len(categories) == 0 {
+		categories = Categories
+	}
+
+	l := &linter{
+		enabled:      map[Category]bool{},
+		scope:        &scope{variables: map[string]*variable{}},
+		pending:      map[*variable][]*ast.Assign{},
+		read:         map[*ast.Assign]bool{},
+		destructured: map[*ast.Identifier]*ast.Assign{},
+	}
+
+	for _, c := range categories {
+		l.enabled[c] = true
+	}
+
+	l.lint(program)
+	l.leaveScope()
+
+	for _, v := range l.assigned {
+		if v.captured || !v.used {
+			continue
+		}
+
+		for _, assignment := range v.assignments {
+			if !l.read[assignment] {
+				l.report(UnusedAssignment, assignment, "value assigned to %s is never read", v.name)
+			}
+		}
+	}
+
+	return l.warnings
+}
+
+func (l *linter) report(category Category, node ast.Node, format string, a ...interface{}) {
+	if !l.enabled[category] {
+		return
+	}
+
+	l.warnings = append(l.warnings, Warning{Category: category, Node: node, Message: fmt.Sprintf(format, a...)})
+}
+
+func (l *linter) enterScope() {
+	l.scope = &scope{variables: map[string]*variable{}, outer: l.scope}
+}
+
+func (l *linter) leaveScope() {
+	s := l.scope
+	l.scope = s.outer
+
+	if l.silent > 0 {
+		return
+	}
+
+	for _, v := range s.order {
+		if v.used || strings.HasPrefix(v.name, "_") {
+			continue
+		}
+
+		switch v.kind {
+		case declaredVariable:
+			l.report(UnusedVariable, v.node, "%s is declared but never used", v.name)
+		case declaredParameter:
+			l.report(UnusedParameter, v.node, "parameter %s is never used", v.name)
+		case declaredImport:
+			l.report(UnusedImport, v.node, "import %s is never used", v.name)
+		}
+	}
+}
+
+func (l *linter) declare(name string, k kind, node ast.Node) {
+	if l.silent == 0 && l.scope.outer != nil && l.scope.outer.find(name) != nil {
+		l.report(Shadow, node, "%s shadows a variable of an outer scope", name)
+	}
+
+	v := &variable{name: name, kind: k, node: node, depth: l.depth}
+
+	// Variables of the second walk through a loop body are thrown away
+	if l.silent == 0 {
+		l.scope.order = append(l.scope.order, v)
+	}
+
+	l.scope.variables[name] = v
+}
+
+// resolve returns the variable name refers to, or nil for builtins and
+// undefined variables
+func (l *linter) resolve(name string) *variable {
+	v := l.scope.find(name)
+
+	if v != nil && v.depth < l.depth {
+		v.captured = true
+	}
+
+	return v
+}
+
+func (l *linter) lint(node ast.Node) {
+	switch node := node.(type) {
+	case *ast.Program:
+		l.hoist(node.Statements)
+
+		for _, s := range node.Statements {
+			l.lint(s)
+		}
+	case *ast.ExpressionStatement:
+		l.lint(node.Expression)
+	case *ast.SuffixExpression:
+		l.lint(node.Left)
+		l.lint(node.Right)
+	case *ast.While:
+		l.lint(node.Condition)
+
+		before := l.copyPending()
+		l.block(node.Block)
+
+		// Values assigned at the end of the body are read by the condition
+		// and the start of the body of the next iteration
+		l.mergePending(before)
+		l.lint(node.Condition)
+
+		l.silent++
+		l.block(node.Block)
+		l.silent--
+
+		l.mergePending(before)
+	case *syntax.Template:
+		for _, part := range node.Parts {
+			l.lint(part)
+		}
+	case *syntax.ForEach:
+		l.lint(node.Iterable)
+
+		l.enterScope()
+
+		for _, v := range node.Variables {
+			l.declare(v.Value, declaredVariable, node)
+		}
+
+		before := l.copyPending()
+		l.block(node.Body)
+
+		// Like a while loop, the next iteration reads the values assigned at
+		// the end of the body
+		l.mergePending(before)
+
+		l.silent++
+		l.block(node.Body)
+		l.silent--
+
+		l.mergePending(before)
+
+		l.leaveScope()
+	case *syntax.Match:
+		l.match(node)
+	case *ast.ConditionalStatement:
+		l.lint(node.Condition)
+
+		before := l.copyPending()
+		l.block(node.Body)
+
+		after := l.pending
+		l.pending = before
+
+		if node.ElseCondition != nil {
+			l.lint(node.ElseCondition)
+		} else if node.ElseStatement != nil {
+			l.block(node.ElseStatement)
+		}
+
+		l.mergePending(after)
+	case *ast.BlockStatement:
+		l.block(node)
+	case *ast.VariableDeclaration:
+		// The variable can be used in its own value, by a recursive function
+		l.declare(node.Identifier.Value, declaredVariable, node)
+		l.lint(node.Value)
+	case *syntax.ConstantDeclaration:
+		l.declare(node.Identifier.Value, declaredVariable, node)
+		l.lint(node.Value)
+	case *syntax.FunctionDeclaration:
+		// Declared by hoist when the block started
+		l.function(node, node.Function.Parameters, node.Function.Defaults, node.Function.Body)
+	case *syntax.Destructuring:
+		for _, name := range syntax.Bindings(node.Pattern) {
+			l.declare(name.Value, declaredVariable, node)
+		}
+
+		l.patternKeys(node.Pattern)
+		l.lint(node.Value)
+	case *syntax.DestructuringAssign:
+		l.patternKeys(node.Pattern)
+		l.lint(node.Value)
+
+		// Every variable gets an assignment of its own, the same one each
+		// time the statement is linted
+		for _, name := range syntax.Bindings(node.Pattern) {
+			assignment, ok := l.destructured[name]
+			if !ok {
+				assignment = &ast.Assign{Identifier: name, Value: node.Value}
+				l.destructured[name] = assignment
+			}
+
+			l.assign(assignment)
+		}
+	case *ast.Assign:
+		l.lint(node.Value)
+		l.assign(node)
+	case *ast.IndexAssign:
+		l.lint(node.Value)
+		l.lint(node.Index)
+		l.lint(node.Object)
+	case *ast.Identifier:
+		v := l.resolve(node.Value)
+		if v == nil {
+			return
+		}
+
+		v.used = true
+
+		for _, assignment := range l.pending[v] {
+			l.read[assignment] = true
+		}
+	case *ast.Array:
+		for _, element := range node.Elements {
+			l.lint(element)
+		}
+	case *ast.IndexExpression:
+		l.lint(node.Value)
+		l.lint(node.Index)
+	case *ast.Hashmap:
+		for _, k := range sortedKeys(node) {
+			l.lint(k)
+			l.lint(node.Values[k])
+		}
+	case *ast.Function:
+		l.function(node, node.Parameters, nil, node.Body)
+	case *syntax.Function:
+		l.function(node, node.Parameters, node.Defaults, node.Body)
+	case *ast.Return:
+		l.lint(node.Value)
+	case *ast.CallExpression:
+		l.lint(node.Function)
+
+		for _, arg := range node.Parameters {
+			l.lint(arg)
+		}
+	case *ast.Import:
+		l.declare(node.Identifier, declaredImport, node)
+	case *ast.Export:
+		l.lint(node.Expression)
+	}
+}
+
+// match lints the arms of a match, each of them starts with the assignments
+// pending before it. Without an arm matching everything none of the arms
+// might run.
+func (l *linter) match(node *syntax.Match) {
+	l.lint(node.Subject)
+
+	before := l.copyPending()
+	after := map[*variable][]*ast.Assign{}
+
+	for _, arm := range node.Arms {
+		l.pending = before
+		l.pending = l.copyPending()
+
+		l.enterScope()
+
+		l.pattern(arm.Pattern)
+		l.block(arm.Body)
+
+		l.leaveScope()
+
+		pending := l.pending
+		l.pending = after
+		l.mergePending(pending)
+		after = l.pending
+	}
+
+	l.pending = after
+
+	if !exhaustive(node) {
+		l.report(NonExhaustiveMatch, node, "match has no default arm")
+		l.mergePending(before)
+	}
+}
+
+// pattern lints the values a pattern compares with and declares the
+// variables it binds
+func (l *linter) pattern(pattern syntax.Pattern) {
+	switch pattern := pattern.(type) {
+	case *syntax.LiteralPattern:
+		l.lint(pattern.Value)
+	case *syntax.BindingPattern:
+		l.declare(pattern.Name.Value, declaredVariable, pattern)
+	case *syntax.ArrayPattern:
+		for _, element := range pattern.Elements {
+			l.pattern(element)
+		}
+	case *syntax.HashPattern:
+		for i, key := range pattern.Keys {
+			l.lint(key)
+			l.pattern(pattern.Values[i])
+		}
+	}
+}
+
+// exhaustive reports whether one of the arms of a match always matches,
+// either because its pattern matches everything or because the arms before
+// it match both booleans
+func exhaustive(node *syntax.Match) bool {
+	booleans := map[bool]bool{}
+
+	for _, arm := range node.Arms {
+		switch pattern := arm.Pattern.(type) {
+		case *syntax.WildcardPattern, *syntax.BindingPattern:
+			return true
+		case *syntax.LiteralPattern:
+			if b, ok := pattern.Value.(*ast.Boolean); ok {
+				booleans[b.Value] = true
+			}
+		}
+	}
+
+	return booleans[true] && booleans[false]
+}
+
+// assign records an assignment to a variable, which is pending until the
+// variable is read
+func (l *linter) assign(node *ast.Assign) {
+	v := l.resolve(node.Identifier.Value)
+	if v == nil {
+		return
+	}
+
+	if l.silent == 0 {
+		if len(v.assignments) == 0 {
+			l.assigned = append(l.assigned, v)
+		}
+
+		v.assignments = append(v.assignments, node)
+	}
+
+	l.pending[v] = []*ast.Assign{node}
+}
+
+// patternKeys lints the keys of the hashmaps a pattern destructures
+func (l *linter) patternKeys(pattern syntax.Pattern) {
+	switch pattern := pattern.(type) {
+	case *syntax.ArrayPattern:
+		for _, element := range pattern.Elements {
+			l.patternKeys(element)
+		}
+	case *syntax.HashPattern:
+		for i, key := range pattern.Keys {
+			l.lint(key)
+			l.patternKeys(pattern.Values[i])
+		}
+	}
+}
+
+func (l *linter) block(node *ast.BlockStatement) {
+	l.enterScope()
+	l.hoist(node.Statements)
+
+	for _, s := range node.Statements {
+		l.lint(s)
+	}
+
+	l.leaveScope()
+}
+
+// function lints the body of a function, which runs at some unknown time, so
+// it starts without any pending assignments. The default values of the
+// parameters are evaluated by the function too.
+func (l *linter) function(node ast.Node, parameters []*ast.Identifier, defaults []ast.Expression, body *ast.BlockStatement) {
+	pending := l.pending
+	l.pending = map[*variable][]*ast.Assign{}
+	l.depth++
+
+	l.enterScope()
+
+	for _, p := range parameters {
+		l.declare(p.Value, declaredParameter, node)
+	}
+
+	for _, value := range defaults {
+		if value != nil {
+			l.lint(value)
+		}
+	}
+
+	l.hoist(body.Statements)
+
+	for _, s := range body.Statements {
+		l.lint(s)
+	}
+
+	l.leaveScope()
+
+	l.depth--
+	l.pending = pending
+}
+
+// hoist declares the functions declared by statements, they exist from the
+// start of their block
+func (l *linter) hoist(statements []ast.Statement) {
+	for _, s := range statements {
+		if node, ok := s.(*syntax.FunctionDeclaration); ok {
+			l.declare(node.Name.Value, declaredVariable, node)
+		}
+	}
+}
+
+func (l *linter) copyPending() map[*variable][]*ast.Assign {
+	pending := make(map[*variable][]*ast.Assign, len(l.pending))
+	for v, assignments := range l.pending {
+		pending[v] = append([]*ast.Assign{}, assignments...)
+	}
+
+	return pending
+}
+
+// mergePending adds the assignments pending on another path to the current
+// ones, for where two paths join
+func (l *linter) mergePending(other map[*variable][]*ast.Assign) {
+	for v, assignments := range other {
+	next:
+		for _, assignment := range assignments {
+			for _, existing := range l.pending[v] {
+				if existing == assignment {
+					continue next
+				}
+			}
+
+			l.pending[v] = append(l.pending[v], assignment)
+		}
+	}
+}
+
+// sortedKeys returns the keys of a hashmap in the order the compiler compiles
+// them, so warnings are always reported in the same order
+func sortedKeys(node *ast.Hashmap) []ast.Expression {
+	keys := []ast.Expression{}
+	for k := range node.Values {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	return keys
+}
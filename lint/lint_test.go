@@ -0,0 +1,433 @@
+package lint
+
+import (
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/lexer"
+	"github.com/looplanguage/loop/models/ast"
+	"github.com/looplanguage/loop/parser"
+	"testing"
+)
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+
+	p := parser.Create(lexer.Create(input))
+	program := p.Parse()
+
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors for %q: %v", input, p.Errors)
+	}
+
+	return program
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{`var x = 1; print(x)`, nil},
+		{`var x = 1`, []string{"x is declared but never used"}},
+		{`var _x = 1`, nil},
+		{`var x = 1; x = 2`, []string{"x is declared but never used"}},
+		{`import "a.lp" as a`, []string{"import a is never used"}},
+		{`import "a.lp" as a; a["b"]`, nil},
+		{`var f = fun(a, b) { a }; f(1, 2)`, []string{"parameter b is never used"}},
+		{`var f = fun(a, _b) { a }; f(1, 2)`, nil},
+		{
+			`var x = 1; if(true) { var x = 2; print(x) }; print(x)`,
+			[]string{"x shadows a variable of an outer scope"},
+		},
+		{
+			`var x = 1; var f = fun(x) { x }; f(x)`,
+			[]string{"x shadows a variable of an outer scope"},
+		},
+		{`var x = 1; print(x); x = 2`, []string{"value assigned to x is never read"}},
+		{`var x = 1; x = 2; x = 3; print(x)`, []string{"value assigned to x is never read"}},
+		{`var x = 1; x = 2; if(true) { x = 3 }; print(x)`, nil},
+		{`var x = 1; if(true) { x = 2 } else { x = 3 }; print(x)`, nil},
+		{
+			// The value assigned at the end of the body is read by the next
+			// iteration
+			`var x = 0; while(x < 10) { x = x + 1 }`,
+			nil,
+		},
+		{`var x = 0; while(true) { print(x); x = 1 }`, nil},
+		{
+			`var x = 0; while(true) { x = 1; x = 2; print(x) }`,
+			[]string{"value assigned to x is never read"},
+		},
+		{
+			// Functions can read the variable at any time
+			`var x = 0; var f = fun() { x }; x = 1; f()`,
+			nil,
+		},
+		{
+			`var f = fun() { var y = 1; print(y); y = 2 }; f()`,
+			[]string{"value assigned to y is never read"},
+		},
+		{`var f = fun(n) { if(n < 1) { return 1 }; f(n - 1) }; f(3)`, nil},
+	}
+
+	for _, tc := range tests {
+		warnings := Lint(parse(t, tc.input))
+
+		if len(warnings) != len(tc.expected) {
+			t.Fatalf("wrong number of warnings for %q. got=%v. expected=%q", tc.input, warnings, tc.expected)
+		}
+
+		for i, w := range warnings {
+			if w.Message != tc.expected[i] {
+				t.Errorf("wrong warning for %q. got=%q. expected=%q", tc.input, w.Message, tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestLint_Constant(t *testing.T) {
+	program := parse(t, `var x = 1`)
+	program.Statements[0] = syntax.Constant("x", &ast.IntegerLiteral{Value: 1})
+
+	warnings := Lint(program)
+	if len(warnings) != 1 {
+		t.Fatalf("wrong number of warnings. got=%v", warnings)
+	}
+
+	expected := "warning: x is declared but never used in const x [-Wunused-variable]"
+	if warnings[0].String() != expected {
+		t.Errorf("wrong string. got=%q. expected=%q", warnings[0].String(), expected)
+	}
+}
+
+func TestLint_Template(t *testing.T) {
+	// var name = "x"; "hello ${name}"
+	program := parse(t, `var name = "x"; 0`)
+	program.Statements[1] = &ast.ExpressionStatement{
+		Expression: &syntax.Template{Parts: []ast.Expression{&ast.String{Value: "hello "}, &ast.Identifier{Value: "name"}}},
+	}
+
+	warnings := Lint(program)
+	if len(warnings) != 0 {
+		t.Fatalf("wrong number of warnings. got=%v", warnings)
+	}
+}
+
+func TestLint_ForEach(t *testing.T) {
+	// for (k, v in m) { total = v }; total
+	program := parse(t, `var m = {}; var total = 0; fun(k, v) { total = v }; total`)
+	body := program.Statements[2].(*ast.ExpressionStatement).Expression.(*ast.Function)
+	program.Statements[2] = &ast.ExpressionStatement{
+		Expression: &syntax.ForEach{Variables: body.Parameters, Iterable: &ast.Identifier{Value: "m"}, Body: body.Body},
+	}
+
+	warnings := Lint(program)
+	if len(warnings) != 1 {
+		t.Fatalf("wrong number of warnings. got=%v", warnings)
+	}
+
+	expected := "warning: k is declared but never used in for (k, v in m) [-Wunused-variable]"
+	if warnings[0].String() != expected {
+		t.Errorf("wrong string. got=%q. expected=%q", warnings[0].String(), expected)
+	}
+}
+
+func TestLint_Match(t *testing.T) {
+	arm := func(pattern syntax.Pattern, input string) *syntax.Arm {
+		return &syntax.Arm{Pattern: pattern, Body: &ast.BlockStatement{Statements: parse(t, input).Statements}}
+	}
+	literal := func(value ast.Expression) syntax.Pattern {
+		return &syntax.LiteralPattern{Value: value}
+	}
+	binding := func(name string) syntax.Pattern {
+		return &syntax.BindingPattern{Name: &ast.Identifier{Value: name}}
+	}
+
+	tests := []struct {
+		match    *syntax.Match
+		expected []string
+	}{
+		{
+			// match (x) { 1 => { y = 1 }, [a, b] => { y = a }, _ => { 0 } }
+			&syntax.Match{Subject: &ast.Identifier{Value: "x"}, Arms: []*syntax.Arm{
+				arm(literal(&ast.IntegerLiteral{Value: 1}), "y = 1"),
+				arm(&syntax.ArrayPattern{Elements: []syntax.Pattern{binding("a"), binding("b")}}, "y = a"),
+				arm(&syntax.WildcardPattern{}, "0"),
+			}},
+			[]string{"b is declared but never used"},
+		},
+		{
+			// match (x) { true => { 1 }, false => { y = 2 } }
+			&syntax.Match{Subject: &ast.Identifier{Value: "x"}, Arms: []*syntax.Arm{
+				arm(literal(&ast.Boolean{Value: true}), "1"),
+				arm(literal(&ast.Boolean{Value: false}), "y = 2"),
+			}},
+			nil,
+		},
+		{
+			// match (x) { {"k": x} => { x } }
+			&syntax.Match{Subject: &ast.Identifier{Value: "x"}, Arms: []*syntax.Arm{
+				arm(&syntax.HashPattern{Keys: []ast.Expression{&ast.String{Value: "k"}}, Values: []syntax.Pattern{binding("x")}}, "x"),
+			}},
+			[]string{"x shadows a variable of an outer scope", "match has no default arm"},
+		},
+	}
+
+	for _, tc := range tests {
+		// var x = 1; var y = 0; match; print(y)
+		program := parse(t, `var x = 1; var y = 0; 0; print(y)`)
+		program.Statements[2] = &ast.ExpressionStatement{Expression: tc.match}
+
+		warnings := Lint(program)
+
+		if len(warnings) != len(tc.expected) {
+			t.Fatalf("wrong number of warnings for %q. got=%v. expected=%q", tc.match.String(), warnings, tc.expected)
+		}
+
+		for i, w := range warnings {
+			if w.Message != tc.expected[i] {
+				t.Errorf("wrong warning for %q. got=%q. expected=%q", tc.match.String(), w.Message, tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestLint_Destructuring(t *testing.T) {
+	binding := func(name string) syntax.Pattern {
+		return &syntax.BindingPattern{Name: &ast.Identifier{Value: name}}
+	}
+	pair := func(a, b string) syntax.Pattern {
+		return &syntax.ArrayPattern{Elements: []syntax.Pattern{binding(a), binding(b)}}
+	}
+
+	tests := []struct {
+		input string
+		// Replaces the statements "0" of input and of a loop ending it
+		statement ast.Statement
+		expected  []string
+	}{
+		{
+			// var [a, b] = xs; print(a)
+			`0; print(a)`,
+			&syntax.Destructuring{Pattern: pair("a", "b"), Value: &ast.Identifier{Value: "xs"}},
+			[]string{"b is declared but never used"},
+		},
+		{
+			// var {"x": _x} = p
+			`0`,
+			&syntax.Destructuring{
+				Pattern: &syntax.HashPattern{Keys: []ast.Expression{&ast.String{Value: "x"}}, Values: []syntax.Pattern{binding("_x")}},
+				Value:   &ast.Identifier{Value: "p"},
+			},
+			nil,
+		},
+		{
+			// [a, b] = [b, a]; print(a)
+			`var a = 1; var b = 2; 0; print(a)`,
+			&syntax.DestructuringAssign{Pattern: pair("a", "b"), Value: &ast.Identifier{Value: "b"}},
+			[]string{"value assigned to b is never read"},
+		},
+		{
+			// while(len(r) > 0) { [x, ...r] = r; print(x) }
+			`var x = 0; var r = [1]; while(len(r) > 0) { 0; print(x) }`,
+			&syntax.DestructuringAssign{
+				Pattern: &syntax.ArrayPattern{Elements: []syntax.Pattern{binding("x")}, Rest: &ast.Identifier{Value: "r"}},
+				Value:   &ast.Identifier{Value: "r"},
+			},
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		program := parse(t, tc.input)
+
+		statements := program.Statements
+		if loop, ok := statements[len(statements)-1].(*ast.ExpressionStatement); ok {
+			if while, ok := loop.Expression.(*ast.While); ok {
+				statements = while.Block.Statements
+			}
+		}
+
+		for i, s := range statements {
+			if e, ok := s.(*ast.ExpressionStatement); ok && e.Expression.String() == "0" {
+				statements[i] = tc.statement
+			}
+		}
+
+		warnings := Lint(program)
+
+		if len(warnings) != len(tc.expected) {
+			t.Fatalf("wrong number of warnings for %q. got=%v. expected=%q", program.String(), warnings, tc.expected)
+		}
+
+		for i, w := range warnings {
+			if w.Message != tc.expected[i] {
+				t.Errorf("wrong warning for %q. got=%q. expected=%q", program.String(), w.Message, tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestLint_Defaults(t *testing.T) {
+	name := func(name string) ast.Expression { return &ast.Identifier{Value: name} }
+
+	tests := []struct {
+		// The function f is declared with defaults and variadic
+		input    string
+		defaults []ast.Expression
+		variadic bool
+		expected []string
+	}{
+		{`var n = 1; var f = fun(a) { a }; f()`, []ast.Expression{name("n")}, false, nil},
+		{`var f = fun(a, b) { b }; f(1)`, []ast.Expression{nil, name("a")}, false, nil},
+		{`var f = fun(a, r) { a }; f(1)`, nil, true, []string{"parameter r is never used"}},
+		{
+			`var f = fun(a, b) { a }; f(1)`,
+			[]ast.Expression{nil, &ast.IntegerLiteral{Value: 1}},
+			false,
+			[]string{"parameter b is never used"},
+		},
+	}
+
+	for _, tc := range tests {
+		program := parse(t, tc.input)
+
+		for _, s := range program.Statements {
+			if declaration, ok := s.(*ast.VariableDeclaration); ok && declaration.Identifier.Value == "f" {
+				declaration.Value = &syntax.Function{
+					Function: *declaration.Value.(*ast.Function),
+					Defaults: tc.defaults,
+					Variadic: tc.variadic,
+				}
+			}
+		}
+
+		warnings := Lint(program)
+
+		if len(warnings) != len(tc.expected) {
+			t.Fatalf("wrong number of warnings for %q. got=%v. expected=%q", program.String(), warnings, tc.expected)
+		}
+
+		for i, w := range warnings {
+			if w.Message != tc.expected[i] {
+				t.Errorf("wrong warning for %q. got=%q. expected=%q", program.String(), w.Message, tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestLint_Categories(t *testing.T) {
+	program := parse(t, `import "a.lp" as a; var x = 1; var f = fun(x) { 1 }; f(1)`)
+
+	tests := []struct {
+		categories []Category
+		expected   []Category
+	}{
+		{nil, []Category{Shadow, UnusedParameter, UnusedImport, UnusedVariable}},
+		{[]Category{UnusedImport}, []Category{UnusedImport}},
+		{[]Category{Shadow, UnusedVariable}, []Category{Shadow, UnusedVariable}},
+		{[]Category{UnusedAssignment}, nil},
+	}
+
+	for _, tc := range tests {
+		warnings := Lint(program, tc.categories...)
+
+		if len(warnings) != len(tc.expected) {
+			t.Fatalf("wrong number of warnings for %v. got=%v. expected=%v", tc.categories, warnings, tc.expected)
+		}
+
+		for i, w := range warnings {
+			if w.Category != tc.expected[i] {
+				t.Errorf("wrong category for %v. got=%s. expected=%s", tc.categories, w.Category, tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestWarning_String(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`var x = 1`, "warning: x is declared but never used in var x [-Wunused-variable]"},
+		{
+			// Only the parameters of a function are shown, not its body
+			`var f = fun(a, b) { var c = a * 2; c + 1 }; f(1, 2)`,
+			"warning: parameter b is never used in fun(a, b) [-Wunused-parameter]",
+		},
+		{
+			`var x = 1; print(x); x = [1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14]`,
+			"warning: value assigned to x is never read in x = [1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1... [-Wunused-assignment]",
+		},
+		{`import "a.lp" as a`, "warning: import a is never used in import a.lp as a [-Wunused-import]"},
+	}
+
+	for _, tc := range tests {
+		warnings := Lint(parse(t, tc.input))
+		if len(warnings) != 1 {
+			t.Fatalf("wrong number of warnings for %q. got=%v", tc.input, warnings)
+		}
+
+		if warnings[0].String() != tc.expected {
+			t.Errorf("wrong string for %q. got=%q. expected=%q", tc.input, warnings[0].String(), tc.expected)
+		}
+	}
+
+	// Declared functions are shown like their declaration
+	program := parse(t, `var double = fun(n) { n * 2 }`)
+	declareFunctions(program.Statements)
+
+	expected := "warning: double is declared but never used in fun double(n) [-Wunused-variable]"
+	if warnings := Lint(program); len(warnings) != 1 || warnings[0].String() != expected {
+		t.Errorf("wrong warnings for %q. got=%v. expected=%q", program.String(), warnings, expected)
+	}
+}
+
+// declareFunctions turns every var declaration of a function into a function
+// declaration, the parser doesn't know them yet
+func declareFunctions(statements []ast.Statement) {
+	for i, s := range statements {
+		declaration, ok := s.(*ast.VariableDeclaration)
+		if !ok {
+			continue
+		}
+
+		function, ok := declaration.Value.(*ast.Function)
+		if !ok {
+			continue
+		}
+
+		declareFunctions(function.Body.Statements)
+		statements[i] = &syntax.FunctionDeclaration{Name: declaration.Identifier, Function: &syntax.Function{Function: *function}}
+	}
+}
+
+func TestLint_FunctionDeclarations(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{`print(f()); var f = fun() { 1 }`, nil},
+		{`var even = fun(n) { odd(n) }; var odd = fun(n) { even(n) }; even(1)`, nil},
+		{`var f = fun() { 1 }`, []string{"f is declared but never used"}},
+		{`var f = fun() { var g = fun() { h() }; var h = fun() { 1 }; g() }; f()`, nil},
+		{`var f = fun() { var g = fun() { 1 }; 2 }; f()`, []string{"g is declared but never used"}},
+		{`var x = 1; var f = fun() { var x = fun() { 1 }; x() }; f(); print(x)`, []string{"x shadows a variable of an outer scope"}},
+	}
+
+	for _, tc := range tests {
+		program := parse(t, tc.input)
+		declareFunctions(program.Statements)
+
+		warnings := Lint(program)
+
+		if len(warnings) != len(tc.expected) {
+			t.Fatalf("wrong number of warnings for %q. got=%v. expected=%q", program.String(), warnings, tc.expected)
+		}
+
+		for i, w := range warnings {
+			if w.Message != tc.expected[i] {
+				t.Errorf("wrong warning for %q. got=%q. expected=%q", program.String(), w.Message, tc.expected[i])
+			}
+		}
+	}
+}
@@ -1,3 +1,7 @@
+// lpc compiles a Loop source file to bytecode, "lpc check" reports its lint
+// warnings. The source is parsed by github.com/looplanguage/loop, so only the
+// syntax that parser knows can be compiled, see package syntax for the nodes
+// the compiler supports ahead of it.
 package main
 
 import (
@@ -6,16 +10,32 @@ import (
 	"flag"
 	"fmt"
 	"github.com/looplanguage/compiler/compiler"
+	"github.com/looplanguage/compiler/peephole"
+	"github.com/looplanguage/compiler/types"
+	"github.com/looplanguage/compiler/verify"
 	"github.com/looplanguage/loop/lexer"
 	"github.com/looplanguage/loop/parser"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
 	"strings"
 )
 
 func main() {
-	debugPtr := flag.Bool("debug", false, "Enables printing of bytecode")
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		check(os.Args[2:])
+		return
+	}
+
+	debugPtr := flag.Bool("debug", false, "Enables printing of the bytecode and its constants")
+	levelPtr := flag.Int("O", 0, "Optimization level, 0 compiles without optimizing, 1 optimizes an intermediate representation and 2 also inlines small functions")
+	peepholePtr := flag.Bool("peephole", false, "Simplifies the bytecode with peephole rules")
+	superPtr := flag.Bool("superinstructions", false, "Replaces common sequences of instructions by superinstructions")
+	tailCallsPtr := flag.Bool("tailcalls", false, "Reuses the frame of the calling function for calls in tail position, other than calls to itself the VM has to support OpTailCall")
+	typecheckPtr := flag.Bool("typecheck", false, "Reports operations that always fail at runtime")
+	strictPtr := flag.Bool("strict", false, "Like -typecheck, but doesn't emit bytecode if there are type errors")
+	emitPtr := flag.String("emit", "gob", "Output format of the bytecode, either \"gob\" or \"json\"")
 	flag.Parse()
 
 	file := flag.Arg(0)
@@ -26,6 +46,12 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	// Already compiled files are loaded and verified instead of compiled
+	if strings.HasSuffix(file, ".lpx") || strings.HasSuffix(file, ".lpx.json") {
+		loadCompiled(file, bytes, *debugPtr)
+		return
+	}
+
 	fmt.Println(fmt.Sprintf("compiling %q", file))
 
 	fileContent := string(bytes)
@@ -41,28 +67,64 @@ func main() {
 		return
 	}
 
+	if *typecheckPtr || *strictPtr {
+		diagnostics := types.Check(program)
+
+		for _, diagnostic := range diagnostics {
+			fmt.Println(diagnostic)
+		}
+
+		if *strictPtr && len(diagnostics) != 0 {
+			log.Fatalf("not compiling %q, it has %d type errors", file, len(diagnostics))
+		}
+	}
+
 	comp := compiler.Create()
+	comp.OptimizationLevel = *levelPtr
+	comp.Superinstructions = *superPtr
+	comp.TailCalls = *tailCallsPtr
+
+	if *peepholePtr {
+		comp.Rules = peephole.Rules
+	}
+
 	err = comp.Compile(program, file, "", file)
 
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	compiler.RegisterGobTypes()
+	bytecode := comp.Bytecode()
+
+	err = verify.Verify(bytecode.Instructions, bytecode.Constants)
+
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	var constantBytes bytes2.Buffer
 
-	enc := gob.NewEncoder(&constantBytes)
-	err = enc.Encode(comp.Bytecode())
+	dir := filepath.Dir(file) + "/" + fileNameWithoutExtension(filepath.Base(file)) + ".lpx"
+
+	switch *emitPtr {
+	case "gob":
+		compiler.RegisterGobTypes()
+
+		enc := gob.NewEncoder(&constantBytes)
+		err = enc.Encode(bytecode)
+	case "json":
+		dir += ".json"
+		err = compiler.EncodeJSON(&constantBytes, bytecode)
+	default:
+		log.Fatalf("unknown output format %q", *emitPtr)
+	}
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	dir := filepath.Dir(file) + "/" + fileNameWithoutExtension(filepath.Base(file)) + ".lpx"
-
 	if *debugPtr {
-		fmt.Println(comp.Bytecode().Instructions.String())
+		fmt.Println(compiler.Disassemble(bytecode))
 	}
 
 	err = ioutil.WriteFile(dir, constantBytes.Bytes(), 0644)
@@ -74,6 +136,36 @@ func main() {
 	fmt.Println(fmt.Sprintf("successfully compiled %q to %q", file, dir))
 }
 
+func loadCompiled(file string, content []byte, debug bool) {
+	var bytecode *compiler.Bytecode
+	var err error
+
+	if strings.HasSuffix(file, ".json") {
+		bytecode, err = compiler.DecodeJSON(bytes2.NewReader(content))
+	} else {
+		compiler.RegisterGobTypes()
+
+		bytecode = &compiler.Bytecode{}
+		err = gob.NewDecoder(bytes2.NewReader(content)).Decode(bytecode)
+	}
+
+	if err != nil {
+		log.Fatalf("unable to load %q. error=%q", file, err)
+	}
+
+	err = verify.Verify(bytecode.Instructions, bytecode.Constants)
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if debug {
+		fmt.Println(compiler.Disassemble(bytecode))
+	}
+
+	fmt.Println(fmt.Sprintf("successfully verified %q", file))
+}
+
 func fileNameWithoutExtension(fileName string) string {
 	return strings.TrimSuffix(fileName, filepath.Ext(fileName))
 }
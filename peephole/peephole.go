@@ -0,0 +1,255 @@
+// Package peephole rewrites short sequences of instructions. Instructions are
+// decoded into a list in which jumps refer to labels instead of offsets, so
+// rules can add and remove instructions without fixing up any jumps
+// themselves.
+package peephole
+
+import (
+	"fmt"
+	"github.com/looplanguage/compiler/code"
+)
+
+// Instruction is a decoded instruction or a label. The last operand of a jump
+// is the label it jumps to.
+type Instruction struct {
+	Op       code.OpCode
+	Operands []int
+	isLabel  bool
+}
+
+// Label returns the label instruction that marks the position of label
+func Label(label int) Instruction {
+	return Instruction{Operands: []int{label}, isLabel: true}
+}
+
+// IsLabel reports whether the instruction is a label
+func (ins Instruction) IsLabel() bool {
+	return ins.isLabel
+}
+
+// Make returns the instruction op with the given operands
+func Make(op code.OpCode, operands ...int) Instruction {
+	return Instruction{Op: op, Operands: operands}
+}
+
+func (ins Instruction) String() string {
+	if ins.isLabel {
+		return fmt.Sprintf("L%d:", ins.Operands[0])
+	}
+
+	def, err := code.Lookup(byte(ins.Op))
+	if err != nil {
+		return err.Error()
+	}
+
+	out := def.Name
+	for i, operand := range ins.Operands {
+		if def.Is(code.Jump) && i == len(ins.Operands)-1 {
+			out += fmt.Sprintf(" L%d", operand)
+		} else {
+			out += fmt.Sprintf(" %d", operand)
+		}
+	}
+
+	return out
+}
+
+// Decode decodes instructions into a list of instructions and labels. Every
+// offset that is jumped to gets a label, named after that offset.
+func Decode(ins code.Instructions) ([]Instruction, error) {
+	var decoded []Instruction
+	offsets := map[int]int{}
+
+	for i := 0; i < len(ins); {
+		instruction, err := code.ReadInstruction(ins, i)
+		if err != nil {
+			return nil, err
+		}
+
+		offsets[i] = len(decoded)
+		decoded = append(decoded, Make(instruction.Op, instruction.Operands...))
+
+		i += instruction.Size
+	}
+
+	offsets[len(ins)] = len(decoded)
+
+	labels := map[int]bool{}
+	for _, instruction := range decoded {
+		if jumps(instruction) {
+			target := instruction.Operands[len(instruction.Operands)-1]
+
+			if _, ok := offsets[target]; !ok {
+				return nil, fmt.Errorf("jump to %d is not the start of an instruction", target)
+			}
+
+			labels[target] = true
+		}
+	}
+
+	list := make([]Instruction, 0, len(decoded)+len(labels))
+
+	for i := 0; i <= len(ins); i++ {
+		index, ok := offsets[i]
+		if !ok {
+			continue
+		}
+
+		if labels[i] {
+			list = append(list, Label(i))
+		}
+
+		if index < len(decoded) {
+			list = append(list, decoded[index])
+		}
+	}
+
+	return list, nil
+}
+
+// Encode encodes a list of instructions and labels, replacing labels by the
+// offset they mark. Jumps get an OpWide prefix when their target requires it.
+func Encode(list []Instruction) (code.Instructions, error) {
+	wide := make([]bool, len(list))
+
+	// Widening a jump moves every label after it, so this repeats until no
+	// more jumps need to be widened
+	for {
+		offsets, size, err := layout(list, wide)
+		if err != nil {
+			return nil, err
+		}
+
+		widened := false
+		out := make(code.Instructions, 0, size)
+
+		for i, instruction := range list {
+			if instruction.isLabel {
+				continue
+			}
+
+			operands := instruction.Operands
+
+			if jumps(instruction) {
+				operands = append([]int{}, operands...)
+				operands[len(operands)-1] = offsets[operands[len(operands)-1]]
+			}
+
+			encoded, err := encode(instruction.Op, operands, wide[i])
+			if err != nil {
+				return nil, err
+			}
+
+			if !wide[i] && code.OpCode(encoded[0]) == code.OpWide {
+				wide[i] = true
+				widened = true
+			}
+
+			out = append(out, encoded...)
+		}
+
+		if uniformTables(list, wide) {
+			widened = true
+		}
+
+		if !widened {
+			return out, nil
+		}
+	}
+}
+
+// uniformTables widens all entries of a jump table once one of them is wide,
+// they need to have the same width. It reports whether it widened any.
+func uniformTables(list []Instruction, wide []bool) bool {
+	widened := false
+
+	for i, instruction := range list {
+		if instruction.isLabel {
+			continue
+		}
+
+		def, err := code.Lookup(byte(instruction.Op))
+		if err != nil || !def.Is(code.Table) {
+			continue
+		}
+
+		var entries []int
+		for j := i + 1; j < len(list) && len(entries) < instruction.Operands[1]; j++ {
+			if !list[j].isLabel {
+				entries = append(entries, j)
+			}
+		}
+
+		anyWide := false
+		for _, entry := range entries {
+			anyWide = anyWide || wide[entry]
+		}
+
+		for _, entry := range entries {
+			if anyWide && !wide[entry] {
+				wide[entry] = true
+				widened = true
+			}
+		}
+	}
+
+	return widened
+}
+
+// layout returns the offset of every label and the size of the instructions,
+// with jumps encoded as wide or not as given
+func layout(list []Instruction, wide []bool) (map[int]int, int, error) {
+	offsets := map[int]int{}
+	size := 0
+
+	for i, instruction := range list {
+		if instruction.isLabel {
+			offsets[instruction.Operands[0]] = size
+			continue
+		}
+
+		operands := instruction.Operands
+
+		if jumps(instruction) {
+			operands = append([]int{}, operands...)
+			operands[len(operands)-1] = 0
+		}
+
+		encoded, err := encode(instruction.Op, operands, wide[i])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		wide[i] = code.OpCode(encoded[0]) == code.OpWide
+		size += len(encoded)
+	}
+
+	for _, instruction := range list {
+		if jumps(instruction) {
+			label := instruction.Operands[len(instruction.Operands)-1]
+
+			if _, ok := offsets[label]; !ok {
+				return nil, 0, fmt.Errorf("undefined label %d", label)
+			}
+		}
+	}
+
+	return offsets, size, nil
+}
+
+func encode(op code.OpCode, operands []int, wide bool) ([]byte, error) {
+	if wide {
+		return code.EncodeWide(op, operands...)
+	}
+
+	return code.Encode(op, operands...)
+}
+
+func jumps(instruction Instruction) bool {
+	if instruction.isLabel {
+		return false
+	}
+
+	def, err := code.Lookup(byte(instruction.Op))
+	return err == nil && def.Is(code.Jump)
+}
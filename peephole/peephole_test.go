@@ -0,0 +1,191 @@
+package peephole
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	input := concat(
+		codetest.Make(code.OpTrue),
+		codetest.Make(code.OpJumpIfNotTrue, 10),
+		codetest.Make(code.OpConstant, 0),
+		codetest.Make(code.OpJump, 11),
+		codetest.Make(code.OpNull),
+		codetest.Make(code.OpPop),
+	)
+
+	expected := []string{
+		"OpTrue",
+		"OpJumpIfNotTrue L10",
+		"OpConstant 0",
+		"OpJump L11",
+		"L10:",
+		"OpNull",
+		"L11:",
+		"OpPop",
+	}
+
+	list, err := Decode(input)
+	if err != nil {
+		t.Fatalf("unable to decode. error=%q", err)
+	}
+
+	testList(t, expected, list)
+
+	encoded, err := Encode(list)
+	if err != nil {
+		t.Fatalf("unable to encode. error=%q", err)
+	}
+
+	if encoded.String() != input.String() {
+		t.Fatalf("wrong instructions. want=\n%s\ngot=\n%s", input, encoded)
+	}
+}
+
+func TestDecode_Errors(t *testing.T) {
+	tests := []struct {
+		input    code.Instructions
+		expected string
+	}{
+		{codetest.Make(code.OpJump, 1), "jump to 1 is not the start of an instruction"},
+		{code.Instructions{byte(code.OpConstant), 0}, "OpConstant is truncated"},
+	}
+
+	for _, tc := range tests {
+		_, err := Decode(tc.input)
+
+		if err == nil || err.Error() != tc.expected {
+			t.Errorf("incorrect error. got=%q. expected=%q", err, tc.expected)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		input    []Instruction
+		expected code.Instructions
+	}{
+		{
+			// A jump to the end of the instructions
+			[]Instruction{
+				Make(code.OpJump, 1),
+				Make(code.OpNull),
+				Label(1),
+			},
+			concat(
+				codetest.Make(code.OpJump, 4),
+				codetest.Make(code.OpNull),
+			),
+		},
+		{
+			// A jump backwards
+			[]Instruction{
+				Label(7),
+				Make(code.OpNull),
+				Make(code.OpPop),
+				Make(code.OpJump, 7),
+			},
+			concat(
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpJump, 0),
+			),
+		},
+	}
+
+	for _, tc := range tests {
+		actual, err := Encode(tc.input)
+		if err != nil {
+			t.Fatalf("unable to encode. error=%q", err)
+		}
+
+		if actual.String() != tc.expected.String() {
+			t.Errorf("wrong instructions. want=\n%s\ngot=\n%s", tc.expected, actual)
+		}
+	}
+
+	_, err := Encode([]Instruction{Make(code.OpJump, 3)})
+	if err == nil || err.Error() != "undefined label 3" {
+		t.Errorf("incorrect error. got=%q. expected=%q", err, "undefined label 3")
+	}
+}
+
+func TestEncode_WideJumps(t *testing.T) {
+	list := []Instruction{Make(code.OpJump, 0)}
+	for i := 0; i < 70000; i++ {
+		list = append(list, Make(code.OpNull))
+	}
+	list = append(list, Label(0), Make(code.OpJump, 0))
+
+	encoded, err := Encode(list)
+	if err != nil {
+		t.Fatalf("unable to encode. error=%q", err)
+	}
+
+	// The first jump only fits when it is wide, which moves the label
+	target := 6 + 70000
+
+	first, err := code.ReadInstruction(encoded, 0)
+	if err != nil || !first.Wide || first.Operands[0] != target {
+		t.Fatalf("wrong first jump. got=%+v. expected a wide jump to %d", first, target)
+	}
+
+	last, err := code.ReadInstruction(encoded, target)
+	if err != nil || !last.Wide || last.Operands[0] != target {
+		t.Fatalf("wrong last jump. got=%+v. expected a wide jump to %d", last, target)
+	}
+}
+
+func TestEncode_WideTables(t *testing.T) {
+	list := []Instruction{Make(code.OpJumpTable, 0, 2, 0), Make(code.OpJump, 1), Make(code.OpJump, 0), Label(1)}
+	for i := 0; i < 70000; i++ {
+		list = append(list, Make(code.OpNull))
+	}
+	list = append(list, Label(0), Make(code.OpPop))
+
+	encoded, err := Encode(list)
+	if err != nil {
+		t.Fatalf("unable to encode. error=%q", err)
+	}
+
+	// Only the second entry needs to be wide, the first one is widened with it
+	table, err := code.ReadInstruction(encoded, 0)
+	if err != nil {
+		t.Fatalf("unable to read the table. error=%q", err)
+	}
+
+	_, err = code.TableEntries(encoded, table, 0)
+	if err != nil {
+		t.Fatalf("wrong table. error=%q", err)
+	}
+
+	first, err := code.ReadInstruction(encoded, table.Size)
+	if err != nil || !first.Wide {
+		t.Fatalf("wrong first entry. got=%+v. expected a wide jump", first)
+	}
+}
+
+func testList(t *testing.T, expected []string, actual []Instruction) {
+	t.Helper()
+
+	if len(actual) != len(expected) {
+		t.Fatalf("wrong list length. got=%v. expected=%v", actual, expected)
+	}
+
+	for i, instruction := range actual {
+		if instruction.String() != expected[i] {
+			t.Errorf("wrong instruction at %d. got=%q. expected=%q", i, instruction, expected[i])
+		}
+	}
+}
+
+func concat(s ...code.Instructions) code.Instructions {
+	out := code.Instructions{}
+	for _, ins := range s {
+		out = append(out, ins...)
+	}
+
+	return out
+}
@@ -0,0 +1,163 @@
+package peephole
+
+import "github.com/looplanguage/compiler/code"
+
+// Rule replaces a sequence of instructions matching Pattern. Labels are never
+// part of a sequence, so a rule can't remove the target of a jump.
+type Rule struct {
+	Name    string
+	Pattern []code.OpCode
+	// Replace receives the matched instructions and returns their
+	// replacement, or false if these instructions should be left alone
+	Replace func(matched []Instruction) ([]Instruction, bool)
+}
+
+// Rules simplify instructions without changing what they do
+var Rules = []Rule{
+	{
+		Name:    "true condition",
+		Pattern: []code.OpCode{code.OpTrue, code.OpJumpIfNotTrue},
+		Replace: func(matched []Instruction) ([]Instruction, bool) {
+			return nil, true
+		},
+	},
+	{
+		Name:    "false condition",
+		Pattern: []code.OpCode{code.OpFalse, code.OpJumpIfNotTrue},
+		Replace: func(matched []Instruction) ([]Instruction, bool) {
+			return []Instruction{Make(code.OpJump, matched[1].Operands...)}, true
+		},
+	},
+	{
+		Name:    "unused null",
+		Pattern: []code.OpCode{code.OpNull, code.OpPop},
+		Replace: func(matched []Instruction) ([]Instruction, bool) {
+			return nil, true
+		},
+	},
+}
+
+// Superinstructions returns a rule for every superinstruction
+func Superinstructions() []Rule {
+	var rules []Rule
+
+	for _, s := range code.Superinstructions() {
+		fuse := s.Fuse
+
+		rules = append(rules, Rule{
+			Name:    "superinstruction",
+			Pattern: s.Pattern,
+			Replace: func(matched []Instruction) ([]Instruction, bool) {
+				operands := make([][]int, len(matched))
+				for i, instruction := range matched {
+					operands[i] = instruction.Operands
+				}
+
+				op, fused, ok := fuse(operands)
+				if !ok {
+					return nil, false
+				}
+
+				return []Instruction{Make(op, fused...)}, true
+			},
+		})
+	}
+
+	return rules
+}
+
+// Apply applies rules until none of them matches anymore. Labels that are no
+// longer jumped to are removed, so they don't keep rules from matching.
+func Apply(list []Instruction, rules []Rule) []Instruction {
+	for {
+		list = removeUnusedLabels(list)
+
+		changed := false
+		out := make([]Instruction, 0, len(list))
+
+		for i := 0; i < len(list); {
+			replacement, length := match(list[i:], rules)
+
+			if length == 0 {
+				out = append(out, list[i])
+				i++
+				continue
+			}
+
+			out = append(out, replacement...)
+			i += length
+			changed = true
+		}
+
+		list = out
+
+		if !changed {
+			return list
+		}
+	}
+}
+
+// Optimize applies rules to instructions. Instructions that can't be decoded
+// are returned unchanged.
+func Optimize(ins code.Instructions, rules []Rule) code.Instructions {
+	list, err := Decode(ins)
+	if err != nil {
+		return ins
+	}
+
+	optimized, err := Encode(Apply(list, rules))
+	if err != nil {
+		return ins
+	}
+
+	return optimized
+}
+
+func match(list []Instruction, rules []Rule) ([]Instruction, int) {
+	for _, rule := range rules {
+		if len(list) < len(rule.Pattern) {
+			continue
+		}
+
+		matches := true
+
+		for i, op := range rule.Pattern {
+			if list[i].isLabel || list[i].Op != op {
+				matches = false
+				break
+			}
+		}
+
+		if !matches {
+			continue
+		}
+
+		if replacement, ok := rule.Replace(list[:len(rule.Pattern)]); ok {
+			return replacement, len(rule.Pattern)
+		}
+	}
+
+	return nil, 0
+}
+
+func removeUnusedLabels(list []Instruction) []Instruction {
+	used := map[int]bool{}
+
+	for _, instruction := range list {
+		if jumps(instruction) {
+			used[instruction.Operands[len(instruction.Operands)-1]] = true
+		}
+	}
+
+	out := make([]Instruction, 0, len(list))
+
+	for _, instruction := range list {
+		if instruction.isLabel && !used[instruction.Operands[0]] {
+			continue
+		}
+
+		out = append(out, instruction)
+	}
+
+	return out
+}
@@ -0,0 +1,188 @@
+package peephole
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		input    []code.Instructions
+		expected []code.Instructions
+	}{
+		{
+			// if(true) { 1 } else { 2 }
+			[]code.Instructions{
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpIfNotTrue, 10),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpJump, 13),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpPop),
+			},
+			[]code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpJump, 9),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			// while(false) { 1 }
+			[]code.Instructions{
+				codetest.Make(code.OpFalse),
+				codetest.Make(code.OpJumpIfNotTrue, 11),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpJump, 0),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+			[]code.Instructions{
+				codetest.Make(code.OpJump, 10),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpJump, 0),
+			},
+		},
+		{
+			// Removing an instruction can make a rule match that didn't before
+			[]code.Instructions{
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+				codetest.Make(code.OpPop),
+			},
+			[]code.Instructions{},
+		},
+		{
+			// A jump between OpNull and OpPop keeps them
+			[]code.Instructions{
+				codetest.Make(code.OpJumpIfNotTrue, 4),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+			[]code.Instructions{
+				codetest.Make(code.OpJumpIfNotTrue, 4),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		input := concat(tc.input...)
+		expected := concat(tc.expected...)
+
+		actual := Optimize(input, Rules)
+		if actual.String() != expected.String() {
+			t.Errorf("wrong instructions for\n%s\nwant=\n%s\ngot=\n%s", input, expected, actual)
+		}
+	}
+}
+
+func TestSuperinstructions(t *testing.T) {
+	tests := []struct {
+		input    []code.Instructions
+		expected []code.Instructions
+	}{
+		{
+			// x = x + 1
+			[]code.Instructions{
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpSetVar, 0),
+			},
+			[]code.Instructions{
+				codetest.Make(code.OpIncrementVar, 1, 0),
+			},
+		},
+		{
+			// x = y + 1 can't be fused
+			[]code.Instructions{
+				codetest.Make(code.OpGetVar, 1),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpSetVar, 0),
+			},
+			[]code.Instructions{
+				codetest.Make(code.OpGetVar, 1),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpSetVar, 0),
+			},
+		},
+		{
+			// while(x < 10) { x = x + 1 }
+			[]code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpGreaterThan),
+				codetest.Make(code.OpJumpIfNotTrue, 23),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpSetVar, 0),
+				codetest.Make(code.OpJump, 0),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+			[]code.Instructions{
+				codetest.Make(code.OpJumpIfConstantNotGreater, 0, 0, 15),
+				codetest.Make(code.OpIncrementVar, 1, 0),
+				codetest.Make(code.OpJump, 0),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			// if(x > 1) { 2 }
+			[]code.Instructions{
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpGreaterThan),
+				codetest.Make(code.OpJumpIfNotTrue, 16),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpJump, 17),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+			[]code.Instructions{
+				codetest.Make(code.OpJumpIfVarNotGreater, 0, 0, 13),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpJump, 14),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+		},
+		{
+			// A jump into the middle of a sequence prevents fusing it
+			[]code.Instructions{
+				codetest.Make(code.OpJump, 6),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpSetVar, 0),
+			},
+			[]code.Instructions{
+				codetest.Make(code.OpJump, 6),
+				codetest.Make(code.OpGetVar, 0),
+				codetest.Make(code.OpConstant, 1),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpSetVar, 0),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		input := concat(tc.input...)
+		expected := concat(tc.expected...)
+
+		actual := Optimize(input, Superinstructions())
+		if actual.String() != expected.String() {
+			t.Errorf("wrong instructions for\n%s\nwant=\n%s\ngot=\n%s", input, expected, actual)
+		}
+	}
+}
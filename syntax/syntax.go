@@ -0,0 +1,308 @@
+// Package syntax holds nodes of the language that the parser of
+// github.com/looplanguage/loop doesn't produce yet. They implement the
+// interfaces of its ast package, so they can be put in a program next to the
+// nodes of the parser and compiled like them.
+//
+// lpc parses its input with that parser (v0.7.0), so none of these nodes can
+// be written in a source file yet: const, for-each loops, break and continue,
+// floats, templates, match, destructuring, default and variadic parameters and
+// function declarations are only reachable from programs built in Go, like the
+// tests of this module do by rewriting parsed calls. The source in the comments
+// below is the syntax the nodes are meant for once the parser has it.
+package syntax
+
+import (
+	"github.com/looplanguage/compiler/values"
+	"github.com/looplanguage/loop/models/ast"
+	"strings"
+)
+
+// expression and statement make the nodes of this package implement
+// ast.Expression and ast.Statement, whose marker methods are unexported. The
+// embedded interfaces are always nil, every node has its own TokenLiteral and
+// String.
+type expression struct{ ast.Expression }
+type statement struct{ ast.Statement }
+
+// ConstantDeclaration declares a variable that can't be assigned to, as in
+// "const size = 10"
+type ConstantDeclaration struct {
+	ast.VariableDeclaration
+}
+
+func (c *ConstantDeclaration) TokenLiteral() string { return "const" }
+func (c *ConstantDeclaration) String() string {
+	return "const " + c.Identifier.String() + " = " + c.Value.String()
+}
+
+// Constant creates the declaration of the constant name
+func Constant(name string, value ast.Expression) *ConstantDeclaration {
+	return &ConstantDeclaration{ast.VariableDeclaration{Identifier: &ast.Identifier{Value: name}, Value: value}}
+}
+
+// Destructuring declares the variables bound by an array or hashmap pattern,
+// as in "var [a, b] = f()" or "var {x, y} = point". Elements that are missing
+// are null.
+type Destructuring struct {
+	statement
+	Pattern Pattern
+	Value   ast.Expression
+}
+
+func (d *Destructuring) TokenLiteral() string { return "var" }
+func (d *Destructuring) String() string {
+	return "var " + d.Pattern.String() + " = " + d.Value.String()
+}
+
+// DestructuringAssign is Destructuring assigning to variables that already
+// exist, as in "[a, b] = [b, a]"
+type DestructuringAssign struct {
+	statement
+	Pattern Pattern
+	Value   ast.Expression
+}
+
+func (d *DestructuringAssign) TokenLiteral() string { return d.Pattern.TokenLiteral() }
+func (d *DestructuringAssign) String() string {
+	return d.Pattern.String() + " = " + d.Value.String()
+}
+
+// Function is a function whose last parameters can have a default value or
+// collect the remaining arguments, as in "fun(a, b = 2, ...rest) { }".
+// Defaults has an entry for every parameter, nil for those without one. A
+// default is evaluated by the function when a call leaves its argument out.
+type Function struct {
+	ast.Function
+	Defaults []ast.Expression
+	// Whether the last parameter is an array of the arguments after the
+	// other parameters
+	Variadic bool
+}
+
+func (f *Function) String() string {
+	var parameters []string
+	for i, p := range f.Parameters {
+		switch {
+		case f.Variadic && i == len(f.Parameters)-1:
+			parameters = append(parameters, "..."+p.Value)
+		case i < len(f.Defaults) && f.Defaults[i] != nil:
+			parameters = append(parameters, p.Value+" = "+f.Defaults[i].String())
+		default:
+			parameters = append(parameters, p.Value)
+		}
+	}
+
+	return "fun(" + strings.Join(parameters, ", ") + ") " + f.Body.String()
+}
+
+// FunctionDeclaration declares a variable holding a function, as in
+// "fun name(a, b) { }". Declarations are hoisted, every function declared in
+// a block can be called by the others no matter the order they are in.
+type FunctionDeclaration struct {
+	statement
+	Name     *ast.Identifier
+	Function *Function
+}
+
+func (f *FunctionDeclaration) TokenLiteral() string { return "fun" }
+func (f *FunctionDeclaration) String() string {
+	return "fun " + f.Name.Value + strings.TrimPrefix(f.Function.String(), "fun")
+}
+
+// Float is a floating point literal, as in "3.14"
+type Float struct {
+	expression
+	Value float64
+}
+
+func (f *Float) TokenLiteral() string { return f.String() }
+func (f *Float) String() string       { return values.FormatFloat(f.Value) }
+
+// Template is a string with expressions in it, as in "hello ${name}!". Parts
+// that are *ast.String are the text between the expressions.
+type Template struct {
+	expression
+	Parts []ast.Expression
+}
+
+func (t *Template) TokenLiteral() string { return t.String() }
+func (t *Template) String() string {
+	var out strings.Builder
+
+	out.WriteString(`"`)
+
+	for _, part := range t.Parts {
+		if str, ok := part.(*ast.String); ok {
+			out.WriteString(str.Value)
+		} else {
+			out.WriteString("${" + part.String() + "}")
+		}
+	}
+
+	out.WriteString(`"`)
+
+	return out.String()
+}
+
+// ForEach runs its body for every element of an array or hashmap, as in
+// "for (x in array) { }" or "for (k, v in hashmap) { }". With one variable it
+// is set to the elements of an array or the keys of a hashmap, with two to the
+// index and element or the key and value.
+type ForEach struct {
+	expression
+	Variables []*ast.Identifier
+	Iterable  ast.Expression
+	Body      *ast.BlockStatement
+}
+
+func (f *ForEach) TokenLiteral() string { return "for" }
+func (f *ForEach) String() string {
+	var variables []string
+	for _, v := range f.Variables {
+		variables = append(variables, v.String())
+	}
+
+	return "for (" + strings.Join(variables, ", ") + " in " + f.Iterable.String() + ") " + f.Body.String()
+}
+
+// Match evaluates the body of the first arm whose pattern matches the
+// subject, as in "match (x) { 1 => { "one" }, [a, _] => { a }, _ => { x } }".
+// Without a matching arm it evaluates to null.
+type Match struct {
+	expression
+	Subject ast.Expression
+	Arms    []*Arm
+}
+
+func (m *Match) TokenLiteral() string { return "match" }
+func (m *Match) String() string {
+	var arms []string
+	for _, arm := range m.Arms {
+		arms = append(arms, arm.Pattern.String()+" => "+arm.Body.String())
+	}
+
+	return "match (" + m.Subject.String() + ") { " + strings.Join(arms, ", ") + " }"
+}
+
+type Arm struct {
+	Pattern Pattern
+	Body    *ast.BlockStatement
+}
+
+// Pattern is what an arm of a match expression matches
+type Pattern interface {
+	ast.Node
+	pattern()
+}
+
+// LiteralPattern matches values equal to an integer, float, string or
+// boolean literal
+type LiteralPattern struct {
+	Value ast.Expression
+}
+
+func (p *LiteralPattern) pattern()             {}
+func (p *LiteralPattern) TokenLiteral() string { return p.Value.TokenLiteral() }
+func (p *LiteralPattern) String() string       { return p.Value.String() }
+
+// WildcardPattern matches any value, as in "_"
+type WildcardPattern struct{}
+
+func (p *WildcardPattern) pattern()             {}
+func (p *WildcardPattern) TokenLiteral() string { return "_" }
+func (p *WildcardPattern) String() string       { return "_" }
+
+// BindingPattern matches any value and declares a variable holding it
+type BindingPattern struct {
+	Name *ast.Identifier
+}
+
+func (p *BindingPattern) pattern()             {}
+func (p *BindingPattern) TokenLiteral() string { return p.Name.Value }
+func (p *BindingPattern) String() string       { return p.Name.Value }
+
+// ArrayPattern matches arrays with as many elements as it has patterns, each
+// element matching its pattern. Rest is an optional variable for the elements
+// after those, as in "[a, ...rest]", with it longer arrays match as well.
+type ArrayPattern struct {
+	Elements []Pattern
+	Rest     *ast.Identifier
+}
+
+func (p *ArrayPattern) pattern()             {}
+func (p *ArrayPattern) TokenLiteral() string { return "[" }
+func (p *ArrayPattern) String() string {
+	var elements []string
+	for _, element := range p.Elements {
+		elements = append(elements, element.String())
+	}
+
+	if p.Rest != nil {
+		elements = append(elements, "..."+p.Rest.Value)
+	}
+
+	return "[" + strings.Join(elements, ", ") + "]"
+}
+
+// HashPattern matches hashmaps that have all of its keys, with the value of
+// each key matching its pattern. Other keys are ignored.
+type HashPattern struct {
+	Keys   []ast.Expression
+	Values []Pattern
+}
+
+func (p *HashPattern) pattern()             {}
+func (p *HashPattern) TokenLiteral() string { return "{" }
+func (p *HashPattern) String() string {
+	var pairs []string
+	for i, key := range p.Keys {
+		pairs = append(pairs, key.String()+": "+p.Values[i].String())
+	}
+
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// Bindings returns the variables a pattern declares, in the order they are
+// bound
+func Bindings(pattern Pattern) []*ast.Identifier {
+	switch pattern := pattern.(type) {
+	case *BindingPattern:
+		return []*ast.Identifier{pattern.Name}
+	case *ArrayPattern:
+		var names []*ast.Identifier
+		for _, element := range pattern.Elements {
+			names = append(names, Bindings(element)...)
+		}
+
+		if pattern.Rest != nil {
+			names = append(names, pattern.Rest)
+		}
+
+		return names
+	case *HashPattern:
+		var names []*ast.Identifier
+		for _, value := range pattern.Values {
+			names = append(names, Bindings(value)...)
+		}
+
+		return names
+	}
+
+	return nil
+}
+
+// Break ends the innermost loop
+type Break struct {
+	statement
+}
+
+func (b *Break) TokenLiteral() string { return "break" }
+func (b *Break) String() string       { return "break" }
+
+// Continue starts the next iteration of the innermost loop
+type Continue struct {
+	statement
+}
+
+func (c *Continue) TokenLiteral() string { return "continue" }
+func (c *Continue) String() string       { return "continue" }
@@ -0,0 +1,108 @@
+package syntax
+
+import (
+	"github.com/looplanguage/loop/models/ast"
+	"strings"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		node     ast.Node
+		expected string
+	}{
+		{Constant("size", &ast.IntegerLiteral{Value: 10}), "const size = 10"},
+		{
+			&Function{
+				Function: ast.Function{
+					Parameters: []*ast.Identifier{{Value: "a"}, {Value: "b"}, {Value: "rest"}},
+					Body:       &ast.BlockStatement{Statements: []ast.Statement{&Break{}}},
+				},
+				Defaults: []ast.Expression{nil, &ast.IntegerLiteral{Value: 2}, nil},
+				Variadic: true,
+			},
+			"fun(a, b = 2, ...rest) { break }",
+		},
+		{
+			&FunctionDeclaration{
+				Name: &ast.Identifier{Value: "double"},
+				Function: &Function{Function: ast.Function{
+					Parameters: []*ast.Identifier{{Value: "n"}},
+					Body:       &ast.BlockStatement{Statements: []ast.Statement{&Break{}}},
+				}},
+			},
+			"fun double(n) { break }",
+		},
+		{&Float{Value: 3.14}, "3.14"},
+		{&Float{Value: 2}, "2.0"},
+		{
+			&Template{Parts: []ast.Expression{&ast.String{Value: "hello "}, &ast.Identifier{Value: "name"}, &ast.String{Value: "!"}}},
+			`"hello ${name}!"`,
+		},
+		{
+			&Match{
+				Subject: &ast.Identifier{Value: "x"},
+				Arms: []*Arm{
+					{&LiteralPattern{&ast.IntegerLiteral{Value: 1}}, &ast.BlockStatement{Statements: []ast.Statement{&Break{}}}},
+					{
+						&ArrayPattern{Elements: []Pattern{&BindingPattern{&ast.Identifier{Value: "a"}}, &WildcardPattern{}}},
+						&ast.BlockStatement{Statements: []ast.Statement{&Continue{}}},
+					},
+					{
+						&HashPattern{[]ast.Expression{&ast.String{Value: "k"}}, []Pattern{&WildcardPattern{}}},
+						&ast.BlockStatement{Statements: []ast.Statement{&Break{}}},
+					},
+				},
+			},
+			"match (x) { 1 => { break }, [a, _] => { continue }, {\"k\": _} => { break } }",
+		},
+		{
+			&Destructuring{
+				Pattern: &ArrayPattern{Elements: []Pattern{&BindingPattern{&ast.Identifier{Value: "a"}}}, Rest: &ast.Identifier{Value: "rest"}},
+				Value:   &ast.Identifier{Value: "xs"},
+			},
+			"var [a, ...rest] = xs",
+		},
+		{
+			&DestructuringAssign{
+				Pattern: &HashPattern{[]ast.Expression{&ast.String{Value: "x"}}, []Pattern{&BindingPattern{&ast.Identifier{Value: "x"}}}},
+				Value:   &ast.Identifier{Value: "point"},
+			},
+			`{"x": x} = point`,
+		},
+		{
+			&ForEach{
+				Variables: []*ast.Identifier{{Value: "k"}, {Value: "v"}},
+				Iterable:  &ast.Identifier{Value: "m"},
+				Body:      &ast.BlockStatement{Statements: []ast.Statement{&Break{}, &Continue{}}},
+			},
+			"for (k, v in m) { break; continue }",
+		},
+	}
+
+	for _, tc := range tests {
+		if tc.node.String() != tc.expected {
+			t.Errorf("wrong string. got=%q. expected=%q", tc.node.String(), tc.expected)
+		}
+	}
+}
+
+func TestBindings(t *testing.T) {
+	pattern := &ArrayPattern{Elements: []Pattern{
+		&BindingPattern{&ast.Identifier{Value: "a"}},
+		&WildcardPattern{},
+		&HashPattern{
+			[]ast.Expression{&ast.String{Value: "x"}, &ast.String{Value: "y"}},
+			[]Pattern{&BindingPattern{&ast.Identifier{Value: "b"}}, &LiteralPattern{&ast.IntegerLiteral{Value: 1}}},
+		},
+	}, Rest: &ast.Identifier{Value: "c"}}
+
+	var names []string
+	for _, name := range Bindings(pattern) {
+		names = append(names, name.Value)
+	}
+
+	if strings.Join(names, " ") != "a b c" {
+		t.Errorf("wrong bindings. got=%q. expected=%q", names, "a b c")
+	}
+}
@@ -0,0 +1,25 @@
+package types
+
+import "fmt"
+
+// builtinSignatures are the signatures of the functions in object.Builtins,
+// by name. Builtins that aren't listed here accept any arguments.
+var builtinSignatures = map[string]*Signature{
+	"len": {
+		Params: []Type{AnyType},
+		Result: IntegerType,
+		Check: func(args []Type) error {
+			switch args[0].Kind {
+			case Any, String, Array, Hashmap:
+				return nil
+			}
+
+			return fmt.Errorf("len does not accept %s", args[0])
+		},
+	},
+	"print": {
+		Params:   []Type{AnyType},
+		Variadic: true,
+		Result:   NullType,
+	},
+}
@@ -0,0 +1,729 @@
+package types
+
+import (
+	"fmt"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/models/ast"
+	"github.com/looplanguage/loop/models/object"
+	"sort"
+)
+
+// Diagnostic is a type error in a program
+type Diagnostic struct {
+	// Node is the expression or statement the error is in
+	Node    ast.Node
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("type error: %s in %s", d.Message, d.Node.String())
+}
+
+type scope struct {
+	variables map[string]*Type
+	outer     *scope
+	// Whether this is the scope of a function body
+	function bool
+}
+
+func (s *scope) find(name string) *Type {
+	for ; s != nil; s = s.outer {
+		if t, ok := s.variables[name]; ok {
+			return t
+		}
+	}
+
+	return nil
+}
+
+type Checker struct {
+	Diagnostics []Diagnostic
+
+	scope *scope
+	// Types returned by each function being checked, innermost last
+	returns [][]Type
+	// Diagnostics are left out while this is above zero
+	silent int
+
+	// Names assigned to anywhere in the program. A function can be called
+	// after the variables it captures are assigned a value of another type.
+	reassigned map[string]bool
+	// Values and keys stored at an index anywhere in the program, nil if
+	// there are none. The checker can't tell which arrays and hashmaps they
+	// are stored in, so they widen the elements of every one.
+	stored, storedKeys *Type
+}
+
+// maxPasses is how many times a program is checked to find everything it
+// assigns and stores before giving up on knowing it
+const maxPasses = 10
+
+// Check infers the types in a program and returns its type errors
+func Check(program *ast.Program) []Diagnostic {
+	c := NewChecker()
+	c.Check(program)
+
+	return c.Diagnostics
+}
+
+// NewChecker returns a checker that knows the builtin functions
+func NewChecker() *Checker {
+	c := &Checker{scope: &scope{variables: map[string]*Type{}}, reassigned: map[string]bool{}}
+
+	for _, builtin := range object.Builtins {
+		t := Type{Kind: Function}
+		if signature, ok := builtinSignatures[builtin.Name]; ok {
+			t = FunctionOf(signature)
+		}
+
+		c.scope.variables[builtin.Name] = &t
+	}
+
+	return c
+}
+
+func (c *Checker) report(node ast.Node, format string, a ...interface{}) {
+	if c.silent > 0 {
+		return
+	}
+
+	c.Diagnostics = append(c.Diagnostics, Diagnostic{Node: node, Message: fmt.Sprintf(format, a...)})
+}
+
+func (c *Checker) enterScope() {
+	c.scope = &scope{variables: map[string]*Type{}, outer: c.scope}
+}
+
+func (c *Checker) leaveScope() {
+	c.scope = c.scope.outer
+}
+
+func (c *Checker) define(name string, t Type) {
+	c.scope.variables[name] = &t
+}
+
+// Check returns the type of node, statements are null
+func (c *Checker) Check(node ast.Node) Type {
+	switch node := node.(type) {
+	case *ast.Program:
+		c.prepare(node)
+		c.statements(node.Statements)
+	case *ast.ExpressionStatement:
+		c.Check(node.Expression)
+	case *ast.SuffixExpression:
+		left := c.Check(node.Left)
+		right := c.Check(node.Right)
+
+		return c.binary(node, left, right)
+	case *ast.IntegerLiteral:
+		return IntegerType
+	case *syntax.Float:
+		return FloatType
+	case *syntax.Template:
+		for _, part := range node.Parts {
+			c.Check(part)
+		}
+
+		return StringType
+	case *ast.String:
+		return StringType
+	case *ast.Boolean:
+		return BooleanType
+	case *ast.While:
+		c.Check(node.Condition)
+
+		// Variables assigned in the body have a wider type from the second
+		// iteration on, so only the second time is reported
+		c.silent++
+		c.block(node.Block)
+		c.silent--
+
+		c.block(node.Block)
+	case *syntax.ForEach:
+		variables := c.loopVariables(node, c.Check(node.Iterable))
+
+		c.enterScope()
+
+		for i, v := range node.Variables {
+			c.define(v.Value, variables[i])
+		}
+
+		c.silent++
+		c.block(node.Body)
+		c.silent--
+
+		c.block(node.Body)
+
+		c.leaveScope()
+	case *syntax.Match:
+		return c.match(node)
+	case *ast.ConditionalStatement:
+		c.Check(node.Condition)
+
+		var values []Type
+
+		if value, returned := c.block(node.Body); !returned {
+			values = append(values, value)
+		}
+
+		if node.ElseCondition != nil {
+			values = append(values, c.Check(node.ElseCondition))
+		} else if node.ElseStatement != nil {
+			if value, returned := c.block(node.ElseStatement); !returned {
+				values = append(values, value)
+			}
+		} else {
+			values = append(values, NullType)
+		}
+
+		return joinAll(values)
+	case *ast.BlockStatement:
+		c.block(node)
+	case *ast.VariableDeclaration:
+		// The variable can be used in its own value, by a recursive function
+		c.define(node.Identifier.Value, AnyType)
+		c.define(node.Identifier.Value, c.Check(node.Value))
+	case *syntax.ConstantDeclaration:
+		c.Check(&node.VariableDeclaration)
+	case *syntax.FunctionDeclaration:
+		c.define(node.Name.Value, c.function(node.Function))
+	case *syntax.Destructuring:
+		for _, name := range syntax.Bindings(node.Pattern) {
+			c.define(name.Value, AnyType)
+		}
+
+		c.pattern(node.Pattern, c.Check(node.Value), c.define)
+	case *syntax.DestructuringAssign:
+		c.pattern(node.Pattern, c.Check(node.Value), c.assign)
+	case *ast.Assign:
+		c.assign(node.Identifier.Value, c.Check(node.Value))
+	case *ast.IndexAssign:
+		value := c.Check(node.Value)
+		index := c.Check(node.Index)
+		object := c.Check(node.Object)
+
+		switch object.Kind {
+		case Array:
+			if index.Kind != Any && index.Kind != Integer {
+				c.report(node, "cannot index array with %s", index)
+			}
+		case Integer, String, Boolean, Null, Function:
+			c.report(node, "cannot assign to an index of %s", object)
+		}
+
+		c.store(object, index, value)
+	case *ast.Identifier:
+		return c.lookup(node.Value)
+	case *ast.Array:
+		var elements []Type
+		for _, element := range node.Elements {
+			elements = append(elements, c.Check(element))
+		}
+
+		if len(elements) == 0 {
+			return Type{Kind: Array}
+		}
+
+		return ArrayOf(joinAll(elements))
+	case *ast.IndexExpression:
+		value := c.Check(node.Value)
+		index := c.Check(node.Index)
+
+		switch value.Kind {
+		case Array:
+			if index.Kind != Any && index.Kind != Integer {
+				c.report(node, "cannot index array with %s", index)
+			}
+
+			return c.element(value.Elem)
+		case Hashmap:
+			return c.element(value.Elem)
+		case Integer, Boolean, Null, Function:
+			c.report(node, "cannot index %s", value)
+		}
+
+		return AnyType
+	case *ast.Hashmap:
+		var keys, values []Type
+
+		for _, k := range sortedKeys(node) {
+			key := c.Check(k)
+
+			if key.Kind == Array || key.Kind == Hashmap || key.Kind == Function {
+				c.report(node, "%s can not be used as a hashmap key", key)
+			}
+
+			keys = append(keys, key)
+			values = append(values, c.Check(node.Values[k]))
+		}
+
+		if len(keys) == 0 {
+			return Type{Kind: Hashmap}
+		}
+
+		return HashmapOf(joinAll(keys), joinAll(values))
+	case *ast.Function:
+		return c.function(&syntax.Function{Function: *node})
+	case *syntax.Function:
+		return c.function(node)
+	case *ast.Return:
+		value := c.Check(node.Value)
+
+		if len(c.returns) > 0 {
+			c.returns[len(c.returns)-1] = append(c.returns[len(c.returns)-1], value)
+		}
+	case *ast.CallExpression:
+		callee := c.Check(node.Function)
+
+		var args []Type
+		for _, arg := range node.Parameters {
+			args = append(args, c.Check(arg))
+		}
+
+		return c.call(node, callee, args)
+	case *ast.Import:
+		c.define(node.Identifier, AnyType)
+	case *ast.Export:
+		c.Check(node.Expression)
+	}
+
+	return NullType
+}
+
+// prepare checks a program without reporting anything, until the names it
+// assigns to and the values it stores don't change anymore. Those are known
+// everywhere once the program is checked again.
+func (c *Checker) prepare(node *ast.Program) {
+	for i := 0; i < maxPasses; i++ {
+		before := c.summary()
+
+		c.silent++
+		c.enterScope()
+		c.statements(node.Statements)
+		c.leaveScope()
+		c.silent--
+
+		if c.summary() == before {
+			return
+		}
+	}
+
+	c.stored = widen(nil, AnyType)
+	c.storedKeys = widen(nil, AnyType)
+}
+
+// summary describes what prepare looks for
+func (c *Checker) summary() string {
+	describe := func(t *Type) string {
+		if t == nil {
+			return ""
+		}
+
+		return t.String()
+	}
+
+	return fmt.Sprintf("%d %s %s", len(c.reassigned), describe(c.stored), describe(c.storedKeys))
+}
+
+func (c *Checker) statements(statements []ast.Statement) {
+	c.hoist(statements)
+
+	for _, s := range statements {
+		c.Check(s)
+	}
+}
+
+// block checks the statements of a block and returns its value, which is the
+// value of its last expression. Blocks that return have no value.
+func (c *Checker) block(node *ast.BlockStatement) (Type, bool) {
+	c.enterScope()
+	defer c.leaveScope()
+
+	value := NullType
+	returned := false
+
+	c.hoist(node.Statements)
+
+	for _, s := range node.Statements {
+		value = NullType
+
+		switch s := s.(type) {
+		case *ast.ExpressionStatement:
+			value = c.Check(s.Expression)
+		case *ast.Return:
+			returned = true
+			c.Check(s)
+		default:
+			c.Check(s)
+		}
+	}
+
+	return value, returned
+}
+
+// hoist defines the functions declared by statements, they exist from the
+// start of their block. Their signatures are only known once they are
+// declared.
+func (c *Checker) hoist(statements []ast.Statement) {
+	for _, s := range statements {
+		if node, ok := s.(*syntax.FunctionDeclaration); ok {
+			c.define(node.Name.Value, Type{Kind: Function})
+		}
+	}
+}
+
+// loopVariables returns the types of the variables of a for-each loop over a
+// value of type iterable
+func (c *Checker) loopVariables(node *syntax.ForEach, iterable Type) []Type {
+	var types []Type
+
+	switch iterable.Kind {
+	case Array:
+		types = []Type{IntegerType, c.element(iterable.Elem)}
+	case Hashmap:
+		types = []Type{c.key(iterable.Key), c.element(iterable.Elem)}
+	case Any:
+		types = []Type{AnyType, AnyType}
+	default:
+		c.report(node, "cannot iterate over %s", iterable)
+		types = []Type{AnyType, AnyType}
+	}
+
+	// A single variable is the element of an array or the key of a hashmap
+	if len(node.Variables) == 1 && iterable.Kind == Array {
+		return types[1:]
+	}
+
+	return types
+}
+
+// match checks the arms of a match and returns the values they can have, null
+// included when there might not be a matching arm
+func (c *Checker) match(node *syntax.Match) Type {
+	subject := c.Check(node.Subject)
+
+	var values []Type
+	exhaustive := false
+
+	for _, arm := range node.Arms {
+		c.enterScope()
+		c.pattern(arm.Pattern, subject, c.define)
+
+		if value, returned := c.block(arm.Body); !returned {
+			values = append(values, value)
+		}
+
+		c.leaveScope()
+
+		switch arm.Pattern.(type) {
+		case *syntax.WildcardPattern, *syntax.BindingPattern:
+			exhaustive = true
+		}
+	}
+
+	if !exhaustive {
+		values = append(values, NullType)
+	}
+
+	return joinAll(values)
+}
+
+// pattern binds the variables of a pattern matching a value of type t. Only
+// the elements of arrays and hashmaps of a known type are known.
+func (c *Checker) pattern(pattern syntax.Pattern, t Type, bind func(name string, t Type)) {
+	switch pattern := pattern.(type) {
+	case *syntax.LiteralPattern:
+		c.Check(pattern.Value)
+	case *syntax.BindingPattern:
+		bind(pattern.Name.Value, t)
+	case *syntax.ArrayPattern:
+		elem := AnyType
+		if t.Kind == Array {
+			elem = c.element(t.Elem)
+		}
+
+		for _, element := range pattern.Elements {
+			c.pattern(element, elem, bind)
+		}
+
+		if pattern.Rest != nil {
+			rest := Type{Kind: Array}
+			if t.Kind == Array {
+				rest = t
+			}
+
+			bind(pattern.Rest.Value, rest)
+		}
+	case *syntax.HashPattern:
+		elem := AnyType
+		if t.Kind == Hashmap {
+			elem = c.element(t.Elem)
+		}
+
+		for i, key := range pattern.Keys {
+			c.Check(key)
+			c.pattern(pattern.Values[i], elem, bind)
+		}
+	}
+}
+
+// assign widens the type of a variable to include the type of a value
+// assigned to it
+func (c *Checker) assign(name string, t Type) {
+	c.reassigned[name] = true
+
+	if variable := c.scope.find(name); variable != nil {
+		*variable = Join(*variable, t)
+	}
+}
+
+// lookup returns the type of a variable. The variables a function captures
+// are Any if they are assigned to anywhere, the function might be called
+// after that.
+func (c *Checker) lookup(name string) Type {
+	captured := false
+
+	for s := c.scope; s != nil; s = s.outer {
+		if t, ok := s.variables[name]; ok {
+			if captured && c.reassigned[name] {
+				return AnyType
+			}
+
+			return *t
+		}
+
+		captured = captured || s.function
+	}
+
+	return AnyType
+}
+
+// store widens the elements of every array and hashmap to include a value
+// stored at an index of object
+func (c *Checker) store(object, index, value Type) {
+	c.stored = widen(c.stored, value)
+
+	if object.Kind != Array {
+		c.storedKeys = widen(c.storedKeys, index)
+	}
+}
+
+// element returns the type of the elements of an array or the values of a
+// hashmap, including the values stored in any of them
+func (c *Checker) element(elem *Type) Type {
+	if c.stored == nil {
+		return element(elem)
+	}
+
+	return join(elem, c.stored)
+}
+
+// key returns the type of the keys of a hashmap, including the keys values
+// are stored at in any of them
+func (c *Checker) key(key *Type) Type {
+	if c.storedKeys == nil {
+		return element(key)
+	}
+
+	return join(key, c.storedKeys)
+}
+
+func widen(t *Type, u Type) *Type {
+	if t == nil {
+		return &u
+	}
+
+	joined := Join(*t, u)
+	return &joined
+}
+
+func (c *Checker) function(node *syntax.Function) Type {
+	signature := &Signature{Variadic: node.Variadic}
+
+	c.enterScope()
+	defer c.leaveScope()
+
+	c.scope.function = true
+
+	for i, p := range node.Parameters {
+		signature.Params = append(signature.Params, AnyType)
+
+		// The variadic parameter is an array of the remaining arguments
+		if node.Variadic && i == len(node.Parameters)-1 {
+			c.define(p.Value, Type{Kind: Array})
+		} else {
+			c.define(p.Value, AnyType)
+		}
+	}
+
+	for i, value := range node.Defaults {
+		if value == nil {
+			continue
+		}
+
+		c.Check(value)
+
+		if !node.Variadic || i < len(node.Parameters)-1 {
+			signature.Optional++
+		}
+	}
+
+	c.returns = append(c.returns, nil)
+
+	value, returned := c.block(node.Body)
+
+	results := c.returns[len(c.returns)-1]
+	c.returns = c.returns[:len(c.returns)-1]
+
+	if !returned {
+		results = append(results, value)
+	}
+
+	signature.Result = joinAll(results)
+
+	return FunctionOf(signature)
+}
+
+func (c *Checker) call(node *ast.CallExpression, callee Type, args []Type) Type {
+	switch callee.Kind {
+	case Any:
+		return AnyType
+	case Function:
+		if callee.Signature == nil {
+			return AnyType
+		}
+	default:
+		c.report(node, "cannot call %s", callee)
+		return AnyType
+	}
+
+	signature := callee.Signature
+	params := signature.Params
+
+	required := len(params) - signature.Optional
+	if signature.Variadic {
+		required--
+	}
+
+	switch {
+	case len(args) < required && (signature.Variadic || signature.Optional > 0):
+		c.report(node, "not enough arguments. got=%d. expected at least %d", len(args), required)
+		return signature.Result
+	case len(args) > len(params) && !signature.Variadic && signature.Optional > 0:
+		c.report(node, "too many arguments. got=%d. expected at most %d", len(args), len(params))
+		return signature.Result
+	case len(args) != len(params) && !signature.Variadic && signature.Optional == 0:
+		c.report(node, "wrong number of arguments. got=%d. expected=%d", len(args), len(params))
+		return signature.Result
+	}
+
+	for i, arg := range args {
+		param := params[len(params)-1]
+		if i < len(params) {
+			param = params[i]
+		}
+
+		if param.Kind != Any && arg.Kind != Any && param.Kind != arg.Kind {
+			c.report(node, "cannot use %s as argument %d of type %s", arg, i+1, param)
+		}
+	}
+
+	if signature.Check != nil {
+		if err := signature.Check(args); err != nil {
+			c.report(node, "%s", err)
+		}
+	}
+
+	return signature.Result
+}
+
+// scalar kinds can only be combined with the same kind, if at all
+var scalar = map[Kind]bool{
+	Integer:  true,
+	Float:    true,
+	String:   true,
+	Boolean:  true,
+	Null:     true,
+	Function: true,
+}
+
+func (c *Checker) binary(node *ast.SuffixExpression, left, right Type) Type {
+	switch node.Operator {
+	case "==", "!=":
+		return BooleanType
+	case "+":
+		if left.Kind == String && right.Kind == String {
+			return StringType
+		}
+
+		if numeric(left, right) {
+			return arithmetic(left, right)
+		}
+	case "-", "*", "/":
+		if numeric(left, right) {
+			return arithmetic(left, right)
+		}
+	case ">", "<":
+		if numeric(left, right) {
+			return BooleanType
+		}
+	default:
+		return AnyType
+	}
+
+	if scalar[left.Kind] && scalar[right.Kind] {
+		c.report(node, "invalid operation: %s %s %s", left, node.Operator, right)
+	}
+
+	if node.Operator == ">" || node.Operator == "<" {
+		return BooleanType
+	}
+
+	return AnyType
+}
+
+// numeric reports whether both types are numbers, integers and floats can be
+// mixed
+func numeric(left, right Type) bool {
+	isNumber := func(t Type) bool { return t.Kind == Integer || t.Kind == Float }
+
+	return isNumber(left) && isNumber(right)
+}
+
+// arithmetic returns the type of arithmetic on two numbers, a float if either
+// of them is one
+func arithmetic(left, right Type) Type {
+	if left.Kind == Float || right.Kind == Float {
+		return FloatType
+	}
+
+	return IntegerType
+}
+
+func joinAll(types []Type) Type {
+	if len(types) == 0 {
+		return NullType
+	}
+
+	result := types[0]
+	for _, t := range types[1:] {
+		result = Join(result, t)
+	}
+
+	return result
+}
+
+// sortedKeys returns the keys of a hashmap in the order the compiler compiles
+// them, so diagnostics are always reported in the same order
+func sortedKeys(node *ast.Hashmap) []ast.Expression {
+	keys := []ast.Expression{}
+	for k := range node.Values {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	return keys
+}
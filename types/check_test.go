@@ -0,0 +1,484 @@
+package types
+
+import (
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/lexer"
+	"github.com/looplanguage/loop/models/ast"
+	"github.com/looplanguage/loop/parser"
+	"testing"
+)
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+
+	p := parser.Create(lexer.Create(input))
+	program := p.Parse()
+
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors for %q: %v", input, p.Errors)
+	}
+
+	return program
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{`1 + 2; "a" + "b"; 1 == "a"`, nil},
+		{`1 + "a"`, []string{"invalid operation: int + string"}},
+		{`true - 1`, []string{"invalid operation: bool - int"}},
+		{`len(5)`, []string{"len does not accept int"}},
+		{`len("abc"); len([1, 2])`, nil},
+		{`len(1, 2)`, []string{"wrong number of arguments. got=2. expected=1"}},
+		{`5()`, []string{"cannot call int"}},
+		{`var x = 5; x()`, []string{"cannot call int"}},
+		{`var x = 5; x = "a"; x()`, nil},
+		{`var f = fun(a, b) { a }; f(1)`, []string{"wrong number of arguments. got=1. expected=2"}},
+		{`var f = fun() { 1 }; f() + "a"`, []string{"invalid operation: int + string"}},
+		{`var f = fun(a) { if(a) { return "a" }; 1 }; f(1) + 1`, nil},
+		{`var f = fun() { return 1 }; f()()`, []string{"cannot call int"}},
+		{`[1, 2]["a"]`, []string{"cannot index array with string"}},
+		{`[1, 2][0] + "a"`, []string{"invalid operation: int + string"}},
+		{`{"a": 1}["a"] + "b"`, []string{"invalid operation: int + string"}},
+		{`{[1]: 2}`, []string{"[int] can not be used as a hashmap key"}},
+		{`5[0]`, []string{"cannot index int"}},
+		{`var x = if(true) { 1 } else { 2 }; x + "a"`, []string{"invalid operation: int + string"}},
+		{`var x = if(true) { 1 }; x + "a"`, nil},
+		{`var x = 1; if(true) { x = "a" }; x + 1`, nil},
+		{
+			// The second iteration adds a string to a string
+			`var x = 1; while(true) { x + 1; x = "a" }`,
+			nil,
+		},
+		{`var x = 1; while(true) { len(x) }`, []string{"len does not accept int"}},
+		{`var x = fun(a) { a() }; x(1)`, nil},
+		{`print(1, "a", true)`, nil},
+	}
+
+	for _, tc := range tests {
+		diagnostics := Check(parse(t, tc.input))
+
+		if len(diagnostics) != len(tc.expected) {
+			t.Errorf("wrong number of diagnostics for %q. got=%v. expected=%v", tc.input, diagnostics, tc.expected)
+			continue
+		}
+
+		for i, diagnostic := range diagnostics {
+			if diagnostic.Message != tc.expected[i] {
+				t.Errorf("wrong diagnostic for %q. got=%q. expected=%q", tc.input, diagnostic.Message, tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestCheck_Widening(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{`var a = [1]; a[0] = "s"; a[0] + "t"`, nil},
+		{`var a = [1]; a[0] = 2; a[0] + "t"`, []string{"invalid operation: int + string"}},
+		{`var h = {"a": 1}; h["b"] = "s"; h["a"] + 1`, nil},
+		{`var h = {"a": 1}; h[1] = 2; each(h, fun(k, v) { k + 1 })`, nil},
+		{`var h = {"a": 1}; h["b"] = 2; each(h, fun(k, v) { k + 1 })`, []string{"invalid operation: string + int"}},
+		// The array might be changed through any other reference to it
+		{`var a = [1]; var b = a; b[0] = "s"; a[0] + "t"`, nil},
+		{`var a = [1]; var set = fun(xs) { xs[0] = "s" }; set(a); a[0] + "t"`, nil},
+		{`var a = [[1]]; a[0][0] = "s"; a[0][0] + "t"`, nil},
+		{`var a = [1]; unpack([x], a); a[0] = "s"; x + "t"`, nil},
+		// Functions are checked with the types their captured variables get
+		// anywhere
+		{`var x = 1; var f = fun() { x + "a" }; x = "b"; f()`, nil},
+		{`var x = 1; var f = fun() { x + "a" }; f()`, []string{"invalid operation: int + string"}},
+		{`var g = fun() { 1 }; var f = fun() { g() + "a" }; g = fun() { "b" }; f()`, nil},
+		{`var g = fun() { 1 }; var f = fun() { g() + "a" }; f()`, []string{"invalid operation: int + string"}},
+		// Outside of functions the type at that point is known
+		{`var x = 1; x + "a"; x = "b"`, []string{"invalid operation: int + string"}},
+	}
+
+	for _, tc := range tests {
+		program := parse(t, tc.input)
+
+		// unpack([x], a) is a destructuring declaration and each is a
+		// for-each loop like in TestCheck_ForEach
+		for i, s := range program.Statements {
+			statement, ok := s.(*ast.ExpressionStatement)
+			if !ok {
+				continue
+			}
+
+			call, ok := statement.Expression.(*ast.CallExpression)
+			if !ok {
+				continue
+			}
+
+			switch call.Function.String() {
+			case "unpack":
+				name := call.Parameters[0].(*ast.Array).Elements[0].(*ast.Identifier)
+				program.Statements[i] = &syntax.Destructuring{
+					Pattern: &syntax.ArrayPattern{Elements: []syntax.Pattern{&syntax.BindingPattern{Name: name}}},
+					Value:   call.Parameters[1],
+				}
+			case "each":
+				body := call.Parameters[1].(*ast.Function)
+				statement.Expression = &syntax.ForEach{Variables: body.Parameters, Iterable: call.Parameters[0], Body: body.Body}
+			}
+		}
+
+		diagnostics := Check(program)
+
+		if len(diagnostics) != len(tc.expected) {
+			t.Fatalf("wrong diagnostics for %q. got=%v. expected=%q", program.String(), diagnostics, tc.expected)
+		}
+
+		for i, d := range diagnostics {
+			if d.Message != tc.expected[i] {
+				t.Errorf("wrong diagnostic for %q. got=%q. expected=%q", program.String(), d.Message, tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestCheck_Float(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"x + 1; x * x; x > 1; 1 / x", nil},
+		{`x + "a"`, []string{"invalid operation: float + string"}},
+		{`(x + 1) + "a"`, []string{"invalid operation: float + string"}},
+		{"[1][x]", []string{"cannot index array with float"}},
+	}
+
+	for _, tc := range tests {
+		// x is the float 1.5
+		program := parse(t, "var x = 0; "+tc.input)
+		program.Statements[0].(*ast.VariableDeclaration).Value = &syntax.Float{Value: 1.5}
+
+		diagnostics := Check(program)
+
+		if len(diagnostics) != len(tc.expected) {
+			t.Fatalf("wrong diagnostics for %q. got=%v. expected=%q", tc.input, diagnostics, tc.expected)
+		}
+
+		for i, d := range diagnostics {
+			if d.Message != tc.expected[i] {
+				t.Errorf("wrong diagnostic for %q. got=%q. expected=%q", tc.input, d.Message, tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestCheck_Template(t *testing.T) {
+	// "${1 + "a"}" - 1
+	program := parse(t, `1 + "a"; 0`)
+	part := program.Statements[0].(*ast.ExpressionStatement).Expression
+	program.Statements = []ast.Statement{&ast.ExpressionStatement{Expression: &ast.SuffixExpression{
+		Left:     &syntax.Template{Parts: []ast.Expression{part}},
+		Operator: "-",
+		Right:    &ast.IntegerLiteral{Value: 1},
+	}}}
+
+	diagnostics := Check(program)
+	expected := []string{"invalid operation: int + string", "invalid operation: string - int"}
+
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("wrong diagnostics. got=%v. expected=%q", diagnostics, expected)
+	}
+
+	for i, d := range diagnostics {
+		if d.Message != expected[i] {
+			t.Errorf("wrong diagnostic. got=%q. expected=%q", d.Message, expected[i])
+		}
+	}
+}
+
+func TestCheck_Constant(t *testing.T) {
+	program := parse(t, "var x = 5; x()")
+	program.Statements[0] = syntax.Constant("x", &ast.IntegerLiteral{Value: 5})
+
+	diagnostics := Check(program)
+	if len(diagnostics) != 1 || diagnostics[0].Message != "cannot call int" {
+		t.Fatalf("wrong diagnostics. got=%v. expected=%q", diagnostics, "cannot call int")
+	}
+}
+
+func TestCheck_Match(t *testing.T) {
+	arm := func(pattern syntax.Pattern, input string) *syntax.Arm {
+		return &syntax.Arm{Pattern: pattern, Body: &ast.BlockStatement{Statements: parse(t, input).Statements}}
+	}
+	binding := func(name string) syntax.Pattern {
+		return &syntax.BindingPattern{Name: &ast.Identifier{Value: name}}
+	}
+	subject := func(input string) ast.Expression {
+		return parse(t, input).Statements[0].(*ast.ExpressionStatement).Expression
+	}
+
+	tests := []struct {
+		match    *syntax.Match
+		expected []string
+	}{
+		{
+			// match (1) { 1 => { "a" }, _ => { "b" } } - 1
+			&syntax.Match{Subject: subject("1"), Arms: []*syntax.Arm{
+				arm(&syntax.LiteralPattern{Value: &ast.IntegerLiteral{Value: 1}}, `"a"`),
+				arm(&syntax.WildcardPattern{}, `"b"`),
+			}},
+			[]string{"invalid operation: string - int"},
+		},
+		{
+			// Without a default arm the match can be null
+			&syntax.Match{Subject: subject("1"), Arms: []*syntax.Arm{
+				arm(&syntax.LiteralPattern{Value: &ast.IntegerLiteral{Value: 1}}, `"a"`),
+			}},
+			nil,
+		},
+		{
+			// match (["a"]) { [x] => { x - 1 } } - 1
+			&syntax.Match{Subject: subject(`["a"]`), Arms: []*syntax.Arm{
+				arm(&syntax.ArrayPattern{Elements: []syntax.Pattern{binding("x")}}, "x - 1"),
+			}},
+			[]string{"invalid operation: string - int"},
+		},
+		{
+			// match ({"k": 1}) { {"k": v} => { v + "s" }, v => { 0 } } - 1
+			&syntax.Match{Subject: subject(`{"k": 1}`), Arms: []*syntax.Arm{
+				arm(&syntax.HashPattern{Keys: []ast.Expression{&ast.String{Value: "k"}}, Values: []syntax.Pattern{binding("v")}}, `v + "s"`),
+				arm(binding("v"), "v"),
+			}},
+			[]string{"invalid operation: int + string"},
+		},
+	}
+
+	for _, tc := range tests {
+		program := &ast.Program{Statements: []ast.Statement{&ast.ExpressionStatement{Expression: &ast.SuffixExpression{
+			Left:     tc.match,
+			Operator: "-",
+			Right:    &ast.IntegerLiteral{Value: 1},
+		}}}}
+
+		diagnostics := Check(program)
+
+		if len(diagnostics) != len(tc.expected) {
+			t.Fatalf("wrong diagnostics for %q. got=%v. expected=%q", tc.match.String(), diagnostics, tc.expected)
+		}
+
+		for i, d := range diagnostics {
+			if d.Message != tc.expected[i] {
+				t.Errorf("wrong diagnostic for %q. got=%q. expected=%q", tc.match.String(), d.Message, tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestCheck_Destructuring(t *testing.T) {
+	binding := func(name string) syntax.Pattern {
+		return &syntax.BindingPattern{Name: &ast.Identifier{Value: name}}
+	}
+
+	tests := []struct {
+		input string
+		// Replaces the first expression statement of input
+		statement ast.Statement
+		expected  []string
+	}{
+		{
+			// var [a, ...r] = [1, 2]; a + "x"; r[0] - "x"
+			`[1, 2]; a + "x"; r[0] - "x"`,
+			&syntax.Destructuring{
+				Pattern: &syntax.ArrayPattern{Elements: []syntax.Pattern{binding("a")}, Rest: &ast.Identifier{Value: "r"}},
+				Value:   &ast.Array{Elements: []ast.Expression{&ast.IntegerLiteral{Value: 1}, &ast.IntegerLiteral{Value: 2}}},
+			},
+			[]string{"invalid operation: int + string", "invalid operation: int - string"},
+		},
+		{
+			// var {"k": v} = {"k": "s"}; v - 1
+			`{"k": "s"}; v - 1`,
+			&syntax.Destructuring{
+				Pattern: &syntax.HashPattern{Keys: []ast.Expression{&ast.String{Value: "k"}}, Values: []syntax.Pattern{binding("v")}},
+				Value:   &ast.Hashmap{Values: map[ast.Expression]ast.Expression{&ast.String{Value: "k"}: &ast.String{Value: "s"}}},
+			},
+			[]string{"invalid operation: string - int"},
+		},
+		{
+			// Assigned values widen the type: var v = 1; [v] = ["s"]; v - 1
+			`var v = 1; ["s"]; v - 1`,
+			&syntax.DestructuringAssign{
+				Pattern: &syntax.ArrayPattern{Elements: []syntax.Pattern{binding("v")}},
+				Value:   &ast.Array{Elements: []ast.Expression{&ast.String{Value: "s"}}},
+			},
+			nil,
+		},
+	}
+
+	for _, tc := range tests {
+		program := parse(t, tc.input)
+
+		for i, s := range program.Statements {
+			if _, ok := s.(*ast.ExpressionStatement); ok {
+				program.Statements[i] = tc.statement
+				break
+			}
+		}
+
+		diagnostics := Check(program)
+
+		if len(diagnostics) != len(tc.expected) {
+			t.Fatalf("wrong diagnostics for %q. got=%v. expected=%q", program.String(), diagnostics, tc.expected)
+		}
+
+		for i, d := range diagnostics {
+			if d.Message != tc.expected[i] {
+				t.Errorf("wrong diagnostic for %q. got=%q. expected=%q", program.String(), d.Message, tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestCheck_Defaults(t *testing.T) {
+	one := &ast.IntegerLiteral{Value: 1}
+
+	tests := []struct {
+		// The function f is declared with defaults and variadic
+		input    string
+		defaults []ast.Expression
+		variadic bool
+		expected []string
+	}{
+		{`var f = fun(a, b) { a }; f(1); f(1, 2)`, []ast.Expression{nil, one}, false, nil},
+		{`var f = fun(a, b) { a }; f()`, []ast.Expression{nil, one}, false, []string{"not enough arguments. got=0. expected at least 1"}},
+		{`var f = fun(a, b) { a }; f(1, 2, 3)`, []ast.Expression{nil, one}, false, []string{"too many arguments. got=3. expected at most 2"}},
+		{`var f = fun(a, r) { a }; f(1); f(1, 2, 3)`, nil, true, nil},
+		{`var f = fun(a, r) { a }; f()`, nil, true, []string{"not enough arguments. got=0. expected at least 1"}},
+		{`var f = fun(r) { r() }; f()`, nil, true, []string{"cannot call array"}},
+		{
+			`var f = fun(a) { a }; f()`,
+			[]ast.Expression{&ast.SuffixExpression{Left: one, Operator: "+", Right: &ast.String{Value: "a"}}},
+			false,
+			[]string{"invalid operation: int + string"},
+		},
+	}
+
+	for _, tc := range tests {
+		program := parse(t, tc.input)
+
+		for _, s := range program.Statements {
+			if declaration, ok := s.(*ast.VariableDeclaration); ok && declaration.Identifier.Value == "f" {
+				declaration.Value = &syntax.Function{
+					Function: *declaration.Value.(*ast.Function),
+					Defaults: tc.defaults,
+					Variadic: tc.variadic,
+				}
+			}
+		}
+
+		diagnostics := Check(program)
+
+		if len(diagnostics) != len(tc.expected) {
+			t.Fatalf("wrong diagnostics for %q. got=%v. expected=%q", program.String(), diagnostics, tc.expected)
+		}
+
+		for i, d := range diagnostics {
+			if d.Message != tc.expected[i] {
+				t.Errorf("wrong diagnostic for %q. got=%q. expected=%q", program.String(), d.Message, tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestCheck_ForEach(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{`each(["a"], fun(x) { x + "b" })`, nil},
+		{`each(["a"], fun(i, x) { i + x })`, []string{"invalid operation: int + string"}},
+		{`each({"a": 1}, fun(k) { k + 1 })`, []string{"invalid operation: string + int"}},
+		{`each({"a": 1}, fun(k, v) { v + 1 })`, nil},
+		{`each(5, fun(x) { x })`, []string{"cannot iterate over int"}},
+	}
+
+	for _, tc := range tests {
+		// each(iterable, fun(variables) { body }) stands for a for-each loop,
+		// the parser doesn't know them yet
+		program := parse(t, tc.input)
+		call := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.CallExpression)
+		body := call.Parameters[1].(*ast.Function)
+		program.Statements[0] = &ast.ExpressionStatement{
+			Expression: &syntax.ForEach{Variables: body.Parameters, Iterable: call.Parameters[0], Body: body.Body},
+		}
+
+		diagnostics := Check(program)
+
+		if len(diagnostics) != len(tc.expected) {
+			t.Fatalf("wrong diagnostics for %q. got=%v. expected=%q", tc.input, diagnostics, tc.expected)
+		}
+
+		for i, d := range diagnostics {
+			if d.Message != tc.expected[i] {
+				t.Errorf("wrong diagnostic for %q. got=%q. expected=%q", tc.input, d.Message, tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestDiagnostic_String(t *testing.T) {
+	diagnostic := Diagnostic{Node: &ast.IntegerLiteral{Value: 5}, Message: "cannot call int"}
+	expected := "type error: cannot call int in 5"
+
+	if diagnostic.String() != expected {
+		t.Fatalf("wrong string. got=%q. expected=%q", diagnostic.String(), expected)
+	}
+}
+
+// declareFunctions turns every var declaration of a function into a function
+// declaration, the parser doesn't know them yet
+func declareFunctions(statements []ast.Statement) {
+	for i, s := range statements {
+		declaration, ok := s.(*ast.VariableDeclaration)
+		if !ok {
+			continue
+		}
+
+		function, ok := declaration.Value.(*ast.Function)
+		if !ok {
+			continue
+		}
+
+		declareFunctions(function.Body.Statements)
+		statements[i] = &syntax.FunctionDeclaration{Name: declaration.Identifier, Function: &syntax.Function{Function: *function}}
+	}
+}
+
+func TestCheck_FunctionDeclarations(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		// Before its declaration the signature of a function isn't known yet
+		{`f(1, 2) + "a"; var f = fun() { 1 }`, nil},
+		{`var f = fun() { 1 }; f(1)`, []string{"wrong number of arguments. got=1. expected=0"}},
+		{`var f = fun() { 1 }; f() + "a"`, []string{"invalid operation: int + string"}},
+		{`var even = fun(n) { odd(n) }; var odd = fun(n) { even(n) }; even(1, 2)`, []string{"wrong number of arguments. got=2. expected=1"}},
+		{`var f = fun() { g(); var g = fun() { 1 }; g(2) }`, []string{"wrong number of arguments. got=1. expected=0"}},
+	}
+
+	for _, tc := range tests {
+		program := parse(t, tc.input)
+		declareFunctions(program.Statements)
+
+		diagnostics := Check(program)
+
+		if len(diagnostics) != len(tc.expected) {
+			t.Fatalf("wrong diagnostics for %q. got=%v. expected=%q", program.String(), diagnostics, tc.expected)
+		}
+
+		for i, d := range diagnostics {
+			if d.Message != tc.expected[i] {
+				t.Errorf("wrong diagnostic for %q. got=%q. expected=%q", program.String(), d.Message, tc.expected[i])
+			}
+		}
+	}
+}
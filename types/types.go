@@ -0,0 +1,160 @@
+// Package types infers the types of a Loop program and reports operations
+// that would always fail at runtime, like adding a string to an integer.
+// Loop is dynamically typed, so anything whose type can't be inferred is
+// Any and never reported.
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Kind int
+
+const (
+	Any Kind = iota
+	Integer
+	Float
+	String
+	Boolean
+	Null
+	Array
+	Hashmap
+	Function
+)
+
+var kindNames = map[Kind]string{
+	Any:      "any",
+	Integer:  "int",
+	Float:    "float",
+	String:   "string",
+	Boolean:  "bool",
+	Null:     "null",
+	Array:    "array",
+	Hashmap:  "hashmap",
+	Function: "function",
+}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+// Type is the inferred type of an expression
+type Type struct {
+	Kind Kind
+	// Type of the elements of an array or the values of a hashmap
+	Elem *Type
+	// Type of the keys of a hashmap
+	Key *Type
+	// Signature of a function, nil if it isn't known
+	Signature *Signature
+}
+
+type Signature struct {
+	Params []Type
+	// Variadic functions accept any number of arguments of the type of their
+	// last parameter
+	Variadic bool
+	// Parameters before the variadic one that calls can leave out, they
+	// have a default value
+	Optional int
+	Result   Type
+	// Check reports arguments the function doesn't accept, beyond what
+	// Params describes
+	Check func(args []Type) error
+}
+
+var (
+	AnyType     = Type{Kind: Any}
+	IntegerType = Type{Kind: Integer}
+	FloatType   = Type{Kind: Float}
+	StringType  = Type{Kind: String}
+	BooleanType = Type{Kind: Boolean}
+	NullType    = Type{Kind: Null}
+)
+
+// ArrayOf returns the type of an array with elements of type elem
+func ArrayOf(elem Type) Type {
+	return Type{Kind: Array, Elem: &elem}
+}
+
+// HashmapOf returns the type of a hashmap from key to value
+func HashmapOf(key, value Type) Type {
+	return Type{Kind: Hashmap, Key: &key, Elem: &value}
+}
+
+// FunctionOf returns the type of a function with the given signature
+func FunctionOf(signature *Signature) Type {
+	return Type{Kind: Function, Signature: signature}
+}
+
+func (t Type) String() string {
+	switch t.Kind {
+	case Array:
+		if t.Elem != nil {
+			return fmt.Sprintf("[%s]", t.Elem)
+		}
+	case Hashmap:
+		if t.Key != nil && t.Elem != nil {
+			return fmt.Sprintf("{%s: %s}", t.Key, t.Elem)
+		}
+	case Function:
+		if t.Signature != nil {
+			params := make([]string, len(t.Signature.Params))
+			for i, param := range t.Signature.Params {
+				params[i] = param.String()
+			}
+
+			last := len(params)
+			if t.Signature.Variadic && len(params) > 0 {
+				last--
+				params[last] += "..."
+			}
+
+			for i := last - t.Signature.Optional; i < last; i++ {
+				params[i] += "?"
+			}
+
+			return fmt.Sprintf("fun(%s) %s", strings.Join(params, ", "), t.Signature.Result)
+		}
+	}
+
+	return t.Kind.String()
+}
+
+// Join returns a type describing values of both a and b
+func Join(a, b Type) Type {
+	if a.Kind != b.Kind {
+		return AnyType
+	}
+
+	switch a.Kind {
+	case Array:
+		return ArrayOf(join(a.Elem, b.Elem))
+	case Hashmap:
+		return HashmapOf(join(a.Key, b.Key), join(a.Elem, b.Elem))
+	case Function:
+		if a.Signature != b.Signature {
+			return Type{Kind: Function}
+		}
+	}
+
+	return a
+}
+
+func join(a, b *Type) Type {
+	if a == nil || b == nil {
+		return AnyType
+	}
+
+	return Join(*a, *b)
+}
+
+// element returns the type of the elements, or Any if it isn't known
+func element(t *Type) Type {
+	if t == nil {
+		return AnyType
+	}
+
+	return *t
+}
@@ -0,0 +1,49 @@
+package types
+
+import "testing"
+
+func TestJoin(t *testing.T) {
+	signature := &Signature{Result: IntegerType}
+
+	tests := []struct {
+		a, b     Type
+		expected string
+	}{
+		{IntegerType, IntegerType, "int"},
+		{IntegerType, StringType, "any"},
+		{ArrayOf(IntegerType), ArrayOf(IntegerType), "[int]"},
+		{ArrayOf(IntegerType), ArrayOf(StringType), "[any]"},
+		{ArrayOf(IntegerType), Type{Kind: Array}, "[any]"},
+		{HashmapOf(StringType, IntegerType), HashmapOf(StringType, BooleanType), "{string: any}"},
+		{FunctionOf(signature), FunctionOf(signature), "fun() int"},
+		{FunctionOf(signature), FunctionOf(&Signature{Result: IntegerType}), "function"},
+	}
+
+	for _, tc := range tests {
+		actual := Join(tc.a, tc.b)
+
+		if actual.String() != tc.expected {
+			t.Errorf("wrong join of %s and %s. got=%s. expected=%s", tc.a, tc.b, actual, tc.expected)
+		}
+	}
+}
+
+func TestType_String(t *testing.T) {
+	tests := []struct {
+		t        Type
+		expected string
+	}{
+		{AnyType, "any"},
+		{NullType, "null"},
+		{Type{Kind: Hashmap}, "hashmap"},
+		{FunctionOf(&Signature{Params: []Type{IntegerType, AnyType}, Result: StringType}), "fun(int, any) string"},
+		{FunctionOf(builtinSignatures["print"]), "fun(any...) null"},
+		{FunctionOf(&Signature{Params: []Type{AnyType, AnyType, AnyType}, Variadic: true, Optional: 1, Result: AnyType}), "fun(any, any?, any...) any"},
+	}
+
+	for _, tc := range tests {
+		if tc.t.String() != tc.expected {
+			t.Errorf("wrong string. got=%s. expected=%s", tc.t, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Package values holds object types of the language that the models/object
+// package of github.com/looplanguage/loop doesn't have yet. They implement
+// object.Object, so they can be stored in the constant pool next to its types.
+package values
+
+import (
+	"github.com/looplanguage/loop/models/object"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const FLOAT = "FLOAT"
+
+// Float is a 64-bit floating point number
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() object.ObjectType { return FLOAT }
+func (f *Float) Inspect() string         { return FormatFloat(f.Value) }
+
+// Floats returns two numbers as floats if at least one of them is a float.
+// Arithmetic mixing an integer with a float converts the integer to a float.
+func Floats(left, right object.Object) (float64, float64, bool) {
+	l, leftFloat := number(left)
+	r, rightFloat := number(right)
+
+	if l == nil || r == nil || (!leftFloat && !rightFloat) {
+		return 0, 0, false
+	}
+
+	return *l, *r, true
+}
+
+func number(obj object.Object) (*float64, bool) {
+	switch obj := obj.(type) {
+	case *Float:
+		return &obj.Value, true
+	case *object.Integer:
+		value := float64(obj.Value)
+		return &value, false
+	}
+
+	return nil, false
+}
+
+// FormatFloat formats a float with the fewest digits that read back as the
+// same value. Whole numbers keep a ".0" so they aren't mistaken for integers.
+func FormatFloat(value float64) string {
+	formatted := strconv.FormatFloat(value, 'g', -1, 64)
+
+	if math.IsInf(value, 0) || math.IsNaN(value) || strings.ContainsAny(formatted, ".e") {
+		return formatted
+	}
+
+	return formatted + ".0"
+}
@@ -0,0 +1,53 @@
+package values
+
+import (
+	"github.com/looplanguage/loop/models/object"
+	"math"
+	"testing"
+)
+
+func TestFloats(t *testing.T) {
+	tests := []struct {
+		left, right object.Object
+		ok          bool
+		l, r        float64
+	}{
+		{&Float{Value: 1.5}, &Float{Value: 2}, true, 1.5, 2},
+		{&object.Integer{Value: 1}, &Float{Value: 0.5}, true, 1, 0.5},
+		{&Float{Value: 0.5}, &object.Integer{Value: -3}, true, 0.5, -3},
+		{&object.Integer{Value: 1}, &object.Integer{Value: 2}, false, 0, 0},
+		{&Float{Value: 1}, &object.String{Value: "a"}, false, 0, 0},
+	}
+
+	for _, tc := range tests {
+		l, r, ok := Floats(tc.left, tc.right)
+
+		if ok != tc.ok || l != tc.l || r != tc.r {
+			t.Errorf("wrong floats for %s and %s. got=(%v, %v, %t). expected=(%v, %v, %t)", tc.left.Inspect(), tc.right.Inspect(), l, r, ok, tc.l, tc.r, tc.ok)
+		}
+	}
+}
+
+func TestFloat_Inspect(t *testing.T) {
+	tests := []struct {
+		value    float64
+		expected string
+	}{
+		{3.14, "3.14"},
+		{2, "2.0"},
+		{-0.5, "-0.5"},
+		{0.30000000000000004, "0.30000000000000004"},
+		{1e21, "1e+21"},
+		{1.5e-7, "1.5e-07"},
+		{math.MaxFloat64, "1.7976931348623157e+308"},
+		{math.Inf(1), "+Inf"},
+	}
+
+	for _, tc := range tests {
+		f := &Float{Value: tc.value}
+
+		if f.Inspect() != tc.expected {
+			t.Errorf("wrong string. got=%q. expected=%q", f.Inspect(), tc.expected)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package verify
+
+import (
+	"fmt"
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/loop/models/object"
+)
+
+// MainFunction is the function index used in errors for the top-level program
+const MainFunction = -1
+
+// Error describes why an instruction stream was rejected
+type Error struct {
+	// Index of the function in the constant pool, or MainFunction
+	Function int
+	// Offset of the offending instruction
+	Position int
+	Message  string
+}
+
+func (e *Error) Error() string {
+	if e.Function == MainFunction {
+		return fmt.Sprintf("invalid bytecode at [%04d]: %s", e.Position, e.Message)
+	}
+
+	return fmt.Sprintf("invalid bytecode in function %d at [%04d]: %s", e.Function, e.Position, e.Message)
+}
+
+type instruction struct {
+	position int
+	op       code.OpCode
+	def      *code.Definition
+	operands []int
+	width    int
+}
+
+type function struct {
+	index         int
+	instructions  code.Instructions
+	numLocals     int
+	numParameters int
+	numFree       int
+	isMain        bool
+}
+
+type verifier struct {
+	constants []object.Object
+	// Amount of free variables each function constant is closed over with
+	numFree map[int]int
+}
+
+// Verify checks the instructions of the main program and every function in
+// the constant pool. It makes sure that every opcode exists, operands are in
+// range, jumps land on instructions and that the stack depth is the same on
+// every path to an instruction.
+func Verify(instructions code.Instructions, constants []object.Object) error {
+	v := &verifier{
+		constants: constants,
+		numFree:   map[int]int{},
+	}
+
+	functions := []function{{index: MainFunction, instructions: instructions, isMain: true}}
+
+	for i, constant := range constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			functions = append(functions, function{
+				index:         i,
+				instructions:  fn.Instructions,
+				numLocals:     fn.NumLocals,
+				numParameters: fn.NumParameters,
+			})
+		}
+	}
+
+	decoded := make([][]instruction, len(functions))
+
+	// Decode everything first, the amount of free variables of a function is
+	// only known once the closure that creates it has been seen
+	for i, fn := range functions {
+		instructions, err := decode(fn)
+		if err != nil {
+			return err
+		}
+
+		for _, ins := range instructions {
+			err := v.recordClosure(fn, ins)
+			if err != nil {
+				return err
+			}
+		}
+
+		decoded[i] = instructions
+	}
+
+	for i, fn := range functions {
+		if !fn.isMain {
+			fn.numFree = v.numFree[fn.index]
+		}
+
+		err := v.verifyFunction(fn, decoded[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *verifier) verifyFunction(fn function, instructions []instruction) error {
+	// Offset of each instruction to its place in the decoded list
+	offsets := map[int]int{}
+	for i, ins := range instructions {
+		offsets[ins.position] = i
+	}
+
+	for _, ins := range instructions {
+		err := v.checkOperands(fn, ins, offsets)
+		if err != nil {
+			return err
+		}
+	}
+
+	return checkStack(fn, instructions, offsets)
+}
+
+func (v *verifier) recordClosure(fn function, ins instruction) error {
+	if ins.op != code.OpClosure {
+		return nil
+	}
+
+	index, numFree := ins.operands[0], ins.operands[1]
+
+	if index >= len(v.constants) {
+		return &Error{
+			Function: fn.index,
+			Position: ins.position,
+			Message:  fmt.Sprintf("constant %d out of range. constants=%d", index, len(v.constants)),
+		}
+	}
+
+	if _, ok := v.constants[index].(*object.CompiledFunction); !ok {
+		return &Error{
+			Function: fn.index,
+			Position: ins.position,
+			Message:  fmt.Sprintf("constant %d is not a function. got=%s", index, v.constants[index].Type()),
+		}
+	}
+
+	if previous, ok := v.numFree[index]; ok && previous != numFree {
+		return &Error{
+			Function: fn.index,
+			Position: ins.position,
+			Message:  fmt.Sprintf("function %d is closed over %d free variables, previously %d", index, numFree, previous),
+		}
+	}
+
+	v.numFree[index] = numFree
+
+	return nil
+}
+
+func decode(fn function) ([]instruction, error) {
+	var instructions []instruction
+
+	i := 0
+	for i < len(fn.instructions) {
+		ins, err := code.ReadInstruction(fn.instructions, i)
+		if err != nil {
+			return nil, &Error{Function: fn.index, Position: i, Message: err.Error()}
+		}
+
+		instructions = append(instructions, instruction{
+			position: i,
+			op:       ins.Op,
+			def:      ins.Def,
+			operands: ins.Operands,
+			width:    ins.Size,
+		})
+
+		i += ins.Size
+	}
+
+	return instructions, nil
+}
+
+// decoded returns an instruction as the code package decodes it
+func decoded(ins instruction) code.Instruction {
+	return code.Instruction{Op: ins.op, Def: ins.def, Operands: ins.operands, Size: ins.width}
+}
+
+func (v *verifier) checkOperands(fn function, ins instruction, offsets map[int]int) error {
+	fail := func(format string, args ...interface{}) error {
+		return &Error{Function: fn.index, Position: ins.position, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if ins.def.Is(code.ReadsConstant) && ins.operands[0] >= len(v.constants) {
+		return fail("constant %d out of range. constants=%d", ins.operands[0], len(v.constants))
+	}
+
+	if ins.def.Is(code.Jump) {
+		target := ins.def.JumpTarget(ins.operands)
+
+		// Jumping to the very end is allowed, it simply ends execution
+		if _, ok := offsets[target]; !ok && target != len(fn.instructions) {
+			return fail("jump target %d is not the start of an instruction", target)
+		}
+	}
+
+	if ins.def.Is(code.Table) {
+		table, ok := v.constants[ins.operands[0]].(*object.Array)
+		if !ok || len(table.Elements) != ins.operands[1] {
+			return fail("constant %d is not a table of %d values", ins.operands[0], ins.operands[1])
+		}
+
+		_, err := code.TableEntries(fn.instructions, decoded(ins), ins.position)
+		if err != nil {
+			return fail("%s", err)
+		}
+	}
+
+	switch ins.op {
+	case code.OpGetLocal, code.OpSetLocal, code.OpMakeCell:
+		if fn.isMain {
+			return fail("local %d used outside of a function", ins.operands[0])
+		}
+
+		if ins.operands[0] >= fn.numLocals {
+			return fail("local %d out of range. locals=%d", ins.operands[0], fn.numLocals)
+		}
+	case code.OpJumpIfArgument:
+		if ins.operands[0] >= fn.numParameters {
+			return fail("parameter %d out of range. parameters=%d", ins.operands[0], fn.numParameters)
+		}
+	case code.OpGetFree:
+		if ins.operands[0] >= fn.numFree {
+			return fail("free variable %d out of range. free=%d", ins.operands[0], fn.numFree)
+		}
+	case code.OpGetBuiltinFunction:
+		if ins.operands[0] >= len(object.Builtins) {
+			return fail("builtin %d out of range. builtins=%d", ins.operands[0], len(object.Builtins))
+		}
+	}
+
+	return nil
+}
+
+// checkStack walks every reachable path and tracks the operand stack depth
+func checkStack(fn function, instructions []instruction, offsets map[int]int) error {
+	depths := map[int]int{}
+	work := []int{0}
+
+	if len(instructions) == 0 {
+		if fn.isMain {
+			return nil
+		}
+
+		return &Error{Function: fn.index, Message: "function has no instructions"}
+	}
+
+	depths[0] = 0
+
+	visit := func(from instruction, target, depth int) error {
+		if target == len(fn.instructions) {
+			if !fn.isMain {
+				return &Error{Function: fn.index, Position: from.position, Message: "function does not end with a return"}
+			}
+
+			return nil
+		}
+
+		if previous, ok := depths[target]; ok {
+			if previous != depth {
+				return &Error{
+					Function: fn.index,
+					Position: target,
+					Message:  fmt.Sprintf("inconsistent stack depth. got=%d. previously=%d", depth, previous),
+				}
+			}
+
+			return nil
+		}
+
+		depths[target] = depth
+		work = append(work, target)
+
+		return nil
+	}
+
+	for len(work) > 0 {
+		position := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		ins := instructions[offsets[position]]
+		depth := depths[position]
+
+		pop, push := ins.def.StackEffect(ins.operands)
+		if depth < pop {
+			return &Error{
+				Function: fn.index,
+				Position: ins.position,
+				Message:  fmt.Sprintf("stack underflow. depth=%d. pops=%d", depth, pop),
+			}
+		}
+
+		depth = depth - pop + push
+
+		if ins.def.Is(code.Jump) {
+			err := visit(ins, ins.def.JumpTarget(ins.operands), depth)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !ins.def.Is(code.Terminator) {
+			err := visit(ins, ins.position+ins.width, depth)
+			if err != nil {
+				return err
+			}
+		}
+
+		if ins.def.Is(code.Table) {
+			entries, _ := code.TableEntries(fn.instructions, decoded(ins), ins.position)
+			for _, entry := range entries {
+				err := visit(ins, entry, depth)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,506 @@
+package verify
+
+import (
+	"github.com/looplanguage/compiler/code"
+	"github.com/looplanguage/compiler/code/codetest"
+	"github.com/looplanguage/compiler/compiler"
+	"github.com/looplanguage/compiler/peephole"
+	"github.com/looplanguage/compiler/syntax"
+	"github.com/looplanguage/loop/lexer"
+	"github.com/looplanguage/loop/models/ast"
+	"github.com/looplanguage/loop/models/object"
+	"github.com/looplanguage/loop/parser"
+	"testing"
+)
+
+type verifyTestCase struct {
+	instructions []code.Instructions
+	constants    []object.Object
+	expected     string
+}
+
+func TestVerify(t *testing.T) {
+	tests := []verifyTestCase{
+		{
+			instructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpAdd),
+				codetest.Make(code.OpPop),
+			},
+			constants: []object.Object{&object.Integer{Value: 1}},
+			expected:  "",
+		},
+		{
+			instructions: []code.Instructions{
+				{255},
+			},
+			expected: "invalid bytecode at [0000]: unknown opcode 255",
+		},
+		{
+			instructions: []code.Instructions{
+				codetest.Make(code.OpTrue),
+				{byte(code.OpJump), 0},
+			},
+			expected: "invalid bytecode at [0001]: OpJump is truncated",
+		},
+		{
+			instructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 1),
+			},
+			constants: []object.Object{&object.Integer{Value: 1}},
+			expected:  "invalid bytecode at [0000]: constant 1 out of range. constants=1",
+		},
+		{
+			instructions: []code.Instructions{
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpIfNotTrue, 9999),
+			},
+			expected: "invalid bytecode at [0001]: jump target 9999 is not the start of an instruction",
+		},
+		{
+			instructions: []code.Instructions{
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpIfNotTrue, 2),
+			},
+			expected: "invalid bytecode at [0001]: jump target 2 is not the start of an instruction",
+		},
+		{
+			instructions: []code.Instructions{
+				codetest.Make(code.OpTrue),
+				wide(code.OpJumpIfNotTrue, 9),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+			expected: "",
+		},
+		{
+			instructions: []code.Instructions{
+				codetest.Make(code.OpTrue),
+				wide(code.OpJumpIfNotTrue, 2),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+			expected: "invalid bytecode at [0001]: jump target 2 is not the start of an instruction",
+		},
+		{
+			instructions: []code.Instructions{
+				{byte(code.OpWide), byte(code.OpPop)},
+			},
+			expected: "invalid bytecode at [0000]: OpWide can not prefix OpPop",
+		},
+		{
+			instructions: []code.Instructions{
+				codetest.Make(code.OpPop),
+			},
+			expected: "invalid bytecode at [0000]: stack underflow. depth=0. pops=1",
+		},
+		{
+			// The consequence pushes a value, the alternative doesn't
+			instructions: []code.Instructions{
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpIfNotTrue, 8),
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJump, 8),
+				codetest.Make(code.OpPop),
+			},
+			expected: "invalid bytecode at [0008]: inconsistent stack depth. got=1. previously=0",
+		},
+		{
+			instructions: []code.Instructions{
+				codetest.Make(code.OpGetLocal, 0),
+			},
+			expected: "invalid bytecode at [0000]: local 0 used outside of a function",
+		},
+		{
+			instructions: []code.Instructions{
+				codetest.Make(code.OpClosure, 0, 0),
+				codetest.Make(code.OpPop),
+			},
+			constants: []object.Object{
+				&object.CompiledFunction{
+					Instructions: concat(codetest.Make(code.OpGetLocal, 1), codetest.Make(code.OpReturnValue)),
+					NumLocals:    1,
+				},
+			},
+			expected: "invalid bytecode in function 0 at [0000]: local 1 out of range. locals=1",
+		},
+		{
+			instructions: []code.Instructions{
+				codetest.Make(code.OpConstant, 0),
+				codetest.Make(code.OpPop),
+			},
+			constants: []object.Object{
+				&object.CompiledFunction{
+					Instructions:  concat(codetest.Make(code.OpJumpIfArgument, 1, 4), codetest.Make(code.OpReturn)),
+					NumLocals:     1,
+					NumParameters: 1,
+				},
+			},
+			expected: "invalid bytecode in function 0 at [0000]: parameter 1 out of range. parameters=1",
+		},
+		{
+			instructions: []code.Instructions{
+				codetest.Make(code.OpClosure, 0, 0),
+				codetest.Make(code.OpPop),
+			},
+			constants: []object.Object{
+				&object.CompiledFunction{
+					Instructions: concat(codetest.Make(code.OpGetFree, 0), codetest.Make(code.OpReturnValue)),
+				},
+			},
+			expected: "invalid bytecode in function 0 at [0000]: free variable 0 out of range. free=0",
+		},
+		{
+			instructions: []code.Instructions{
+				codetest.Make(code.OpClosure, 0, 0),
+			},
+			constants: []object.Object{&object.Integer{Value: 1}},
+			expected:  "invalid bytecode at [0000]: constant 0 is not a function. got=INTEGER",
+		},
+		{
+			instructions: []code.Instructions{},
+			constants: []object.Object{
+				&object.CompiledFunction{
+					Instructions: codetest.Make(code.OpNull),
+				},
+			},
+			expected: "invalid bytecode in function 0 at [0000]: function does not end with a return",
+		},
+		{
+			// Both entries of the table lead to OpNull
+			instructions: []code.Instructions{
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpTable, 0, 2, 16),
+				codetest.Make(code.OpJump, 14),
+				codetest.Make(code.OpJump, 14),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+			constants: []object.Object{&object.Array{Elements: []object.Object{&object.Integer{Value: 1}, &object.Integer{Value: 2}}}},
+			expected:  "",
+		},
+		{
+			// The second entry skips OpNull
+			instructions: []code.Instructions{
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpTable, 0, 2, 16),
+				codetest.Make(code.OpJump, 14),
+				codetest.Make(code.OpJump, 15),
+				codetest.Make(code.OpNull),
+				codetest.Make(code.OpPop),
+			},
+			constants: []object.Object{&object.Array{Elements: []object.Object{&object.Integer{Value: 1}, &object.Integer{Value: 2}}}},
+			expected:  "invalid bytecode at [0015]: stack underflow. depth=0. pops=1",
+		},
+		{
+			instructions: []code.Instructions{
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpTable, 0, 2, 12),
+				codetest.Make(code.OpJump, 12),
+				codetest.Make(code.OpNull),
+			},
+			constants: []object.Object{&object.Array{Elements: []object.Object{&object.Integer{Value: 1}, &object.Integer{Value: 2}}}},
+			expected:  "invalid bytecode at [0001]: entry 1 of OpJumpTable is not OpJump. got=OpNull",
+		},
+		{
+			instructions: []code.Instructions{
+				codetest.Make(code.OpTrue),
+				codetest.Make(code.OpJumpTable, 0, 1, 11),
+				codetest.Make(code.OpJump, 11),
+			},
+			constants: []object.Object{&object.Integer{Value: 1}},
+			expected:  "invalid bytecode at [0001]: constant 0 is not a table of 1 values",
+		},
+	}
+
+	for _, tc := range tests {
+		err := Verify(concat(tc.instructions...), tc.constants)
+
+		if err == nil && tc.expected != "" {
+			t.Fatalf("expected error %q, got none", tc.expected)
+		}
+
+		if err != nil && err.Error() != tc.expected {
+			t.Fatalf("incorrect error. got=%q. expected=%q", err, tc.expected)
+		}
+	}
+}
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+
+	p := parser.Create(lexer.Create(input))
+	program := p.Parse()
+
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors for %q: %v", input, p.Errors)
+	}
+
+	return program
+}
+
+// configurations are the compiler settings whose output is verified
+var configurations = []func(c *compiler.Compiler){
+	func(c *compiler.Compiler) {},
+	func(c *compiler.Compiler) {
+		c.OptimizationLevel = 1
+	},
+	func(c *compiler.Compiler) {
+		c.OptimizationLevel = 1
+		c.Superinstructions = true
+		c.Rules = peephole.Rules
+	},
+	func(c *compiler.Compiler) {
+		c.Superinstructions = true
+		c.Rules = peephole.Rules
+	},
+	func(c *compiler.Compiler) {
+		c.OptimizationLevel = 2
+	},
+	func(c *compiler.Compiler) {
+		c.TailCalls = true
+	},
+	func(c *compiler.Compiler) {
+		c.OptimizationLevel = 1
+		c.TailCalls = true
+	},
+}
+
+func TestVerify_CompilerOutput(t *testing.T) {
+	inputs := []string{
+		"1 + 2; 3",
+		"var x = 1; if(x == 1) { 10 } else { 20 }",
+		"if(true) { var x = 1 }; 5",
+		"if(true) { 1 } else if(false) { 2 }",
+		"var i = 0; while(i < 10) { i = i + 1 }",
+		"var test = fun(a, b) { return a + b }; test(1, 2)",
+		"fun(a) { return fun(b) { return a + b } }",
+		"fun(a) { if(a > 1) { return 1 }; 2 }",
+		"fun() { while(true) { if(true) { return 1 } } }",
+		"var x = [1, 2, 3]; x[0] = {1: 2}[1]; len(x)",
+		"var x = 1 + 2 * 3; if(x > 5) { x } else { 0 }",
+		"fun(a) { var b = if(a > 1) { 1 } else { return 2 }; b }",
+		"var double = fun(x) { x * 2 }; var i = 0; while(i < 3) { i = i + double(i) }",
+		"var f = fun(n, g) { if(n > 0) { f(n - 1, g) } else { return g(n) } }",
+		"var f = fun(n) { var g = fun() { n = n + 1 }; g(); n }; f(1)",
+	}
+
+	for _, input := range inputs {
+		program := parse(t, input)
+
+		for _, configure := range configurations {
+			comp := compiler.Create()
+			configure(comp)
+
+			err := comp.Compile(program, "", "", "")
+			if err != nil {
+				t.Fatalf("compiler error for %q: %s", input, err)
+			}
+
+			bytecode := comp.Bytecode()
+
+			err = Verify(bytecode.Instructions, bytecode.Constants)
+			if err != nil {
+				t.Fatalf("compiler output for %q does not verify: %s\n%s", input, err, bytecode.Instructions)
+			}
+		}
+	}
+}
+
+func TestVerify_ForEach(t *testing.T) {
+	// fun(xs) { for (x in xs) { if(x) { break }; if(x) { continue }; if(x) { return x } }; 0 }
+	program := parse(t, "fun(xs) { 0; 0 }")
+	body := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.Function).Body
+	loop := parse(t, "if(x) { 1 }; if(x) { 2 }; if(x) { return x }")
+	loop.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.ConditionalStatement).Body.Statements[0] = &syntax.Break{}
+	loop.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.ConditionalStatement).Body.Statements[0] = &syntax.Continue{}
+	body.Statements[0] = &ast.ExpressionStatement{Expression: &syntax.ForEach{
+		Variables: []*ast.Identifier{{Value: "x"}},
+		Iterable:  &ast.Identifier{Value: "xs"},
+		Body:      &ast.BlockStatement{Statements: loop.Statements},
+	}}
+
+	for _, configure := range configurations {
+		comp := compiler.Create()
+		configure(comp)
+
+		err := comp.Compile(program, "", "", "")
+		if err != nil {
+			t.Fatalf("compiler error for %q: %s", program.String(), err)
+		}
+
+		bytecode := comp.Bytecode()
+
+		err = Verify(bytecode.Instructions, bytecode.Constants)
+		if err != nil {
+			t.Fatalf("compiler output for %q does not verify: %s", program.String(), err)
+		}
+	}
+}
+
+func TestVerify_Match(t *testing.T) {
+	// fun(n) { match (n) { 1 => { 1 }, 2 => { return 2 }, 3 => { 3 }, x => { x } };
+	//   match (n) { [a, _] => { a }, {"k": [b]} => { b } } }
+	program := parse(t, "fun(n) { 0; 0 }")
+	body := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.Function).Body
+	arm := func(pattern syntax.Pattern, input string) *syntax.Arm {
+		return &syntax.Arm{Pattern: pattern, Body: &ast.BlockStatement{Statements: parse(t, input).Statements}}
+	}
+	binding := func(name string) syntax.Pattern {
+		return &syntax.BindingPattern{Name: &ast.Identifier{Value: name}}
+	}
+
+	body.Statements[0] = &ast.ExpressionStatement{Expression: &syntax.Match{
+		Subject: &ast.Identifier{Value: "n"},
+		Arms: []*syntax.Arm{
+			arm(&syntax.LiteralPattern{Value: &ast.IntegerLiteral{Value: 1}}, "1"),
+			arm(&syntax.LiteralPattern{Value: &ast.IntegerLiteral{Value: 2}}, "return 2"),
+			arm(&syntax.LiteralPattern{Value: &ast.IntegerLiteral{Value: 3}}, "3"),
+			arm(binding("x"), "x"),
+		},
+	}}
+	body.Statements[1] = &ast.ExpressionStatement{Expression: &syntax.Match{
+		Subject: &ast.Identifier{Value: "n"},
+		Arms: []*syntax.Arm{
+			arm(&syntax.ArrayPattern{Elements: []syntax.Pattern{binding("a"), &syntax.WildcardPattern{}}}, "a"),
+			arm(&syntax.HashPattern{
+				Keys:   []ast.Expression{&ast.String{Value: "k"}},
+				Values: []syntax.Pattern{&syntax.ArrayPattern{Elements: []syntax.Pattern{binding("b")}}},
+			}, "b"),
+		},
+	}}
+
+	for _, configure := range configurations {
+		comp := compiler.Create()
+		configure(comp)
+
+		err := comp.Compile(program, "", "", "")
+		if err != nil {
+			t.Fatalf("compiler error for %q: %s", program.String(), err)
+		}
+
+		bytecode := comp.Bytecode()
+
+		err = Verify(bytecode.Instructions, bytecode.Constants)
+		if err != nil {
+			t.Fatalf("compiler output for %q does not verify: %s", program.String(), err)
+		}
+	}
+}
+
+func TestVerify_Destructuring(t *testing.T) {
+	// var [a, ...r] = [1, 2, 3]; fun(p) { var {"x": [x, _]} = p; [x, a] = [a, x]; x }
+	program := parse(t, "0; fun(p) { 0; 0; x }")
+	body := program.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.Function).Body
+	a := &syntax.BindingPattern{Name: &ast.Identifier{Value: "a"}}
+	x := &syntax.BindingPattern{Name: &ast.Identifier{Value: "x"}}
+
+	program.Statements[0] = &syntax.Destructuring{
+		Pattern: &syntax.ArrayPattern{Elements: []syntax.Pattern{a}, Rest: &ast.Identifier{Value: "r"}},
+		Value:   parse(t, "[1, 2, 3]").Statements[0].(*ast.ExpressionStatement).Expression,
+	}
+	body.Statements[0] = &syntax.Destructuring{
+		Pattern: &syntax.HashPattern{
+			Keys:   []ast.Expression{&ast.String{Value: "x"}},
+			Values: []syntax.Pattern{&syntax.ArrayPattern{Elements: []syntax.Pattern{x, &syntax.WildcardPattern{}}}},
+		},
+		Value: &ast.Identifier{Value: "p"},
+	}
+	body.Statements[1] = &syntax.DestructuringAssign{
+		Pattern: &syntax.ArrayPattern{Elements: []syntax.Pattern{x, a}},
+		Value:   parse(t, "[a, x]").Statements[0].(*ast.ExpressionStatement).Expression,
+	}
+
+	for _, configure := range configurations {
+		comp := compiler.Create()
+		configure(comp)
+
+		err := comp.Compile(program, "", "", "")
+		if err != nil {
+			t.Fatalf("compiler error for %q: %s", program.String(), err)
+		}
+
+		bytecode := comp.Bytecode()
+
+		err = Verify(bytecode.Instructions, bytecode.Constants)
+		if err != nil {
+			t.Fatalf("compiler output for %q does not verify: %s", program.String(), err)
+		}
+	}
+}
+
+func TestVerify_Defaults(t *testing.T) {
+	// var f = fun(a, b = a, ...r) { [a, b, r] }; f(1)
+	program := parse(t, "var f = fun(a, b, r) { [a, b, r] }; f(1)")
+	declaration := program.Statements[0].(*ast.VariableDeclaration)
+	declaration.Value = &syntax.Function{
+		Function: *declaration.Value.(*ast.Function),
+		Defaults: []ast.Expression{nil, &ast.Identifier{Value: "a"}, nil},
+		Variadic: true,
+	}
+
+	for _, configure := range configurations {
+		comp := compiler.Create()
+		configure(comp)
+
+		err := comp.Compile(program, "", "", "")
+		if err != nil {
+			t.Fatalf("compiler error for %q: %s", program.String(), err)
+		}
+
+		bytecode := comp.Bytecode()
+
+		err = Verify(bytecode.Instructions, bytecode.Constants)
+		if err != nil {
+			t.Fatalf("compiler output for %q does not verify: %s", program.String(), err)
+		}
+	}
+}
+
+func TestVerify_FunctionDeclarations(t *testing.T) {
+	// fun f() { var g = fun() { h() }; fun h() { 1 }; g() }; f()
+	program := parse(t, "var f = fun() { var g = fun() { h() }; var h = fun() { 1 }; g() }; f()")
+	declaration := program.Statements[0].(*ast.VariableDeclaration)
+	function := declaration.Value.(*ast.Function)
+	inner := function.Body.Statements[1].(*ast.VariableDeclaration)
+	function.Body.Statements[1] = &syntax.FunctionDeclaration{
+		Name:     inner.Identifier,
+		Function: &syntax.Function{Function: *inner.Value.(*ast.Function)},
+	}
+	program.Statements[0] = &syntax.FunctionDeclaration{Name: declaration.Identifier, Function: &syntax.Function{Function: *function}}
+
+	for _, configure := range configurations {
+		comp := compiler.Create()
+		configure(comp)
+
+		err := comp.Compile(program, "", "", "")
+		if err != nil {
+			t.Fatalf("compiler error for %q: %s", program.String(), err)
+		}
+
+		bytecode := comp.Bytecode()
+
+		err = Verify(bytecode.Instructions, bytecode.Constants)
+		if err != nil {
+			t.Fatalf("compiler output for %q does not verify: %s", program.String(), err)
+		}
+	}
+}
+
+func concat(s ...code.Instructions) code.Instructions {
+	out := code.Instructions{}
+	for _, ins := range s {
+		out = append(out, ins...)
+	}
+	return out
+}
+
+func wide(op code.OpCode, operands ...int) code.Instructions {
+	ins, err := code.EncodeWide(op, operands...)
+	if err != nil {
+		panic(err)
+	}
+
+	return ins
+}